@@ -0,0 +1,31 @@
+// Command fakegateway runs an in-memory payment gateway for local development.
+//
+// Start the server with PAYMENT_GATEWAY=fake and FAKE_GATEWAY_URL pointing at it. Checkout
+// links the bot sends open a page with buttons to pay or refuse, and the result is sent
+// to the server's payment webhook like a real gateway would.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"project-ara/internal/payments"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:9191", "address to listen on")
+	webhookURL := flag.String("webhook", "http://localhost:8080/api/v1/subscriptions/webhook/fake", "payment webhook URL of the server")
+	publicURL := flag.String("public-url", "", "base URL of checkout links (defaults to the request host)")
+	flag.Parse()
+
+	server := payments.NewFakeServer(*webhookURL)
+	server.PublicURL = *publicURL
+
+	fmt.Printf("Fake payment gateway on http://%s — start the server with PAYMENT_GATEWAY=fake FAKE_GATEWAY_URL=http://%s\n", *listen, *listen)
+	if err := http.ListenAndServe(*listen, server); err != nil {
+		fmt.Fprintf(os.Stderr, "fake gateway stopped: %v\n", err)
+		os.Exit(1)
+	}
+}
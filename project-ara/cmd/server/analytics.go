@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"project-ara/internal/database"
+	"project-ara/internal/repository"
+	"project-ara/internal/services"
+)
+
+const analyticsUsage = "usage: server analytics <funnel [-days N] [-by week|month] | transactions [-months N]>"
+
+// runAnalytics implements the analytics subcommand, which prints the reports of the admin
+// analytics API
+func runAnalytics(args []string) error {
+	if len(args) == 0 {
+		return errors.New(analyticsUsage)
+	}
+
+	flags := flag.NewFlagSet("analytics "+args[0], flag.ContinueOnError)
+	days := flags.Int("days", 90, "report the users who signed up in the last days")
+	period := flags.String("by", services.CohortWeek, "cohort period: week or month")
+	months := flags.Int("months", 6, "count the transactions of the last months")
+	if err := flags.Parse(args[1:]); err != nil {
+		return errors.New(analyticsUsage)
+	}
+
+	db, err := database.Open()
+	if err != nil {
+		return err
+	}
+	plans, err := services.LoadPlanCatalog(os.Getenv("PLANS_FILE"))
+	if err != nil {
+		return err
+	}
+	repos := repository.NewGorm(db)
+	analytics := services.NewAnalyticsService(repos.Analytics, repos.Users, plans)
+
+	now := time.Now()
+	switch args[0] {
+	case "funnel":
+		if *days <= 0 {
+			return errors.New(analyticsUsage)
+		}
+		report, err := analytics.FunnelReport(now.AddDate(0, 0, -*days), now, *period)
+		if err != nil {
+			return err
+		}
+		return printFunnel(os.Stdout, report)
+	case "transactions":
+		if *months <= 0 {
+			return errors.New(analyticsUsage)
+		}
+		results, err := analytics.TransactionsPerMonth(now, *months)
+		if err != nil {
+			return err
+		}
+		return printTransactionsPerMonth(os.Stdout, results)
+	}
+	return errors.New(analyticsUsage)
+}
+
+// printFunnel prints a funnel report as two tables: the funnel with its KPIs, and where
+// the users who didn't subscribe stopped
+func printFunnel(out io.Writer, report *services.FunnelReport) error {
+	limit := report.TrialTransactions
+	fmt.Fprintf(out, "Users who signed up from %s to %s, by %s (trial of %d transactions)\n\n",
+		report.From.Format(time.DateOnly), report.To.Format(time.DateOnly), report.Period, limit)
+
+	cohorts := append(append([]services.CohortFunnel{}, report.Cohorts...), report.Total)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "COHORT\tUSERS")
+	for _, step := range report.Total.Steps {
+		fmt.Fprintf(w, "\t%s", strings.ToUpper(step.Event))
+	}
+	fmt.Fprintf(w, "\tCONVERSION\tDROP-OFF <%d\tNOT CONVERTED AT %d\tDAYS TO %d (MEDIAN)\n", limit, limit, limit)
+	for _, cohort := range cohorts {
+		fmt.Fprintf(w, "%s\t%d", cohort.Cohort, cohort.Users)
+		for _, step := range cohort.Steps {
+			fmt.Fprintf(w, "\t%d (%s)", step.Users, percent(step.Rate))
+		}
+		daysToLimit := "-"
+		if cohort.DaysToLimit != nil {
+			daysToLimit = fmt.Sprintf("%.1f", cohort.DaysToLimit.Median)
+		}
+		fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\n", percent(cohort.ConversionRate), percent(cohort.DropOffBeforeLimit),
+			percent(cohort.NonConversionAfterLimit), daysToLimit)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprint(out, "\nUsers who didn't subscribe, by transactions logged\n\n")
+	fmt.Fprint(w, "COHORT")
+	for _, point := range report.Total.DropOff {
+		fmt.Fprintf(w, "\t%s", point.Transactions)
+	}
+	fmt.Fprintln(w)
+	for _, cohort := range cohorts {
+		fmt.Fprint(w, cohort.Cohort)
+		for _, point := range cohort.DropOff {
+			fmt.Fprintf(w, "\t%d", point.Users)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+func printTransactionsPerMonth(out io.Writer, results []services.MonthlyTransactions) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MONTH\tTRANSACTIONS\tACTIVE USERS\tPER ACTIVE USER")
+	for _, month := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\n", month.Month, month.Transactions, month.ActiveUsers, month.PerActiveUser)
+	}
+	return w.Flush()
+}
+
+func percent(rate float64) string {
+	return fmt.Sprintf("%.0f%%", rate*100)
+}
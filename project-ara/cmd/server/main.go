@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -10,7 +13,11 @@ import (
 
 	"project-ara/internal/database"
 	"project-ara/internal/handlers"
+	"project-ara/internal/middleware"
+	"project-ara/internal/payments"
+	"project-ara/internal/repository"
 	"project-ara/internal/services"
+	"project-ara/internal/storage"
 )
 
 func main() {
@@ -25,30 +32,102 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	// `server migrate ...` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			logrus.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	// `server analytics ...` prints the conversion funnel reports and exits
+	if len(os.Args) > 1 && os.Args[1] == "analytics" {
+		if err := runAnalytics(os.Args[2:]); err != nil {
+			logrus.Fatalf("Analytics failed: %v", err)
+		}
+		return
+	}
+
 	// Initialize database
 	db, err := database.Initialize()
 	if err != nil {
 		logrus.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	templates, err := services.LoadTemplateRegistry(os.Getenv("WHATSAPP_TEMPLATES_FILE"))
+	if err != nil {
+		logrus.Fatalf("Failed to load WhatsApp templates: %v", err)
+	}
+	plans, err := services.LoadPlanCatalog(os.Getenv("PLANS_FILE"))
+	if err != nil {
+		logrus.Fatalf("Failed to load plans: %v", err)
+	}
+	dasTable, err := services.LoadDASTable(os.Getenv("DAS_TABLE_FILE"))
+	if err != nil {
+		logrus.Fatalf("Failed to load DAS table: %v", err)
+	}
+
 	// Initialize services
-	whatsappService := services.NewWhatsAppService()
+	repos := repository.NewGorm(db)
+	analyticsService := services.NewAnalyticsService(repos.Analytics, repos.Users, plans)
+	mediaCache := services.NewMediaCache(db)
+	transactionService := services.NewTransactionService(repos.Transactions, repos.Users, analyticsService)
+	userService := services.NewUserService(repos.Users, plans, analyticsService)
+	outboundQueue := services.NewOutboundQueue(db)
+	whatsappService := services.NewWhatsAppService(userService, templates, outboundQueue)
+	telegramService := services.NewTelegramService()
 	nlpService := services.NewNLPService()
-	voiceService := services.NewVoiceService()
-	ocrService := services.NewOCRService()
-	transactionService := services.NewTransactionService(db)
-	userService := services.NewUserService(db)
+	voiceService := services.NewVoiceService(mediaCache)
+	ocrService := services.NewOCRService(mediaCache)
 
 	// Initialize Phase 3 services
-	reportingService := services.NewFinancialReportingService(transactionService, userService)
-	subscriptionService := services.NewSubscriptionService(userService, transactionService, reportingService)
+	reportingService := services.NewFinancialReportingService(transactionService, userService, plans, analyticsService)
+	paymentGateway, err := payments.NewFromEnv()
+	if err != nil {
+		logrus.Fatalf("Failed to configure payment gateway: %v", err)
+	}
+	if paymentGateway == nil {
+		logrus.Warn("No payment gateway configured: subscriptions can't be sold")
+	}
+	subscriptionService := services.NewSubscriptionService(repos.Subscriptions, userService, transactionService, reportingService, plans, whatsappService, paymentGateway, analyticsService)
+	entitlementService := services.NewEntitlementService(repos.Subscriptions, userService, plans)
+	dasService := services.NewDASService(dasTable, repos.Users, repos.Transactions, transactionService, entitlementService, whatsappService)
+
+	// Media archive is optional: without ENCRYPTION_KEY media isn't kept
+	var archiveService *services.MediaArchiveService
+	if mediaStore, err := storage.NewFromEnv(); err != nil {
+		logrus.Warnf("Media archive disabled: %v", err)
+	} else {
+		archiveService = services.NewMediaArchiveService(db, mediaStore)
+	}
+
+	scheduler := services.NewJobScheduler(db)
+	for _, register := range []func(*services.JobScheduler) error{mediaCache.RegisterJobs, subscriptionService.RegisterJobs, dasService.RegisterJobs} {
+		if err := register(scheduler); err != nil {
+			logrus.Fatalf("Failed to register jobs: %v", err)
+		}
+	}
+
+	// Deliver queued WhatsApp messages and run scheduled jobs in the background, unless
+	// a separate cmd/worker deployment does it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if os.Getenv("RUN_BACKGROUND_JOBS") != "false" {
+		go services.NewOutboundSender(outboundQueue, whatsappService).Run(ctx)
+		go scheduler.Run(ctx)
+	}
 
 	// Initialize handlers
-	whatsappHandler := handlers.NewWhatsAppHandler(whatsappService, nlpService, voiceService, ocrService, transactionService, userService, reportingService, subscriptionService)
+	conversationHandler := handlers.NewConversationHandler(nlpService, voiceService, ocrService, transactionService, userService, reportingService, subscriptionService, entitlementService, archiveService, dasService)
+	whatsappHandler := handlers.NewWhatsAppHandler(whatsappService, conversationHandler)
+	telegramHandler := handlers.NewTelegramHandler(telegramService, conversationHandler)
 	healthHandler := handlers.NewHealthHandler()
 
 	// Initialize Phase 3 handlers
 	financialHandler := handlers.NewFinancialHandler(transactionService, reportingService, subscriptionService)
+	attachmentHandler := handlers.NewAttachmentHandler(archiveService, transactionService)
+	outboundHandler := handlers.NewOutboundHandler(outboundQueue)
+	jobHandler := handlers.NewJobHandler(scheduler)
+	analyticsHandler := handlers.NewAnalyticsHandler(analyticsService)
 
 	// Set up router
 	router := gin.Default()
@@ -66,33 +145,67 @@ func main() {
 		// WhatsApp webhook
 		api.POST("/webhook/whatsapp", whatsappHandler.HandleWebhook)
 
+		// Telegram bot webhook (register it with setWebhook and TELEGRAM_WEBHOOK_SECRET)
+		if telegramService.Enabled() {
+			api.POST("/webhook/telegram", telegramHandler.HandleWebhook)
+		}
+
 		// Transaction endpoints
-		api.POST("/transactions", whatsappHandler.CreateTransaction)
-		api.GET("/users/:id/summary", whatsappHandler.GetUserSummary)
+		api.POST("/transactions", conversationHandler.CreateTransaction)
+		api.GET("/users/:id/summary", conversationHandler.GetUserSummary)
 
 		// Phase 3: Financial endpoints
 		financial := api.Group("/financial")
 		{
 			financial.GET("/users/:userID/summary", financialHandler.GetFinancialSummary)
-			financial.GET("/users/:userID/report", financialHandler.GetDetailedReport)
+			financial.GET("/users/:userID/report", middleware.RequireAuth(os.Getenv("JWT_SECRET")), middleware.RequireFeature(entitlementService, services.FeatureAdvancedReports), financialHandler.GetDetailedReport)
 			financial.GET("/users/:userID/balance", financialHandler.GetUserBalance)
 			financial.GET("/users/:userID/transactions", financialHandler.GetUserTransactions)
 			financial.PUT("/transactions/:transactionID/correct", financialHandler.CorrectTransaction)
-			financial.GET("/users/:userID/categories", financialHandler.GetTopCategories)
+			financial.GET("/users/:userID/categories", middleware.RequireAuth(os.Getenv("JWT_SECRET")), middleware.RequireFeature(entitlementService, services.FeatureAutoCategorization), financialHandler.GetTopCategories)
 		}
 
 		// Phase 3: Subscription endpoints
 		subscriptions := api.Group("/subscriptions")
 		{
+			subscriptions.GET("/plans", financialHandler.GetPlans)
 			subscriptions.GET("/users/:userID/trial-status", financialHandler.GetTrialStatus)
 			subscriptions.GET("/users/:userID/info", financialHandler.GetSubscriptionInfo)
+			subscriptions.GET("/users/:userID/history", financialHandler.GetBillingHistory)
 			subscriptions.POST("/users/:userID", financialHandler.CreateSubscription)
+			subscriptions.GET("/users/:userID/referral", financialHandler.GetReferralInvite)
+			subscriptions.POST("/users/:userID/referral", middleware.RequireAuth(os.Getenv("JWT_SECRET")), financialHandler.ClaimReferral)
 			subscriptions.DELETE("/users/:userID", financialHandler.CancelSubscription)
 			subscriptions.POST("/webhook/payment", financialHandler.ProcessPaymentWebhook)
+			subscriptions.POST("/webhook/:gateway", financialHandler.HandleGatewayWebhook)
+		}
+
+		// Archived receipts and voice notes (require a JWT signed with JWT_SECRET and a plan
+		// with the cloud backup)
+		if archiveService != nil {
+			attachments := api.Group("", middleware.RequireAuth(os.Getenv("JWT_SECRET")), middleware.RequireFeature(entitlementService, services.FeatureCloudBackup))
+			{
+				attachments.GET("/transactions/:transactionID/attachments", attachmentHandler.GetTransactionAttachments)
+				attachments.GET("/attachments/:attachmentID", attachmentHandler.DownloadAttachment)
+			}
+		}
+
+		// Outbound delivery, job, billing and funnel monitoring (admin JWT)
+		admin := api.Group("/admin", middleware.RequireAuth(os.Getenv("JWT_SECRET")), middleware.RequireAdmin())
+		{
+			admin.GET("/messages/undelivered", outboundHandler.ListUndelivered)
+			admin.GET("/jobs", jobHandler.ListJobs)
+			admin.GET("/subscriptions/dunning", financialHandler.GetDunningStats)
+			admin.GET("/referrals", financialHandler.GetReferralStats)
+			admin.GET("/coupons", financialHandler.ListCoupons)
+			admin.POST("/coupons", financialHandler.CreateCoupon)
+			admin.DELETE("/coupons/:code", financialHandler.DeactivateCoupon)
+			admin.GET("/analytics/funnel", analyticsHandler.GetFunnel)
+			admin.GET("/analytics/transactions", analyticsHandler.GetTransactionsPerMonth)
 		}
 
 		// Legacy endpoints (for backward compatibility)
-		api.POST("/subscriptions", whatsappHandler.CreateSubscription)
+		api.POST("/subscriptions", conversationHandler.CreateSubscription)
 	}
 
 	// Get port from environment or use default
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"project-ara/internal/services"
+)
+
+// storedMedia is a file uploaded by the simulated user or by the bot
+type storedMedia struct {
+	Data     []byte
+	MimeType string
+}
+
+// graphAPI fakes the parts of the WhatsApp Cloud API the server calls:
+// POST /{version}/{phone-id}/messages, POST /{version}/{phone-id}/media,
+// GET /{version}/{media-id} and the media download URL it returns
+type graphAPI struct {
+	publicURL string
+	onMessage func(response services.WhatsAppResponse, wamid string)
+
+	mu    sync.Mutex
+	media map[string]storedMedia
+}
+
+func newGraphAPI(publicURL string, onMessage func(response services.WhatsAppResponse, wamid string)) *graphAPI {
+	return &graphAPI{
+		publicURL: strings.TrimRight(publicURL, "/"),
+		onMessage: onMessage,
+		media:     make(map[string]storedMedia),
+	}
+}
+
+// storeMedia keeps a file and returns its media ID
+func (g *graphAPI) storeMedia(data []byte, mimeType string) string {
+	id := randomID(8)
+	g.mu.Lock()
+	g.media[id] = storedMedia{Data: data, MimeType: mimeType}
+	g.mu.Unlock()
+	return id
+}
+
+func (g *graphAPI) getMedia(id string) (storedMedia, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	media, ok := g.media[id]
+	return media, ok
+}
+
+func (g *graphAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeGraphError(w, http.StatusUnauthorized, "Missing access token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "messages":
+		g.handleMessage(w, r)
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "media":
+		g.handleUpload(w, r)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "media-files":
+		g.handleDownload(w, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 2:
+		g.handleMediaInfo(w, parts[1])
+	default:
+		writeGraphError(w, http.StatusNotFound, "Unknown path "+r.URL.Path)
+	}
+}
+
+func (g *graphAPI) handleMessage(w http.ResponseWriter, r *http.Request) {
+	var response services.WhatsAppResponse
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		writeGraphError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	wamid := "wamid.SIM" + randomID(12)
+	g.onMessage(response, wamid)
+
+	writeJSON(w, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"contacts":          []map[string]string{{"input": response.To, "wa_id": response.To}},
+		"messages":          []map[string]string{{"id": wamid}},
+	})
+}
+
+func (g *graphAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "Missing file")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "Failed to read file")
+		return
+	}
+
+	writeJSON(w, map[string]string{"id": g.storeMedia(data, header.Header.Get("Content-Type"))})
+}
+
+func (g *graphAPI) handleMediaInfo(w http.ResponseWriter, id string) {
+	media, ok := g.getMedia(id)
+	if !ok {
+		writeGraphError(w, http.StatusNotFound, "Unknown media "+id)
+		return
+	}
+
+	sum := sha256.Sum256(media.Data)
+	writeJSON(w, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"id":                id,
+		"url":               g.publicURL + "/media-files/" + id,
+		"mime_type":         media.MimeType,
+		"sha256":            hex.EncodeToString(sum[:]),
+		"file_size":         len(media.Data),
+	})
+}
+
+func (g *graphAPI) handleDownload(w http.ResponseWriter, id string) {
+	media, ok := g.getMedia(id)
+	if !ok {
+		writeGraphError(w, http.StatusNotFound, "Unknown media "+id)
+		return
+	}
+
+	w.Header().Set("Content-Type", media.MimeType)
+	w.Write(media.Data)
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeGraphError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "code": status},
+	})
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate ID: %v", err))
+	}
+	return strings.TrimRight(base64.RawURLEncoding.EncodeToString(b), "=")
+}
@@ -0,0 +1,224 @@
+// Command simulator chats with a locally running server as if from WhatsApp.
+//
+// It serves a fake Graph API (start the server with WHATSAPP_API_BASE_URL pointing at it),
+// delivers signed webhooks for what you type and prints the bot's replies. Lines are
+// sent as text messages; commands start with a slash:
+//
+//	/audio <file>            send a voice note
+//	/image <file> [caption]  send a photo
+//	/tap <n|id>              tap a button or list row of the last menu
+//	/as <phone>              switch to another phone number
+//	/expect <text>           wait for a reply containing text (fails the script otherwise)
+//	/wait <duration>         pause, e.g. /wait 2s
+//	/quit
+//
+// With -script the lines are read from a file and the process exits non-zero when an
+// /expect fails, which makes conversations easy to check in CI. Replies arrive
+// asynchronously, so scripts should /expect a menu before they /tap it.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"project-ara/internal/services"
+)
+
+func main() {
+	serverURL := flag.String("server", "http://localhost:8080/api/v1/webhook/whatsapp", "webhook URL of the server")
+	listen := flag.String("listen", "localhost:9090", "address of the fake Graph API")
+	phone := flag.String("phone", "5511999999999", "phone number of the simulated user")
+	appSecret := flag.String("app-secret", os.Getenv("WHATSAPP_APP_SECRET"), "app secret used to sign webhooks")
+	phoneNumberID := flag.String("phone-number-id", envOr("WHATSAPP_PHONE_NUMBER_ID", "SIMULATOR"), "business phone number ID in webhook metadata")
+	script := flag.String("script", "", "run the commands in this file instead of reading the terminal")
+	timeout := flag.Duration("timeout", 15*time.Second, "how long /expect waits for a reply")
+	receipts := flag.Bool("receipts", true, "send delivered/read receipts for the bot's messages")
+	mediaDir := flag.String("media-dir", os.TempDir(), "where images sent by the bot are saved")
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to listen on %s: %v\n", *listen, err)
+		os.Exit(1)
+	}
+
+	webhooks := &webhookClient{
+		url:           *serverURL,
+		appSecret:     *appSecret,
+		phoneNumberID: *phoneNumberID,
+		client:        &http.Client{Timeout: 2 * time.Minute},
+	}
+	chat := newChatView(os.Stdout, *mediaDir)
+	sim := &simulator{phone: *phone, webhooks: webhooks, chat: chat, timeout: *timeout}
+	sim.graph = newGraphAPI("http://"+listener.Addr().String(), sim.onBotMessage)
+	sim.receipts = *receipts
+
+	go http.Serve(listener, sim.graph)
+	fmt.Printf("Fake Graph API on http://%s — start the server with WHATSAPP_API_BASE_URL=http://%s\n", listener.Addr(), listener.Addr())
+
+	input := io.Reader(os.Stdin)
+	interactive := *script == ""
+	if !interactive {
+		file, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open script: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	} else {
+		fmt.Printf("Chatting as %s. Type a message or /help.\n", sim.phone)
+	}
+
+	scanner := bufio.NewScanner(input)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !interactive {
+			chat.printUser(sim.phone, line)
+		}
+
+		err := sim.run(line)
+		if errors.Is(err, errQuit) {
+			break
+		}
+		if err != nil {
+			if interactive {
+				fmt.Printf("⚠️  %v\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "✗ %s:%d: %v\n", *script, lineNumber, err)
+			os.Exit(1)
+		}
+	}
+
+	if !interactive {
+		// Let trailing replies arrive so the transcript is complete
+		chat.waitQuiet(time.Second)
+		fmt.Println("✓ script passed")
+	}
+}
+
+var errQuit = errors.New("quit")
+
+type simulator struct {
+	phone    string
+	graph    *graphAPI
+	webhooks *webhookClient
+	chat     *chatView
+	timeout  time.Duration
+	receipts bool
+}
+
+func (s *simulator) run(line string) error {
+	if !strings.HasPrefix(line, "/") {
+		return s.webhooks.deliver(s.webhooks.message(s.phone, "text", map[string]string{"body": line}))
+	}
+
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch command {
+	case "/audio":
+		return s.sendMedia("audio", arg, "")
+	case "/image":
+		path, caption, _ := strings.Cut(arg, " ")
+		return s.sendMedia("image", path, caption)
+	case "/tap":
+		return s.tap(arg)
+	case "/as":
+		if arg == "" {
+			return fmt.Errorf("usage: /as <phone>")
+		}
+		s.phone = arg
+		return nil
+	case "/expect":
+		return s.chat.expect(arg, s.timeout)
+	case "/wait":
+		duration, err := time.ParseDuration(arg)
+		if err != nil {
+			return fmt.Errorf("usage: /wait <duration>")
+		}
+		time.Sleep(duration)
+		return nil
+	case "/help":
+		fmt.Println("Commands: /audio <file>, /image <file> [caption], /tap <n|id>, /as <phone>, /expect <text>, /wait <duration>, /quit")
+		return nil
+	case "/quit", "/exit":
+		return errQuit
+	}
+	return fmt.Errorf("unknown command %s (try /help)", command)
+}
+
+func (s *simulator) sendMedia(kind, path, caption string) error {
+	if path == "" {
+		return fmt.Errorf("usage: /%s <file>", kind)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	mimeType := mimeTypeOf(path, data)
+	content := map[string]interface{}{"id": s.graph.storeMedia(data, mimeType), "mime_type": mimeType}
+	if kind == "audio" {
+		content["voice"] = true
+	}
+	if caption != "" {
+		content["caption"] = caption
+	}
+	return s.webhooks.deliver(s.webhooks.message(s.phone, kind, content))
+}
+
+// tap answers the last interactive message, by position (1-based) or by option ID
+func (s *simulator) tap(arg string) error {
+	option, ok := s.chat.findOption(arg)
+	if !ok {
+		return fmt.Errorf("no option %q in the last menu", arg)
+	}
+
+	replyType := "button_reply"
+	if option.list {
+		replyType = "list_reply"
+	}
+	return s.webhooks.deliver(s.webhooks.message(s.phone, "interactive", map[string]interface{}{
+		"type":    replyType,
+		replyType: map[string]string{"id": option.id, "title": option.title},
+	}))
+}
+
+func (s *simulator) onBotMessage(response services.WhatsAppResponse, wamid string) {
+	s.chat.printBot(response, s.graph)
+	if !s.receipts {
+		return
+	}
+
+	go func() {
+		// Receipts go out after the Graph API call returns, like on WhatsApp
+		time.Sleep(100 * time.Millisecond)
+		for _, status := range []string{"delivered", "read"} {
+			if err := s.webhooks.deliver(s.webhooks.status(response.To, wamid, status)); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to send %s receipt: %v\n", status, err)
+				return
+			}
+		}
+	}()
+}
+
+func envOr(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/services"
+)
+
+// echoBot is a minimal server: it verifies the webhook signature like the real one and
+// replies through the WhatsApp client, which talks to the simulator's fake Graph API
+func echoBot(t *testing.T, whatsapp *services.WhatsAppService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !whatsapp.VerifySignature(body, r.Header.Get("X-Hub-Signature-256")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		webhook, err := whatsapp.ParseWebhook(body)
+		require.NoError(t, err)
+		for _, message := range webhook.Entry[0].Changes[0].Value.Messages {
+			inbound := message.ToInbound()
+			switch inbound.Type {
+			case services.InboundText:
+				require.NoError(t, whatsapp.SendButtons(inbound.From, "Você disse: "+inbound.Text, []services.Button{
+					{ID: "opt_a", Title: "A"},
+					{ID: "opt_b", Title: "B"},
+				}))
+			case services.InboundAudio:
+				media, err := whatsapp.DownloadMedia(context.Background(), inbound.Media.ID, 0)
+				require.NoError(t, err)
+				require.NoError(t, whatsapp.SendMessage(inbound.From, fmt.Sprintf("Áudio de %d bytes (%s)", len(media.Data), media.MimeType)))
+			case services.InboundInteractive:
+				require.NoError(t, whatsapp.SendMessage(inbound.From, "Escolheu "+inbound.ReplyID))
+			}
+		}
+	})
+}
+
+func TestSimulatorConversation(t *testing.T) {
+	chat := newChatView(io.Discard, t.TempDir())
+	sim := &simulator{phone: "5511988887777", chat: chat, timeout: 5 * time.Second}
+	sim.graph = newGraphAPI("", sim.onBotMessage)
+	graphServer := httptest.NewServer(sim.graph)
+	defer graphServer.Close()
+	sim.graph.publicURL = graphServer.URL
+
+	t.Setenv("WHATSAPP_API_BASE_URL", graphServer.URL)
+	t.Setenv("WHATSAPP_ACCESS_TOKEN", "test-token")
+	t.Setenv("WHATSAPP_APP_SECRET", "s3cret")
+	botServer := httptest.NewServer(echoBot(t, services.NewWhatsAppService(nil, nil, nil)))
+	defer botServer.Close()
+
+	sim.webhooks = &webhookClient{url: botServer.URL, appSecret: "s3cret", phoneNumberID: "SIMULATOR", client: http.DefaultClient}
+
+	audioPath := filepath.Join(t.TempDir(), "venda.ogg")
+	require.NoError(t, os.WriteFile(audioPath, []byte("OggS fake audio"), 0o644))
+
+	for _, line := range []string{
+		"vendi 10 reais",
+		"/expect você disse: vendi 10 reais",
+		"/tap 2",
+		"/expect escolheu opt_b",
+		"/audio " + audioPath,
+		"/expect áudio de 15 bytes (audio/ogg)",
+	} {
+		require.NoError(t, sim.run(line), line)
+	}
+
+	assert.Error(t, sim.chat.expect("nunca enviado", 50*time.Millisecond))
+
+	// A webhook signed with the wrong secret is rejected
+	sim.webhooks.appSecret = "wrong"
+	assert.Error(t, sim.run("oi"))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"project-ara/internal/services"
+)
+
+// option is a button or list row the user can tap
+type option struct {
+	id    string
+	title string
+	list  bool
+}
+
+// chatView prints the conversation and keeps the bot's replies for /expect and /tap
+type chatView struct {
+	out      io.Writer
+	mediaDir string
+
+	mu      sync.Mutex
+	replies []string // Searchable text of every bot reply
+	checked int      // Replies already consumed by /expect
+	options []option // Options of the last interactive reply
+	changed chan struct{}
+	lastAt  time.Time
+}
+
+func newChatView(out io.Writer, mediaDir string) *chatView {
+	return &chatView{out: out, mediaDir: mediaDir, changed: make(chan struct{})}
+}
+
+func (v *chatView) printUser(phone, line string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(v.out, "\n%s 👤 %s\n", time.Now().Format("15:04:05"), phone)
+	fmt.Fprintf(v.out, "   %s\n", line)
+}
+
+func (v *chatView) printBot(response services.WhatsAppResponse, graph *graphAPI) {
+	var lines []string
+	var options []option
+
+	switch response.Type {
+	case "text":
+		lines = append(lines, response.Text.Body)
+	case "interactive":
+		lines = append(lines, response.Interactive.Body.Body)
+		if response.Interactive.Action.Button != "" {
+			lines = append(lines, "☰ "+response.Interactive.Action.Button)
+		}
+		for _, button := range response.Interactive.Action.Buttons {
+			options = append(options, option{id: button.Reply.ID, title: button.Reply.Title})
+		}
+		for _, section := range response.Interactive.Action.Sections {
+			if section.Title != "" {
+				lines = append(lines, "── "+section.Title)
+			}
+			for _, row := range section.Rows {
+				options = append(options, option{id: row.ID, title: row.Title, list: true})
+				lines = append(lines, fmt.Sprintf("[%d] %s", len(options), optionLabel(row.Title, row.Description)))
+			}
+		}
+		if len(response.Interactive.Action.Buttons) > 0 {
+			labels := make([]string, len(options))
+			for i, o := range options {
+				labels[i] = fmt.Sprintf("[%d] %s", i+1, o.title)
+			}
+			lines = append(lines, strings.Join(labels, "  "))
+		}
+	case "image":
+		lines = append(lines, v.saveImage(response.Image, graph))
+	case "template":
+		params := []string{}
+		for _, component := range response.Template.Components {
+			for _, parameter := range component.Parameters {
+				params = append(params, parameter.Text)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("📨 template %s (%s)", response.Template.Name, strings.Join(params, ", ")))
+	default:
+		lines = append(lines, fmt.Sprintf("(unsupported message type %q)", response.Type))
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(v.out, "\n%s 🤖 Ara → %s\n", time.Now().Format("15:04:05"), response.To)
+	for _, line := range lines {
+		for _, part := range strings.Split(line, "\n") {
+			fmt.Fprintf(v.out, "   %s\n", part)
+		}
+	}
+
+	v.replies = append(v.replies, strings.Join(lines, "\n"))
+	if options != nil {
+		v.options = options
+	}
+	v.lastAt = time.Now()
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+func optionLabel(title, description string) string {
+	if description == "" {
+		return title
+	}
+	return title + " — " + description
+}
+
+func (v *chatView) saveImage(image *services.WhatsAppMediaMessage, graph *graphAPI) string {
+	media, ok := graph.getMedia(image.ID)
+	if !ok {
+		return fmt.Sprintf("🖼️ (unknown media %s) %s", image.ID, image.Caption)
+	}
+
+	extension := ".img"
+	if extensions, _ := mime.ExtensionsByType(media.MimeType); len(extensions) > 0 {
+		extension = extensions[0]
+	}
+	path := filepath.Join(v.mediaDir, "ara-"+image.ID+extension)
+	if err := os.WriteFile(path, media.Data, 0o644); err != nil {
+		return fmt.Sprintf("🖼️ (failed to save: %v) %s", err, image.Caption)
+	}
+	return fmt.Sprintf("🖼️ %s\n%s", path, image.Caption)
+}
+
+// expect waits for a reply containing text, skipping the replies before it
+func (v *chatView) expect(text string, timeout time.Duration) error {
+	if text == "" {
+		return fmt.Errorf("usage: /expect <text>")
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		v.mu.Lock()
+		for v.checked < len(v.replies) {
+			reply := v.replies[v.checked]
+			v.checked++
+			if strings.Contains(strings.ToLower(reply), strings.ToLower(text)) {
+				v.mu.Unlock()
+				return nil
+			}
+		}
+		changed := v.changed
+		v.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("no reply containing %q within %s", text, timeout)
+		}
+	}
+}
+
+// findOption looks up an option of the last interactive reply by position or ID
+func (v *chatView) findOption(arg string) (option, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if n, err := strconv.Atoi(arg); err == nil && n >= 1 && n <= len(v.options) {
+		return v.options[n-1], true
+	}
+	for _, o := range v.options {
+		if o.id == arg || strings.EqualFold(o.title, arg) {
+			return o, true
+		}
+	}
+	return option{}, false
+}
+
+// waitQuiet returns once no reply has arrived for the given duration
+func (v *chatView) waitQuiet(quiet time.Duration) {
+	for {
+		v.mu.Lock()
+		idle := time.Since(v.lastAt)
+		v.mu.Unlock()
+		if idle >= quiet {
+			return
+		}
+		time.Sleep(quiet - idle)
+	}
+}
+
+// mimeTypeOf guesses the MIME type of a file to attach
+func mimeTypeOf(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ogg", ".opus":
+		return "audio/ogg"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a":
+		return "audio/mp4"
+	case ".wav":
+		return "audio/wav"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	}
+	return http.DetectContentType(data)
+}
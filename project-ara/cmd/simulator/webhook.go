@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// webhookClient delivers messages to the server the way Meta does, signed with the app secret
+type webhookClient struct {
+	url           string
+	appSecret     string
+	phoneNumberID string
+	client        *http.Client
+}
+
+// message builds the webhook value of a user message; content holds the type-specific
+// object (e.g. {"body": "..."} for text)
+func (c *webhookClient) message(from, messageType string, content interface{}) map[string]interface{} {
+	message := map[string]interface{}{
+		"from":      from,
+		"id":        "wamid.USER" + randomID(12),
+		"timestamp": strconv.FormatInt(time.Now().Unix(), 10),
+		"type":      messageType,
+		messageType: content,
+	}
+
+	return map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"metadata": map[string]string{
+			"display_phone_number": "5511000000000",
+			"phone_number_id":      c.phoneNumberID,
+		},
+		"contacts": []map[string]interface{}{{
+			"profile": map[string]string{"name": "Simulador"},
+			"wa_id":   from,
+		}},
+		"messages": []interface{}{message},
+	}
+}
+
+// status builds the webhook value of a delivery receipt for a bot message
+func (c *webhookClient) status(to, wamid, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"metadata": map[string]string{
+			"display_phone_number": "5511000000000",
+			"phone_number_id":      c.phoneNumberID,
+		},
+		"statuses": []map[string]string{{
+			"id":           wamid,
+			"status":       status,
+			"timestamp":    strconv.FormatInt(time.Now().Unix(), 10),
+			"recipient_id": to,
+		}},
+	}
+}
+
+// deliver wraps a value in the webhook envelope and posts it
+func (c *webhookClient) deliver(value map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"object": "whatsapp_business_account",
+		"entry": []map[string]interface{}{{
+			"id": "SIMULATOR",
+			"changes": []map[string]interface{}{{
+				"field": "messages",
+				"value": value,
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.appSecret != "" {
+		mac := hmac.New(sha256.New, []byte(c.appSecret))
+		mac.Write(body)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deliver webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
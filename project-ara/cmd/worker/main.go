@@ -0,0 +1,93 @@
+// Command worker runs the background work of the server without serving HTTP: delivery of
+// queued WhatsApp messages and the scheduled jobs. Run it next to servers started with
+// RUN_BACKGROUND_JOBS=false; several workers can run at once.
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+
+	"project-ara/internal/database"
+	"project-ara/internal/payments"
+	"project-ara/internal/repository"
+	"project-ara/internal/services"
+)
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		logrus.Warn("No .env file found, using system environment variables")
+	}
+
+	logrus.SetLevel(logrus.InfoLevel)
+	if gin.Mode() == gin.DebugMode {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	db, err := database.Initialize()
+	if err != nil {
+		logrus.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	templates, err := services.LoadTemplateRegistry(os.Getenv("WHATSAPP_TEMPLATES_FILE"))
+	if err != nil {
+		logrus.Fatalf("Failed to load WhatsApp templates: %v", err)
+	}
+	plans, err := services.LoadPlanCatalog(os.Getenv("PLANS_FILE"))
+	if err != nil {
+		logrus.Fatalf("Failed to load plans: %v", err)
+	}
+	dasTable, err := services.LoadDASTable(os.Getenv("DAS_TABLE_FILE"))
+	if err != nil {
+		logrus.Fatalf("Failed to load DAS table: %v", err)
+	}
+
+	repos := repository.NewGorm(db)
+	analyticsService := services.NewAnalyticsService(repos.Analytics, repos.Users, plans)
+	mediaCache := services.NewMediaCache(db)
+	userService := services.NewUserService(repos.Users, plans, analyticsService)
+	transactionService := services.NewTransactionService(repos.Transactions, repos.Users, analyticsService)
+	outboundQueue := services.NewOutboundQueue(db)
+	whatsappService := services.NewWhatsAppService(userService, templates, outboundQueue)
+	reportingService := services.NewFinancialReportingService(transactionService, userService, plans, analyticsService)
+	paymentGateway, err := payments.NewFromEnv()
+	if err != nil {
+		logrus.Fatalf("Failed to configure payment gateway: %v", err)
+	}
+	if paymentGateway == nil {
+		logrus.Warn("No payment gateway configured: subscriptions can't be sold")
+	}
+	subscriptionService := services.NewSubscriptionService(repos.Subscriptions, userService, transactionService, reportingService, plans, whatsappService, paymentGateway, analyticsService)
+	entitlementService := services.NewEntitlementService(repos.Subscriptions, userService, plans)
+	dasService := services.NewDASService(dasTable, repos.Users, repos.Transactions, transactionService, entitlementService, whatsappService)
+
+	scheduler := services.NewJobScheduler(db)
+	for _, register := range []func(*services.JobScheduler) error{mediaCache.RegisterJobs, subscriptionService.RegisterJobs, dasService.RegisterJobs} {
+		if err := register(scheduler); err != nil {
+			logrus.Fatalf("Failed to register jobs: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logrus.Info("Starting worker")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		services.NewOutboundSender(outboundQueue, whatsappService).Run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		scheduler.Run(ctx)
+	}()
+	wg.Wait()
+	logrus.Info("Worker stopped")
+}
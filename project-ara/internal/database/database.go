@@ -8,13 +8,29 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
-
-	"project-ara/internal/models"
 )
 
 var DB *gorm.DB
 
+// Initialize connects to the database and applies pending migrations, unless
+// DB_AUTO_MIGRATE=false leaves that to `server migrate up` (e.g. a deploy job)
 func Initialize() (*gorm.DB, error) {
+	db, err := Open()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runMigrations(db); err != nil {
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	DB = db
+	log.Println("Database initialized successfully")
+	return db, nil
+}
+
+// Open connects to the database configured by the DB_* variables
+func Open() (*gorm.DB, error) {
 	// Database configuration from environment variables
 	dbHost := getEnv("DB_HOST", "localhost")
 	dbPort := getEnv("DB_PORT", "5432")
@@ -51,22 +67,27 @@ func Initialize() (*gorm.DB, error) {
 	sqlDB.SetMaxIdleConns(10)
 	sqlDB.SetMaxOpenConns(100)
 
-	// Run migrations
-	if err := runMigrations(db); err != nil {
-		return nil, fmt.Errorf("failed to run migrations: %w", err)
-	}
-
-	DB = db
-	log.Println("Database initialized successfully")
 	return db, nil
 }
 
 func runMigrations(db *gorm.DB) error {
-	// Auto migrate the schema
-	return db.AutoMigrate(
-		&models.User{},
-		&models.Transaction{},
-	)
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if getEnv("DB_AUTO_MIGRATE", "true") == "false" {
+		pending, err := migrator.Pending()
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			log.Printf("Auto-migration disabled; %d migration(s) pending", pending)
+		}
+		return nil
+	}
+
+	return migrator.Up()
 }
 
 func getEnv(key, defaultValue string) string {
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestEmbeddedMigrationsAreComplete(t *testing.T) {
+	migrations, err := LoadMigrations(migrationFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, migration := range migrations {
+		assert.Equal(t, i+1, migration.Version, "versions must be consecutive")
+		assert.NotEmpty(t, migration.Up)
+		assert.NotEmpty(t, migration.Down)
+	}
+}
+
+func TestLoadMigrationsRejectsIncompleteSets(t *testing.T) {
+	_, err := LoadMigrations(fstest.MapFS{
+		"migrations/0001_init.up.sql": {Data: []byte("CREATE TABLE a (id int);")},
+	})
+	assert.ErrorContains(t, err, "needs both an up and a down file")
+
+	_, err = LoadMigrations(fstest.MapFS{
+		"migrations/init.sql": {Data: []byte("CREATE TABLE a (id int);")},
+	})
+	assert.ErrorContains(t, err, "invalid migration file name")
+}
+
+// baselineUser and baselineTransaction are the models of the first release, whose tables
+// AutoMigrate created before there were versioned migrations
+type baselineUser struct {
+	ID                     uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	PhoneNumber            string    `gorm:"type:varchar(20);unique;not null"`
+	CreatedAt              time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+	TrialTransactionsCount int       `gorm:"default:0"`
+	SubscriptionStatus     string    `gorm:"type:varchar(20);default:'trial'"`
+	SubscriptionExpiresAt  *time.Time
+
+	Transactions []baselineTransaction `gorm:"foreignKey:UserID"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineTransaction struct {
+	ID              uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID          uuid.UUID `gorm:"type:uuid;not null"`
+	Amount          float64   `gorm:"type:decimal(10,2);not null"`
+	Description     string    `gorm:"type:text"`
+	TransactionType string    `gorm:"type:varchar(10);not null"`
+	Source          string    `gorm:"type:varchar(20);not null"`
+	CreatedAt       time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+	CorrectedAt     *time.Time
+	CorrectionData  *json.RawMessage `gorm:"type:jsonb"`
+}
+
+func (baselineTransaction) TableName() string { return "transactions" }
+
+// TestMigrationsRoundTrip adopts a database of the first release, rolls every migration
+// back and applies them again on the scratch database in TEST_DATABASE_URL
+func TestMigrationsRoundTrip(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+
+	migrator, err := NewMigrator(db)
+	require.NoError(t, err)
+
+	// The first release's database, with a user and a transaction
+	require.NoError(t, migrator.To(0))
+	require.NoError(t, db.AutoMigrate(&baselineUser{}, &baselineTransaction{}))
+	user := baselineUser{ID: uuid.New(), PhoneNumber: "5511900000000"}
+	require.NoError(t, db.Create(&user).Error)
+	require.NoError(t, db.Create(&baselineTransaction{ID: uuid.New(), UserID: user.ID, Amount: 10, TransactionType: "income", Source: "text"}).Error)
+
+	require.NoError(t, migrator.Up())
+	pending, err := migrator.Pending()
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+	for _, column := range []string{"telegram_chat_id", "channel", "last_inbound_at"} {
+		assert.True(t, db.Migrator().HasColumn("users", column), column)
+	}
+	for _, column := range []string{"media_sha256", "external_ref", "media_artifact_id"} {
+		assert.True(t, db.Migrator().HasColumn("transactions", column), column)
+	}
+	// Telegram users have no phone number, and there can be many of them
+	for _, chatID := range []string{"1001", "1002"} {
+		require.NoError(t, db.Exec("INSERT INTO users (id, phone_number, telegram_chat_id, channel) VALUES (?, '', ?, 'telegram')", uuid.New(), chatID).Error)
+	}
+	assert.Error(t, db.Exec("INSERT INTO users (id, phone_number) VALUES (?, ?)", uuid.New(), user.PhoneNumber).Error)
+
+	require.NoError(t, migrator.Down())
+	pending, err = migrator.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+
+	require.NoError(t, migrator.To(0))
+	assert.False(t, db.Migrator().HasTable("users"))
+
+	require.NoError(t, migrator.Up())
+	assert.True(t, db.Migrator().HasTable("users"))
+}
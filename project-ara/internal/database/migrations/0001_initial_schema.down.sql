@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS outbound_messages;
+DROP TABLE IF EXISTS attachments;
+DROP TABLE IF EXISTS media_artifacts;
+DROP TABLE IF EXISTS pending_transactions;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS users;
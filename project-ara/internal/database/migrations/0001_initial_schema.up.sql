@@ -0,0 +1,114 @@
+-- Baseline: the schema GORM AutoMigrate used to create. Databases created before versioned
+-- migrations only have the users and transactions tables of the first models; IF NOT EXISTS
+-- keeps them, and the ALTERs below bring them up to this schema.
+
+CREATE TABLE IF NOT EXISTS users (
+    id                       uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    phone_number             varchar(20),
+    telegram_chat_id         varchar(32),
+    channel                  varchar(20) DEFAULT 'whatsapp',
+    created_at               timestamptz DEFAULT CURRENT_TIMESTAMP,
+    trial_transactions_count bigint DEFAULT 0,
+    subscription_status      varchar(20) DEFAULT 'trial',
+    subscription_expires_at  timestamptz,
+    last_inbound_at          timestamptz
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS telegram_chat_id varchar(32);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS channel varchar(20) DEFAULT 'whatsapp';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_inbound_at timestamptz;
+-- The first users table had a unique, not null phone_number, which Telegram users, whose
+-- phone number is empty, would collide on. The partial index below replaces it.
+ALTER TABLE users ALTER COLUMN phone_number DROP NOT NULL;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS uni_users_phone_number;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_phone_number_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_phone_number ON users (phone_number) WHERE phone_number <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_telegram_chat_id ON users (telegram_chat_id) WHERE telegram_chat_id <> '';
+
+CREATE TABLE IF NOT EXISTS transactions (
+    id                uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id           uuid NOT NULL,
+    amount            decimal(10,2) NOT NULL,
+    description       text,
+    transaction_type  varchar(10) NOT NULL,
+    source            varchar(20) NOT NULL,
+    created_at        timestamptz DEFAULT CURRENT_TIMESTAMP,
+    corrected_at      timestamptz,
+    correction_data   jsonb,
+    media_sha256      varchar(64),
+    external_ref      varchar(64),
+    media_artifact_id uuid,
+    CONSTRAINT fk_users_transactions FOREIGN KEY (user_id) REFERENCES users (id)
+);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS media_sha256 varchar(64);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS external_ref varchar(64);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS media_artifact_id uuid;
+CREATE INDEX IF NOT EXISTS idx_transactions_media_sha256 ON transactions (media_sha256);
+CREATE INDEX IF NOT EXISTS idx_transactions_external_ref ON transactions (external_ref);
+
+CREATE TABLE IF NOT EXISTS pending_transactions (
+    id                uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id           uuid NOT NULL,
+    amount            decimal(10,2) NOT NULL,
+    description       text,
+    transaction_type  varchar(10) NOT NULL,
+    source            varchar(20) NOT NULL,
+    media_sha256      varchar(64),
+    external_ref      varchar(64),
+    media_artifact_id uuid,
+    attachment_id     uuid,
+    duplicate_of_id   uuid NOT NULL,
+    match_reason      varchar(20) NOT NULL,
+    created_at        timestamptz DEFAULT CURRENT_TIMESTAMP,
+    expires_at        timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_pending_transactions_user_id ON pending_transactions (user_id);
+
+CREATE TABLE IF NOT EXISTS media_artifacts (
+    id            uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    media_sha256  varchar(64) NOT NULL,
+    kind          varchar(20) NOT NULL,
+    provider      varchar(100) NOT NULL,
+    model_version varchar(100) NOT NULL,
+    content       jsonb NOT NULL,
+    created_at    timestamptz DEFAULT CURRENT_TIMESTAMP,
+    expires_at    timestamptz NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_artifact_key ON media_artifacts (media_sha256, kind, provider, model_version);
+CREATE INDEX IF NOT EXISTS idx_media_artifacts_expires_at ON media_artifacts (expires_at);
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id             uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id        uuid NOT NULL,
+    transaction_id uuid,
+    kind           varchar(10) NOT NULL,
+    mime_type      varchar(100),
+    media_sha256   varchar(64),
+    size_bytes     bigint,
+    storage_key    varchar(255) NOT NULL,
+    created_at     timestamptz DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_user_id ON attachments (user_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_transaction_id ON attachments (transaction_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_media_sha256 ON attachments (media_sha256);
+
+CREATE TABLE IF NOT EXISTS outbound_messages (
+    id              uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    "to"            varchar(20) NOT NULL,
+    message_type    varchar(20) NOT NULL,
+    payload         jsonb NOT NULL,
+    status          varchar(20) NOT NULL,
+    attempts        bigint DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL,
+    locked_until    timestamptz,
+    last_error      text,
+    wamid           varchar(128),
+    created_at      timestamptz DEFAULT CURRENT_TIMESTAMP,
+    sent_at         timestamptz,
+    delivered_at    timestamptz,
+    read_at         timestamptz,
+    failed_at       timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_outbound_messages_to ON outbound_messages ("to");
+CREATE INDEX IF NOT EXISTS idx_outbound_messages_status ON outbound_messages (status);
+CREATE INDEX IF NOT EXISTS idx_outbound_messages_next_attempt_at ON outbound_messages (next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_outbound_messages_wamid ON outbound_messages (wamid);
@@ -0,0 +1,9 @@
+ALTER TABLE pending_transactions
+    DROP CONSTRAINT IF EXISTS chk_pending_transactions_source,
+    DROP CONSTRAINT IF EXISTS chk_pending_transactions_transaction_type;
+
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS chk_transactions_source,
+    DROP CONSTRAINT IF EXISTS chk_transactions_transaction_type;
+
+DROP INDEX IF EXISTS idx_transactions_user_created_at;
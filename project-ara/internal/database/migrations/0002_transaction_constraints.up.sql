@@ -0,0 +1,10 @@
+-- Period summaries, duplicate detection and reports all filter a user's transactions by date
+CREATE INDEX IF NOT EXISTS idx_transactions_user_created_at ON transactions (user_id, created_at);
+
+ALTER TABLE transactions
+    ADD CONSTRAINT chk_transactions_transaction_type CHECK (transaction_type IN ('income', 'expense')),
+    ADD CONSTRAINT chk_transactions_source CHECK (source IN ('text', 'voice', 'image'));
+
+ALTER TABLE pending_transactions
+    ADD CONSTRAINT chk_pending_transactions_transaction_type CHECK (transaction_type IN ('income', 'expense')),
+    ADD CONSTRAINT chk_pending_transactions_source CHECK (source IN ('text', 'voice', 'image'));
@@ -0,0 +1,35 @@
+CREATE TABLE jobs (
+    id           uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    unique_key   varchar(255),
+    name         varchar(100) NOT NULL,
+    payload      jsonb NOT NULL DEFAULT '{}',
+    schedule     varchar(100),
+    status       varchar(20) NOT NULL,
+    run_at       timestamptz NOT NULL,
+    attempts     bigint DEFAULT 0,
+    max_attempts bigint DEFAULT 5,
+    locked_until timestamptz,
+    locked_by    varchar(100),
+    last_error   text,
+    last_run_at  timestamptz,
+    created_at   timestamptz DEFAULT CURRENT_TIMESTAMP,
+    updated_at   timestamptz,
+    CONSTRAINT chk_jobs_status CHECK (status IN ('scheduled', 'running', 'done', 'failed'))
+);
+-- Recurring jobs use "cron:<name>"; one-off jobs may set a key to be enqueued only once
+CREATE UNIQUE INDEX idx_jobs_unique_key ON jobs (unique_key) WHERE unique_key <> '';
+CREATE INDEX idx_jobs_due ON jobs (status, run_at);
+
+CREATE TABLE job_runs (
+    id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    job_id      uuid NOT NULL,
+    name        varchar(100) NOT NULL,
+    attempt     bigint NOT NULL,
+    status      varchar(20) NOT NULL,
+    error       text,
+    worker      varchar(100),
+    started_at  timestamptz NOT NULL,
+    finished_at timestamptz NOT NULL
+);
+CREATE INDEX idx_job_runs_job_id ON job_runs (job_id);
+CREATE INDEX idx_job_runs_name_started_at ON job_runs (name, started_at);
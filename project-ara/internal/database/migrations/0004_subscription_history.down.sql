@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_users_subscription_expiry;
+DROP TABLE IF EXISTS subscription_history;
@@ -0,0 +1,13 @@
+CREATE TABLE subscription_history (
+    id          uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id     uuid NOT NULL,
+    from_status varchar(20) NOT NULL,
+    to_status   varchar(20) NOT NULL,
+    reason      varchar(50) NOT NULL,
+    created_at  timestamptz DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_subscription_history_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_subscription_history_user_created_at ON subscription_history (user_id, created_at);
+
+-- Finds subscriptions that lapsed, for the expiry sweep
+CREATE INDEX idx_users_subscription_expiry ON users (subscription_status, subscription_expires_at);
@@ -0,0 +1,16 @@
+DELETE FROM subscription_events WHERE type <> 'status_changed';
+DROP INDEX IF EXISTS idx_subscription_events_subscription_id;
+ALTER TABLE subscription_events
+    DROP COLUMN period_end,
+    DROP COLUMN amount,
+    DROP COLUMN type,
+    DROP COLUMN payment_id,
+    DROP COLUMN subscription_id,
+    ALTER COLUMN to_status SET NOT NULL,
+    ALTER COLUMN from_status SET NOT NULL;
+ALTER INDEX idx_subscription_events_user_created_at RENAME TO idx_subscription_history_user_created_at;
+ALTER TABLE subscription_events RENAME CONSTRAINT fk_subscription_events_user TO fk_subscription_history_user;
+ALTER TABLE subscription_events RENAME TO subscription_history;
+
+DROP TABLE IF EXISTS payments;
+DROP TABLE IF EXISTS subscriptions;
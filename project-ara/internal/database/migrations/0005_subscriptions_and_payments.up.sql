@@ -0,0 +1,64 @@
+CREATE TABLE subscriptions (
+    id                      uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id                 uuid NOT NULL,
+    plan                    varchar(50) NOT NULL,
+    price                   decimal(10,2) NOT NULL,
+    currency                varchar(3) NOT NULL DEFAULT 'BRL',
+    status                  varchar(20) NOT NULL,
+    payment_method          varchar(30),
+    gateway                 varchar(30),
+    gateway_subscription_id varchar(100),
+    current_period_start    timestamptz NOT NULL,
+    current_period_end      timestamptz NOT NULL,
+    cancelled_at            timestamptz,
+    created_at              timestamptz DEFAULT CURRENT_TIMESTAMP,
+    updated_at              timestamptz,
+    CONSTRAINT fk_subscriptions_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_subscriptions_user_created_at ON subscriptions (user_id, created_at);
+CREATE INDEX idx_subscriptions_status_period_end ON subscriptions (status, current_period_end);
+
+CREATE TABLE payments (
+    id                 uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    subscription_id    uuid,
+    user_id            uuid NOT NULL,
+    gateway            varchar(30) NOT NULL,
+    gateway_payment_id varchar(100) NOT NULL,
+    amount             decimal(10,2) NOT NULL,
+    currency           varchar(3) NOT NULL DEFAULT 'BRL',
+    status             varchar(20) NOT NULL,
+    method             varchar(30),
+    period_start       timestamptz,
+    period_end         timestamptz,
+    paid_at            timestamptz,
+    failure_reason     text,
+    created_at         timestamptz DEFAULT CURRENT_TIMESTAMP,
+    updated_at         timestamptz,
+    CONSTRAINT fk_payments_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE UNIQUE INDEX idx_payments_gateway_payment_id ON payments (gateway, gateway_payment_id);
+CREATE INDEX idx_payments_subscription_id ON payments (subscription_id);
+CREATE INDEX idx_payments_user_created_at ON payments (user_id, created_at);
+
+-- The status history becomes the billing event log
+ALTER TABLE subscription_history RENAME TO subscription_events;
+ALTER TABLE subscription_events RENAME CONSTRAINT fk_subscription_history_user TO fk_subscription_events_user;
+ALTER INDEX idx_subscription_history_user_created_at RENAME TO idx_subscription_events_user_created_at;
+ALTER TABLE subscription_events
+    ALTER COLUMN from_status DROP NOT NULL,
+    ALTER COLUMN to_status DROP NOT NULL,
+    ADD COLUMN subscription_id uuid,
+    ADD COLUMN payment_id uuid,
+    ADD COLUMN type varchar(30) NOT NULL DEFAULT 'status_changed',
+    ADD COLUMN amount decimal(10,2),
+    ADD COLUMN period_end timestamptz;
+CREATE INDEX idx_subscription_events_subscription_id ON subscription_events (subscription_id);
+
+-- Subscriptions so far only lived on users; give each subscriber a subscription row
+INSERT INTO subscriptions (user_id, plan, price, currency, status, current_period_start, current_period_end, created_at, updated_at)
+SELECT id, 'monthly', 9.90, 'BRL', subscription_status,
+       COALESCE(subscription_expires_at - interval '30 days', created_at),
+       COALESCE(subscription_expires_at, CURRENT_TIMESTAMP),
+       CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+FROM users
+WHERE subscription_status <> 'trial';
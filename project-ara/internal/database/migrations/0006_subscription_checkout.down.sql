@@ -0,0 +1,6 @@
+-- Abandoned checkouts only make sense with the columns this migration adds
+DELETE FROM subscriptions WHERE status = 'pending';
+DROP INDEX IF EXISTS idx_subscriptions_gateway_subscription_id;
+ALTER TABLE subscriptions
+    DROP COLUMN IF EXISTS checkout_url,
+    DROP COLUMN IF EXISTS gateway_customer_id;
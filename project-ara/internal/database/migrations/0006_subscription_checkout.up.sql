@@ -0,0 +1,4 @@
+ALTER TABLE subscriptions
+    ADD COLUMN gateway_customer_id varchar(100),
+    ADD COLUMN checkout_url text;
+CREATE INDEX idx_subscriptions_gateway_subscription_id ON subscriptions (gateway, gateway_subscription_id);
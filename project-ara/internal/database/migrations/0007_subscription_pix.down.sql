@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions
+    DROP COLUMN IF EXISTS pix_expires_at,
+    DROP COLUMN IF EXISTS pix_code;
@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions
+    ADD COLUMN pix_code text,
+    ADD COLUMN pix_expires_at timestamptz;
@@ -0,0 +1,15 @@
+CREATE TABLE payment_webhook_events (
+    id           uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    gateway      varchar(30) NOT NULL,
+    event_id     varchar(150) NOT NULL,
+    type         varchar(60),
+    payment_id   varchar(100),
+    status       varchar(20),
+    payload      jsonb NOT NULL,
+    attempts     integer NOT NULL DEFAULT 0,
+    last_error   text,
+    processed_at timestamptz,
+    created_at   timestamptz DEFAULT CURRENT_TIMESTAMP,
+    updated_at   timestamptz
+);
+CREATE UNIQUE INDEX idx_payment_webhook_events_gateway_event_id ON payment_webhook_events (gateway, event_id);
@@ -0,0 +1,21 @@
+CREATE TABLE dunning_cases (
+    id              uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id         uuid NOT NULL,
+    subscription_id uuid NOT NULL,
+    status          varchar(20) NOT NULL DEFAULT 'open',
+    failure_reason  text,
+    failures        integer NOT NULL DEFAULT 1,
+    notices_sent    integer NOT NULL DEFAULT 0,
+    next_notice_at  timestamptz,
+    grace_ends_at   timestamptz NOT NULL,
+    resolved_at     timestamptz,
+    created_at      timestamptz DEFAULT CURRENT_TIMESTAMP,
+    updated_at      timestamptz,
+    CONSTRAINT fk_dunning_cases_user FOREIGN KEY (user_id) REFERENCES users (id),
+    CONSTRAINT fk_dunning_cases_subscription FOREIGN KEY (subscription_id) REFERENCES subscriptions (id)
+);
+CREATE INDEX idx_dunning_cases_user_id ON dunning_cases (user_id);
+CREATE INDEX idx_dunning_cases_created_at ON dunning_cases (created_at);
+CREATE INDEX idx_dunning_cases_status_next_notice_at ON dunning_cases (status, next_notice_at);
+-- One open case per subscription
+CREATE UNIQUE INDEX idx_dunning_cases_open_subscription ON dunning_cases (subscription_id) WHERE status = 'open';
@@ -0,0 +1,12 @@
+ALTER TABLE subscriptions
+    DROP CONSTRAINT IF EXISTS fk_subscriptions_coupon,
+    DROP COLUMN IF EXISTS coupon_id;
+
+DROP TABLE IF EXISTS coupon_redemptions;
+DROP TABLE IF EXISTS coupons;
+DROP TABLE IF EXISTS referrals;
+
+DROP INDEX IF EXISTS idx_users_referral_code;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS bonus_transactions,
+    DROP COLUMN IF EXISTS referral_code;
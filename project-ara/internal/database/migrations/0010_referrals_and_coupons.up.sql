@@ -0,0 +1,55 @@
+ALTER TABLE users
+    ADD COLUMN referral_code varchar(16),
+    ADD COLUMN bonus_transactions integer NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX idx_users_referral_code ON users (referral_code) WHERE referral_code <> '';
+
+CREATE TABLE referrals (
+    id            uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    referrer_id   uuid NOT NULL,
+    referred_id   uuid NOT NULL,
+    code          varchar(16) NOT NULL,
+    device_id     varchar(128),
+    status        varchar(20) NOT NULL DEFAULT 'pending',
+    reject_reason varchar(30),
+    rewarded_at   timestamptz,
+    created_at    timestamptz DEFAULT CURRENT_TIMESTAMP,
+    updated_at    timestamptz,
+    CONSTRAINT fk_referrals_referrer FOREIGN KEY (referrer_id) REFERENCES users (id),
+    CONSTRAINT fk_referrals_referred FOREIGN KEY (referred_id) REFERENCES users (id)
+);
+CREATE INDEX idx_referrals_referrer_created_at ON referrals (referrer_id, created_at);
+CREATE INDEX idx_referrals_device_id ON referrals (device_id) WHERE device_id <> '';
+-- A user is referred once; rejected claims are kept for review but don't count
+CREATE UNIQUE INDEX idx_referrals_referred ON referrals (referred_id) WHERE status <> 'rejected';
+
+CREATE TABLE coupons (
+    id         uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    code       varchar(32) NOT NULL,
+    kind       varchar(20) NOT NULL,
+    value      decimal(10,2) NOT NULL,
+    expires_at timestamptz,
+    max_uses   integer NOT NULL DEFAULT 0,
+    uses       integer NOT NULL DEFAULT 0,
+    active     boolean NOT NULL DEFAULT true,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamptz,
+    CONSTRAINT chk_coupons_kind CHECK (kind IN ('percentage', 'fixed'))
+);
+CREATE UNIQUE INDEX idx_coupons_code ON coupons (code);
+
+CREATE TABLE coupon_redemptions (
+    id              uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    coupon_id       uuid NOT NULL,
+    user_id         uuid NOT NULL,
+    subscription_id uuid NOT NULL,
+    discount        decimal(10,2) NOT NULL,
+    created_at      timestamptz DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_coupon_redemptions_coupon FOREIGN KEY (coupon_id) REFERENCES coupons (id),
+    CONSTRAINT fk_coupon_redemptions_user FOREIGN KEY (user_id) REFERENCES users (id),
+    CONSTRAINT fk_coupon_redemptions_subscription FOREIGN KEY (subscription_id) REFERENCES subscriptions (id)
+);
+CREATE UNIQUE INDEX idx_coupon_redemptions_coupon_user ON coupon_redemptions (coupon_id, user_id);
+
+ALTER TABLE subscriptions
+    ADD COLUMN coupon_id uuid,
+    ADD CONSTRAINT fk_subscriptions_coupon FOREIGN KEY (coupon_id) REFERENCES coupons (id);
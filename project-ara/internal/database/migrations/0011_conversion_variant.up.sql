@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN conversion_variant varchar(32);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_transactions_created_at;
+DROP TABLE IF EXISTS analytics_events;
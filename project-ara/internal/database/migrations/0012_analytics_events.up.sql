@@ -0,0 +1,16 @@
+CREATE TABLE analytics_events (
+    id         uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    uuid NOT NULL,
+    name       varchar(40) NOT NULL,
+    once_key   varchar(40),
+    properties jsonb NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_analytics_events_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_analytics_events_user_id ON analytics_events (user_id);
+CREATE INDEX idx_analytics_events_name_created_at ON analytics_events (name, created_at);
+-- Events with a once key, like a user's first transaction, are recorded once per user
+CREATE UNIQUE INDEX idx_analytics_events_once ON analytics_events (user_id, once_key) WHERE once_key <> '';
+
+-- The funnel reports count transactions by user and by month
+CREATE INDEX IF NOT EXISTS idx_transactions_created_at ON transactions (created_at);
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN mei_activity varchar(20);
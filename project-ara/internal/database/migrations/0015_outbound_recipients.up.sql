@@ -0,0 +1,6 @@
+-- The last send to each number, which the outbound senders of every process share to keep
+-- the per-number rate limit
+CREATE TABLE outbound_recipients (
+    phone_number varchar(20) PRIMARY KEY,
+    last_sent_at timestamptz NOT NULL
+);
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"project-ara/internal/services"
+)
+
+type AnalyticsHandler struct {
+	analyticsService *services.AnalyticsService
+}
+
+func NewAnalyticsHandler(analyticsService *services.AnalyticsService) *AnalyticsHandler {
+	return &AnalyticsHandler{analyticsService: analyticsService}
+}
+
+// GetFunnel reports the conversion funnel of the users who signed up in the last days, by
+// weekly or monthly cohort
+func (h *AnalyticsHandler) GetFunnel(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "90"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid days parameter",
+		})
+		return
+	}
+	period := c.DefaultQuery("by", services.CohortWeek)
+	if period != services.CohortWeek && period != services.CohortMonth {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid by parameter: use week or month",
+		})
+		return
+	}
+
+	now := time.Now()
+	report, err := h.analyticsService.FunnelReport(now.AddDate(0, 0, -days), now, period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to build funnel report",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetTransactionsPerMonth counts the transactions of the last months and the users who
+// logged them
+func (h *AnalyticsHandler) GetTransactionsPerMonth(c *gin.Context) {
+	months, err := strconv.Atoi(c.DefaultQuery("months", "6"))
+	if err != nil || months <= 0 || months > 36 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid months parameter",
+		})
+		return
+	}
+
+	results, err := h.analyticsService.TransactionsPerMonth(time.Now(), months)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to count transactions",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"months": results,
+		"count":  len(results),
+	})
+}
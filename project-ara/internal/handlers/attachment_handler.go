@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"project-ara/internal/middleware"
+	"project-ara/internal/services"
+)
+
+type AttachmentHandler struct {
+	archiveService     *services.MediaArchiveService
+	transactionService *services.TransactionService
+}
+
+func NewAttachmentHandler(archiveService *services.MediaArchiveService, transactionService *services.TransactionService) *AttachmentHandler {
+	return &AttachmentHandler{
+		archiveService:     archiveService,
+		transactionService: transactionService,
+	}
+}
+
+// GetTransactionAttachments lists the archived media of a transaction
+func (h *AttachmentHandler) GetTransactionAttachments(c *gin.Context) {
+	transactionID := c.Param("transactionID")
+
+	transaction, err := h.transactionService.GetTransactionByID(transactionID)
+	if err != nil || !middleware.CanAccessUser(c, transaction.UserID.String()) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Transaction not found",
+		})
+		return
+	}
+
+	attachments, err := h.archiveService.GetTransactionAttachments(transactionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get attachments",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"transaction_id": transactionID,
+		"attachments":    attachments,
+		"count":          len(attachments),
+	})
+}
+
+// DownloadAttachment returns the decrypted media file
+func (h *AttachmentHandler) DownloadAttachment(c *gin.Context) {
+	attachment, err := h.archiveService.GetAttachment(c.Param("attachmentID"))
+	if err != nil || !middleware.CanAccessUser(c, attachment.UserID.String()) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Attachment not found",
+		})
+		return
+	}
+
+	data, err := h.archiveService.GetAttachmentContent(c.Request.Context(), attachment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to read attachment",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.Data(http.StatusOK, attachment.MimeType, data)
+}
@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"project-ara/internal/models"
+	"project-ara/internal/services"
+)
+
+// ConversationHandler runs the bot conversation. It is channel-agnostic: channel webhook
+// handlers convert their payloads to services.InboundMessage and call HandleMessage.
+type ConversationHandler struct {
+	nlpService          services.TransactionExtractor
+	voiceService        services.Transcriber
+	ocrService          services.ReceiptReader
+	transactionService  *services.TransactionService
+	userService         *services.UserService
+	reportingService    *services.FinancialReportingService
+	subscriptionService *services.SubscriptionService
+	entitlementService  *services.EntitlementService
+	archiveService      *services.MediaArchiveService
+	dasService          *services.DASService
+}
+
+// maxImageBytes is the largest image the WhatsApp Cloud API accepts
+const maxImageBytes = 5 * 1024 * 1024
+
+func NewConversationHandler(
+	nlpService services.TransactionExtractor,
+	voiceService services.Transcriber,
+	ocrService services.ReceiptReader,
+	transactionService *services.TransactionService,
+	userService *services.UserService,
+	reportingService *services.FinancialReportingService,
+	subscriptionService *services.SubscriptionService,
+	entitlementService *services.EntitlementService,
+	archiveService *services.MediaArchiveService,
+	dasService *services.DASService,
+) *ConversationHandler {
+	return &ConversationHandler{
+		nlpService:          nlpService,
+		voiceService:        voiceService,
+		ocrService:          ocrService,
+		transactionService:  transactionService,
+		userService:         userService,
+		reportingService:    reportingService,
+		subscriptionService: subscriptionService,
+		entitlementService:  entitlementService,
+		archiveService:      archiveService,
+		dasService:          dasService,
+	}
+}
+
+// HandleMessage processes one inbound message and replies on the channel it came from
+func (h *ConversationHandler) HandleMessage(channel services.Channel, message services.InboundMessage) error {
+	chat := services.Chat{Channel: channel, To: message.From}
+
+	// Get or create user
+	user, err := h.userService.GetOrCreateChannelUser(channel.Name(), message.From)
+	if err != nil {
+		return fmt.Errorf("failed to get/create user: %w", err)
+	}
+
+	// Button and list replies, commands and receipt retrieval work regardless of the trial limit
+	if message.ReplyID != "" {
+		return h.processInteractiveReply(chat, message.ReplyID, user)
+	}
+
+	if message.Type == services.InboundText {
+		if handled, err := h.processCommand(chat, message.Text, user); handled {
+			return err
+		}
+
+		if h.archiveService != nil {
+			if day, ok := services.ParseReceiptRequest(message.Text, time.Now()); ok {
+				return h.sendReceipts(chat, day, user)
+			}
+		}
+	}
+
+	// Check if user can create transactions
+	canCreate, err := h.userService.CanUserCreateTransaction(user.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to check user permissions: %w", err)
+	}
+
+	if !canCreate {
+		return h.sendSubscriptionPrompt(chat, user)
+	}
+
+	// Process different message types
+	switch message.Type {
+	case services.InboundText:
+		return h.processTextMessage(chat, message.Text, user)
+	case services.InboundAudio:
+		return h.processAudioMessage(chat, message.Media, user)
+	case services.InboundImage:
+		return h.processImageMessage(chat, message.Media, user)
+	default:
+		return chat.SendText("Desculpe, não consegui processar esse tipo de mensagem. Envie texto, áudio ou uma foto de recibo.")
+	}
+}
+
+func (h *ConversationHandler) processTextMessage(chat services.Chat, text string, user *models.User) error {
+	// A pending duplicate confirmation takes precedence over a new transaction
+	if handled, err := h.resolvePendingDuplicate(chat, text, user); handled {
+		return err
+	}
+
+	return h.processTransactionText(chat, text, services.TransactionInput{Source: models.TransactionSourceText}, user)
+}
+
+// processTransactionText extracts a transaction from text. evidence carries the source
+// and any media identifiers the text came from.
+func (h *ConversationHandler) processTransactionText(chat services.Chat, text string, evidence services.TransactionInput, user *models.User) error {
+	ctx := context.Background()
+	data, err := h.nlpService.ExtractTransaction(ctx, text)
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui entender a transação. Tente novamente ou envie de outra forma.")
+	}
+	// Save transaction
+	input := evidence
+	input.Amount = data.Amount
+	input.Description = data.Description
+	input.TransactionType = models.TransactionType(data.Type)
+	input.ExternalRef = services.ExtractExternalReference(text)
+	if _, err := h.transactionService.CreateTransactionFromInput(user.ID.String(), input); err != nil {
+		if handled, dupErr := h.askDuplicateConfirmation(chat, input, err, user); handled {
+			return dupErr
+		}
+		return chat.SendText("Erro ao registrar a transação. Tente novamente mais tarde.")
+	}
+	// Send summary (stub)
+	return chat.SendText("Transação registrada! Valor: R$ " + fmt.Sprintf("%.2f", data.Amount) + " (" + data.Type + ") - " + data.Description)
+}
+
+func (h *ConversationHandler) processAudioMessage(chat services.Chat, audio *services.MediaRef, user *models.User) error {
+	ctx := context.Background()
+	media, err := chat.DownloadMedia(ctx, audio, h.voiceService.MaxBytes())
+	if err != nil {
+		if errors.Is(err, services.ErrMediaTooLarge) {
+			return h.sendAudioTooLong(chat)
+		}
+		return chat.SendText("Desculpe, não consegui transcrever o áudio. Tente novamente.")
+	}
+
+	evidence := services.TransactionInput{
+		Source:       models.TransactionSourceVoice,
+		MediaSHA256:  media.SHA256,
+		AttachmentID: h.archiveMedia(ctx, user, models.AttachmentKindAudio, media),
+	}
+
+	// Vocabulary only improves accuracy, so a lookup failure shouldn't block transcription
+	vocabulary, _ := h.transactionService.GetUserVocabulary(user.ID.String(), 20)
+
+	transcription, err := h.voiceService.TranscribeAudioData(ctx, media.Data, services.TranscriptionOptions{
+		MimeType:    media.MimeType,
+		MediaSHA256: media.SHA256,
+		Vocabulary:  vocabulary,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrAudioTooLong):
+			return h.sendAudioTooLong(chat)
+		case errors.Is(err, services.ErrUnsupportedAudioFormat):
+			return chat.SendText("Desculpe, não consigo ouvir esse formato de áudio. Grave uma mensagem de voz pelo próprio aplicativo ou envie por texto.")
+		}
+		return chat.SendText("Desculpe, não consegui transcrever o áudio. Tente novamente.")
+	}
+
+	evidence.MediaSHA256 = transcription.MediaSHA256
+	evidence.MediaArtifactID = transcription.ArtifactID
+	return h.processTransactionText(chat, transcription.Text, evidence, user)
+}
+
+func (h *ConversationHandler) sendAudioTooLong(chat services.Chat) error {
+	return chat.SendText(fmt.Sprintf("🎙️ Áudio muito longo! Envie áudios de até %d segundos, de preferência com uma transação por vez.", h.voiceService.MaxDurationSeconds()))
+}
+
+func (h *ConversationHandler) processImageMessage(chat services.Chat, image *services.MediaRef, user *models.User) error {
+	ctx := context.Background()
+	media, err := chat.DownloadMedia(ctx, image, maxImageBytes)
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui ler o recibo. Tente novamente.")
+	}
+
+	attachmentID := h.archiveMedia(ctx, user, models.AttachmentKindImage, media)
+
+	extraction, err := h.ocrService.ExtractReceiptData(ctx, media.Data, media.MimeType, services.OCROptions{MediaSHA256: media.SHA256})
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui ler o recibo. Tente novamente.")
+	}
+	data := extraction.Data
+	input := services.TransactionInput{
+		Amount:          data.Amount,
+		Description:     data.Description,
+		TransactionType: models.TransactionType(data.Type),
+		Source:          models.TransactionSourceImage,
+		MediaSHA256:     extraction.MediaSHA256,
+		ExternalRef:     data.ExternalRef,
+		MediaArtifactID: extraction.ArtifactID,
+		AttachmentID:    attachmentID,
+	}
+	if input.ExternalRef == "" {
+		// Readers that only return the receipt's text, and extractions cached before
+		// references were read, still get the receipt's identifier
+		input.ExternalRef = services.ExtractExternalReference(data.Text)
+	}
+	if _, err := h.transactionService.CreateTransactionFromInput(user.ID.String(), input); err != nil {
+		if handled, dupErr := h.askDuplicateConfirmation(chat, input, err, user); handled {
+			return dupErr
+		}
+		return chat.SendText("Erro ao registrar a transação do recibo. Tente novamente mais tarde.")
+	}
+	return chat.SendText("Recibo processado! Valor: R$ " + fmt.Sprintf("%.2f", data.Amount) + " (" + data.Type + ") - " + data.Description)
+}
+
+// archiveMedia keeps the media as fiscal evidence. Archiving is best effort: a storage
+// failure is logged and the transaction is still recorded.
+func (h *ConversationHandler) archiveMedia(ctx context.Context, user *models.User, kind models.AttachmentKind, media *services.Media) *uuid.UUID {
+	if h.archiveService == nil {
+		return nil
+	}
+
+	attachment, err := h.archiveService.Archive(ctx, user.ID.String(), kind, media)
+	if err != nil {
+		fmt.Printf("Error archiving media: %v\n", err)
+		return nil
+	}
+	return &attachment.ID
+}
+
+// sendReceipts answers "mande a foto do recibo de ontem" with the archived receipts of that
+// day. Media is archived for every user, but only plans with the cloud backup retrieve it.
+func (h *ConversationHandler) sendReceipts(chat services.Chat, day time.Time, user *models.User) error {
+	if locked, err := h.requireFeature(chat, user, services.FeatureCloudBackup); locked {
+		return err
+	}
+
+	receipts, err := h.archiveService.FindReceipts(user.ID.String(), day)
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui buscar seus recibos. Tente novamente mais tarde.")
+	}
+
+	if len(receipts) == 0 {
+		return chat.SendText(fmt.Sprintf("📭 Não encontrei recibos enviados em %s.", day.Format("02/01/2006")))
+	}
+
+	ctx := context.Background()
+	for i, receipt := range receipts {
+		data, err := h.archiveService.GetAttachmentContent(ctx, &receipt)
+		if err != nil {
+			return chat.SendText("Desculpe, não consegui recuperar o recibo. Tente novamente mais tarde.")
+		}
+
+		caption := fmt.Sprintf("🧾 Recibo %d de %d - %s", i+1, len(receipts), receipt.CreatedAt.Format("02/01/2006 15:04"))
+		if err := chat.SendImage(data, receipt.MimeType, caption); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// askDuplicateConfirmation parks a suspected duplicate and asks the user whether to record it anyway.
+// It reports false when err is not a duplicate error.
+func (h *ConversationHandler) askDuplicateConfirmation(chat services.Chat, input services.TransactionInput, err error, user *models.User) (bool, error) {
+	var dupErr *services.DuplicateTransactionError
+	if !errors.As(err, &dupErr) {
+		return false, nil
+	}
+
+	if _, err := h.transactionService.SavePendingDuplicate(user.ID.String(), input, dupErr.Match); err != nil {
+		return true, chat.SendText("Erro ao registrar a transação. Tente novamente mais tarde.")
+	}
+
+	existing := dupErr.Match.Existing
+	message := fmt.Sprintf("🤔 Parece repetido, registrar mesmo assim?\n\nJá existe: R$ %.2f (%s) - %s, registrado em %s.",
+		existing.Amount, existing.TransactionType, existing.Description, existing.CreatedAt.Format("02/01 15:04"))
+	return true, chat.SendButtons(message, []services.Button{
+		{ID: replyDuplicateConfirm, Title: "Registrar"},
+		{ID: replyDuplicateDiscard, Title: "Descartar"},
+	})
+}
+
+// resolvePendingDuplicate handles a typed SIM/NÃO reply to a duplicate confirmation.
+// It reports false when there is nothing pending or the text is not a reply.
+func (h *ConversationHandler) resolvePendingDuplicate(chat services.Chat, text string, user *models.User) (bool, error) {
+	answer := strings.ToLower(strings.TrimSpace(text))
+	isYes := answer == "sim" || answer == "s" || answer == "registrar"
+	isNo := answer == "não" || answer == "nao" || answer == "n" || answer == "descartar"
+	if !isYes && !isNo {
+		return false, nil
+	}
+
+	return h.applyDuplicateDecision(chat, isYes, user)
+}
+
+// applyDuplicateDecision records or discards the pending duplicate.
+// It reports false when there is nothing pending.
+func (h *ConversationHandler) applyDuplicateDecision(chat services.Chat, keep bool, user *models.User) (bool, error) {
+	pending, err := h.transactionService.GetPendingDuplicate(user.ID.String())
+	if err != nil || pending == nil {
+		return false, nil
+	}
+
+	if !keep {
+		if err := h.transactionService.DiscardPendingDuplicate(user.ID.String()); err != nil {
+			return true, fmt.Errorf("failed to discard pending transaction: %w", err)
+		}
+		return true, chat.SendText("👍 Ok, não registrei a transação repetida.")
+	}
+
+	transaction, err := h.transactionService.ConfirmPendingDuplicate(user.ID.String())
+	if err != nil {
+		return true, chat.SendText("Erro ao registrar a transação. Tente novamente mais tarde.")
+	}
+	return true, chat.SendText("Transação registrada! Valor: R$ " + fmt.Sprintf("%.2f", transaction.Amount) + " (" + string(transaction.TransactionType) + ") - " + transaction.Description)
+}
+
+func (h *ConversationHandler) CreateTransaction(c *gin.Context) {
+	// API endpoint for creating transactions
+	c.JSON(http.StatusOK, gin.H{"message": "Transaction created"})
+}
+
+func (h *ConversationHandler) GetUserSummary(c *gin.Context) {
+	userID := c.Param("id")
+
+	summary, err := h.transactionService.GetFinancialSummary(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+func (h *ConversationHandler) CreateSubscription(c *gin.Context) {
+	// Placeholder for subscription creation
+	// In Phase 3, this will integrate with payment gateways
+	c.JSON(http.StatusOK, gin.H{"message": "Subscription created"})
+}
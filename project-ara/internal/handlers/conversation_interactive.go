@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"project-ara/internal/models"
+	"project-ara/internal/payments"
+	"project-ara/internal/pix"
+	"project-ara/internal/services"
+)
+
+// IDs of the reply buttons and list rows the bot sends. WhatsApp echoes them back
+// in interactive.button_reply / list_reply when the user taps one.
+const (
+	replyDuplicateConfirm = "dup_confirm"
+	replyDuplicateDiscard = "dup_discard"
+
+	replySummaryToday   = "summary_today"
+	replySummaryWeek    = "summary_week"
+	replySummaryMonth   = "summary_month"
+	replyDetailedReport = "report_detailed"
+	replyCategories     = "report_categories"
+	replyDAS            = "das"
+
+	replySubscribe         = "subscribe" // "subscribe:<plan>" for a plan other than the default
+	replySubscribeBenefits = "subscribe_benefits"
+	replyTrialStatus       = "trial_status"
+)
+
+// processInteractiveReply handles a tapped reply button or list row
+func (h *ConversationHandler) processInteractiveReply(chat services.Chat, replyID string, user *models.User) error {
+	switch replyID {
+	case replyDuplicateConfirm, replyDuplicateDiscard:
+		if handled, err := h.applyDuplicateDecision(chat, replyID == replyDuplicateConfirm, user); handled {
+			return err
+		}
+		return chat.SendText("Essa confirmação expirou. Envie a transação novamente se quiser registrá-la.")
+	case replySummaryToday:
+		return h.sendSummary(chat, "today", user)
+	case replySummaryWeek:
+		return h.sendSummary(chat, "week", user)
+	case replySummaryMonth:
+		return h.sendSummary(chat, "month", user)
+	case replyDetailedReport:
+		return h.sendDetailedReport(chat, user)
+	case replyCategories:
+		return h.sendCategories(chat, user)
+	case replyDAS:
+		return h.sendDAS(chat, user)
+	case replySubscribe:
+		return h.startSubscription(chat, user, "", "")
+	case replySubscribeBenefits:
+		return h.sendConversionMessage(chat, user)
+	case replyTrialStatus:
+		return h.sendTrialStatus(chat, user)
+	}
+	if planID, ok := strings.CutPrefix(replyID, replySubscribe+":"); ok {
+		return h.startSubscription(chat, user, planID, "")
+	}
+	return chat.SendText("Desculpe, não entendi essa opção. Envie *menu* para ver o que posso fazer.")
+}
+
+// processCommand handles typed keywords. It reports false when the text isn't a command
+// and should be treated as a transaction.
+func (h *ConversationHandler) processCommand(chat services.Chat, text string, user *models.User) (bool, error) {
+	command := strings.ToLower(strings.TrimSpace(text))
+	switch command {
+	case "menu", "ajuda", "opções", "opcoes":
+		return true, h.sendMenu(chat)
+	case "resumo", "relatório", "relatorio", "saldo":
+		return true, h.sendSummaryPeriodPrompt(chat)
+	case "relatório completo", "relatorio completo":
+		return true, h.sendDetailedReport(chat, user)
+	case "categorias":
+		return true, h.sendCategories(chat, user)
+	case "assinar":
+		return true, h.startSubscription(chat, user, "", "")
+	case "cartão", "cartao", "assinar com cartão", "assinar com cartao":
+		return true, h.startCardSubscription(chat, user, "", "")
+	case "meu plano", "plano", "status":
+		return true, h.sendTrialStatus(chat, user)
+	case "indicar", "indique", "indicação", "indicacao":
+		return true, h.sendReferralInvite(chat, user)
+	case "das", "meu das", "imposto", "impostos":
+		return true, h.sendDAS(chat, user)
+	}
+
+	// "das comércio", "das serviços" and "das comércio e serviços" set the MEI activity
+	if activity, ok := services.ParseMEIActivity(command); ok {
+		return true, h.setMEIActivity(chat, user, activity)
+	}
+	// "paguei o das", optionally with the amount paid, logs the DAS expense
+	if amount, ok := services.ParseDASPayment(command); ok {
+		return true, h.recordDASPayment(chat, user, amount)
+	}
+
+	// "cupom BEMVINDO" subscribes with a coupon, by Pix or, with "cupom BEMVINDO cartão", by card
+	if fields := strings.Fields(command); len(fields) >= 2 && fields[0] == "cupom" {
+		if len(fields) == 3 && (fields[2] == "cartão" || fields[2] == "cartao") {
+			return true, h.startCardSubscription(chat, user, "", fields[1])
+		}
+		return true, h.startSubscription(chat, user, "", fields[1])
+	}
+	// The invite link types the referrer's code in the first message
+	if code, found := services.FindReferralCode(text); found {
+		return true, h.claimReferral(chat, user, code)
+	}
+
+	// "assinar anual" and "cartão anual" pick a plan of the catalog by its keyword
+	verb, keyword, _ := strings.Cut(command, " ")
+	if plan, found := h.subscriptionService.Plans().ByKeyword(keyword); found {
+		switch verb {
+		case "assinar":
+			return true, h.startSubscription(chat, user, plan.ID, "")
+		case "cartão", "cartao":
+			return true, h.startCardSubscription(chat, user, plan.ID, "")
+		}
+	}
+	return false, nil
+}
+
+func (h *ConversationHandler) sendMenu(chat services.Chat) error {
+	return chat.SendList("👋 Para registrar, é só me mandar um texto, áudio ou foto do recibo. Ou escolha uma opção:", "Ver opções", []services.ListSection{
+		{
+			Title: "Resumos",
+			Rows: []services.ListRow{
+				{ID: replySummaryToday, Title: "Resumo de hoje"},
+				{ID: replySummaryWeek, Title: "Resumo da semana"},
+				{ID: replySummaryMonth, Title: "Resumo do mês"},
+				{ID: replyDetailedReport, Title: "Relatório completo", Description: "Premium"},
+				{ID: replyCategories, Title: "Categorias", Description: "Premium"},
+			},
+		},
+		{
+			Title: "Impostos",
+			Rows: []services.ListRow{
+				{ID: replyDAS, Title: "DAS do mês", Description: "Valor e vencimento"},
+			},
+		},
+		{
+			Title: "Assinatura",
+			Rows: []services.ListRow{
+				{ID: replyTrialStatus, Title: "Meu plano", Description: "Veja quantas transações restam"},
+				{ID: replySubscribeBenefits, Title: "Conhecer o Premium"},
+				{ID: replySubscribe, Title: "Assinar"},
+			},
+		},
+	})
+}
+
+func (h *ConversationHandler) sendSummaryPeriodPrompt(chat services.Chat) error {
+	return chat.SendButtons("📊 Qual período você quer ver?", []services.Button{
+		{ID: replySummaryToday, Title: "Hoje"},
+		{ID: replySummaryWeek, Title: "Semana"},
+		{ID: replySummaryMonth, Title: "Mês"},
+	})
+}
+
+func (h *ConversationHandler) sendSummary(chat services.Chat, period string, user *models.User) error {
+	summary, err := h.reportingService.GenerateConversationalSummary(user.ID.String(), period)
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui gerar o resumo. Tente novamente mais tarde.")
+	}
+	return chat.SendText(summary)
+}
+
+// sendDetailedReport sends the month's detailed report, a premium feature
+func (h *ConversationHandler) sendDetailedReport(chat services.Chat, user *models.User) error {
+	if locked, err := h.requireFeature(chat, user, services.FeatureAdvancedReports); locked {
+		return err
+	}
+	report, err := h.reportingService.GenerateDetailedReportMessage(user.ID.String(), "month")
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui gerar o relatório. Tente novamente mais tarde.")
+	}
+	return chat.SendText(report)
+}
+
+// sendCategories sends the month's transactions grouped by category, a premium feature
+func (h *ConversationHandler) sendCategories(chat services.Chat, user *models.User) error {
+	if locked, err := h.requireFeature(chat, user, services.FeatureAutoCategorization); locked {
+		return err
+	}
+	message, err := h.reportingService.GenerateCategoriesMessage(user.ID.String(), "month")
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui agrupar suas transações. Tente novamente mais tarde.")
+	}
+	return chat.SendText(message)
+}
+
+// sendDAS sends the amount and due date of the DAS due this month
+func (h *ConversationHandler) sendDAS(chat services.Chat, user *models.User) error {
+	message, err := h.dasService.DASMessage(user, time.Now())
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui calcular seu DAS. Tente novamente mais tarde.")
+	}
+	return chat.SendText(message)
+}
+
+// setMEIActivity records the user's MEI activity and sends their DAS, now exact
+func (h *ConversationHandler) setMEIActivity(chat services.Chat, user *models.User, activity string) error {
+	if err := h.dasService.SetActivity(user, activity); err != nil {
+		return chat.SendText("Desculpe, não consegui salvar sua atividade. Tente novamente mais tarde.")
+	}
+	return h.sendDAS(chat, user)
+}
+
+// recordDASPayment logs the DAS the user says they paid as an expense. Like any
+// transaction, it counts toward the trial.
+func (h *ConversationHandler) recordDASPayment(chat services.Chat, user *models.User, amount float64) error {
+	canCreate, err := h.userService.CanUserCreateTransaction(user.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to check user permissions: %w", err)
+	}
+	if !canCreate {
+		return h.sendSubscriptionPrompt(chat, user)
+	}
+
+	transaction, due, err := h.dasService.RecordPayment(user, amount, time.Now())
+	switch {
+	case errors.Is(err, services.ErrDASAlreadyPaid):
+		return chat.SendText("✅ Você já registrou o pagamento do DAS deste mês.")
+	case errors.Is(err, services.ErrMEIActivityUnknown):
+		return chat.SendText("Quanto você pagou? Responda, por exemplo, *PAGUEI O DAS 80,90*. Ou me diga sua atividade (*DAS COMÉRCIO*, *DAS SERVIÇOS* ou *DAS COMÉRCIO E SERVIÇOS*) que eu calculo o valor.")
+	case err != nil:
+		return chat.SendText("Erro ao registrar o pagamento do DAS. Tente novamente mais tarde.")
+	}
+	return chat.SendText(fmt.Sprintf("✅ Pagamento do %s registrado: R$ %.2f como despesa de %s.", due.Name(), transaction.Amount, services.DASDescription))
+}
+
+// requireFeature checks that the user's plan includes a feature. When it doesn't, the user
+// is told what the feature does and offered the plan that unlocks it, and it reports true.
+func (h *ConversationHandler) requireFeature(chat services.Chat, user *models.User, feature services.Feature) (bool, error) {
+	err := h.entitlementService.CheckUser(user, feature)
+	if err == nil {
+		return false, nil
+	}
+	var locked *services.FeatureLockedError
+	if !errors.As(err, &locked) {
+		return true, chat.SendText("Desculpe, não consegui consultar seu plano. Tente novamente mais tarde.")
+	}
+
+	message := h.entitlementService.LockedMessage(locked)
+	if locked.Upgrade == nil || locked.Subscribed {
+		return true, chat.SendText(message)
+	}
+	subscribe := replySubscribe
+	if locked.Upgrade.ID != h.subscriptionService.Plans().DefaultPlan {
+		subscribe += ":" + locked.Upgrade.ID
+	}
+	return true, chat.SendButtons(message, []services.Button{
+		{ID: subscribe, Title: "Assinar"},
+		{ID: replySubscribeBenefits, Title: "Ver benefícios"},
+	})
+}
+
+// sendSubscriptionPrompt tells a user who used up the trial how to continue
+func (h *ConversationHandler) sendSubscriptionPrompt(chat services.Chat, user *models.User) error {
+	plans := h.subscriptionService.Plans()
+	subscriptionMessage := fmt.Sprintf("Você atingiu o limite de %d transações gratuitas. Para continuar usando o serviço, assine nosso plano premium por apenas %s.",
+		plans.Trial.Limit(user), plans.Default().PriceLabel())
+	return chat.SendButtons(subscriptionMessage, []services.Button{
+		{ID: replySubscribe, Title: "Assinar"},
+		{ID: replySubscribeBenefits, Title: "Ver benefícios"},
+	})
+}
+
+func (h *ConversationHandler) sendConversionMessage(chat services.Chat, user *models.User) error {
+	message, err := h.reportingService.GenerateConversionMessage(user.ID.String())
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui carregar os detalhes do plano. Tente novamente mais tarde.")
+	}
+	return chat.SendButtons(message.Text, []services.Button{
+		{ID: replySubscribe, Title: "Assinar"},
+	})
+}
+
+func (h *ConversationHandler) sendTrialStatus(chat services.Chat, user *models.User) error {
+	message, err := h.reportingService.GenerateTrialStatusMessage(user.ID.String())
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui consultar seu plano. Tente novamente mais tarde.")
+	}
+	return chat.SendText(message)
+}
+
+// startSubscription charges the subscription of a plan (the default one when planID is
+// empty), with a coupon when couponCode isn't empty, by Pix, which is how most users pay:
+// a QR code to scan and the "copia e cola" code to paste in the bank app. When the gateway
+// can't charge by Pix, the card checkout is offered instead.
+func (h *ConversationHandler) startSubscription(chat services.Chat, user *models.User, planID, couponCode string) error {
+	subscription, err := h.subscriptionService.CreateSubscription(user.ID.String(), planID, payments.MethodPix, couponCode)
+	var couponErr *services.CouponError
+	if errors.As(err, &couponErr) {
+		return chat.SendText(couponMessage(couponErr))
+	}
+	if err != nil {
+		if user.SubscriptionStatus == models.SubscriptionStatusActive {
+			return chat.SendText("✅ Sua assinatura já está ativa!")
+		}
+		if errors.Is(err, services.ErrNoPaymentGateway) {
+			return chat.SendText("Desculpe, não consegui iniciar sua assinatura. Tente novamente mais tarde.")
+		}
+		return h.startCardSubscription(chat, user, planID, couponCode)
+	}
+
+	price := h.subscriptionService.Plans().PriceLabel(subscription)
+	if couponCode != "" {
+		price += " com o cupom " + strings.ToUpper(couponCode)
+	}
+	caption := fmt.Sprintf("💠 Assinatura do Ara: %s\nAbra o app do seu banco, escolha pagar com Pix e leia este QR Code, ou use o código copia e cola que mando a seguir.", price)
+	if subscription.PixExpiresAt != nil {
+		caption += fmt.Sprintf(" Ele vale até %s.", subscription.PixExpiresAt.Local().Format("02/01/2006 15:04"))
+	}
+	cardCommand := "CARTÃO"
+	if plan := h.subscriptionService.Plans().PlanOf(subscription); plan.ID != h.subscriptionService.Plans().DefaultPlan && plan.Keyword != "" {
+		cardCommand += " " + strings.ToUpper(plan.Keyword)
+	}
+	if couponCode != "" {
+		cardCommand = "CUPOM " + strings.ToUpper(couponCode) + " CARTÃO"
+	}
+	caption += fmt.Sprintf("\n\nAssim que o pagamento for confirmado, eu te aviso por aqui. Prefere cartão? Responda *%s*.", cardCommand)
+
+	qrCode, err := pix.QRCodePNG(subscription.PixCode, pix.DefaultQRCodeSize)
+	if err == nil {
+		err = chat.SendImage(qrCode, "image/png", caption)
+	} else {
+		err = chat.SendText(caption)
+	}
+	if err != nil {
+		return err
+	}
+	// On its own, so a long press copies just the code
+	return chat.SendText(subscription.PixCode)
+}
+
+// startCardSubscription sends the link to the gateway's checkout, where the user subscribes
+// with a card that is charged every billing interval of the plan
+func (h *ConversationHandler) startCardSubscription(chat services.Chat, user *models.User, planID, couponCode string) error {
+	subscription, err := h.subscriptionService.CreateSubscription(user.ID.String(), planID, "credit_card", couponCode)
+	var couponErr *services.CouponError
+	if errors.As(err, &couponErr) {
+		return chat.SendText(couponMessage(couponErr))
+	}
+	if err != nil {
+		if user.SubscriptionStatus == models.SubscriptionStatusActive {
+			return chat.SendText("✅ Sua assinatura já está ativa!")
+		}
+		return chat.SendText("Desculpe, não consegui iniciar sua assinatura. Tente novamente mais tarde.")
+	}
+	return chat.SendText(fmt.Sprintf("💳 Para assinar o Ara por %s, é só pagar por este link:\n%s\n\nAssim que o pagamento for confirmado, eu te aviso por aqui.",
+		h.subscriptionService.Plans().PriceLabel(subscription), subscription.CheckoutURL))
+}
+
+// couponMessage tells the user why their coupon can't be used
+func couponMessage(couponErr *services.CouponError) string {
+	switch couponErr.Reason {
+	case services.CouponUnknown:
+		return fmt.Sprintf("🏷️ Não encontrei o cupom *%s*. Confira se digitou certinho.", couponErr.Code)
+	case services.CouponUsedUp:
+		return fmt.Sprintf("🏷️ O cupom *%s* já foi usado o máximo de vezes.", couponErr.Code)
+	case services.CouponAlreadyRedeemed:
+		return fmt.Sprintf("🏷️ Você já usou o cupom *%s*.", couponErr.Code)
+	case services.CouponTooLarge:
+		return fmt.Sprintf("🏷️ O cupom *%s* não vale para esse plano.", couponErr.Code)
+	default:
+		return fmt.Sprintf("🏷️ O cupom *%s* não está mais valendo.", couponErr.Code)
+	}
+}
+
+// sendReferralInvite sends the user's referral code, and an invite on its own so it can
+// be forwarded as is
+func (h *ConversationHandler) sendReferralInvite(chat services.Chat, user *models.User) error {
+	invite, err := h.subscriptionService.GetReferralInvite(user.ID.String())
+	if errors.Is(err, services.ErrReferralsDisabled) {
+		return chat.SendText("O programa de indicação não está disponível no momento.")
+	}
+	if err != nil {
+		return chat.SendText("Desculpe, não consegui gerar seu código de indicação. Tente novamente mais tarde.")
+	}
+
+	message := fmt.Sprintf("🤝 *Indique o Ara e ganhe!*\n\nQuando alguém que você indicou assinar o Premium, vocês dois ganham %s.\n\nSeu código de indicação é *%s*. Encaminhe a mensagem abaixo para quem também tem um negócio:",
+		invite.Policy.RewardSummary(), invite.Code)
+	if err := chat.SendText(message); err != nil {
+		return err
+	}
+	if invite.Link == "" {
+		return chat.SendText(fmt.Sprintf("Conheça o Ara: ele organiza as vendas e despesas do seu negócio pelo WhatsApp, é só mandar uma mensagem ou um áudio. Comece grátis enviando o código %s para o Ara.", invite.Code))
+	}
+	return chat.SendText(fmt.Sprintf("Conheça o Ara: ele organiza as vendas e despesas do seu negócio pelo WhatsApp, é só mandar uma mensagem ou um áudio. Comece grátis pelo meu link: %s", invite.Link))
+}
+
+// claimReferral applies the referral code a new user sent
+func (h *ConversationHandler) claimReferral(chat services.Chat, user *models.User, code string) error {
+	_, err := h.subscriptionService.ClaimReferral(user.ID.String(), code, "")
+	var rejected *services.ReferralRejectedError
+	switch {
+	case err == nil:
+		return chat.SendText(fmt.Sprintf("🎉 Código de indicação aplicado! Quando você assinar o Premium, você e quem te indicou ganham %s.\n\nPara começar, é só me mandar uma venda ou despesa por texto, áudio ou foto do recibo.",
+			h.subscriptionService.Plans().Referral.RewardSummary()))
+	case errors.As(err, &rejected) && rejected.Reason == models.ReferralRejectedSelf:
+		return chat.SendText("Esse é o seu próprio código de indicação. 😉 Para indicar o Ara, envie *INDICAR*.")
+	case errors.As(err, &rejected) && rejected.Reason == models.ReferralRejectedNotNew:
+		return chat.SendText("O código de indicação vale só para quem está começando a usar o Ara.")
+	case errors.As(err, &rejected):
+		// The other fraud checks aren't explained
+		return chat.SendText("Não consegui aplicar esse código de indicação.")
+	case errors.Is(err, services.ErrUnknownReferralCode):
+		return chat.SendText(fmt.Sprintf("Não encontrei o código de indicação %s. Confira com quem te indicou.", code))
+	case errors.Is(err, services.ErrAlreadyReferred):
+		return chat.SendText("Você já está usando o código de indicação de outra pessoa.")
+	case errors.Is(err, services.ErrReferralsDisabled):
+		return chat.SendText("O programa de indicação não está disponível no momento.")
+	}
+	return chat.SendText("Desculpe, não consegui aplicar o código de indicação. Tente novamente mais tarde.")
+}
@@ -1,11 +1,18 @@
 package handlers
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"project-ara/internal/middleware"
+	"project-ara/internal/models"
+	"project-ara/internal/payments"
+	"project-ara/internal/repository"
 	"project-ara/internal/services"
 )
 
@@ -204,12 +211,41 @@ func (h *FinancialHandler) GetSubscriptionInfo(c *gin.Context) {
 	c.JSON(http.StatusOK, info)
 }
 
-// CreateSubscription creates a new subscription
+// GetBillingHistory lists the user's subscription events and payments
+func (h *FinancialHandler) GetBillingHistory(c *gin.Context) {
+	userID := c.Param("userID")
+
+	history, err := h.subscriptionService.GetBillingHistory(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get billing history",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+// GetPlans lists the plans on sale and the free trial's rules
+func (h *FinancialHandler) GetPlans(c *gin.Context) {
+	plans := h.subscriptionService.Plans()
+	c.JSON(http.StatusOK, gin.H{
+		"trial":        plans.Trial,
+		"default_plan": plans.DefaultPlan,
+		"plans":        plans.Available(),
+	})
+}
+
+// CreateSubscription starts a checkout of the requested plan, or the default one, with an
+// optional coupon; the subscription activates once it's paid
 func (h *FinancialHandler) CreateSubscription(c *gin.Context) {
 	userID := c.Param("userID")
 
 	var request struct {
+		Plan          string `json:"plan"`
 		PaymentMethod string `json:"payment_method" binding:"required"`
+		Coupon        string `json:"coupon"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -220,7 +256,28 @@ func (h *FinancialHandler) CreateSubscription(c *gin.Context) {
 		return
 	}
 
-	subscription, err := h.subscriptionService.CreateSubscription(userID, request.PaymentMethod)
+	subscription, err := h.subscriptionService.CreateSubscription(userID, request.Plan, request.PaymentMethod, request.Coupon)
+	if errors.Is(err, services.ErrUnknownPlan) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid plan",
+			"details": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidCoupon) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid coupon",
+			"details": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrNoPaymentGateway) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Failed to create subscription",
+			"details": err.Error(),
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to create subscription",
@@ -230,7 +287,8 @@ func (h *FinancialHandler) CreateSubscription(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":      "Subscription created successfully",
+		"message":      "Checkout created, the subscription activates once it's paid",
+		"checkout_url": subscription.CheckoutURL,
 		"subscription": subscription,
 	})
 }
@@ -252,19 +310,74 @@ func (h *FinancialHandler) CancelSubscription(c *gin.Context) {
 	})
 }
 
-// ProcessPaymentWebhook handles payment gateway webhooks
+// ProcessPaymentWebhook handles payment notifications in our own format, for payments
+// taken outside a gateway. They must carry the payments.ManualSignatureHeader signature.
 func (h *FinancialHandler) ProcessPaymentWebhook(c *gin.Context) {
-	var webhookData map[string]interface{}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid webhook data",
+			"details": err.Error(),
+		})
+		return
+	}
 
-	if err := c.ShouldBindJSON(&webhookData); err != nil {
+	err = h.subscriptionService.ProcessPaymentWebhook(c.Request.Context(), c.Request.Header, body)
+	if errors.Is(err, payments.ErrInvalidSignature) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "Invalid webhook signature",
+			"details": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidWebhook) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "Invalid webhook data",
 			"details": err.Error(),
 		})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to process payment webhook",
+			"details": err.Error(),
+		})
+		return
+	}
 
-	if err := h.subscriptionService.ProcessPaymentWebhook(webhookData); err != nil {
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Payment webhook processed successfully",
+	})
+}
+
+// HandleGatewayWebhook handles the notifications of the configured payment gateway, at
+// /subscriptions/webhook/{gateway}. Errors answer 5xx so the gateway retries.
+func (h *FinancialHandler) HandleGatewayWebhook(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid webhook data",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	err = h.subscriptionService.HandlePaymentWebhook(c.Request.Context(), c.Param("gateway"), c.Request.Header, body)
+	if errors.Is(err, services.ErrUnknownGateway) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Unknown payment gateway",
+			"details": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, payments.ErrInvalidSignature) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "Invalid webhook signature",
+			"details": err.Error(),
+		})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to process payment webhook",
 			"details": err.Error(),
@@ -276,3 +389,238 @@ func (h *FinancialHandler) ProcessPaymentWebhook(c *gin.Context) {
 		"message": "Payment webhook processed successfully",
 	})
 }
+
+// GetDunningStats counts the subscriptions that went into dunning in the last ?days=
+// (30 by default) by how they ended: recovered, churned or still open
+func (h *FinancialHandler) GetDunningStats(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid days parameter",
+		})
+		return
+	}
+
+	stats, err := h.subscriptionService.GetDunningStats(days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get dunning stats",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"days":  days,
+		"stats": stats,
+	})
+}
+
+// GetReferralInvite returns the user's referral code and the wa.me link to share it with
+func (h *FinancialHandler) GetReferralInvite(c *gin.Context) {
+	userID := c.Param("userID")
+
+	invite, err := h.subscriptionService.GetReferralInvite(userID)
+	if errors.Is(err, services.ErrReferralsDisabled) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Referrals are disabled",
+			"details": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get referral invite",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invite": invite,
+	})
+}
+
+// ClaimReferral records who referred the user, for the user themselves or an admin. The
+// signup page sends a fingerprint of the device so the same phone can't claim referrals
+// over and over.
+func (h *FinancialHandler) ClaimReferral(c *gin.Context) {
+	userID := c.Param("userID")
+	if !middleware.CanAccessUser(c, userID) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Cannot claim a referral for another user",
+		})
+		return
+	}
+
+	var request struct {
+		Code     string `json:"code" binding:"required"`
+		DeviceID string `json:"device_id"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	referral, err := h.subscriptionService.ClaimReferral(userID, request.Code, request.DeviceID)
+	var rejected *services.ReferralRejectedError
+	switch {
+	case errors.As(err, &rejected):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":   "Referral rejected",
+			"reason":  rejected.Reason,
+			"details": err.Error(),
+		})
+		return
+	case errors.Is(err, services.ErrUnknownReferralCode):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Unknown referral code",
+			"details": err.Error(),
+		})
+		return
+	case errors.Is(err, services.ErrAlreadyReferred):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "User was already referred",
+			"details": err.Error(),
+		})
+		return
+	case errors.Is(err, services.ErrReferralsDisabled):
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Referrals are disabled",
+			"details": err.Error(),
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to claim referral",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Referral recorded, both sides are rewarded once the user subscribes",
+		"referral": referral,
+	})
+}
+
+// GetReferralStats counts the referrals made in the last ?days= (30 by default) by how
+// they ended: pending, rewarded or rejected, and why
+func (h *FinancialHandler) GetReferralStats(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid days parameter",
+		})
+		return
+	}
+
+	stats, err := h.subscriptionService.GetReferralStats(days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get referral stats",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"days":  days,
+		"stats": stats,
+	})
+}
+
+// CreateCoupon creates a coupon users can apply to new subscriptions
+func (h *FinancialHandler) CreateCoupon(c *gin.Context) {
+	var request struct {
+		Code      string     `json:"code" binding:"required"`
+		Kind      string     `json:"kind" binding:"required"`
+		Value     float64    `json:"value" binding:"required"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		MaxUses   int        `json:"max_uses"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	coupon := &models.Coupon{
+		Code:      request.Code,
+		Kind:      request.Kind,
+		Value:     request.Value,
+		ExpiresAt: request.ExpiresAt,
+		MaxUses:   request.MaxUses,
+	}
+	err := h.subscriptionService.CreateCoupon(coupon)
+	if errors.Is(err, services.ErrInvalidCoupon) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid coupon",
+			"details": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrCouponExists) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Coupon already exists",
+			"details": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to create coupon",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"coupon": coupon,
+	})
+}
+
+// ListCoupons lists every coupon with how often it was used
+func (h *FinancialHandler) ListCoupons(c *gin.Context) {
+	coupons, err := h.subscriptionService.ListCoupons()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to list coupons",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"coupons": coupons,
+	})
+}
+
+// DeactivateCoupon stops a coupon from being used on new checkouts
+func (h *FinancialHandler) DeactivateCoupon(c *gin.Context) {
+	err := h.subscriptionService.DeactivateCoupon(c.Param("code"))
+	if errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Coupon not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to deactivate coupon",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Coupon deactivated",
+	})
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/middleware"
+	"project-ara/internal/repository"
+	"project-ara/internal/services"
+)
+
+func TestOnlyTheUserClaimsTheirReferral(t *testing.T) {
+	const secret = "test-jwt-secret"
+	plans, err := services.LoadPlanCatalog("")
+	require.NoError(t, err)
+	repos := repository.NewMemory()
+	userService := services.NewUserService(repos.Users, plans, nil)
+	subscriptionService := services.NewSubscriptionService(repos.Subscriptions, userService, nil, nil, plans, nil, nil, nil)
+	handler := NewFinancialHandler(nil, nil, subscriptionService)
+
+	referrer, err := userService.GetOrCreateChannelUser(services.ChannelWhatsApp, "5511966660000")
+	require.NoError(t, err)
+	invite, err := subscriptionService.GetReferralInvite(referrer.ID.String())
+	require.NoError(t, err)
+	referred, err := userService.GetOrCreateChannelUser(services.ChannelWhatsApp, "5521977771111")
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users/:userID/referral", middleware.RequireAuth(secret), handler.ClaimReferral)
+	claim := func(subject string) int {
+		request := httptest.NewRequest(http.MethodPost, "/users/"+referred.ID.String()+"/referral",
+			strings.NewReader(`{"code": "`+invite.Code+`", "device_id": "device-1"}`))
+		if subject != "" {
+			token, err := middleware.IssueToken(secret, middleware.Claims{Subject: subject})
+			require.NoError(t, err)
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, claim(""))
+	assert.Equal(t, http.StatusForbidden, claim(referrer.ID.String()))
+	referral, err := repos.Subscriptions.GetReferral(referred.ID)
+	require.NoError(t, err)
+	assert.Nil(t, referral)
+
+	assert.Equal(t, http.StatusOK, claim(referred.ID.String()))
+	referral, err = repos.Subscriptions.GetReferral(referred.ID)
+	require.NoError(t, err)
+	require.NotNil(t, referral)
+	assert.Equal(t, referrer.ID, referral.ReferrerID)
+}
+
+func TestPlanGatedReportsNeedTheUsersToken(t *testing.T) {
+	const secret = "test-jwt-secret"
+	plans, err := services.LoadPlanCatalog("")
+	require.NoError(t, err)
+	repos := repository.NewMemory()
+	userService := services.NewUserService(repos.Users, plans, nil)
+	entitlements := services.NewEntitlementService(repos.Subscriptions, userService, plans)
+	user, err := userService.GetOrCreateChannelUser(services.ChannelWhatsApp, "5511966660000")
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/users/:userID/report", middleware.RequireAuth(secret),
+		middleware.RequireFeature(entitlements, services.FeatureAdvancedReports), func(c *gin.Context) { c.Status(http.StatusOK) })
+	report := func(claims *middleware.Claims) int {
+		request := httptest.NewRequest(http.MethodGet, "/users/"+user.ID.String()+"/report", nil)
+		if claims != nil {
+			token, err := middleware.IssueToken(secret, *claims)
+			require.NoError(t, err)
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, report(nil))
+	assert.Equal(t, http.StatusForbidden, report(&middleware.Claims{Subject: "5521977771111"}))
+	assert.Equal(t, http.StatusPaymentRequired, report(&middleware.Claims{Subject: user.ID.String()}))
+	assert.Equal(t, http.StatusOK, report(&middleware.Claims{Subject: "admin", Role: middleware.RoleAdmin}))
+}
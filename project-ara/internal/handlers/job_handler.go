@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"project-ara/internal/services"
+)
+
+type JobHandler struct {
+	scheduler *services.JobScheduler
+}
+
+func NewJobHandler(scheduler *services.JobScheduler) *JobHandler {
+	return &JobHandler{scheduler: scheduler}
+}
+
+// ListJobs lists the scheduled jobs with their last runs
+func (h *JobHandler) ListJobs(c *gin.Context) {
+	jobs, runs, err := h.scheduler.ListJobs(200, 5)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to list jobs",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":  jobs,
+		"runs":  runs,
+		"count": len(jobs),
+	})
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"project-ara/internal/services"
+)
+
+type OutboundHandler struct {
+	queue *services.OutboundQueue
+}
+
+func NewOutboundHandler(queue *services.OutboundQueue) *OutboundHandler {
+	return &OutboundHandler{queue: queue}
+}
+
+// ListUndelivered lists messages that failed or weren't delivered within ?minutes= (default 30)
+func (h *OutboundHandler) ListUndelivered(c *gin.Context) {
+	minutes := 30
+	if value, err := strconv.Atoi(c.Query("minutes")); err == nil && value > 0 {
+		minutes = value
+	}
+
+	messages, err := h.queue.ListUndelivered(time.Now().Add(-time.Duration(minutes)*time.Minute), 200)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to list undelivered messages",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages": messages,
+		"count":    len(messages),
+	})
+}
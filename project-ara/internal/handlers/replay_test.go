@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+
+	"project-ara/internal/models"
+	"project-ara/internal/payments"
+	"project-ara/internal/repository"
+	"project-ara/internal/services"
+	"project-ara/internal/testdb"
+)
+
+// Conversation replay tests. Each file in testdata/conversations is a script of user
+// messages played against ConversationHandler with scripted NLP, voice and OCR providers,
+// a recording WhatsApp channel and a fresh in-memory database. Steps assert on replies
+// and on User/Transaction state; the whole transcript is compared to a .golden file.
+//
+// Regenerate the golden files with: go test ./internal/handlers -run TestConversationReplay -update
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden transcripts")
+
+type replayScript struct {
+	User  string      `yaml:"user"`
+	Setup replaySetup `yaml:"setup"`
+
+	// Scripted providers: text → extraction, audio name → transcript, image name → receipt
+	NLP         map[string]replayTransaction `yaml:"nlp"`
+	Transcripts map[string]string            `yaml:"transcripts"`
+	Receipts    map[string]replayTransaction `yaml:"receipts"`
+
+	Steps []replayStep `yaml:"steps"`
+}
+
+type replaySetup struct {
+	User         map[string]interface{} `yaml:"user"`
+	Transactions []replayTransaction    `yaml:"transactions"`
+	Coupons      []replayCoupon         `yaml:"coupons"`
+}
+
+type replayCoupon struct {
+	Code  string  `yaml:"code"`
+	Kind  string  `yaml:"kind"`
+	Value float64 `yaml:"value"`
+}
+
+type replayTransaction struct {
+	Amount      float64 `yaml:"amount"`
+	Type        string  `yaml:"type"`
+	Description string  `yaml:"description"`
+	ExternalRef string  `yaml:"external_ref"`
+	Text        string  `yaml:"text"` // What OCR read on a receipt
+	Source      string  `yaml:"source"`
+	MinutesAgo  int     `yaml:"minutes_ago"`
+}
+
+type replayStep struct {
+	Send    string `yaml:"send"`
+	Audio   string `yaml:"audio"`
+	Image   string `yaml:"image"`
+	Caption string `yaml:"caption"`
+	Tap     string `yaml:"tap"`
+	Pay     string `yaml:"pay"` // Settle the user's checkout at the fake gateway: approved or failed
+
+	Expect []string     `yaml:"expect"` // Each must appear in one of this step's replies
+	State  *replayState `yaml:"state"`
+}
+
+type replayState struct {
+	User            map[string]interface{} `yaml:"user"`
+	Transactions    *int                   `yaml:"transactions"`
+	LastTransaction *replayTransaction     `yaml:"last_transaction"`
+}
+
+func TestConversationReplay(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "conversations", "*.yaml"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".yaml"), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			var script replayScript
+			require.NoError(t, yaml.Unmarshal(data, &script))
+
+			transcript := runReplay(t, &script)
+
+			golden := strings.TrimSuffix(file, ".yaml") + ".golden"
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, []byte(transcript), 0o644))
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err, "missing golden transcript; run with -update")
+			assert.Equal(t, string(expected), transcript)
+		})
+	}
+}
+
+func runReplay(t *testing.T, script *replayScript) string {
+	db := testdb.SQLite(t)
+	repos := repository.NewGorm(db)
+	plans, err := services.LoadPlanCatalog("")
+	require.NoError(t, err)
+	analyticsService := services.NewAnalyticsService(repos.Analytics, repos.Users, plans)
+	transactionService := services.NewTransactionService(repos.Transactions, repos.Users, analyticsService)
+	userService := services.NewUserService(repos.Users, plans, analyticsService)
+	reportingService := services.NewFinancialReportingService(transactionService, userService, plans, analyticsService)
+	gateway := payments.NewFakeServer("")
+	gateway.PublicURL = "https://pagamento.exemplo"
+	gatewayServer := httptest.NewServer(gateway)
+	t.Cleanup(gatewayServer.Close)
+	channel := &recordingChannel{}
+	subscriptionService := services.NewSubscriptionService(repos.Subscriptions, userService, transactionService, reportingService, plans, channel, payments.NewFakeGateway(gatewayServer.URL), analyticsService)
+	entitlementService := services.NewEntitlementService(repos.Subscriptions, userService, plans)
+	dasTable, err := services.LoadDASTable("")
+	require.NoError(t, err)
+	dasService := services.NewDASService(dasTable, repos.Users, repos.Transactions, transactionService, entitlementService, channel)
+	handler := NewConversationHandler(
+		fakeExtractor(script.NLP),
+		fakeTranscriber(script.Transcripts),
+		fakeReceiptReader(script.Receipts),
+		transactionService, userService, reportingService, subscriptionService, entitlementService, nil, dasService,
+	)
+
+	phone := script.User
+	if phone == "" {
+		phone = "5511999990000"
+	}
+	user, err := userService.GetOrCreateChannelUser(services.ChannelWhatsApp, phone)
+	require.NoError(t, err)
+	applySetup(t, db, user, script.Setup)
+
+	var transcript strings.Builder
+	for i, step := range script.Steps {
+		message := services.InboundMessage{
+			Channel:    services.ChannelWhatsApp,
+			From:       phone,
+			ID:         fmt.Sprintf("wamid.step%d", i+1),
+			ReceivedAt: time.Now(),
+		}
+		switch {
+		case step.Send != "":
+			message.Type = services.InboundText
+			message.Text = step.Send
+			fmt.Fprintf(&transcript, "👤 %s\n", step.Send)
+		case step.Audio != "":
+			message.Type = services.InboundAudio
+			message.Media = &services.MediaRef{ID: step.Audio, MimeType: "audio/ogg"}
+			fmt.Fprintf(&transcript, "👤 [áudio %s]\n", step.Audio)
+		case step.Image != "":
+			message.Type = services.InboundImage
+			message.Text = step.Caption
+			message.Media = &services.MediaRef{ID: step.Image, MimeType: "image/jpeg"}
+			fmt.Fprintf(&transcript, "👤 %s\n", strings.TrimSpace("[foto "+step.Image+"] "+step.Caption))
+		case step.Tap != "":
+			message.Type = services.InboundInteractive
+			message.ReplyID = step.Tap
+			fmt.Fprintf(&transcript, "👤 [toque %s]\n", step.Tap)
+		case step.Pay != "":
+			fmt.Fprintf(&transcript, "💳 [pagamento %s]\n", step.Pay)
+		}
+
+		replies := channel.take()
+		if message.Type != "" || step.Pay != "" {
+			if step.Pay != "" {
+				payCheckout(t, repos, subscriptionService, gateway, user.ID, models.PaymentStatus(step.Pay))
+			} else {
+				require.NoError(t, handler.HandleMessage(channel, message), "step %d", i+1)
+			}
+			replies = channel.take()
+			for _, reply := range replies {
+				fmt.Fprintf(&transcript, "🤖 %s\n", strings.ReplaceAll(reply, "\n", "\n   "))
+			}
+			transcript.WriteString("\n")
+		}
+
+		for _, expected := range step.Expect {
+			assert.True(t, containsAny(replies, expected), "step %d: no reply contains %q in %q", i+1, expected, replies)
+		}
+		if step.State != nil {
+			assertReplayState(t, db, user.ID, step.State, i+1)
+		}
+	}
+
+	return normalizeTranscript(transcript.String())
+}
+
+// payCheckout settles the checkout the user was last sent and delivers the gateway's webhook
+func payCheckout(t *testing.T, repos *repository.Repositories, subscriptionService *services.SubscriptionService, gateway *payments.FakeServer, userID uuid.UUID, status models.PaymentStatus) {
+	subscription, err := repos.Subscriptions.GetPending(userID)
+	require.NoError(t, err)
+	if subscription == nil {
+		subscription, err = repos.Subscriptions.GetCurrent(userID)
+		require.NoError(t, err)
+	}
+	require.NotNil(t, subscription, "no checkout to pay")
+	checkoutID := subscription.CheckoutURL[strings.LastIndex(subscription.CheckoutURL, "/")+1:]
+
+	webhook, err := gateway.Pay(checkoutID, status)
+	require.NoError(t, err)
+	require.NoError(t, subscriptionService.HandlePaymentWebhook(context.Background(), payments.GatewayFake, webhook.Header, webhook.Body))
+}
+
+func applySetup(t *testing.T, db *gorm.DB, user *models.User, setup replaySetup) {
+	if len(setup.User) > 0 {
+		require.NoError(t, db.Model(&models.User{}).Where("id = ?", user.ID).Updates(setup.User).Error)
+	}
+	signedUp := user.CreatedAt
+	for _, tx := range setup.Transactions {
+		source := models.TransactionSourceText
+		if tx.Source != "" {
+			source = models.TransactionSource(tx.Source)
+		}
+		createdAt := time.Now().Add(-time.Duration(tx.MinutesAgo) * time.Minute)
+		require.NoError(t, db.Create(&models.Transaction{
+			UserID:          user.ID,
+			Amount:          tx.Amount,
+			Description:     tx.Description,
+			TransactionType: models.TransactionType(tx.Type),
+			Source:          source,
+			ExternalRef:     tx.ExternalRef,
+			CreatedAt:       createdAt,
+		}).Error)
+		if createdAt.Before(signedUp) {
+			signedUp = createdAt
+		}
+	}
+	// Nobody logs before signing up
+	if signedUp.Before(user.CreatedAt) {
+		require.NoError(t, db.Model(&models.User{}).Where("id = ?", user.ID).Update("created_at", signedUp).Error)
+	}
+	for _, coupon := range setup.Coupons {
+		require.NoError(t, db.Create(&models.Coupon{
+			Code:   coupon.Code,
+			Kind:   coupon.Kind,
+			Value:  coupon.Value,
+			Active: true,
+		}).Error)
+	}
+}
+
+func assertReplayState(t *testing.T, db *gorm.DB, userID interface{}, state *replayState, step int) {
+	if len(state.User) > 0 {
+		row := map[string]interface{}{}
+		require.NoError(t, db.Model(&models.User{}).Where("id = ?", userID).Take(&row).Error)
+		for column, expected := range state.User {
+			assert.Equal(t, fmt.Sprint(expected), fmt.Sprint(row[column]), "step %d: users.%s", step, column)
+		}
+	}
+
+	if state.Transactions != nil {
+		var count int64
+		require.NoError(t, db.Model(&models.Transaction{}).Where("user_id = ?", userID).Count(&count).Error)
+		assert.EqualValues(t, *state.Transactions, count, "step %d: transaction count", step)
+	}
+
+	if expected := state.LastTransaction; expected != nil {
+		var last models.Transaction
+		require.NoError(t, db.Where("user_id = ?", userID).Order("created_at DESC").First(&last).Error)
+		assert.Equal(t, expected.Amount, last.Amount, "step %d: amount", step)
+		if expected.Type != "" {
+			assert.Equal(t, expected.Type, string(last.TransactionType), "step %d: type", step)
+		}
+		if expected.Description != "" {
+			assert.Equal(t, expected.Description, last.Description, "step %d: description", step)
+		}
+		if expected.Source != "" {
+			assert.Equal(t, expected.Source, string(last.Source), "step %d: source", step)
+		}
+	}
+}
+
+func containsAny(replies []string, text string) bool {
+	for _, reply := range replies {
+		if strings.Contains(strings.ToLower(reply), strings.ToLower(text)) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	replayDatePattern         = regexp.MustCompile(`\d{2}/\d{2}(/\d{4})?( \d{2}:\d{2})?( \((segunda|terça|quarta|quinta|sexta)-feira\)| \((sábado|domingo)\))?`)
+	replayReferralCodePattern = regexp.MustCompile(`ARA-[0-9A-Z]{6}`)
+	replayDASMonthPattern     = regexp.MustCompile(`DAS-MEI de [a-zç]+`)
+	// How many tax deadlines fall in the weeks ahead depends on the day
+	replayDeadlinesPattern = regexp.MustCompile(`(?m)(^   • <data>: .*\n)+`)
+)
+
+// normalizeTranscript masks dates (and their weekdays), the tax deadlines listed, the month of
+// the DAS and generated referral codes so golden files don't depend on when the test runs
+func normalizeTranscript(transcript string) string {
+	transcript = replayDatePattern.ReplaceAllString(transcript, "<data>")
+	transcript = replayDeadlinesPattern.ReplaceAllString(transcript, "   • <prazos>\n")
+	transcript = replayDASMonthPattern.ReplaceAllString(transcript, "DAS-MEI de <mês>")
+	return replayReferralCodePattern.ReplaceAllString(transcript, "<codigo>")
+}
+
+// recordingChannel is the fake WhatsApp: it renders every reply and serves media by name
+type recordingChannel struct {
+	replies []string
+}
+
+func (c *recordingChannel) Name() string {
+	return services.ChannelWhatsApp
+}
+
+// SendNotification records template messages, which reach the user outside a reply
+func (c *recordingChannel) SendNotification(to, templateName string, params map[string]string) error {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "[modelo %s]", templateName)
+	for _, name := range names {
+		fmt.Fprintf(&reply, " %s=%s", name, params[name])
+	}
+	c.replies = append(c.replies, reply.String())
+	return nil
+}
+
+func (c *recordingChannel) Send(ctx context.Context, message services.OutgoingMessage) error {
+	var reply strings.Builder
+	reply.WriteString(message.Text)
+	if len(message.Buttons) > 0 {
+		reply.WriteString("\n")
+		for _, button := range message.Buttons {
+			fmt.Fprintf(&reply, "[%s|%s] ", button.Title, button.ID)
+		}
+	}
+	if message.List != nil {
+		fmt.Fprintf(&reply, "\n☰ %s", message.List.ButtonLabel)
+		for _, section := range message.List.Sections {
+			for _, row := range section.Rows {
+				fmt.Fprintf(&reply, "\n- %s|%s", row.Title, row.ID)
+			}
+		}
+	}
+	if message.Image != nil {
+		fmt.Fprintf(&reply, "\n[imagem %s, %d bytes]", message.Image.MimeType, len(message.Image.Data))
+	}
+	c.replies = append(c.replies, strings.TrimRight(reply.String(), " "))
+	return nil
+}
+
+func (c *recordingChannel) DownloadMedia(ctx context.Context, mediaID string, maxBytes int64) (*services.Media, error) {
+	data := []byte("media:" + mediaID)
+	sum := sha256.Sum256(data)
+	return &services.Media{Data: data, SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+func (c *recordingChannel) take() []string {
+	replies := c.replies
+	c.replies = nil
+	return replies
+}
+
+type fakeExtractor map[string]replayTransaction
+
+func (f fakeExtractor) ExtractTransaction(ctx context.Context, text string) (*services.TransactionData, error) {
+	tx, ok := f[text]
+	if !ok {
+		return nil, fmt.Errorf("no scripted extraction for %q", text)
+	}
+	return &services.TransactionData{Amount: tx.Amount, Type: tx.Type, Description: tx.Description, ExternalRef: tx.ExternalRef}, nil
+}
+
+// fakeTranscriber maps audio names to transcripts
+type fakeTranscriber map[string]string
+
+func (f fakeTranscriber) TranscribeAudioData(ctx context.Context, data []byte, opts services.TranscriptionOptions) (*services.TranscriptionResult, error) {
+	text, ok := f[strings.TrimPrefix(string(data), "media:")]
+	if !ok {
+		return nil, fmt.Errorf("no scripted transcript")
+	}
+	return &services.TranscriptionResult{Text: text, MediaSHA256: opts.MediaSHA256}, nil
+}
+
+func (f fakeTranscriber) MaxBytes() int64 {
+	return 5 * 1024 * 1024
+}
+
+func (f fakeTranscriber) MaxDurationSeconds() int {
+	return 120
+}
+
+// fakeReceiptReader maps image names to receipt extractions
+type fakeReceiptReader map[string]replayTransaction
+
+func (f fakeReceiptReader) ExtractReceiptData(ctx context.Context, data []byte, mimeType string, opts services.OCROptions) (*services.OCRResult, error) {
+	tx, ok := f[strings.TrimPrefix(string(data), "media:")]
+	if !ok {
+		return nil, fmt.Errorf("no scripted receipt")
+	}
+	return &services.OCRResult{
+		Data:        &services.TransactionData{Amount: tx.Amount, Type: tx.Type, Description: tx.Description, ExternalRef: tx.ExternalRef, Text: tx.Text},
+		MediaSHA256: opts.MediaSHA256,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"project-ara/internal/services"
+)
+
+// TelegramHandler receives Telegram Bot API updates and hands messages to the conversation
+type TelegramHandler struct {
+	telegramService *services.TelegramService
+	conversation    *ConversationHandler
+}
+
+func NewTelegramHandler(telegramService *services.TelegramService, conversation *ConversationHandler) *TelegramHandler {
+	return &TelegramHandler{
+		telegramService: telegramService,
+		conversation:    conversation,
+	}
+}
+
+func (h *TelegramHandler) HandleWebhook(c *gin.Context) {
+	if !h.telegramService.VerifyWebhook(c.GetHeader("X-Telegram-Bot-Api-Secret-Token")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid secret token"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	update, err := h.telegramService.ParseUpdate(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse update"})
+		return
+	}
+
+	if update.CallbackQuery != nil {
+		if err := h.telegramService.AnswerCallback(c.Request.Context(), update.CallbackQuery.ID); err != nil {
+			fmt.Printf("Error answering callback query: %v\n", err)
+		}
+	}
+
+	if inbound, ok := update.ToInbound(); ok {
+		if err := h.conversation.HandleMessage(h.telegramService, inbound); err != nil {
+			// Log error but don't fail the webhook, or Telegram keeps redelivering it
+			fmt.Printf("Error processing message: %v\n", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/repository"
+	"project-ara/internal/services"
+)
+
+func TestWhatsAppWebhookRepliesToAFirstTimeUser(t *testing.T) {
+	var sent []services.WhatsAppResponse
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response services.WhatsAppResponse
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&response))
+		sent = append(sent, response)
+		w.Write([]byte(`{"messages":[{"id":"wamid.reply"}]}`))
+	}))
+	defer api.Close()
+	t.Setenv("WHATSAPP_API_BASE_URL", api.URL)
+	t.Setenv("WHATSAPP_APP_SECRET", "")
+
+	plans, err := services.LoadPlanCatalog("")
+	require.NoError(t, err)
+	repos := repository.NewMemory()
+	userService := services.NewUserService(repos.Users, plans, nil)
+	templates, err := services.LoadTemplateRegistry("")
+	require.NoError(t, err)
+	whatsappService := services.NewWhatsAppService(userService, templates, nil)
+	handler := NewWhatsAppHandler(whatsappService, &ConversationHandler{userService: userService})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/webhook", handler.HandleWebhook)
+	webhook := `{"object": "whatsapp_business_account", "entry": [{"id": "1", "changes": [{"field": "messages", "value": {
+		"messaging_product": "whatsapp",
+		"messages": [{"from": "5511977770000", "id": "wamid.first", "timestamp": "` + strconv.FormatInt(time.Now().Unix(), 10) + `", "type": "text", "text": {"body": "menu"}}]
+	}}]}]}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(webhook)))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// The first message opens the service window, so the menu goes out as a session message
+	require.Len(t, sent, 1)
+	assert.Equal(t, "5511977770000", sent[0].To)
+	assert.Equal(t, "interactive", sent[0].Type)
+	lastInbound, err := userService.LastInboundAt("5511977770000")
+	require.NoError(t, err)
+	require.NotNil(t, lastInbound)
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"project-ara/internal/services"
+)
+
+// RequireFeature rejects requests for users whose plan doesn't include the feature with
+// 402 Payment Required, naming the plan that unlocks it. It runs after RequireAuth: the user
+// is the authenticated caller, and a :userID path parameter naming someone else is
+// forbidden. Admins are let through.
+func RequireFeature(entitlements *services.EntitlementService, feature services.Feature) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString(ContextRole) == RoleAdmin {
+			c.Next()
+			return
+		}
+		userID := c.GetString(ContextUserID)
+		if userID == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid authorization"})
+			return
+		}
+		if param := c.Param("userID"); param != "" && !CanAccessUser(c, param) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Cannot access another user's data"})
+			return
+		}
+
+		err := entitlements.Check(userID, feature)
+		var locked *services.FeatureLockedError
+		if errors.As(err, &locked) {
+			response := gin.H{"error": "Feature not included in the user's plan", "feature": feature}
+			if locked.Upgrade != nil {
+				response["upgrade_plan"] = locked.Upgrade.ID
+			}
+			c.AbortWithStatusJSON(http.StatusPaymentRequired, response)
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to check the user's plan",
+				"details": err.Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
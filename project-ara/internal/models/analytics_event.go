@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Analytics events, in the order of the conversion funnel
+const (
+	AnalyticsUserCreated           = "user_created"
+	AnalyticsFirstTransaction      = "first_transaction"
+	AnalyticsTrialWarningShown     = "trial_warning_shown"
+	AnalyticsTrialExhausted        = "trial_exhausted"
+	AnalyticsConversionMessageSent = "conversion_message_sent"
+	AnalyticsSubscribed            = "subscribed"
+	AnalyticsChurned               = "churned"
+)
+
+// AnalyticsEvent is a step of a user's way from signing up to paying, or leaving. Events
+// with a once key are recorded once per user; the others every time they happen.
+type AnalyticsEvent struct {
+	ID         uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID     uuid.UUID       `gorm:"type:uuid;not null;index:idx_analytics_events_user_id;uniqueIndex:idx_analytics_events_once,priority:1,where:once_key <> ''" json:"user_id"`
+	Name       string          `gorm:"type:varchar(40);not null;index:idx_analytics_events_name_created_at,priority:1" json:"name"`
+	OnceKey    string          `gorm:"type:varchar(40);uniqueIndex:idx_analytics_events_once,priority:2" json:"once_key,omitempty"`
+	Properties json.RawMessage `gorm:"type:jsonb;not null" json:"properties"`
+	CreatedAt  time.Time       `gorm:"default:CURRENT_TIMESTAMP;index:idx_analytics_events_name_created_at,priority:2" json:"created_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+func (e *AnalyticsEvent) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type AttachmentKind string
+
+const (
+	AttachmentKindImage AttachmentKind = "image"
+	AttachmentKindAudio AttachmentKind = "audio"
+)
+
+// Attachment is an archived media file (receipt photo or voice note). The content
+// lives encrypted in the media store under StorageKey.
+type Attachment struct {
+	ID            uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID        uuid.UUID      `gorm:"type:uuid;not null;index" json:"user_id"`
+	TransactionID *uuid.UUID     `gorm:"type:uuid;index" json:"transaction_id,omitempty"`
+	Kind          AttachmentKind `gorm:"type:varchar(10);not null" json:"kind"`
+	MimeType      string         `gorm:"type:varchar(100)" json:"mime_type"`
+	MediaSHA256   string         `gorm:"type:varchar(64);index" json:"media_sha256"`
+	SizeBytes     int64          `json:"size_bytes"`
+	StorageKey    string         `gorm:"type:varchar(255);not null" json:"-"`
+	CreatedAt     time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+func (a *Attachment) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type JobStatus string
+
+const (
+	JobStatusScheduled JobStatus = "scheduled"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusDone      JobStatus = "done"
+	JobStatusFailed    JobStatus = "failed"
+)
+
+// Job is a unit of background work. Recurring jobs carry a cron schedule and go back to
+// "scheduled" after each run; one-off jobs end as "done" or, out of retries, "failed".
+type Job struct {
+	ID          uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UniqueKey   string          `gorm:"type:varchar(255);uniqueIndex:idx_jobs_unique_key,where:unique_key <> ''" json:"unique_key,omitempty"`
+	Name        string          `gorm:"type:varchar(100);not null" json:"name"` // Registered handler
+	Payload     json.RawMessage `gorm:"type:jsonb;not null" json:"payload"`
+	Schedule    string          `gorm:"type:varchar(100)" json:"schedule,omitempty"` // Cron spec of recurring jobs
+	Status      JobStatus       `gorm:"type:varchar(20);not null;index:idx_jobs_due,priority:1" json:"status"`
+	RunAt       time.Time       `gorm:"not null;index:idx_jobs_due,priority:2" json:"run_at"`
+	Attempts    int             `gorm:"default:0" json:"attempts"`
+	MaxAttempts int             `gorm:"default:5" json:"max_attempts"`
+	LockedUntil *time.Time      `json:"locked_until,omitempty"`
+	LockedBy    string          `gorm:"type:varchar(100)" json:"locked_by,omitempty"`
+	LastError   string          `gorm:"type:text" json:"last_error,omitempty"`
+	LastRunAt   *time.Time      `json:"last_run_at,omitempty"`
+	CreatedAt   time.Time       `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+func (j *Job) BeforeCreate(tx *gorm.DB) error {
+	if j.ID == uuid.Nil {
+		j.ID = uuid.New()
+	}
+	return nil
+}
+
+func (j *Job) IsRecurring() bool {
+	return j.Schedule != ""
+}
+
+type JobRunStatus string
+
+const (
+	JobRunSucceeded JobRunStatus = "succeeded"
+	JobRunFailed    JobRunStatus = "failed"
+)
+
+// JobRun is one execution of a job, kept as history
+type JobRun struct {
+	ID         uuid.UUID    `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	JobID      uuid.UUID    `gorm:"type:uuid;not null;index" json:"job_id"`
+	Name       string       `gorm:"type:varchar(100);not null;index:idx_job_runs_name_started_at,priority:1" json:"name"`
+	Attempt    int          `gorm:"not null" json:"attempt"`
+	Status     JobRunStatus `gorm:"type:varchar(20);not null" json:"status"`
+	Error      string       `gorm:"type:text" json:"error,omitempty"`
+	Worker     string       `gorm:"type:varchar(100)" json:"worker"`
+	StartedAt  time.Time    `gorm:"not null;index:idx_job_runs_name_started_at,priority:2" json:"started_at"`
+	FinishedAt time.Time    `gorm:"not null" json:"finished_at"`
+}
+
+func (r *JobRun) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
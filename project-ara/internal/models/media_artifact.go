@@ -0,0 +1,40 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type MediaArtifactKind string
+
+const (
+	MediaArtifactTranscript MediaArtifactKind = "transcript"
+	MediaArtifactOCR        MediaArtifactKind = "ocr"
+)
+
+// MediaArtifact is the processed result of a media file (a transcript or an OCR
+// extraction), addressed by the media hash and the provider/model that produced it
+type MediaArtifact struct {
+	ID           uuid.UUID         `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	MediaSHA256  string            `gorm:"type:varchar(64);not null;uniqueIndex:idx_media_artifact_key" json:"media_sha256"`
+	Kind         MediaArtifactKind `gorm:"type:varchar(20);not null;uniqueIndex:idx_media_artifact_key" json:"kind"`
+	Provider     string            `gorm:"type:varchar(100);not null;uniqueIndex:idx_media_artifact_key" json:"provider"`
+	ModelVersion string            `gorm:"type:varchar(100);not null;uniqueIndex:idx_media_artifact_key" json:"model_version"`
+	Content      json.RawMessage   `gorm:"type:jsonb;not null" json:"content"`
+	CreatedAt    time.Time         `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	ExpiresAt    time.Time         `gorm:"not null;index" json:"expires_at"`
+}
+
+func (a *MediaArtifact) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
+
+func (a *MediaArtifact) IsExpired() bool {
+	return time.Now().After(a.ExpiresAt)
+}
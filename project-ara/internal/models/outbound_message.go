@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type OutboundStatus string
+
+const (
+	OutboundStatusQueued    OutboundStatus = "queued"
+	OutboundStatusSending   OutboundStatus = "sending"
+	OutboundStatusSent      OutboundStatus = "sent"
+	OutboundStatusDelivered OutboundStatus = "delivered"
+	OutboundStatusRead      OutboundStatus = "read"
+	OutboundStatusFailed    OutboundStatus = "failed"
+)
+
+// OutboundMessage is a WhatsApp message in the outbox. The sender worker delivers it,
+// and status webhooks move it through sent → delivered → read (or failed).
+type OutboundMessage struct {
+	ID            uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	To            string          `gorm:"type:varchar(20);not null;index" json:"to"`
+	MessageType   string          `gorm:"type:varchar(20);not null" json:"message_type"`
+	Payload       json.RawMessage `gorm:"type:jsonb;not null" json:"payload"`
+	Status        OutboundStatus  `gorm:"type:varchar(20);not null;index" json:"status"`
+	Attempts      int             `gorm:"default:0" json:"attempts"`
+	NextAttemptAt time.Time       `gorm:"not null;index" json:"next_attempt_at"`
+	LockedUntil   *time.Time      `json:"-"`
+	LastError     string          `gorm:"type:text" json:"last_error,omitempty"`
+	WAMID         string          `gorm:"column:wamid;type:varchar(128);index" json:"wamid,omitempty"`
+	CreatedAt     time.Time       `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	SentAt        *time.Time      `json:"sent_at,omitempty"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+	ReadAt        *time.Time      `json:"read_at,omitempty"`
+	FailedAt      *time.Time      `json:"failed_at,omitempty"`
+}
+
+func (m *OutboundMessage) BeforeCreate(tx *gorm.DB) error {
+	if m.ID == uuid.Nil {
+		m.ID = uuid.New()
+	}
+	return nil
+}
+
+// OutboundRecipient is when the outbox last sent to a number. Senders in every process
+// reserve their sends on it, so the per-number rate limit holds across them.
+type OutboundRecipient struct {
+	PhoneNumber string    `gorm:"type:varchar(20);primaryKey" json:"phone_number"`
+	LastSentAt  time.Time `gorm:"not null" json:"last_sent_at"`
+}
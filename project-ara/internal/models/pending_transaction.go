@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PendingTransaction holds a transaction that was flagged as a possible
+// duplicate and is waiting for the user to confirm or discard it.
+type PendingTransaction struct {
+	ID              uuid.UUID         `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID          uuid.UUID         `gorm:"type:uuid;not null;index" json:"user_id"`
+	Amount          float64           `gorm:"type:decimal(10,2);not null" json:"amount"`
+	Description     string            `gorm:"type:text" json:"description"`
+	TransactionType TransactionType   `gorm:"type:varchar(10);not null;check:chk_pending_transactions_transaction_type,transaction_type IN ('income', 'expense')" json:"transaction_type"`
+	Source          TransactionSource `gorm:"type:varchar(20);not null;check:chk_pending_transactions_source,source IN ('text', 'voice', 'image')" json:"source"`
+	MediaSHA256     string            `gorm:"type:varchar(64)" json:"media_sha256,omitempty"`
+	ExternalRef     string            `gorm:"type:varchar(64)" json:"external_ref,omitempty"`
+	MediaArtifactID *uuid.UUID        `gorm:"type:uuid" json:"media_artifact_id,omitempty"`
+	AttachmentID    *uuid.UUID        `gorm:"type:uuid" json:"attachment_id,omitempty"`
+	DuplicateOfID   uuid.UUID         `gorm:"type:uuid;not null" json:"duplicate_of_id"`
+	MatchReason     string            `gorm:"type:varchar(20);not null" json:"match_reason"`
+	CreatedAt       time.Time         `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	ExpiresAt       time.Time         `gorm:"not null" json:"expires_at"`
+}
+
+func (p *PendingTransaction) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+func (p *PendingTransaction) IsExpired() bool {
+	return time.Now().After(p.ExpiresAt)
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Referral statuses. A referral is pending until the referred user pays for a subscription,
+// which rewards both users. Claims that fail the fraud checks are kept as rejected, with
+// the reason, for review.
+const (
+	ReferralStatusPending  = "pending"
+	ReferralStatusRewarded = "rewarded"
+	ReferralStatusRejected = "rejected"
+)
+
+// Reasons a referral is rejected
+const (
+	ReferralRejectedSelf   = "self_referral"  // The referrer's own account or phone number
+	ReferralRejectedDevice = "device_reused"  // The device already claimed a referral
+	ReferralRejectedNotNew = "not_new"        // The referred user isn't starting out
+	ReferralRejectedLimit  = "referrer_limit" // The referrer referred too many users lately
+)
+
+// Referral is a user who started using the Ara with another user's referral code. A user
+// is referred once at most: rejected claims don't count.
+type Referral struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ReferrerID   uuid.UUID  `gorm:"type:uuid;not null;index:idx_referrals_referrer_created_at,priority:1" json:"referrer_id"`
+	ReferredID   uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_referrals_referred,where:status <> 'rejected'" json:"referred_id"`
+	Code         string     `gorm:"type:varchar(16);not null" json:"code"`
+	DeviceID     string     `gorm:"type:varchar(128);index:idx_referrals_device_id,where:device_id <> ''" json:"device_id,omitempty"` // Fingerprint of the signup page, when the claim came from it
+	Status       string     `gorm:"type:varchar(20);not null;default:'pending'" json:"status"`
+	RejectReason string     `gorm:"type:varchar(30)" json:"reject_reason,omitempty"`
+	RewardedAt   *time.Time `json:"rewarded_at,omitempty"`
+	CreatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP;index:idx_referrals_referrer_created_at,priority:2" json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relationships
+	Referrer User `gorm:"foreignKey:ReferrerID" json:"-"`
+	Referred User `gorm:"foreignKey:ReferredID" json:"-"`
+}
+
+func (r *Referral) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
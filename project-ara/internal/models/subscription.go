@@ -0,0 +1,223 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Subscription is one paid plan of a user. Its status follows the Subscription* status
+// constants; users.subscription_status and subscription_expires_at mirror the user's
+// latest subscription so access checks need no join.
+type Subscription struct {
+	ID                    uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID                uuid.UUID  `gorm:"type:uuid;not null;index:idx_subscriptions_user_created_at,priority:1" json:"user_id"`
+	Plan                  string     `gorm:"type:varchar(50);not null" json:"plan"`
+	Price                 float64    `gorm:"type:decimal(10,2);not null" json:"price"`
+	Currency              string     `gorm:"type:varchar(3);not null;default:'BRL'" json:"currency"`
+	Status                string     `gorm:"type:varchar(20);not null;index:idx_subscriptions_status_period_end,priority:1" json:"status"`
+	PaymentMethod         string     `gorm:"type:varchar(30)" json:"payment_method,omitempty"`
+	Gateway               string     `gorm:"type:varchar(30);index:idx_subscriptions_gateway_subscription_id,priority:1" json:"gateway,omitempty"`
+	GatewayCustomerID     string     `gorm:"type:varchar(100)" json:"gateway_customer_id,omitempty"`
+	GatewaySubscriptionID string     `gorm:"type:varchar(100);index:idx_subscriptions_gateway_subscription_id,priority:2" json:"gateway_subscription_id,omitempty"`
+	CheckoutURL           string     `gorm:"type:text" json:"checkout_url,omitempty"` // Where the payer completes a pending subscription or renewal
+	PixCode               string     `gorm:"type:text" json:"pix_code,omitempty"`     // "Copia e cola" of the Pix charge, when paid by Pix
+	PixExpiresAt          *time.Time `json:"pix_expires_at,omitempty"`
+	CouponID              *uuid.UUID `gorm:"type:uuid" json:"coupon_id,omitempty"` // Discounted Price, for as long as the subscription lasts
+	CurrentPeriodStart    time.Time  `gorm:"not null" json:"current_period_start"`
+	CurrentPeriodEnd      time.Time  `gorm:"not null;index:idx_subscriptions_status_period_end,priority:2" json:"current_period_end"`
+	CancelledAt           *time.Time `json:"cancelled_at,omitempty"`
+	CreatedAt             time.Time  `gorm:"default:CURRENT_TIMESTAMP;index:idx_subscriptions_user_created_at,priority:2" json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+func (s *Subscription) BeforeCreate(tx *gorm.DB) error {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return nil
+}
+
+type PaymentStatus string
+
+const (
+	PaymentStatusPending   PaymentStatus = "pending"
+	PaymentStatusApproved  PaymentStatus = "approved"
+	PaymentStatusFailed    PaymentStatus = "failed"
+	PaymentStatusRefunded  PaymentStatus = "refunded"
+	PaymentStatusCancelled PaymentStatus = "cancelled"
+)
+
+// Payment is a charge of a subscription as reported by the payment gateway
+type Payment struct {
+	ID               uuid.UUID     `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	SubscriptionID   *uuid.UUID    `gorm:"type:uuid;index" json:"subscription_id,omitempty"`
+	UserID           uuid.UUID     `gorm:"type:uuid;not null;index:idx_payments_user_created_at,priority:1" json:"user_id"`
+	Gateway          string        `gorm:"type:varchar(30);not null;uniqueIndex:idx_payments_gateway_payment_id,priority:1" json:"gateway"`
+	GatewayPaymentID string        `gorm:"type:varchar(100);not null;uniqueIndex:idx_payments_gateway_payment_id,priority:2" json:"gateway_payment_id"`
+	Amount           float64       `gorm:"type:decimal(10,2);not null" json:"amount"`
+	Currency         string        `gorm:"type:varchar(3);not null;default:'BRL'" json:"currency"`
+	Status           PaymentStatus `gorm:"type:varchar(20);not null" json:"status"`
+	Method           string        `gorm:"type:varchar(30)" json:"method,omitempty"`
+	PeriodStart      *time.Time    `json:"period_start,omitempty"` // Subscription period the payment covers
+	PeriodEnd        *time.Time    `json:"period_end,omitempty"`
+	PaidAt           *time.Time    `json:"paid_at,omitempty"`
+	FailureReason    string        `gorm:"type:text" json:"failure_reason,omitempty"`
+	CreatedAt        time.Time     `gorm:"default:CURRENT_TIMESTAMP;index:idx_payments_user_created_at,priority:2" json:"created_at"`
+	UpdatedAt        time.Time     `json:"updated_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+func (p *Payment) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+// PaymentWebhookEvent is a notification received from a payment gateway. Gateways deliver
+// the same event more than once; keyed by the gateway's event ID, each is applied only once.
+type PaymentWebhookEvent struct {
+	ID           uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Gateway      string          `gorm:"type:varchar(30);not null;uniqueIndex:idx_payment_webhook_events_gateway_event_id,priority:1" json:"gateway"`
+	EventID      string          `gorm:"type:varchar(150);not null;uniqueIndex:idx_payment_webhook_events_gateway_event_id,priority:2" json:"event_id"`
+	Type         string          `gorm:"type:varchar(60)" json:"type,omitempty"`
+	PaymentID    string          `gorm:"type:varchar(100)" json:"payment_id,omitempty"`
+	Status       PaymentStatus   `gorm:"type:varchar(20)" json:"status,omitempty"`
+	Payload      json.RawMessage `gorm:"type:jsonb;not null" json:"payload"` // Body of the first delivery
+	Attempts     int             `gorm:"not null;default:0" json:"attempts"` // Deliveries received
+	LastError    string          `gorm:"type:text" json:"last_error,omitempty"`
+	ProcessedAt  *time.Time      `json:"processed_at,omitempty"`
+	ClaimedUntil *time.Time      `json:"claimed_until,omitempty"` // Being processed by a delivery until then
+	CreatedAt    time.Time       `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+func (e *PaymentWebhookEvent) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+type SubscriptionEventType string
+
+const (
+	SubscriptionEventStatusChanged SubscriptionEventType = "status_changed"
+	SubscriptionEventPayment       SubscriptionEventType = "payment"
+	SubscriptionEventPeriodChanged SubscriptionEventType = "period_changed"
+)
+
+// SubscriptionEvent is one entry of a user's billing history: a status change, a payment
+// or a change of the paid period. Together they answer billing disputes.
+type SubscriptionEvent struct {
+	ID             uuid.UUID             `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID             `gorm:"type:uuid;not null;index:idx_subscription_events_user_created_at,priority:1" json:"user_id"`
+	SubscriptionID *uuid.UUID            `gorm:"type:uuid;index" json:"subscription_id,omitempty"`
+	PaymentID      *uuid.UUID            `gorm:"type:uuid" json:"payment_id,omitempty"`
+	Type           SubscriptionEventType `gorm:"type:varchar(30);not null;default:'status_changed'" json:"type"`
+	FromStatus     string                `gorm:"type:varchar(20)" json:"from_status,omitempty"`
+	ToStatus       string                `gorm:"type:varchar(20)" json:"to_status,omitempty"`
+	Amount         *float64              `gorm:"type:decimal(10,2)" json:"amount,omitempty"`
+	PeriodEnd      *time.Time            `json:"period_end,omitempty"`
+	Reason         string                `gorm:"type:varchar(50);not null" json:"reason"` // What caused it: "payment_approved", "expiry_sweep"...
+	CreatedAt      time.Time             `gorm:"default:CURRENT_TIMESTAMP;index:idx_subscription_events_user_created_at,priority:2" json:"created_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+func (e *SubscriptionEvent) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+// Dunning case statuses
+const (
+	DunningStatusOpen      = "open"
+	DunningStatusRecovered = "recovered"
+	DunningStatusChurned   = "churned"
+)
+
+// DunningCase follows a subscription whose renewal charge failed, from the failure to the
+// payment that recovered it or the downgrade that churned it. The user is sent a new way
+// to pay at NextNoticeAt until GraceEndsAt. A subscription has one open case at most.
+type DunningCase struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	SubscriptionID uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_dunning_cases_open_subscription,where:status = 'open'" json:"subscription_id"`
+	Status         string     `gorm:"type:varchar(20);not null;default:'open';index:idx_dunning_cases_status_next_notice_at,priority:1" json:"status"`
+	FailureReason  string     `gorm:"type:text" json:"failure_reason,omitempty"` // Of the latest failed charge
+	Failures       int        `gorm:"not null;default:1" json:"failures"`
+	NoticesSent    int        `gorm:"not null;default:0" json:"notices_sent"`
+	NextNoticeAt   *time.Time `gorm:"index:idx_dunning_cases_status_next_notice_at,priority:2" json:"next_notice_at,omitempty"` // Nil once the schedule is done
+	GraceEndsAt    time.Time  `gorm:"not null" json:"grace_ends_at"`                                                            // When the subscription is downgraded if still unpaid
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt      time.Time  `gorm:"default:CURRENT_TIMESTAMP;index" json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+func (c *DunningCase) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// Coupon kinds
+const (
+	CouponKindPercentage = "percentage"
+	CouponKindFixed      = "fixed"
+)
+
+// Coupon is a discount on the price of new subscriptions, created by an admin. Its code is
+// stored in upper case. A coupon is checked when the checkout starts and counted as used
+// when the checkout is paid; each user redeems it once.
+type Coupon struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Code      string     `gorm:"type:varchar(32);not null;uniqueIndex" json:"code"`
+	Kind      string     `gorm:"type:varchar(20);not null" json:"kind"`
+	Value     float64    `gorm:"type:decimal(10,2);not null" json:"value"` // Percent off, or amount off the price
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxUses   int        `gorm:"not null;default:0" json:"max_uses"` // Zero for unlimited
+	Uses      int        `gorm:"not null;default:0" json:"uses"`
+	Active    bool       `gorm:"not null;default:true" json:"active"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func (c *Coupon) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// CouponRedemption is a coupon used on a paid subscription
+type CouponRedemption struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	CouponID       uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_coupon_redemptions_coupon_user,priority:1" json:"coupon_id"`
+	UserID         uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_coupon_redemptions_coupon_user,priority:2" json:"user_id"`
+	SubscriptionID uuid.UUID `gorm:"type:uuid;not null" json:"subscription_id"`
+	Discount       float64   `gorm:"type:decimal(10,2);not null" json:"discount"` // Off each payment of the subscription
+	CreatedAt      time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+func (r *CouponRedemption) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
@@ -22,14 +22,17 @@ const (
 
 type Transaction struct {
 	ID              uuid.UUID         `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	UserID          uuid.UUID         `gorm:"type:uuid;not null" json:"user_id"`
+	UserID          uuid.UUID         `gorm:"type:uuid;not null;index:idx_transactions_user_created_at" json:"user_id"`
 	Amount          float64           `gorm:"type:decimal(10,2);not null" json:"amount"`
 	Description     string            `gorm:"type:text" json:"description"`
-	TransactionType TransactionType   `gorm:"type:varchar(10);not null" json:"transaction_type"`
-	Source          TransactionSource `gorm:"type:varchar(20);not null" json:"source"`
-	CreatedAt       time.Time         `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	TransactionType TransactionType   `gorm:"type:varchar(10);not null;check:chk_transactions_transaction_type,transaction_type IN ('income', 'expense')" json:"transaction_type"`
+	Source          TransactionSource `gorm:"type:varchar(20);not null;check:chk_transactions_source,source IN ('text', 'voice', 'image')" json:"source"`
+	CreatedAt       time.Time         `gorm:"default:CURRENT_TIMESTAMP;index:idx_transactions_user_created_at;index:idx_transactions_created_at" json:"created_at"`
 	CorrectedAt     *time.Time        `json:"corrected_at,omitempty"`
 	CorrectionData  *json.RawMessage  `gorm:"type:jsonb" json:"correction_data,omitempty"`
+	MediaSHA256     string            `gorm:"type:varchar(64);index" json:"media_sha256,omitempty"`
+	ExternalRef     string            `gorm:"type:varchar(64);index" json:"external_ref,omitempty"` // NFC-e access key or Pix E2E ID
+	MediaArtifactID *uuid.UUID        `gorm:"type:uuid" json:"media_artifact_id,omitempty"`         // Transcript or OCR extraction it came from
 
 	// Relationships
 	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
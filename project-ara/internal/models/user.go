@@ -9,11 +9,18 @@ import (
 
 type User struct {
 	ID                     uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	PhoneNumber            string     `gorm:"type:varchar(20);unique;not null" json:"phone_number"`
+	PhoneNumber            string     `gorm:"type:varchar(20);uniqueIndex:idx_users_phone_number,where:phone_number <> ''" json:"phone_number,omitempty"`
+	TelegramChatID         string     `gorm:"type:varchar(32);uniqueIndex:idx_users_telegram_chat_id,where:telegram_chat_id <> ''" json:"telegram_chat_id,omitempty"`
+	Channel                string     `gorm:"type:varchar(20);default:'whatsapp'" json:"channel"` // Where the user talks to the bot
 	CreatedAt              time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
 	TrialTransactionsCount int        `gorm:"default:0" json:"trial_transactions_count"`
-	SubscriptionStatus     string     `gorm:"type:varchar(20);default:'trial'" json:"subscription_status"`
-	SubscriptionExpiresAt  *time.Time `json:"subscription_expires_at,omitempty"`
+	SubscriptionStatus     string     `gorm:"type:varchar(20);default:'trial';index:idx_users_subscription_expiry,priority:1" json:"subscription_status"`
+	SubscriptionExpiresAt  *time.Time `gorm:"index:idx_users_subscription_expiry,priority:2" json:"subscription_expires_at,omitempty"`
+	LastInboundAt          *time.Time `json:"last_inbound_at,omitempty"`                                                                                     // Opens WhatsApp's 24-hour service window
+	ReferralCode           string     `gorm:"type:varchar(16);uniqueIndex:idx_users_referral_code,where:referral_code <> ''" json:"referral_code,omitempty"` // Set the first time the user refers someone
+	BonusTransactions      int        `gorm:"not null;default:0" json:"bonus_transactions"`                                                                  // Free transactions on top of the trial's, earned by referrals
+	ConversionVariant      string     `gorm:"type:varchar(32)" json:"conversion_variant,omitempty"`                                                          // Variant of the conversion message the user is shown
+	MEIActivity            string     `gorm:"type:varchar(20)" json:"mei_activity,omitempty"`                                                                // Which taxes the user's DAS-MEI includes
 
 	// Relationships
 	Transactions []Transaction `gorm:"foreignKey:UserID" json:"transactions,omitempty"`
@@ -26,13 +33,49 @@ func (u *User) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
-func (u *User) IsTrialExpired() bool {
-	return u.TrialTransactionsCount >= 50
+// MEI activity types, which decide the taxes of the DAS-MEI besides the INSS: ICMS for
+// commerce and industry, ISS for services
+const (
+	MEIActivityCommerce            = "commerce"
+	MEIActivityServices            = "services"
+	MEIActivityCommerceAndServices = "commerce_services"
+)
+
+// Subscription statuses. A subscription is pending until its checkout is paid. One that
+// isn't renewed moves from active to grace_period once SubscriptionExpiresAt passes, and
+// to expired when the grace period ends.
+const (
+	SubscriptionStatusTrial       = "trial"
+	SubscriptionStatusPending     = "pending"
+	SubscriptionStatusActive      = "active"
+	SubscriptionStatusGracePeriod = "grace_period"
+	SubscriptionStatusExpired     = "expired"
+	SubscriptionStatusCancelled   = "cancelled"
+)
+
+// SubscriptionGracePeriod is how long after SubscriptionExpiresAt a lapsed subscription keeps working
+var SubscriptionGracePeriod = 3 * 24 * time.Hour
+
+// IsTrialExpired reports whether the user logged all the free transactions of the trial
+// and those they earned
+func (u *User) IsTrialExpired(trialTransactions int) bool {
+	return u.TrialTransactionsCount >= trialTransactions+u.BonusTransactions
+}
+
+// HasActiveSubscription reports whether the user's paid plan covers now. Expiry is checked
+// here, so access ends on time even if the sweep that updates the status hasn't run yet.
+func (u *User) HasActiveSubscription(now time.Time) bool {
+	if u.SubscriptionStatus != SubscriptionStatusActive && u.SubscriptionStatus != SubscriptionStatusGracePeriod {
+		return false
+	}
+	return u.SubscriptionExpiresAt == nil || now.Before(u.SubscriptionExpiresAt.Add(SubscriptionGracePeriod))
 }
 
-func (u *User) CanCreateTransaction() bool {
-	if u.SubscriptionStatus == "active" {
+// CanCreateTransaction reports whether the user is subscribed or still has free
+// transactions out of trialTransactions and their bonus
+func (u *User) CanCreateTransaction(trialTransactions int) bool {
+	if u.HasActiveSubscription(time.Now()) {
 		return true
 	}
-	return u.TrialTransactionsCount < 50
+	return !u.IsTrialExpired(trialTransactions)
 }
@@ -0,0 +1,118 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIError is a non-2xx response from a gateway's API
+type APIError struct {
+	Gateway    string
+	Operation  string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s returned status %d: %s", e.Gateway, e.Operation, e.StatusCode, e.Body)
+}
+
+// apiClient sends JSON requests to a gateway's REST API
+type apiClient struct {
+	gateway    string
+	baseURL    string
+	httpClient *http.Client
+	authorize  func(req *http.Request)
+}
+
+func newAPIClient(gateway, baseURL string, authorize func(req *http.Request)) apiClient {
+	return apiClient{
+		gateway:    gateway,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		authorize:  authorize,
+	}
+}
+
+// do sends body as JSON (when not nil) and decodes the response into out (when not nil).
+// idempotencyKey, when set, is sent as X-Idempotency-Key so retries don't charge twice.
+func (c *apiClient) do(ctx context.Context, method, path, idempotencyKey string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s request: %w", c.gateway, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("X-Idempotency-Key", idempotencyKey)
+	}
+	c.authorize(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s %s failed: %w", c.gateway, method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &APIError{
+			Gateway:    c.gateway,
+			Operation:  method + " " + path,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(detail)),
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s %s response: %w", c.gateway, path, err)
+	}
+	return nil
+}
+
+// flexibleID is an ID some payloads send as a number and others as a string
+type flexibleID string
+
+func (id *flexibleID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = flexibleID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = flexibleID(n)
+	return nil
+}
+
+// cents converts an amount in reais to the integer cents some APIs expect
+func cents(amount float64) int64 {
+	if amount < 0 {
+		return int64(amount*100 - 0.5)
+	}
+	return int64(amount*100 + 0.5)
+}
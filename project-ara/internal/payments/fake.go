@@ -0,0 +1,113 @@
+package payments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GatewayFake is the name of the fake gateway
+const GatewayFake = "fake"
+
+// FakeGateway talks to a FakeServer, e.g. one started with `go run ./cmd/fakegateway`
+type FakeGateway struct {
+	api apiClient
+}
+
+func NewFakeGateway(baseURL string) *FakeGateway {
+	return &FakeGateway{
+		api: newAPIClient(GatewayFake, baseURL, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer fake")
+		}),
+	}
+}
+
+func (f *FakeGateway) Name() string {
+	return GatewayFake
+}
+
+func (f *FakeGateway) CreateCustomer(ctx context.Context, customer Customer) (string, error) {
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := f.api.do(ctx, http.MethodPost, "/customers", "", customer, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (f *FakeGateway) CreateSubscription(ctx context.Context, request SubscriptionRequest) (*Subscription, error) {
+	var created fakeCheckout
+	if err := f.api.do(ctx, http.MethodPost, "/subscriptions", "", fakeCheckout{
+		CustomerID:  request.CustomerID,
+		Reference:   request.Reference,
+		Description: request.Description,
+		Amount:      request.Amount,
+		Currency:    request.Currency,
+	}, &created); err != nil {
+		return nil, err
+	}
+	return &Subscription{ID: created.ID, Status: created.Status, CheckoutURL: created.CheckoutURL}, nil
+}
+
+func (f *FakeGateway) CreateCharge(ctx context.Context, request ChargeRequest) (*Charge, error) {
+	var created fakeCheckout
+	if err := f.api.do(ctx, http.MethodPost, "/charges", "", fakeCheckout{
+		CustomerID:  request.CustomerID,
+		Reference:   request.Reference,
+		Description: request.Description,
+		Amount:      request.Amount,
+		Currency:    request.Currency,
+		Method:      request.Method,
+		ExpiresAt:   request.ExpiresAt,
+	}, &created); err != nil {
+		return nil, err
+	}
+
+	charge := &Charge{ID: created.ID, Status: created.Status, CheckoutURL: created.CheckoutURL, PixCode: created.PixCode}
+	if !request.ExpiresAt.IsZero() {
+		charge.ExpiresAt = &request.ExpiresAt
+	}
+	return charge, nil
+}
+
+func (f *FakeGateway) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	return f.api.do(ctx, http.MethodPost, "/subscriptions/"+url.PathEscape(subscriptionID)+"/cancel", "", nil, nil)
+}
+
+// ParseWebhook reads the notifications FakeServer sends, which carry the payment itself
+// and are signed like our own webhooks
+func (f *FakeGateway) ParseWebhook(ctx context.Context, header http.Header, body []byte) (*WebhookEvent, error) {
+	signature, ok := strings.CutPrefix(header.Get(fakeSignatureHeader), "sha256=")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidSignature, fakeSignatureHeader)
+	}
+	if err := checkHMAC(sha256.New, fakeWebhookSecret, body, signature); err != nil {
+		return nil, err
+	}
+
+	var notification fakeNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, fmt.Errorf("invalid fake gateway notification: %w", err)
+	}
+	if notification.Data.PaymentID == "" {
+		return nil, ErrIgnored
+	}
+
+	return &WebhookEvent{
+		Gateway:        GatewayFake,
+		EventID:        notification.ID,
+		Type:           notification.Type,
+		PaymentID:      notification.Data.PaymentID,
+		SubscriptionID: notification.Data.SubscriptionID,
+		Reference:      notification.Data.Reference,
+		Status:         notification.Data.Status,
+		Amount:         notification.Data.Amount,
+		Method:         notification.Data.Method,
+		FailureReason:  notification.Data.FailureReason,
+	}, nil
+}
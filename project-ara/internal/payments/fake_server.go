@@ -0,0 +1,298 @@
+package payments
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"project-ara/internal/models"
+	"project-ara/internal/pix"
+)
+
+// fakeCheckout is a subscription or charge waiting for, or done with, its payment
+type fakeCheckout struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"` // "subscription" or "charge"
+	CustomerID  string    `json:"customer_id"`
+	Reference   string    `json:"reference"`
+	Description string    `json:"description"`
+	Amount      float64   `json:"amount"`
+	Currency    string    `json:"currency"`
+	Method      string    `json:"method,omitempty"`
+	Status      string    `json:"status"`
+	CheckoutURL string    `json:"checkout_url"`
+	PixCode     string    `json:"pix_code,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+}
+
+// The fake gateway signs its webhooks with a well-known secret: it only runs locally
+const (
+	fakeWebhookSecret   = "fake-webhook-secret"
+	fakeSignatureHeader = "X-Fake-Signature"
+)
+
+// fakeNotification is the webhook body the fake gateway sends
+type fakeNotification struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		PaymentID      string               `json:"payment_id"`
+		SubscriptionID string               `json:"subscription_id,omitempty"`
+		Reference      string               `json:"reference"`
+		Status         models.PaymentStatus `json:"status"`
+		Amount         float64              `json:"amount"`
+		Method         string               `json:"method"`
+		FailureReason  string               `json:"failure_reason,omitempty"`
+	} `json:"data"`
+}
+
+// FakeServer is an in-memory payment gateway for local development and tests. Its API is
+// what FakeGateway calls:
+//
+//	POST /customers                  register a payer
+//	POST /subscriptions              create a subscription, returns its checkout_url
+//	POST /charges                    create a one-off charge
+//	POST /subscriptions/{id}/cancel  cancel a subscription
+//	GET  /checkout/{id}              page with buttons to pay or refuse the payment
+//
+// Paying sends a webhook to WebhookURL, like a real gateway would.
+type FakeServer struct {
+	WebhookURL string
+	// PublicURL prefixes checkout links; the Host of the request is used when empty
+	PublicURL  string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	sequence  int
+	customers map[string]Customer
+	checkouts map[string]*fakeCheckout
+}
+
+func NewFakeServer(webhookURL string) *FakeServer {
+	return &FakeServer{
+		WebhookURL: webhookURL,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		customers:  make(map[string]Customer),
+		checkouts:  make(map[string]*fakeCheckout),
+	}
+}
+
+// nextID returns a sequential ID, so test transcripts are stable. Callers hold mu.
+func (f *FakeServer) nextID(prefix string) string {
+	f.sequence++
+	return fmt.Sprintf("%s_%d", prefix, f.sequence)
+}
+
+func (f *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	segments := strings.Split(path, "/")
+
+	switch {
+	case r.Method == http.MethodGet && len(segments) == 2 && segments[0] == "checkout":
+		f.serveCheckoutPage(w, segments[1])
+	case r.Method == http.MethodPost && len(segments) == 3 && segments[0] == "checkout":
+		f.serveCheckoutResult(w, segments[1], segments[2])
+	case !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "):
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+	case r.Method == http.MethodPost && path == "customers":
+		var customer Customer
+		if !decodeFakeRequest(w, r, &customer) {
+			return
+		}
+		f.mu.Lock()
+		id := f.nextID("cus")
+		f.customers[id] = customer
+		f.mu.Unlock()
+		writeFakeJSON(w, http.StatusCreated, map[string]string{"id": id})
+	case r.Method == http.MethodPost && (path == "subscriptions" || path == "charges"):
+		var checkout fakeCheckout
+		if !decodeFakeRequest(w, r, &checkout) {
+			return
+		}
+		writeFakeJSON(w, http.StatusCreated, f.createCheckout(r, strings.TrimSuffix(path, "s"), checkout))
+	case r.Method == http.MethodPost && len(segments) == 3 && segments[0] == "subscriptions" && segments[2] == "cancel":
+		f.mu.Lock()
+		checkout, ok := f.checkouts[segments[1]]
+		if ok {
+			checkout.Status = "cancelled"
+		}
+		f.mu.Unlock()
+		if !ok {
+			http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	}
+}
+
+func (f *FakeServer) createCheckout(r *http.Request, kind string, checkout fakeCheckout) *fakeCheckout {
+	publicURL := f.PublicURL
+	if publicURL == "" {
+		publicURL = "http://" + r.Host
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prefix := "sub"
+	if kind == "charge" {
+		prefix = "ch"
+	}
+	checkout.ID = f.nextID(prefix)
+	checkout.Kind = kind
+	checkout.Status = "pending"
+	checkout.CheckoutURL = strings.TrimRight(publicURL, "/") + "/checkout/" + checkout.ID
+	if checkout.Method == MethodPix {
+		// A dynamic code, like a real provider's, whose location is served by nobody
+		checkout.PixCode, _ = pix.Payload{
+			URL:          strings.TrimPrefix(strings.TrimPrefix(checkout.CheckoutURL, "https://"), "http://") + "/pix",
+			MerchantName: "Ara Pagamentos Simulados",
+			MerchantCity: "SAO PAULO",
+			Amount:       checkout.Amount,
+		}.Encode()
+	}
+	f.checkouts[checkout.ID] = &checkout
+	copied := checkout
+	return &copied
+}
+
+// FakeWebhook is a signed notification of the fake gateway
+type FakeWebhook struct {
+	Header http.Header
+	Body   []byte
+}
+
+// Pay settles a subscription or charge with the given status, as if the payer had gone
+// through the checkout, and sends the webhook. Paying a subscription again is a renewal.
+// It returns the webhook.
+func (f *FakeServer) Pay(checkoutID string, status models.PaymentStatus) (*FakeWebhook, error) {
+	f.mu.Lock()
+	checkout, ok := f.checkouts[checkoutID]
+	if !ok {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("unknown checkout %s", checkoutID)
+	}
+	if checkout.Status == "cancelled" {
+		// A cancelled subscription isn't charged anymore
+		f.mu.Unlock()
+		return nil, fmt.Errorf("checkout %s is cancelled", checkoutID)
+	}
+
+	var notification fakeNotification
+	notification.ID = f.nextID("evt")
+	notification.Type = "payment.updated"
+	notification.Data.PaymentID = f.nextID("pay")
+	notification.Data.Reference = checkout.Reference
+	notification.Data.Status = status
+	notification.Data.Amount = checkout.Amount
+	notification.Data.Method = checkout.Method
+	if checkout.Kind == "subscription" {
+		notification.Data.SubscriptionID = checkout.ID
+		notification.Data.Method = "credit_card"
+	}
+	switch status {
+	case models.PaymentStatusApproved:
+		checkout.Status = "paid"
+		if checkout.Kind == "subscription" {
+			checkout.Status = "active"
+		}
+	case models.PaymentStatusFailed:
+		notification.Data.FailureReason = "cc_rejected_insufficient_amount"
+	}
+	f.mu.Unlock()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+	webhook := &FakeWebhook{Header: http.Header{}, Body: body}
+	webhook.Header.Set("Content-Type", "application/json")
+	webhook.Header.Set(fakeSignatureHeader, "sha256="+hmacHex(sha256.New, fakeWebhookSecret, body))
+	if f.WebhookURL == "" {
+		return webhook, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, f.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return webhook, err
+	}
+	req.Header = webhook.Header.Clone()
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return webhook, fmt.Errorf("failed to deliver webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return webhook, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return webhook, nil
+}
+
+var fakeCheckoutPage = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html lang="pt-BR">
+<head><meta charset="utf-8"><title>Pagamento (simulado)</title></head>
+<body>
+<h1>{{.Description}}</h1>
+<p>R$ {{printf "%.2f" .Amount}}{{if eq .Kind "subscription"}} por mês{{end}}</p>
+{{if .PixCode}}<p>Pix copia e cola: <code>{{.PixCode}}</code></p>{{end}}
+<p>Status: {{.Status}}</p>
+<form method="post" action="/checkout/{{.ID}}/approved"><button>Pagar</button></form>
+<form method="post" action="/checkout/{{.ID}}/failed"><button>Recusar pagamento</button></form>
+</body>
+</html>
+`))
+
+func (f *FakeServer) serveCheckoutPage(w http.ResponseWriter, id string) {
+	f.mu.Lock()
+	checkout, ok := f.checkouts[id]
+	var copied fakeCheckout
+	if ok {
+		copied = *checkout
+	}
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fakeCheckoutPage.Execute(w, copied)
+}
+
+func (f *FakeServer) serveCheckoutResult(w http.ResponseWriter, id, status string) {
+	paymentStatus := models.PaymentStatus(status)
+	if paymentStatus != models.PaymentStatusApproved && paymentStatus != models.PaymentStatusFailed {
+		http.NotFound(w, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := f.Pay(id, paymentStatus); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "<p>Pagamento %s, mas o webhook falhou: %s</p>", paymentStatus, template.HTMLEscapeString(err.Error()))
+		return
+	}
+	fmt.Fprintf(w, "<p>Pagamento %s. Pode voltar para o WhatsApp.</p>", paymentStatus)
+}
+
+func decodeFakeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, `{"error":"invalid body"}`, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,100 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/pix"
+)
+
+func TestFakeGatewayCheckoutSendsWebhook(t *testing.T) {
+	var received []FakeWebhook
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, FakeWebhook{Header: r.Header, Body: body})
+	}))
+	defer webhook.Close()
+
+	fake := NewFakeServer(webhook.URL)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	gateway := NewFakeGateway(server.URL)
+	ctx := context.Background()
+
+	customerID, err := gateway.CreateCustomer(ctx, Customer{Reference: "user-1"})
+	require.NoError(t, err)
+	subscription, err := gateway.CreateSubscription(ctx, SubscriptionRequest{
+		CustomerID: customerID, Reference: "sub-1", Description: "Ara - plano mensal", Amount: 9.90, Currency: "BRL", IntervalMonths: 1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "pending", subscription.Status)
+	assert.Equal(t, server.URL+"/checkout/"+subscription.ID, subscription.CheckoutURL)
+
+	// The payer opens the link and pays
+	resp, err := http.Get(subscription.CheckoutURL)
+	require.NoError(t, err)
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(page), "Ara - plano mensal")
+	assert.Contains(t, string(page), "R$ 9.90 por mês")
+
+	resp, err = http.Post(subscription.CheckoutURL+"/approved", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Len(t, received, 1)
+	event, err := gateway.ParseWebhook(ctx, received[0].Header, received[0].Body)
+	require.NoError(t, err)
+	assert.Equal(t, GatewayFake, event.Gateway)
+	assert.Equal(t, "sub-1", event.Reference)
+	assert.Equal(t, subscription.ID, event.SubscriptionID)
+	assert.Equal(t, models.PaymentStatusApproved, event.Status)
+	assert.InDelta(t, 9.90, event.Amount, 0.001)
+	assert.NotEmpty(t, event.EventID)
+	assert.NotEmpty(t, event.PaymentID)
+
+	// A Pix charge comes with a dynamic copia-e-cola code
+	charge, err := gateway.CreateCharge(ctx, ChargeRequest{CustomerID: customerID, Reference: "sub-1", Amount: 9.90, Method: MethodPix})
+	require.NoError(t, err)
+	code, err := pix.Parse(charge.PixCode)
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimPrefix(charge.CheckoutURL, "http://")+"/pix", code.URL)
+	assert.Equal(t, 9.90, code.Amount)
+	delivered, err := fake.Pay("unknown", models.PaymentStatusApproved)
+	assert.Error(t, err)
+	assert.Nil(t, delivered)
+
+	require.NoError(t, gateway.CancelSubscription(ctx, subscription.ID))
+	assert.Error(t, gateway.CancelSubscription(ctx, "sub_404"))
+
+	var notification map[string]interface{}
+	require.NoError(t, json.Unmarshal(received[0].Body, &notification))
+	assert.Equal(t, "payment.updated", notification["type"])
+
+	// Unsigned or tampered notifications are refused
+	_, err = gateway.ParseWebhook(ctx, nil, received[0].Body)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	tampered := strings.Replace(string(received[0].Body), `"approved"`, `"refunded"`, 1)
+	_, err = gateway.ParseWebhook(ctx, received[0].Header, []byte(tampered))
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestFakeServerRequiresAuthorization(t *testing.T) {
+	server := httptest.NewServer(NewFakeServer(""))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/customers", "application/json", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,148 @@
+// Package payments charges subscribers through a payment gateway: Mercado Pago, Pagar.me,
+// or a fake one for local development and tests.
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"project-ara/internal/models"
+)
+
+// ErrIgnored is returned by ParseWebhook for notifications that say nothing about a
+// payment (test pings, customer updates...). They should be acknowledged and dropped.
+var ErrIgnored = errors.New("webhook event ignored")
+
+// Charge methods
+const (
+	MethodPix      = "pix"
+	MethodCheckout = "checkout" // Hosted page where the payer picks card, Pix or boleto
+)
+
+// Customer is the payer registered with the gateway
+type Customer struct {
+	Reference string // Our user ID
+	Name      string
+	Email     string
+	Phone     string // Digits only, with country code
+}
+
+// SubscriptionRequest asks for a recurring charge the payer confirms on a checkout page
+type SubscriptionRequest struct {
+	CustomerID     string
+	Reference      string // Our subscription ID, echoed back in webhooks
+	Description    string
+	Amount         float64
+	Currency       string
+	IntervalMonths int
+	PayerEmail     string
+	BackURL        string // Where the checkout sends the payer when done
+}
+
+// Subscription is a recurring charge created at the gateway
+type Subscription struct {
+	ID          string
+	Status      string // As reported by the gateway
+	CheckoutURL string
+}
+
+// ChargeRequest asks for a single payment
+type ChargeRequest struct {
+	CustomerID  string
+	Reference   string // Our subscription ID, echoed back in webhooks
+	Description string
+	Amount      float64
+	Currency    string
+	Method      string // MethodPix or MethodCheckout
+	PayerEmail  string
+	ExpiresAt   time.Time
+}
+
+// Charge is a single payment created at the gateway
+type Charge struct {
+	ID          string
+	Status      string // As reported by the gateway
+	CheckoutURL string
+	PixCode     string // Pix copia-e-cola, for MethodPix
+	ExpiresAt   *time.Time
+}
+
+// WebhookEvent is a payment notification, normalized across gateways
+type WebhookEvent struct {
+	Gateway        string
+	EventID        string // The gateway's ID of the notification itself
+	Type           string // The gateway's event type
+	PaymentID      string
+	SubscriptionID string // The gateway's subscription ID, for recurring charges
+	Reference      string // Our subscription ID, when the gateway echoes it
+	Status         models.PaymentStatus
+	Amount         float64
+	Method         string
+	FailureReason  string
+}
+
+// PaymentGateway creates customers, subscriptions and charges at a payment provider and
+// turns its webhooks into WebhookEvents
+type PaymentGateway interface {
+	// Name identifies the gateway in payments and webhook URLs
+	Name() string
+	// CreateCustomer registers the payer and returns the gateway's customer ID
+	CreateCustomer(ctx context.Context, customer Customer) (string, error)
+	// CreateSubscription starts a recurring charge; nothing is charged until the payer
+	// completes the checkout at the returned URL
+	CreateSubscription(ctx context.Context, request SubscriptionRequest) (*Subscription, error)
+	CreateCharge(ctx context.Context, request ChargeRequest) (*Charge, error)
+	CancelSubscription(ctx context.Context, subscriptionID string) error
+	// ParseWebhook reads a notification, fetching the payment from the gateway when the
+	// notification only carries its ID. It returns ErrIgnored for unrelated events.
+	ParseWebhook(ctx context.Context, header http.Header, body []byte) (*WebhookEvent, error)
+}
+
+// NewFromEnv builds the gateway named by PAYMENT_GATEWAY ("mercadopago", "pagarme" or
+// "fake"). Without it, the gateway whose credentials are set is used; with none, it
+// returns nil and subscriptions can't be sold.
+func NewFromEnv() (PaymentGateway, error) {
+	name := strings.ToLower(os.Getenv("PAYMENT_GATEWAY"))
+	if name == "" {
+		switch {
+		case os.Getenv("MERCADOPAGO_ACCESS_TOKEN") != "":
+			name = GatewayMercadoPago
+		case os.Getenv("PAGARME_API_KEY") != "":
+			name = GatewayPagarme
+		default:
+			return nil, nil
+		}
+	}
+
+	switch name {
+	case GatewayMercadoPago:
+		return NewMercadoPago(MercadoPagoConfig{
+			AccessToken:     os.Getenv("MERCADOPAGO_ACCESS_TOKEN"),
+			BaseURL:         os.Getenv("MERCADOPAGO_API_BASE_URL"),
+			NotificationURL: os.Getenv("PAYMENT_WEBHOOK_URL"),
+			WebhookSecret:   os.Getenv("MERCADOPAGO_WEBHOOK_SECRET"),
+		}), nil
+	case GatewayPagarme:
+		return NewPagarme(PagarmeConfig{
+			APIKey:        os.Getenv("PAGARME_API_KEY"),
+			BaseURL:       os.Getenv("PAGARME_API_BASE_URL"),
+			WebhookSecret: os.Getenv("PAGARME_WEBHOOK_SECRET"),
+		}), nil
+	case GatewayFake:
+		return NewFakeGateway(getEnv("FAKE_GATEWAY_URL", "http://localhost:9191")), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway: %s", name)
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,373 @@
+package payments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"project-ara/internal/models"
+)
+
+// GatewayMercadoPago is the name of the Mercado Pago gateway
+const GatewayMercadoPago = "mercadopago"
+
+// MercadoPagoConfig holds the credentials of a Mercado Pago application
+type MercadoPagoConfig struct {
+	AccessToken     string
+	BaseURL         string // Defaults to https://api.mercadopago.com
+	NotificationURL string // Webhook URL sent with each charge; the panel's is used when empty
+	// WebhookSecret is the panel's secret signature of webhooks. Without it notifications
+	// aren't checked, which is still safe: the payment is always fetched from the API.
+	WebhookSecret string
+}
+
+// MercadoPago charges through Mercado Pago: subscriptions are preapprovals, Pix charges
+// are payments and checkout charges are Checkout Pro preferences
+type MercadoPago struct {
+	config MercadoPagoConfig
+	api    apiClient
+}
+
+func NewMercadoPago(config MercadoPagoConfig) *MercadoPago {
+	if config.BaseURL == "" {
+		config.BaseURL = "https://api.mercadopago.com"
+	}
+	return &MercadoPago{
+		config: config,
+		api: newAPIClient(GatewayMercadoPago, config.BaseURL, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+		}),
+	}
+}
+
+func (m *MercadoPago) Name() string {
+	return GatewayMercadoPago
+}
+
+type mercadoPagoPhone struct {
+	AreaCode string `json:"area_code"`
+	Number   string `json:"number"`
+}
+
+type mercadoPagoCustomer struct {
+	ID          string            `json:"id,omitempty"`
+	Email       string            `json:"email"`
+	FirstName   string            `json:"first_name,omitempty"`
+	Phone       *mercadoPagoPhone `json:"phone,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+// CreateCustomer registers the payer by email, reusing the customer Mercado Pago already
+// has for that email
+func (m *MercadoPago) CreateCustomer(ctx context.Context, customer Customer) (string, error) {
+	request := mercadoPagoCustomer{
+		Email:       customer.Email,
+		FirstName:   customer.Name,
+		Description: customer.Reference,
+	}
+	if phone := strings.TrimPrefix(customer.Phone, "55"); len(phone) > 2 {
+		request.Phone = &mercadoPagoPhone{AreaCode: phone[:2], Number: phone[2:]}
+	}
+
+	var created mercadoPagoCustomer
+	err := m.api.do(ctx, http.MethodPost, "/v1/customers", "", request, &created)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest {
+		var search struct {
+			Results []mercadoPagoCustomer `json:"results"`
+		}
+		query := url.Values{"email": {customer.Email}}.Encode()
+		if searchErr := m.api.do(ctx, http.MethodGet, "/v1/customers/search?"+query, "", nil, &search); searchErr == nil && len(search.Results) > 0 {
+			return search.Results[0].ID, nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// CreateSubscription creates a pending preapproval; its init_point is where the payer
+// authorizes the recurring charge
+func (m *MercadoPago) CreateSubscription(ctx context.Context, request SubscriptionRequest) (*Subscription, error) {
+	body := map[string]interface{}{
+		"reason":             request.Description,
+		"external_reference": request.Reference,
+		"payer_email":        request.PayerEmail,
+		"back_url":           request.BackURL,
+		"status":             "pending",
+		"auto_recurring": map[string]interface{}{
+			"frequency":          request.IntervalMonths,
+			"frequency_type":     "months",
+			"transaction_amount": request.Amount,
+			"currency_id":        request.Currency,
+		},
+	}
+	if m.config.NotificationURL != "" {
+		body["notification_url"] = m.config.NotificationURL
+	}
+
+	var created struct {
+		ID        string `json:"id"`
+		Status    string `json:"status"`
+		InitPoint string `json:"init_point"`
+	}
+	if err := m.api.do(ctx, http.MethodPost, "/preapproval", request.Reference, body, &created); err != nil {
+		return nil, err
+	}
+	return &Subscription{ID: created.ID, Status: created.Status, CheckoutURL: created.InitPoint}, nil
+}
+
+// CreateCharge creates a Pix payment, or a Checkout Pro preference for MethodCheckout
+func (m *MercadoPago) CreateCharge(ctx context.Context, request ChargeRequest) (*Charge, error) {
+	switch request.Method {
+	case MethodPix:
+		return m.createPixPayment(ctx, request)
+	case MethodCheckout:
+		return m.createPreference(ctx, request)
+	default:
+		return nil, fmt.Errorf("mercadopago: unsupported charge method %q", request.Method)
+	}
+}
+
+func (m *MercadoPago) createPixPayment(ctx context.Context, request ChargeRequest) (*Charge, error) {
+	body := map[string]interface{}{
+		"transaction_amount": request.Amount,
+		"description":        request.Description,
+		"payment_method_id":  "pix",
+		"external_reference": request.Reference,
+		"payer":              map[string]interface{}{"email": request.PayerEmail},
+	}
+	if !request.ExpiresAt.IsZero() {
+		body["date_of_expiration"] = mercadoPagoTime(request.ExpiresAt)
+	}
+	if m.config.NotificationURL != "" {
+		body["notification_url"] = m.config.NotificationURL
+	}
+
+	var created struct {
+		ID                 int64  `json:"id"`
+		Status             string `json:"status"`
+		PointOfInteraction struct {
+			TransactionData struct {
+				QRCode    string `json:"qr_code"`
+				TicketURL string `json:"ticket_url"`
+			} `json:"transaction_data"`
+		} `json:"point_of_interaction"`
+	}
+	// Retrying the same charge can't create a second one
+	idempotencyKey := fmt.Sprintf("%s-%d", request.Reference, request.ExpiresAt.Unix())
+	if err := m.api.do(ctx, http.MethodPost, "/v1/payments", idempotencyKey, body, &created); err != nil {
+		return nil, err
+	}
+
+	charge := &Charge{
+		ID:          fmt.Sprint(created.ID),
+		Status:      created.Status,
+		CheckoutURL: created.PointOfInteraction.TransactionData.TicketURL,
+		PixCode:     created.PointOfInteraction.TransactionData.QRCode,
+	}
+	if !request.ExpiresAt.IsZero() {
+		charge.ExpiresAt = &request.ExpiresAt
+	}
+	return charge, nil
+}
+
+func (m *MercadoPago) createPreference(ctx context.Context, request ChargeRequest) (*Charge, error) {
+	body := map[string]interface{}{
+		"items": []map[string]interface{}{{
+			"title":       request.Description,
+			"quantity":    1,
+			"unit_price":  request.Amount,
+			"currency_id": request.Currency,
+		}},
+		"external_reference": request.Reference,
+		"payer":              map[string]interface{}{"email": request.PayerEmail},
+	}
+	if !request.ExpiresAt.IsZero() {
+		body["expires"] = true
+		body["expiration_date_to"] = mercadoPagoTime(request.ExpiresAt)
+	}
+	if m.config.NotificationURL != "" {
+		body["notification_url"] = m.config.NotificationURL
+	}
+
+	var created struct {
+		ID        string `json:"id"`
+		InitPoint string `json:"init_point"`
+	}
+	if err := m.api.do(ctx, http.MethodPost, "/checkout/preferences", "", body, &created); err != nil {
+		return nil, err
+	}
+
+	charge := &Charge{ID: created.ID, Status: "pending", CheckoutURL: created.InitPoint}
+	if !request.ExpiresAt.IsZero() {
+		charge.ExpiresAt = &request.ExpiresAt
+	}
+	return charge, nil
+}
+
+func (m *MercadoPago) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	return m.api.do(ctx, http.MethodPut, "/preapproval/"+url.PathEscape(subscriptionID), "", map[string]string{"status": "cancelled"}, nil)
+}
+
+// mercadoPagoNotification is the body of a webhook: only the type and the resource ID,
+// the resource itself has to be fetched
+type mercadoPagoNotification struct {
+	ID     flexibleID `json:"id"`
+	Type   string     `json:"type"`
+	Action string     `json:"action"`
+	Data   struct {
+		ID flexibleID `json:"id"`
+	} `json:"data"`
+}
+
+type mercadoPagoPayment struct {
+	ID                flexibleID `json:"id"`
+	Status            string     `json:"status"`
+	StatusDetail      string     `json:"status_detail"`
+	TransactionAmount float64    `json:"transaction_amount"`
+	PaymentMethodID   string     `json:"payment_method_id"`
+	PaymentTypeID     string     `json:"payment_type_id"`
+	ExternalReference string     `json:"external_reference"`
+	Metadata          struct {
+		PreapprovalID string `json:"preapproval_id"`
+	} `json:"metadata"`
+}
+
+// ParseWebhook handles "payment" notifications and the payments of subscriptions
+// ("subscription_authorized_payment"), fetching the payment to learn its status
+func (m *MercadoPago) ParseWebhook(ctx context.Context, header http.Header, body []byte) (*WebhookEvent, error) {
+	var notification mercadoPagoNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, fmt.Errorf("invalid mercadopago notification: %w", err)
+	}
+	resourceID := string(notification.Data.ID)
+	if m.config.WebhookSecret != "" {
+		if err := m.verifySignature(header, resourceID); err != nil {
+			return nil, err
+		}
+	}
+	if resourceID == "" {
+		return nil, ErrIgnored
+	}
+
+	event := &WebhookEvent{
+		Gateway: GatewayMercadoPago,
+		EventID: string(notification.ID),
+		Type:    notification.Type,
+	}
+
+	switch notification.Type {
+	case "payment":
+		var payment mercadoPagoPayment
+		if err := m.api.do(ctx, http.MethodGet, "/v1/payments/"+url.PathEscape(resourceID), "", nil, &payment); err != nil {
+			return nil, err
+		}
+		event.SubscriptionID = payment.Metadata.PreapprovalID
+		fillMercadoPagoPayment(event, payment)
+
+	case "subscription_authorized_payment":
+		var invoice struct {
+			PreapprovalID     string  `json:"preapproval_id"`
+			ExternalReference string  `json:"external_reference"`
+			TransactionAmount float64 `json:"transaction_amount"`
+			Payment           struct {
+				ID flexibleID `json:"id"`
+			} `json:"payment"`
+		}
+		if err := m.api.do(ctx, http.MethodGet, "/authorized_payments/"+url.PathEscape(resourceID), "", nil, &invoice); err != nil {
+			return nil, err
+		}
+		if invoice.Payment.ID == "" {
+			// Scheduled but not charged yet
+			return nil, ErrIgnored
+		}
+		var payment mercadoPagoPayment
+		if err := m.api.do(ctx, http.MethodGet, "/v1/payments/"+url.PathEscape(string(invoice.Payment.ID)), "", nil, &payment); err != nil {
+			return nil, err
+		}
+		event.SubscriptionID = invoice.PreapprovalID
+		fillMercadoPagoPayment(event, payment)
+		if event.Reference == "" {
+			event.Reference = invoice.ExternalReference
+		}
+
+	default:
+		return nil, ErrIgnored
+	}
+
+	if event.EventID == "" {
+		event.EventID = event.Type + ":" + event.PaymentID + ":" + string(event.Status)
+	}
+	return event, nil
+}
+
+// verifySignature checks the x-signature header, "ts=<timestamp>,v1=<signature>", where the
+// signature is the hex HMAC-SHA256 of "id:<data.id>;request-id:<x-request-id>;ts:<timestamp>;"
+// with the parts that are missing left out
+func (m *MercadoPago) verifySignature(header http.Header, resourceID string) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header.Get("x-signature"), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "ts":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("%w: missing x-signature", ErrInvalidSignature)
+	}
+
+	var manifest strings.Builder
+	if resourceID != "" {
+		// Alphanumeric IDs are signed in lowercase
+		fmt.Fprintf(&manifest, "id:%s;", strings.ToLower(resourceID))
+	}
+	if requestID := header.Get("x-request-id"); requestID != "" {
+		fmt.Fprintf(&manifest, "request-id:%s;", requestID)
+	}
+	fmt.Fprintf(&manifest, "ts:%s;", timestamp)
+	return checkHMAC(sha256.New, m.config.WebhookSecret, []byte(manifest.String()), signature)
+}
+
+func fillMercadoPagoPayment(event *WebhookEvent, payment mercadoPagoPayment) {
+	event.PaymentID = string(payment.ID)
+	event.Reference = payment.ExternalReference
+	event.Amount = payment.TransactionAmount
+	event.Method = payment.PaymentMethodID
+	if payment.PaymentTypeID == "bank_transfer" && payment.PaymentMethodID == "pix" {
+		event.Method = MethodPix
+	}
+
+	switch payment.Status {
+	case "approved":
+		event.Status = models.PaymentStatusApproved
+	case "rejected":
+		event.Status = models.PaymentStatusFailed
+		event.FailureReason = payment.StatusDetail
+	case "cancelled":
+		event.Status = models.PaymentStatusCancelled
+		event.FailureReason = payment.StatusDetail
+	case "refunded", "charged_back":
+		event.Status = models.PaymentStatusRefunded
+	default: // pending, in_process, authorized, in_mediation
+		event.Status = models.PaymentStatusPending
+	}
+}
+
+// mercadoPagoTime formats a time the way Mercado Pago's date fields expect
+func mercadoPagoTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05.000-07:00")
+}
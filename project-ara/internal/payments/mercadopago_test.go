@@ -0,0 +1,182 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+)
+
+// fakeAPI answers each "METHOD /path" with a canned JSON response and keeps the requests
+type fakeAPI struct {
+	t         *testing.T
+	responses map[string]string
+	requests  map[string]map[string]interface{}
+	headers   map[string]http.Header
+}
+
+func newFakeAPI(t *testing.T, responses map[string]string) *httptest.Server {
+	api := &fakeAPI{t: t, responses: responses, requests: map[string]map[string]interface{}{}, headers: map[string]http.Header{}}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	response, ok := a.responses[key]
+	if !ok {
+		a.t.Errorf("unexpected request %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.headers[key] = r.Header.Clone()
+	if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+		var body map[string]interface{}
+		require.NoError(a.t, json.Unmarshal(data, &body))
+		a.requests[key] = body
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(response))
+}
+
+func fakeAPIOf(server *httptest.Server) *fakeAPI {
+	return server.Config.Handler.(*fakeAPI)
+}
+
+func TestMercadoPagoSubscriptionAndPixCharge(t *testing.T) {
+	server := newFakeAPI(t, map[string]string{
+		"POST /v1/customers":        `{"id": "123-abc"}`,
+		"POST /preapproval":         `{"id": "2c938084", "status": "pending", "init_point": "https://www.mercadopago.com.br/subscriptions/checkout?preapproval_id=2c938084"}`,
+		"POST /v1/payments":         `{"id": 1234567, "status": "pending", "point_of_interaction": {"transaction_data": {"qr_code": "00020126...6304ABCD", "ticket_url": "https://mp.example/pix/1234567"}}}`,
+		"PUT /preapproval/2c938084": `{"id": "2c938084", "status": "cancelled"}`,
+	})
+	gateway := NewMercadoPago(MercadoPagoConfig{AccessToken: "TEST-token", BaseURL: server.URL, NotificationURL: "https://ara.example/api/v1/subscriptions/webhook/mercadopago"})
+	api := fakeAPIOf(server)
+	ctx := context.Background()
+
+	customerID, err := gateway.CreateCustomer(ctx, Customer{Reference: "user-1", Email: "user-1@clientes.ara.app", Phone: "5511999990000"})
+	require.NoError(t, err)
+	assert.Equal(t, "123-abc", customerID)
+	assert.Equal(t, "Bearer TEST-token", api.headers["POST /v1/customers"].Get("Authorization"))
+	assert.Equal(t, map[string]interface{}{"area_code": "11", "number": "999990000"}, api.requests["POST /v1/customers"]["phone"])
+
+	subscription, err := gateway.CreateSubscription(ctx, SubscriptionRequest{
+		CustomerID: customerID, Reference: "sub-1", Description: "Ara - plano mensal",
+		Amount: 9.90, Currency: "BRL", IntervalMonths: 1, PayerEmail: "user-1@clientes.ara.app",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "2c938084", subscription.ID)
+	assert.Contains(t, subscription.CheckoutURL, "preapproval_id=2c938084")
+	preapproval := api.requests["POST /preapproval"]
+	assert.Equal(t, "sub-1", preapproval["external_reference"])
+	assert.Equal(t, map[string]interface{}{"frequency": 1.0, "frequency_type": "months", "transaction_amount": 9.90, "currency_id": "BRL"}, preapproval["auto_recurring"])
+
+	expiresAt := time.Now().Add(24 * time.Hour)
+	charge, err := gateway.CreateCharge(ctx, ChargeRequest{
+		CustomerID: customerID, Reference: "sub-1", Description: "Ara - renovação",
+		Amount: 9.90, Currency: "BRL", Method: MethodPix, PayerEmail: "user-1@clientes.ara.app", ExpiresAt: expiresAt,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1234567", charge.ID)
+	assert.Equal(t, "00020126...6304ABCD", charge.PixCode)
+	assert.Equal(t, "https://mp.example/pix/1234567", charge.CheckoutURL)
+	assert.NotEmpty(t, api.headers["POST /v1/payments"].Get("X-Idempotency-Key"))
+	assert.Equal(t, "pix", api.requests["POST /v1/payments"]["payment_method_id"])
+	assert.Equal(t, "https://ara.example/api/v1/subscriptions/webhook/mercadopago", api.requests["POST /v1/payments"]["notification_url"])
+
+	require.NoError(t, gateway.CancelSubscription(ctx, "2c938084"))
+	assert.Equal(t, "cancelled", api.requests["PUT /preapproval/2c938084"]["status"])
+}
+
+func TestMercadoPagoWebhookFetchesThePayment(t *testing.T) {
+	server := newFakeAPI(t, map[string]string{
+		"GET /v1/payments/1234567": `{"id": 1234567, "status": "rejected", "status_detail": "cc_rejected_insufficient_amount",
+			"transaction_amount": 9.9, "payment_method_id": "visa", "payment_type_id": "credit_card", "external_reference": "sub-1"}`,
+		"GET /authorized_payments/6114264375": `{"id": 6114264375, "preapproval_id": "2c938084", "external_reference": "sub-1", "payment": {"id": 7654321}}`,
+		"GET /v1/payments/7654321":            `{"id": 7654321, "status": "approved", "transaction_amount": 9.9, "payment_method_id": "master", "external_reference": "sub-1"}`,
+	})
+	gateway := NewMercadoPago(MercadoPagoConfig{AccessToken: "TEST-token", BaseURL: server.URL})
+	ctx := context.Background()
+
+	event, err := gateway.ParseWebhook(ctx, nil, []byte(`{"id": 12345, "type": "payment", "action": "payment.updated", "data": {"id": "1234567"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, &WebhookEvent{
+		Gateway:       GatewayMercadoPago,
+		EventID:       "12345",
+		Type:          "payment",
+		PaymentID:     "1234567",
+		Reference:     "sub-1",
+		Status:        models.PaymentStatusFailed,
+		Amount:        9.9,
+		Method:        "visa",
+		FailureReason: "cc_rejected_insufficient_amount",
+	}, event)
+
+	// Renewals charged by Mercado Pago arrive as authorized payments of the preapproval
+	event, err = gateway.ParseWebhook(ctx, nil, []byte(`{"id": 67890, "type": "subscription_authorized_payment", "data": {"id": 6114264375}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "7654321", event.PaymentID)
+	assert.Equal(t, "2c938084", event.SubscriptionID)
+	assert.Equal(t, "sub-1", event.Reference)
+	assert.Equal(t, models.PaymentStatusApproved, event.Status)
+
+	_, err = gateway.ParseWebhook(ctx, nil, []byte(`{"id": 1, "type": "subscription_preapproval", "data": {"id": "2c938084"}}`))
+	assert.ErrorIs(t, err, ErrIgnored)
+	_, err = gateway.ParseWebhook(ctx, nil, []byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestMercadoPagoWebhookSignature(t *testing.T) {
+	server := newFakeAPI(t, map[string]string{
+		"GET /v1/payments/1234567": `{"id": 1234567, "status": "approved", "transaction_amount": 9.9, "external_reference": "sub-1"}`,
+	})
+	gateway := NewMercadoPago(MercadoPagoConfig{AccessToken: "TEST-token", BaseURL: server.URL, WebhookSecret: "panel-secret"})
+	ctx := context.Background()
+	body := []byte(`{"id": 12345, "type": "payment", "data": {"id": "1234567"}}`)
+
+	mac := hmac.New(sha256.New, []byte("panel-secret"))
+	mac.Write([]byte("id:1234567;request-id:bb56a2f1-6aae-46ac-982e-9dcd3581d08e;ts:1704908010;"))
+	header := http.Header{}
+	header.Set("x-request-id", "bb56a2f1-6aae-46ac-982e-9dcd3581d08e")
+	header.Set("x-signature", "ts=1704908010,v1="+hex.EncodeToString(mac.Sum(nil)))
+	event, err := gateway.ParseWebhook(ctx, header, body)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStatusApproved, event.Status)
+
+	header.Set("x-request-id", "another-request")
+	_, err = gateway.ParseWebhook(ctx, header, body)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = gateway.ParseWebhook(ctx, nil, body)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestMercadoPagoReusesExistingCustomer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/customers":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "the customer already exist", "status": 400}`))
+		case "/v1/customers/search":
+			assert.Equal(t, "user-1@clientes.ara.app", r.URL.Query().Get("email"))
+			w.Write([]byte(`{"results": [{"id": "123-abc", "email": "user-1@clientes.ara.app"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	gateway := NewMercadoPago(MercadoPagoConfig{AccessToken: "TEST-token", BaseURL: server.URL})
+	customerID, err := gateway.CreateCustomer(context.Background(), Customer{Email: "user-1@clientes.ara.app"})
+	require.NoError(t, err)
+	assert.Equal(t, "123-abc", customerID)
+}
@@ -0,0 +1,291 @@
+package payments
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"project-ara/internal/models"
+)
+
+// GatewayPagarme is the name of the Pagar.me gateway
+const GatewayPagarme = "pagarme"
+
+// PagarmeConfig holds the secret key of a Pagar.me account
+type PagarmeConfig struct {
+	APIKey        string
+	BaseURL       string // Defaults to https://api.pagar.me/core/v5
+	WebhookSecret string // Key webhooks are signed with; defaults to APIKey
+}
+
+// Pagarme charges through the Pagar.me v5 API: subscriptions are sold with subscription
+// payment links and one-off charges are orders paid with Pix or a hosted checkout
+type Pagarme struct {
+	api           apiClient
+	webhookSecret string
+}
+
+func NewPagarme(config PagarmeConfig) *Pagarme {
+	if config.BaseURL == "" {
+		config.BaseURL = "https://api.pagar.me/core/v5"
+	}
+	if config.WebhookSecret == "" {
+		config.WebhookSecret = config.APIKey
+	}
+	return &Pagarme{
+		api: newAPIClient(GatewayPagarme, config.BaseURL, func(req *http.Request) {
+			req.SetBasicAuth(config.APIKey, "")
+		}),
+		webhookSecret: config.WebhookSecret,
+	}
+}
+
+func (p *Pagarme) Name() string {
+	return GatewayPagarme
+}
+
+// CreateCustomer registers the payer with our user ID as its code
+func (p *Pagarme) CreateCustomer(ctx context.Context, customer Customer) (string, error) {
+	body := map[string]interface{}{
+		"name":  customer.Name,
+		"email": customer.Email,
+		"code":  customer.Reference,
+		"type":  "individual",
+	}
+	if phone := strings.TrimPrefix(customer.Phone, "55"); len(phone) > 2 {
+		body["phones"] = map[string]interface{}{
+			"mobile_phone": map[string]string{"country_code": "55", "area_code": phone[:2], "number": phone[2:]},
+		}
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := p.api.do(ctx, http.MethodPost, "/customers", "", body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// CreateSubscription creates a subscription payment link. The subscription itself only
+// exists at Pagar.me once the payer completes the link, so the returned ID is the link's.
+func (p *Pagarme) CreateSubscription(ctx context.Context, request SubscriptionRequest) (*Subscription, error) {
+	price := cents(request.Amount)
+	body := map[string]interface{}{
+		"is_building": false,
+		"type":        "subscription",
+		"name":        request.Description,
+		"payment_settings": map[string]interface{}{
+			"accepted_payment_methods": []string{"credit_card"},
+			"credit_card_settings": map[string]interface{}{
+				"operation_type": "auth_and_capture",
+				"installments":   []map[string]interface{}{{"number": 1, "total": price}},
+			},
+		},
+		"cart_settings": map[string]interface{}{
+			"recurrences": []map[string]interface{}{{
+				"start_in": 1,
+				"plan": map[string]interface{}{
+					"name":           request.Description,
+					"interval":       "month",
+					"interval_count": request.IntervalMonths,
+					"billing_type":   "prepaid",
+					"currency":       request.Currency,
+					"pricing_scheme": map[string]interface{}{"scheme_type": "unit", "price": price},
+					"quantity":       1,
+				},
+			}},
+		},
+		"customer_settings": map[string]interface{}{"customer_id": request.CustomerID},
+		"metadata":          map[string]string{"reference": request.Reference},
+	}
+	if request.BackURL != "" {
+		body["layout_settings"] = map[string]interface{}{"success_url": request.BackURL}
+	}
+
+	var created struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		URL    string `json:"url"`
+	}
+	if err := p.api.do(ctx, http.MethodPost, "/paymentlinks", request.Reference, body, &created); err != nil {
+		return nil, err
+	}
+	return &Subscription{ID: created.ID, Status: created.Status, CheckoutURL: created.URL}, nil
+}
+
+// CreateCharge creates an order paid with Pix, or with Pagar.me's hosted checkout
+func (p *Pagarme) CreateCharge(ctx context.Context, request ChargeRequest) (*Charge, error) {
+	payment := map[string]interface{}{"payment_method": request.Method}
+	switch request.Method {
+	case MethodPix:
+		pix := map[string]interface{}{}
+		if !request.ExpiresAt.IsZero() {
+			pix["expires_at"] = request.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		payment["pix"] = pix
+	case MethodCheckout:
+		checkout := map[string]interface{}{
+			"accepted_payment_methods": []string{"credit_card", "pix", "boleto"},
+		}
+		if !request.ExpiresAt.IsZero() {
+			checkout["expires_in"] = int(time.Until(request.ExpiresAt).Minutes())
+		}
+		payment["checkout"] = checkout
+	default:
+		return nil, fmt.Errorf("pagarme: unsupported charge method %q", request.Method)
+	}
+
+	body := map[string]interface{}{
+		"code":        request.Reference,
+		"customer_id": request.CustomerID,
+		"items": []map[string]interface{}{{
+			"amount":      cents(request.Amount),
+			"description": request.Description,
+			"quantity":    1,
+			"code":        "subscription",
+		}},
+		"payments": []interface{}{payment},
+		"metadata": map[string]string{"reference": request.Reference},
+	}
+
+	var created struct {
+		ID      string `json:"id"`
+		Status  string `json:"status"`
+		Charges []struct {
+			ID              string `json:"id"`
+			LastTransaction struct {
+				QRCode    string     `json:"qr_code"`
+				QRCodeURL string     `json:"qr_code_url"`
+				ExpiresAt *time.Time `json:"expires_at"`
+			} `json:"last_transaction"`
+		} `json:"charges"`
+		Checkouts []struct {
+			PaymentURL string `json:"payment_url"`
+		} `json:"checkouts"`
+	}
+	idempotencyKey := fmt.Sprintf("%s-%d", request.Reference, request.ExpiresAt.Unix())
+	if err := p.api.do(ctx, http.MethodPost, "/orders", idempotencyKey, body, &created); err != nil {
+		return nil, err
+	}
+
+	charge := &Charge{ID: created.ID, Status: created.Status}
+	if len(created.Charges) > 0 {
+		transaction := created.Charges[0].LastTransaction
+		charge.PixCode = transaction.QRCode
+		charge.CheckoutURL = transaction.QRCodeURL
+		charge.ExpiresAt = transaction.ExpiresAt
+	}
+	if len(created.Checkouts) > 0 {
+		charge.CheckoutURL = created.Checkouts[0].PaymentURL
+	}
+	if charge.ExpiresAt == nil && !request.ExpiresAt.IsZero() {
+		charge.ExpiresAt = &request.ExpiresAt
+	}
+	return charge, nil
+}
+
+func (p *Pagarme) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	return p.api.do(ctx, http.MethodDelete, "/subscriptions/"+url.PathEscape(subscriptionID), "", nil, nil)
+}
+
+// pagarmeReferenced is what orders, subscriptions and links carry to point back at us
+type pagarmeReferenced struct {
+	ID       string            `json:"id"`
+	Code     string            `json:"code"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (r pagarmeReferenced) reference() string {
+	if reference := r.Metadata["reference"]; reference != "" {
+		return reference
+	}
+	return r.Code
+}
+
+// ParseWebhook checks the X-Hub-Signature, "sha1=" and the hex HMAC-SHA1 of the body, and
+// handles the charge.* events, which carry the whole charge
+func (p *Pagarme) ParseWebhook(ctx context.Context, header http.Header, body []byte) (*WebhookEvent, error) {
+	var notification struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			ID            string            `json:"id"`
+			Metadata      map[string]string `json:"metadata"`
+			Amount        int64             `json:"amount"`
+			Status        string            `json:"status"`
+			PaymentMethod string            `json:"payment_method"`
+			Order         pagarmeReferenced `json:"order"`
+			Subscription  pagarmeReferenced `json:"subscription"`
+			Invoice       struct {
+				SubscriptionID string `json:"subscriptionId"`
+			} `json:"invoice"`
+			LastTransaction struct {
+				Status          string `json:"status"`
+				AcquirerMessage string `json:"acquirer_message"`
+			} `json:"last_transaction"`
+		} `json:"data"`
+	}
+	// Unlike Mercado Pago's, these notifications carry the charge itself, so they must be signed
+	signature, ok := strings.CutPrefix(header.Get("X-Hub-Signature"), "sha1=")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing X-Hub-Signature", ErrInvalidSignature)
+	}
+	if err := checkHMAC(sha1.New, p.webhookSecret, body, signature); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, fmt.Errorf("invalid pagarme notification: %w", err)
+	}
+
+	var status models.PaymentStatus
+	switch notification.Type {
+	case "charge.paid":
+		status = models.PaymentStatusApproved
+	case "charge.payment_failed":
+		status = models.PaymentStatusFailed
+	case "charge.refunded", "charge.chargedback":
+		status = models.PaymentStatusRefunded
+	case "charge.canceled":
+		status = models.PaymentStatusCancelled
+	case "charge.pending", "charge.created":
+		status = models.PaymentStatusPending
+	default:
+		return nil, ErrIgnored
+	}
+
+	data := notification.Data
+	event := &WebhookEvent{
+		Gateway:        GatewayPagarme,
+		EventID:        notification.ID,
+		Type:           notification.Type,
+		PaymentID:      data.ID,
+		SubscriptionID: data.Subscription.ID,
+		Status:         status,
+		Amount:         float64(data.Amount) / 100,
+		Method:         data.PaymentMethod,
+	}
+	if event.SubscriptionID == "" {
+		event.SubscriptionID = data.Invoice.SubscriptionID
+	}
+	// The charge's own code is generated by Pagar.me; the order's is ours
+	event.Reference = data.Metadata["reference"]
+	for _, referenced := range []pagarmeReferenced{data.Order, data.Subscription} {
+		if event.Reference != "" {
+			break
+		}
+		event.Reference = referenced.reference()
+	}
+	if status == models.PaymentStatusFailed || status == models.PaymentStatusCancelled {
+		event.FailureReason = data.LastTransaction.AcquirerMessage
+		if event.FailureReason == "" {
+			event.FailureReason = data.LastTransaction.Status
+		}
+	}
+	return event, nil
+}
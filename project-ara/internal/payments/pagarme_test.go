@@ -0,0 +1,117 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+)
+
+func TestPagarmeSubscriptionLinkAndPixOrder(t *testing.T) {
+	server := newFakeAPI(t, map[string]string{
+		"POST /customers":    `{"id": "cus_x1"}`,
+		"POST /paymentlinks": `{"id": "pl_y2", "status": "active", "url": "https://payment-link.pagar.me/pl_y2"}`,
+		"POST /orders": `{"id": "or_z3", "status": "pending", "charges": [{"id": "ch_w4", "last_transaction":
+			{"qr_code": "00020101021226...", "qr_code_url": "https://api.pagar.me/core/v5/transactions/tran_1/qrcode", "expires_at": "2026-10-19T12:00:00Z"}}]}`,
+		"DELETE /subscriptions/sub_v5": `{"id": "sub_v5", "status": "canceled"}`,
+	})
+	gateway := NewPagarme(PagarmeConfig{APIKey: "sk_test", BaseURL: server.URL})
+	api := fakeAPIOf(server)
+	ctx := context.Background()
+
+	customerID, err := gateway.CreateCustomer(ctx, Customer{Reference: "user-1", Name: "Maria", Email: "user-1@clientes.ara.app", Phone: "5511999990000"})
+	require.NoError(t, err)
+	assert.Equal(t, "cus_x1", customerID)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("sk_test:")), api.headers["POST /customers"].Get("Authorization"))
+	assert.Equal(t, "user-1", api.requests["POST /customers"]["code"])
+
+	subscription, err := gateway.CreateSubscription(ctx, SubscriptionRequest{
+		CustomerID: customerID, Reference: "sub-1", Description: "Ara - plano mensal",
+		Amount: 9.90, Currency: "BRL", IntervalMonths: 1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "pl_y2", subscription.ID)
+	assert.Equal(t, "https://payment-link.pagar.me/pl_y2", subscription.CheckoutURL)
+	link := api.requests["POST /paymentlinks"]
+	assert.Equal(t, "subscription", link["type"])
+	assert.Equal(t, map[string]interface{}{"reference": "sub-1"}, link["metadata"])
+	plan := link["cart_settings"].(map[string]interface{})["recurrences"].([]interface{})[0].(map[string]interface{})["plan"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"scheme_type": "unit", "price": 990.0}, plan["pricing_scheme"])
+
+	charge, err := gateway.CreateCharge(ctx, ChargeRequest{
+		CustomerID: customerID, Reference: "sub-1", Description: "Ara - renovação",
+		Amount: 9.90, Currency: "BRL", Method: MethodPix, ExpiresAt: time.Now().Add(24 * time.Hour),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "or_z3", charge.ID)
+	assert.Equal(t, "00020101021226...", charge.PixCode)
+	require.NotNil(t, charge.ExpiresAt)
+	assert.Equal(t, "sub-1", api.requests["POST /orders"]["code"])
+	item := api.requests["POST /orders"]["items"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, 990.0, item["amount"])
+
+	_, err = gateway.CreateCharge(ctx, ChargeRequest{Method: "boleto"})
+	assert.Error(t, err)
+
+	require.NoError(t, gateway.CancelSubscription(ctx, "sub_v5"))
+}
+
+// signedByPagarme returns the headers of a notification Pagar.me signed with secret
+func signedByPagarme(secret string, body []byte) http.Header {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	return http.Header{"X-Hub-Signature": {"sha1=" + hex.EncodeToString(mac.Sum(nil))}}
+}
+
+func TestPagarmeWebhookEvents(t *testing.T) {
+	gateway := NewPagarme(PagarmeConfig{APIKey: "sk_test"})
+	ctx := context.Background()
+	parse := func(body string) (*WebhookEvent, error) {
+		return gateway.ParseWebhook(ctx, signedByPagarme("sk_test", []byte(body)), []byte(body))
+	}
+
+	event, err := parse(`{"id": "hook_1", "type": "charge.paid", "data": {
+		"id": "ch_w4", "code": "X1Y2Z3", "amount": 990, "status": "paid", "payment_method": "pix",
+		"order": {"id": "or_z3", "code": "sub-1", "metadata": {"reference": "sub-1"}}}}`)
+	require.NoError(t, err)
+	assert.Equal(t, &WebhookEvent{
+		Gateway:   GatewayPagarme,
+		EventID:   "hook_1",
+		Type:      "charge.paid",
+		PaymentID: "ch_w4",
+		Reference: "sub-1",
+		Status:    models.PaymentStatusApproved,
+		Amount:    9.90,
+		Method:    "pix",
+	}, event)
+
+	// Renewals of a subscription carry the subscription instead of our order
+	event, err = parse(`{"id": "hook_2", "type": "charge.payment_failed", "data": {
+		"id": "ch_a1", "amount": 990, "status": "failed", "payment_method": "credit_card",
+		"subscription": {"id": "sub_v5", "metadata": {"reference": "sub-1"}},
+		"last_transaction": {"status": "not_authorized", "acquirer_message": "Transação não autorizada"}}}`)
+	require.NoError(t, err)
+	assert.Equal(t, "sub_v5", event.SubscriptionID)
+	assert.Equal(t, "sub-1", event.Reference)
+	assert.Equal(t, models.PaymentStatusFailed, event.Status)
+	assert.Equal(t, "Transação não autorizada", event.FailureReason)
+
+	_, err = parse(`{"id": "hook_3", "type": "customer.updated", "data": {"id": "cus_x1"}}`)
+	assert.ErrorIs(t, err, ErrIgnored)
+
+	// Anyone can post a charge.paid; only Pagar.me can sign it
+	forged := []byte(`{"id": "hook_4", "type": "charge.paid", "data": {"id": "ch_x", "amount": 990, "metadata": {"reference": "sub-1"}}}`)
+	_, err = gateway.ParseWebhook(ctx, nil, forged)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = gateway.ParseWebhook(ctx, signedByPagarme("guessed", forged), forged)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
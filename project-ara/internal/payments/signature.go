@@ -0,0 +1,57 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidSignature is returned for webhooks that aren't signed by the sender they claim
+// to come from
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// ManualSignatureHeader carries the signature of payment webhooks in our own format:
+// "sha256=" and the hex HMAC-SHA256 of the body, keyed with PAYMENT_WEBHOOK_SECRET
+const ManualSignatureHeader = "X-Ara-Signature"
+
+// SignManualWebhook returns the ManualSignatureHeader value of a body
+func SignManualWebhook(secret string, body []byte) string {
+	return "sha256=" + hmacHex(sha256.New, secret, body)
+}
+
+// VerifyManualWebhook checks the ManualSignatureHeader of a webhook in our own format
+func VerifyManualWebhook(secret string, header http.Header, body []byte) error {
+	if secret == "" {
+		return fmt.Errorf("%w: no secret configured", ErrInvalidSignature)
+	}
+	signature, ok := strings.CutPrefix(header.Get(ManualSignatureHeader), "sha256=")
+	if !ok {
+		return fmt.Errorf("%w: missing %s", ErrInvalidSignature, ManualSignatureHeader)
+	}
+	return checkHMAC(sha256.New, secret, body, signature)
+}
+
+func hmacHex(newHash func() hash.Hash, secret string, message []byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkHMAC compares a hex signature with the HMAC of message in constant time
+func checkHMAC(newHash func() hash.Hash, secret string, message []byte, signature string) error {
+	got, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidSignature)
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(message)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package payments
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualWebhookSignature(t *testing.T) {
+	body := []byte(`{"user_id": "u-1", "payment_id": "pay-1", "status": "approved"}`)
+	header := http.Header{}
+	header.Set(ManualSignatureHeader, SignManualWebhook("secret", body))
+	assert.NoError(t, VerifyManualWebhook("secret", header, body))
+
+	assert.ErrorIs(t, VerifyManualWebhook("other", header, body), ErrInvalidSignature)
+	assert.ErrorIs(t, VerifyManualWebhook("secret", header, []byte(`{"status": "approved"}`)), ErrInvalidSignature)
+	assert.ErrorIs(t, VerifyManualWebhook("secret", http.Header{}, body), ErrInvalidSignature)
+	header.Set(ManualSignatureHeader, "sha256=not-hex")
+	assert.ErrorIs(t, VerifyManualWebhook("secret", header, body), ErrInvalidSignature)
+	// Without a secret, nothing is accepted
+	header.Set(ManualSignatureHeader, SignManualWebhook("", body))
+	assert.ErrorIs(t, VerifyManualWebhook("", header, body), ErrInvalidSignature)
+}
@@ -0,0 +1,256 @@
+// Package pix builds and reads Pix BR Codes, the EMV QR payloads of the Banco Central's
+// "Manual de Padrões para Iniciação do Pix", and renders them as QR code images.
+//
+// A static code carries the receiver's Pix key and is paid by the payer's bank directly;
+// a dynamic code carries the URL where the bank fetches the charge issued by a payment
+// provider, which then reports the payment back to us.
+package pix
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// IDs of the EMV fields a BR Code is made of
+const (
+	idPayloadFormat       = "00"
+	idPointOfInitiation   = "01"
+	idMerchantAccount     = "26"
+	idMerchantCategory    = "52"
+	idTransactionCurrency = "53"
+	idTransactionAmount   = "54"
+	idCountryCode         = "58"
+	idMerchantName        = "59"
+	idMerchantCity        = "60"
+	idPostalCode          = "61"
+	idAdditionalData      = "62"
+	idCRC                 = "63"
+
+	// Inside the merchant account information
+	idGUI         = "00"
+	idKey         = "01"
+	idDescription = "02"
+	idURL         = "25"
+
+	// Inside the additional data
+	idTxID = "05"
+)
+
+const (
+	gui = "br.gov.bcb.pix"
+
+	maxMerchantName = 25
+	maxMerchantCity = 15
+	maxTxID         = 25
+
+	// noTxID is the txid of codes that don't identify the transaction
+	noTxID = "***"
+)
+
+// ErrInvalidCode is returned for payloads that aren't a well-formed BR Code
+var ErrInvalidCode = errors.New("invalid pix code")
+
+var txIDPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,25}$`)
+
+// Payload is the content of a BR Code. Exactly one of Key (static code) and URL (dynamic
+// code) is set.
+type Payload struct {
+	Key          string  // Receiver's Pix key: CPF/CNPJ, email, phone (+55...) or random key
+	URL          string  // Location of a dynamic charge, without the https:// scheme
+	MerchantName string  // Receiver's name, shown by the payer's bank
+	MerchantCity string  // Receiver's city
+	PostalCode   string  // Optional
+	Amount       float64 // Zero lets the payer choose how much to pay
+	TxID         string  // Identifies the payment in static codes; up to 25 letters and digits
+	Description  string  // Optional message to the payer, static codes only
+	OneTime      bool    // The code can be paid only once; dynamic codes always are
+}
+
+// Dynamic reports whether the payload points to a charge at a payment provider
+func (p Payload) Dynamic() bool {
+	return p.URL != ""
+}
+
+// Encode returns the "copia e cola" text of the payload, CRC included. Names and cities
+// are reduced to ASCII, as banks expect.
+func (p Payload) Encode() (string, error) {
+	if (p.Key == "") == (p.URL == "") {
+		return "", fmt.Errorf("%w: exactly one of key and url is required", ErrInvalidCode)
+	}
+	name := truncate(ascii(p.MerchantName), maxMerchantName)
+	city := truncate(ascii(p.MerchantCity), maxMerchantCity)
+	if name == "" || city == "" {
+		return "", fmt.Errorf("%w: merchant name and city are required", ErrInvalidCode)
+	}
+	if p.Amount < 0 {
+		return "", fmt.Errorf("%w: negative amount", ErrInvalidCode)
+	}
+	txID := p.TxID
+	if txID == "" || p.Dynamic() {
+		// Dynamic charges are identified by their URL
+		txID = noTxID
+	} else if !txIDPattern.MatchString(txID) {
+		return "", fmt.Errorf("%w: txid must be up to %d letters and digits", ErrInvalidCode, maxTxID)
+	}
+
+	account := field(idGUI, gui)
+	if p.Dynamic() {
+		account += field(idURL, strings.TrimPrefix(p.URL, "https://"))
+	} else {
+		account += field(idKey, p.Key)
+		if p.Description != "" {
+			account += field(idDescription, ascii(p.Description))
+		}
+	}
+	if len(account) > 99 {
+		return "", fmt.Errorf("%w: key, url or description too long", ErrInvalidCode)
+	}
+
+	var code strings.Builder
+	code.WriteString(field(idPayloadFormat, "01"))
+	if p.OneTime || p.Dynamic() {
+		code.WriteString(field(idPointOfInitiation, "12"))
+	}
+	code.WriteString(field(idMerchantAccount, account))
+	code.WriteString(field(idMerchantCategory, "0000"))
+	code.WriteString(field(idTransactionCurrency, "986")) // BRL
+	if p.Amount > 0 {
+		code.WriteString(field(idTransactionAmount, strconv.FormatFloat(p.Amount, 'f', 2, 64)))
+	}
+	code.WriteString(field(idCountryCode, "BR"))
+	code.WriteString(field(idMerchantName, name))
+	code.WriteString(field(idMerchantCity, city))
+	if p.PostalCode != "" {
+		code.WriteString(field(idPostalCode, p.PostalCode))
+	}
+	code.WriteString(field(idAdditionalData, field(idTxID, txID)))
+
+	// The CRC covers its own ID and length
+	code.WriteString(idCRC + "04")
+	code.WriteString(CRC16(code.String()))
+	return code.String(), nil
+}
+
+// Parse reads a "copia e cola" code, checking its CRC. Codes of gateways are parsed to make
+// sure we never send a user a code their bank would refuse.
+func Parse(code string) (*Payload, error) {
+	code = strings.TrimSpace(code)
+	if len(code) < 8 || code[len(code)-8:len(code)-4] != idCRC+"04" {
+		return nil, fmt.Errorf("%w: missing crc", ErrInvalidCode)
+	}
+	if want := CRC16(code[:len(code)-4]); !strings.EqualFold(code[len(code)-4:], want) {
+		return nil, fmt.Errorf("%w: crc is %s, want %s", ErrInvalidCode, code[len(code)-4:], want)
+	}
+
+	fields, err := fields(code[:len(code)-8])
+	if err != nil {
+		return nil, err
+	}
+	if fields[idPayloadFormat] != "01" {
+		return nil, fmt.Errorf("%w: unknown payload format %q", ErrInvalidCode, fields[idPayloadFormat])
+	}
+	account, err := subfields(fields, idMerchantAccount)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(account[idGUI], gui) {
+		return nil, fmt.Errorf("%w: not a pix code", ErrInvalidCode)
+	}
+	additional, err := subfields(fields, idAdditionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &Payload{
+		Key:          account[idKey],
+		URL:          account[idURL],
+		Description:  account[idDescription],
+		MerchantName: fields[idMerchantName],
+		MerchantCity: fields[idMerchantCity],
+		PostalCode:   fields[idPostalCode],
+		OneTime:      fields[idPointOfInitiation] == "12",
+	}
+	if payload.Key == "" && payload.URL == "" {
+		return nil, fmt.Errorf("%w: no pix key or url", ErrInvalidCode)
+	}
+	if txID := additional[idTxID]; txID != noTxID {
+		payload.TxID = txID
+	}
+	if amount := fields[idTransactionAmount]; amount != "" {
+		payload.Amount, err = strconv.ParseFloat(amount, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: amount %q", ErrInvalidCode, amount)
+		}
+	}
+	return payload, nil
+}
+
+// CRC16 is the CRC-16/CCITT-FALSE checksum (polynomial 0x1021, initial value 0xFFFF) of
+// data, as four uppercase hex digits
+func CRC16(data string) string {
+	crc := uint16(0xFFFF)
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%04X", crc)
+}
+
+func field(id, value string) string {
+	return fmt.Sprintf("%s%02d%s", id, len(value), value)
+}
+
+// fields splits a run of EMV fields by ID
+func fields(data string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w: truncated field", ErrInvalidCode)
+		}
+		length, err := strconv.Atoi(data[2:4])
+		if err != nil || len(data) < 4+length {
+			return nil, fmt.Errorf("%w: bad length of field %s", ErrInvalidCode, data[:2])
+		}
+		parsed[data[:2]] = data[4 : 4+length]
+		data = data[4+length:]
+	}
+	return parsed, nil
+}
+
+func subfields(parent map[string]string, id string) (map[string]string, error) {
+	value, ok := parent[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing field %s", ErrInvalidCode, id)
+	}
+	return fields(value)
+}
+
+// ascii drops accents and any character banks may not accept
+func ascii(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if r < unicode.MaxASCII && unicode.IsPrint(r) {
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return strings.TrimSpace(s[:max])
+	}
+	return s
+}
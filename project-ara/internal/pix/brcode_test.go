@@ -0,0 +1,103 @@
+package pix
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The static code of the Banco Central's manual
+const manualExample = "00020126580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-4266554400005204000053039865802BR5913Fulano de Tal6008BRASILIA62070503***63041D3D"
+
+func TestEncodeStaticCodeMatchesTheManual(t *testing.T) {
+	code, err := Payload{
+		Key:          "123e4567-e12b-12d1-a456-426655440000",
+		MerchantName: "Fulano de Tal",
+		MerchantCity: "BRASILIA",
+	}.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, manualExample, code)
+	assert.Equal(t, "1D3D", CRC16(manualExample[:len(manualExample)-4]))
+}
+
+func TestEncodeAndParse(t *testing.T) {
+	static := Payload{
+		Key:          "+5511999990000",
+		MerchantName: "Padaria São João da Esquina Grande",
+		MerchantCity: "São José dos Campos",
+		Amount:       9.9,
+		TxID:         "ARA123",
+		Description:  "Assinatura Ara",
+	}
+	code, err := static.Encode()
+	require.NoError(t, err)
+	assert.Contains(t, code, "54049.90")
+	assert.Contains(t, code, "5925Padaria Sao Joao da Esqui")
+	assert.Contains(t, code, "6015Sao Jose dos Ca")
+
+	parsed, err := Parse(code)
+	require.NoError(t, err)
+	assert.Equal(t, &Payload{
+		Key:          "+5511999990000",
+		MerchantName: "Padaria Sao Joao da Esqui",
+		MerchantCity: "Sao Jose dos Ca",
+		Amount:       9.9,
+		TxID:         "ARA123",
+		Description:  "Assinatura Ara",
+	}, parsed)
+
+	dynamic, err := Payload{
+		URL:          "https://pix.example.com/qr/v2/9d36b84fc70b478fb95c12729b90ca25",
+		MerchantName: "Ara",
+		MerchantCity: "SAO PAULO",
+		Amount:       9.9,
+		TxID:         "ignored",
+	}.Encode()
+	require.NoError(t, err)
+	parsed, err = Parse(dynamic)
+	require.NoError(t, err)
+	assert.True(t, parsed.Dynamic())
+	assert.True(t, parsed.OneTime)
+	assert.Equal(t, "pix.example.com/qr/v2/9d36b84fc70b478fb95c12729b90ca25", parsed.URL)
+	assert.Empty(t, parsed.TxID)
+}
+
+func TestEncodeRejectsInvalidPayloads(t *testing.T) {
+	for name, payload := range map[string]Payload{
+		"no key or url":   {MerchantName: "Ara", MerchantCity: "SAO PAULO"},
+		"key and url":     {Key: "a@b.com", URL: "pix.example.com/1", MerchantName: "Ara", MerchantCity: "SAO PAULO"},
+		"no name":         {Key: "a@b.com", MerchantCity: "SAO PAULO"},
+		"bad txid":        {Key: "a@b.com", MerchantName: "Ara", MerchantCity: "SAO PAULO", TxID: "with spaces"},
+		"negative amount": {Key: "a@b.com", MerchantName: "Ara", MerchantCity: "SAO PAULO", Amount: -1},
+	} {
+		_, err := payload.Encode()
+		assert.ErrorIs(t, err, ErrInvalidCode, name)
+	}
+}
+
+func TestParseRejectsCorruptCodes(t *testing.T) {
+	for name, code := range map[string]string{
+		"wrong crc":     manualExample[:len(manualExample)-4] + "0000",
+		"changed field": "00020126580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-4266554400005204000053039865802BR5913Fulano de Tau6008BRASILIA62070503***63041D3D",
+		"no crc":        manualExample[:len(manualExample)-8],
+		"empty":         "",
+	} {
+		_, err := Parse(code)
+		assert.ErrorIs(t, err, ErrInvalidCode, name)
+	}
+
+	// Lowercase CRCs are accepted
+	_, err := Parse(manualExample[:len(manualExample)-4] + "1d3d")
+	assert.NoError(t, err)
+}
+
+func TestQRCodePNG(t *testing.T) {
+	data, err := QRCodePNG(manualExample, 256)
+	require.NoError(t, err)
+	image, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 256, image.Bounds().Dx())
+}
@@ -0,0 +1,21 @@
+package pix
+
+import (
+	"fmt"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// DefaultQRCodeSize is the side, in pixels, of QR codes sent on chat apps: large enough
+// to scan from another phone's screen
+const DefaultQRCodeSize = 512
+
+// QRCodePNG renders a "copia e cola" code as a PNG QR code of size x size pixels
+func QRCodePNG(code string, size int) ([]byte, error) {
+	// Medium recovery is what banks print; higher levels make dense codes harder to scan
+	png, err := qrcode.Encode(code, qrcode.Medium, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render pix qr code: %w", err)
+	}
+	return png, nil
+}
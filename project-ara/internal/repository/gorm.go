@@ -0,0 +1,919 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"project-ara/internal/models"
+)
+
+// NewGorm returns repositories backed by the application database
+func NewGorm(db *gorm.DB) *Repositories {
+	return &Repositories{
+		Users:         &GormUserRepository{db: db},
+		Transactions:  &GormTransactionRepository{db: db},
+		Subscriptions: &GormSubscriptionRepository{db: db},
+		Analytics:     &GormAnalyticsRepository{db: db},
+	}
+}
+
+type GormUserRepository struct {
+	db *gorm.DB
+}
+
+func (r *GormUserRepository) Create(user *models.User) error {
+	if err := r.db.Create(user).Error; err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
+}
+
+func (r *GormUserRepository) GetByID(id uuid.UUID) (*models.User, error) {
+	return r.getBy("id = ?", id)
+}
+
+func (r *GormUserRepository) GetByPhoneNumber(phoneNumber string) (*models.User, error) {
+	return r.getBy("phone_number = ?", phoneNumber)
+}
+
+func (r *GormUserRepository) GetByTelegramChatID(chatID string) (*models.User, error) {
+	return r.getBy("telegram_chat_id = ?", chatID)
+}
+
+func (r *GormUserRepository) getBy(query string, arg interface{}) (*models.User, error) {
+	var user models.User
+	if err := r.db.Where(query, arg).First(&user).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (r *GormUserRepository) IncrementTrialTransactions(id uuid.UUID) error {
+	return r.db.Model(&models.User{}).
+		Where("id = ?", id).
+		UpdateColumn("trial_transactions_count", gorm.Expr("trial_transactions_count + 1")).
+		Error
+}
+
+func (r *GormUserRepository) RecordInbound(phoneNumber string, at time.Time) error {
+	return r.db.Model(&models.User{}).
+		Where("phone_number = ? AND (last_inbound_at IS NULL OR last_inbound_at < ?)", phoneNumber, at).
+		Update("last_inbound_at", at).
+		Error
+}
+
+func (r *GormUserRepository) SetReferralCode(id uuid.UUID, code string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var taken int64
+		if err := tx.Model(&models.User{}).Where("referral_code = ? AND id <> ?", code, id).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrConflict
+		}
+		return tx.Model(&models.User{}).Where("id = ?", id).Update("referral_code", code).Error
+	})
+}
+
+func (r *GormUserRepository) GetByReferralCode(code string) (*models.User, error) {
+	return r.getBy("referral_code = ?", code)
+}
+
+func (r *GormUserRepository) AddBonusTransactions(id uuid.UUID, count int) error {
+	return r.db.Model(&models.User{}).
+		Where("id = ?", id).
+		UpdateColumn("bonus_transactions", gorm.Expr("bonus_transactions + ?", count)).
+		Error
+}
+
+func (r *GormUserRepository) SetConversionVariant(id uuid.UUID, variant string) error {
+	return r.db.Model(&models.User{}).Where("id = ?", id).Update("conversion_variant", variant).Error
+}
+
+func (r *GormUserRepository) SetMEIActivity(id uuid.UUID, activity string) error {
+	return r.db.Model(&models.User{}).Where("id = ?", id).Update("mei_activity", activity).Error
+}
+
+func (r *GormUserRepository) ListBySubscriptionStatus(statuses []string, afterID uuid.UUID, limit int) ([]models.User, error) {
+	var users []models.User
+	err := r.db.Where("subscription_status IN ? AND id > ?", statuses, afterID).
+		Order("id").Limit(limit).Find(&users).Error
+	return users, err
+}
+
+type GormTransactionRepository struct {
+	db *gorm.DB
+}
+
+func (r *GormTransactionRepository) Create(transaction *models.Transaction) error {
+	if err := r.db.Create(transaction).Error; err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *GormTransactionRepository) GetByID(id uuid.UUID) (*models.Transaction, error) {
+	var transaction models.Transaction
+	if err := r.db.Where("id = ?", id).First(&transaction).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &transaction, nil
+}
+
+func (r *GormTransactionRepository) Correct(id uuid.UUID, amount float64, description string, correctionData json.RawMessage, at time.Time) error {
+	result := r.db.Model(&models.Transaction{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"amount":          amount,
+		"description":     description,
+		"corrected_at":    at,
+		"correction_data": []byte(correctionData),
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to correct transaction: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormTransactionRepository) LinkAttachment(attachmentID, transactionID uuid.UUID) error {
+	return r.db.Model(&models.Attachment{}).
+		Where("id = ?", attachmentID).
+		Update("transaction_id", transactionID).
+		Error
+}
+
+func (r *GormTransactionRepository) ListByUser(userID uuid.UUID, limit int) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	if err := r.db.Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func (r *GormTransactionRepository) ListBetween(userID uuid.UUID, from, to time.Time) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	if err := r.db.Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, to).
+		Order("created_at DESC").
+		Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func (r *GormTransactionRepository) FindLatestByMediaSHA256(userID uuid.UUID, mediaSHA256 string) (*models.Transaction, error) {
+	return r.findLatest("user_id = ? AND media_sha256 = ?", userID, mediaSHA256)
+}
+
+func (r *GormTransactionRepository) FindLatestByExternalRef(userID uuid.UUID, externalRef string) (*models.Transaction, error) {
+	return r.findLatest("user_id = ? AND external_ref = ?", userID, externalRef)
+}
+
+func (r *GormTransactionRepository) findLatest(query string, args ...interface{}) (*models.Transaction, error) {
+	var transactions []models.Transaction
+	if err := r.db.Where(query, args...).Order("created_at DESC").Limit(1).Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+	if len(transactions) == 0 {
+		return nil, nil
+	}
+	return &transactions[0], nil
+}
+
+func (r *GormTransactionRepository) Balance(userID uuid.UUID) (float64, error) {
+	var result struct {
+		Balance float64
+	}
+
+	query := `
+		SELECT
+			COALESCE(SUM(CASE WHEN transaction_type = 'income' THEN amount ELSE 0 END), 0) -
+			COALESCE(SUM(CASE WHEN transaction_type = 'expense' THEN amount ELSE 0 END), 0) as balance
+		FROM transactions
+		WHERE user_id = ?
+	`
+
+	if err := r.db.Raw(query, userID).Scan(&result).Error; err != nil {
+		return 0, err
+	}
+	return result.Balance, nil
+}
+
+func (r *GormTransactionRepository) TopCategories(userID uuid.UUID, since time.Time, limit int) ([]CategorySummary, error) {
+	var results []CategorySummary
+	query := `
+		SELECT
+			description,
+			transaction_type,
+			COUNT(*) as count,
+			SUM(amount) as total_amount
+		FROM transactions
+		WHERE user_id = ? AND created_at >= ?
+		GROUP BY description, transaction_type
+		ORDER BY total_amount DESC
+		LIMIT ?
+	`
+
+	if err := r.db.Raw(query, userID, since, limit).Scan(&results).Error; err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (r *GormTransactionRepository) FrequentDescriptions(userID uuid.UUID, since time.Time, limit int) ([]string, error) {
+	var descriptions []string
+	query := `
+		SELECT description
+		FROM transactions
+		WHERE user_id = ? AND created_at >= ? AND description <> ''
+		GROUP BY description
+		ORDER BY COUNT(*) DESC
+		LIMIT ?
+	`
+
+	if err := r.db.Raw(query, userID, since, limit).Scan(&descriptions).Error; err != nil {
+		return nil, err
+	}
+	return descriptions, nil
+}
+
+func (r *GormTransactionRepository) ReplacePending(pending *models.PendingTransaction) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", pending.UserID).Delete(&models.PendingTransaction{}).Error; err != nil {
+			return fmt.Errorf("failed to clear pending transactions: %w", err)
+		}
+		if err := tx.Create(pending).Error; err != nil {
+			return fmt.Errorf("failed to save pending transaction: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *GormTransactionRepository) GetPending(userID uuid.UUID, now time.Time) (*models.PendingTransaction, error) {
+	var pending []models.PendingTransaction
+	if err := r.db.Where("user_id = ? AND expires_at > ?", userID, now).
+		Order("created_at DESC").
+		Limit(1).
+		Find(&pending).Error; err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	return &pending[0], nil
+}
+
+func (r *GormTransactionRepository) DeletePending(userID uuid.UUID) error {
+	return r.db.Where("user_id = ?", userID).Delete(&models.PendingTransaction{}).Error
+}
+
+type GormSubscriptionRepository struct {
+	db *gorm.DB
+}
+
+func (r *GormSubscriptionRepository) Atomically(fn func(SubscriptionRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&GormSubscriptionRepository{db: tx})
+	})
+}
+
+func (r *GormSubscriptionRepository) Create(subscription *models.Subscription, reason string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Select("subscription_status").First(&user, "id = ?", subscription.UserID).Error; err != nil {
+			return notFound(err)
+		}
+		if err := tx.Create(subscription).Error; err != nil {
+			return err
+		}
+		if subscription.Status != models.SubscriptionStatusPending {
+			if err := mirrorOnUser(tx, subscription.UserID, map[string]interface{}{
+				"subscription_status":     subscription.Status,
+				"subscription_expires_at": subscription.CurrentPeriodEnd,
+			}); err != nil {
+				return err
+			}
+		}
+		return recordEvent(tx, models.SubscriptionEvent{
+			UserID:         subscription.UserID,
+			SubscriptionID: &subscription.ID,
+			Type:           models.SubscriptionEventStatusChanged,
+			FromStatus:     user.SubscriptionStatus,
+			ToStatus:       subscription.Status,
+			Amount:         &subscription.Price,
+			PeriodEnd:      &subscription.CurrentPeriodEnd,
+			Reason:         reason,
+		})
+	})
+}
+
+func (r *GormSubscriptionRepository) GetByID(id uuid.UUID) (*models.Subscription, error) {
+	var subscription models.Subscription
+	if err := r.db.First(&subscription, "id = ?", id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &subscription, nil
+}
+
+func (r *GormSubscriptionRepository) GetCurrent(userID uuid.UUID) (*models.Subscription, error) {
+	running, err := r.first(r.db.Where("user_id = ? AND status IN ?", userID, []string{models.SubscriptionStatusActive, models.SubscriptionStatusGracePeriod}).Order("created_at DESC"))
+	if running != nil || err != nil {
+		return running, err
+	}
+	return r.first(r.db.Where("user_id = ? AND status <> ?", userID, models.SubscriptionStatusPending).Order("created_at DESC"))
+}
+
+func (r *GormSubscriptionRepository) GetPending(userID uuid.UUID) (*models.Subscription, error) {
+	return r.first(r.db.Where("user_id = ? AND status = ?", userID, models.SubscriptionStatusPending).Order("created_at DESC"))
+}
+
+func (r *GormSubscriptionRepository) GetByGatewaySubscriptionID(gateway, gatewaySubscriptionID string) (*models.Subscription, error) {
+	return r.first(r.db.Where("gateway = ? AND gateway_subscription_id = ?", gateway, gatewaySubscriptionID))
+}
+
+func (r *GormSubscriptionRepository) SaveGatewayDetails(subscription *models.Subscription) error {
+	result := r.db.Model(&models.Subscription{}).Where("id = ?", subscription.ID).Updates(map[string]interface{}{
+		"payment_method":          subscription.PaymentMethod,
+		"gateway":                 subscription.Gateway,
+		"gateway_customer_id":     subscription.GatewayCustomerID,
+		"gateway_subscription_id": subscription.GatewaySubscriptionID,
+		"checkout_url":            subscription.CheckoutURL,
+		"pix_code":                subscription.PixCode,
+		"pix_expires_at":          subscription.PixExpiresAt,
+		"updated_at":              time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// first returns the first subscription the query finds, or nil
+func (r *GormSubscriptionRepository) first(query *gorm.DB) (*models.Subscription, error) {
+	var subscriptions []models.Subscription
+	if err := query.Limit(1).Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	if len(subscriptions) == 0 {
+		return nil, nil
+	}
+	return &subscriptions[0], nil
+}
+
+func (r *GormSubscriptionRepository) Transition(subscriptionID uuid.UUID, from, to, reason string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		updates := map[string]interface{}{"status": to, "updated_at": now}
+		if to == models.SubscriptionStatusCancelled {
+			updates["cancelled_at"] = now
+		}
+		result := tx.Model(&models.Subscription{}).Where("id = ? AND status = ?", subscriptionID, from).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		var subscription models.Subscription
+		if err := tx.First(&subscription, "id = ?", subscriptionID).Error; err != nil {
+			return notFound(err)
+		}
+		if result.RowsAffected == 0 {
+			return ErrConflict
+		}
+
+		if mirrorsTransition(from, to) {
+			columns := map[string]interface{}{"subscription_status": to}
+			if from == models.SubscriptionStatusPending {
+				columns["subscription_expires_at"] = subscription.CurrentPeriodEnd
+			}
+			if err := mirrorOnUser(tx, subscription.UserID, columns); err != nil {
+				return err
+			}
+		}
+		return recordEvent(tx, models.SubscriptionEvent{
+			UserID:         subscription.UserID,
+			SubscriptionID: &subscription.ID,
+			Type:           models.SubscriptionEventStatusChanged,
+			FromStatus:     from,
+			ToStatus:       to,
+			Reason:         reason,
+		})
+	})
+}
+
+func (r *GormSubscriptionRepository) ExtendPeriod(subscriptionID uuid.UUID, start, end time.Time, reason string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var subscription models.Subscription
+		if err := tx.First(&subscription, "id = ?", subscriptionID).Error; err != nil {
+			return notFound(err)
+		}
+		if err := tx.Model(&subscription).Updates(map[string]interface{}{
+			"current_period_start": start,
+			"current_period_end":   end,
+			"updated_at":           time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		if subscription.Status != models.SubscriptionStatusPending {
+			if err := mirrorOnUser(tx, subscription.UserID, map[string]interface{}{"subscription_expires_at": end}); err != nil {
+				return err
+			}
+		}
+		return recordEvent(tx, models.SubscriptionEvent{
+			UserID:         subscription.UserID,
+			SubscriptionID: &subscription.ID,
+			Type:           models.SubscriptionEventPeriodChanged,
+			PeriodEnd:      &end,
+			Reason:         reason,
+		})
+	})
+}
+
+func (r *GormSubscriptionRepository) ListLapsed(status string, endedBefore time.Time, limit int) ([]models.Subscription, error) {
+	var subscriptions []models.Subscription
+	err := r.db.Preload("User").
+		Where("status = ? AND current_period_end < ?", status, endedBefore).
+		Order("current_period_end").
+		Limit(limit).
+		Find(&subscriptions).Error
+	return subscriptions, err
+}
+
+func (r *GormSubscriptionRepository) SavePayment(payment *models.Payment, reason string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var existing []models.Payment
+		if err := tx.Where("gateway = ? AND gateway_payment_id = ?", payment.Gateway, payment.GatewayPaymentID).
+			Limit(1).Find(&existing).Error; err != nil {
+			return err
+		}
+
+		fromStatus := ""
+		if len(existing) == 0 {
+			if err := tx.Create(payment).Error; err != nil {
+				return err
+			}
+		} else {
+			fromStatus = string(existing[0].Status)
+			payment.ID = existing[0].ID
+			payment.CreatedAt = existing[0].CreatedAt
+			if err := tx.Model(&models.Payment{}).Where("id = ?", payment.ID).Updates(map[string]interface{}{
+				"subscription_id": payment.SubscriptionID,
+				"amount":          payment.Amount,
+				"status":          payment.Status,
+				"method":          payment.Method,
+				"period_start":    payment.PeriodStart,
+				"period_end":      payment.PeriodEnd,
+				"paid_at":         payment.PaidAt,
+				"failure_reason":  payment.FailureReason,
+				"updated_at":      time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		return recordEvent(tx, models.SubscriptionEvent{
+			UserID:         payment.UserID,
+			SubscriptionID: payment.SubscriptionID,
+			PaymentID:      &payment.ID,
+			Type:           models.SubscriptionEventPayment,
+			FromStatus:     fromStatus,
+			ToStatus:       string(payment.Status),
+			Amount:         &payment.Amount,
+			PeriodEnd:      payment.PeriodEnd,
+			Reason:         reason,
+		})
+	})
+}
+
+func (r *GormSubscriptionRepository) GetPaymentByGatewayID(gateway, gatewayPaymentID string) (*models.Payment, error) {
+	var payments []models.Payment
+	if err := r.db.Where("gateway = ? AND gateway_payment_id = ?", gateway, gatewayPaymentID).Limit(1).Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	if len(payments) == 0 {
+		return nil, nil
+	}
+	return &payments[0], nil
+}
+
+func (r *GormSubscriptionRepository) ListPayments(userID uuid.UUID) ([]models.Payment, error) {
+	var payments []models.Payment
+	err := r.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&payments).Error
+	return payments, err
+}
+
+func (r *GormSubscriptionRepository) Events(userID uuid.UUID) ([]models.SubscriptionEvent, error) {
+	var events []models.SubscriptionEvent
+	err := r.db.Where("user_id = ?", userID).Order("created_at, id").Find(&events).Error
+	return events, err
+}
+
+func (r *GormSubscriptionRepository) ClaimWebhookEvent(event *models.PaymentWebhookEvent, claimedUntil time.Time) (bool, error) {
+	claimed := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		event.Attempts = 1
+		event.ClaimedUntil = &claimedUntil
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			claimed = true
+			return nil
+		}
+
+		// A redelivery. The claim is a conditional update, so of two deliveries racing for
+		// an unprocessed event only one gets it.
+		now := time.Now()
+		query := tx.Model(&models.PaymentWebhookEvent{}).Where("gateway = ? AND event_id = ?", event.Gateway, event.EventID)
+		if err := query.Updates(map[string]interface{}{
+			"attempts":   gorm.Expr("attempts + 1"),
+			"updated_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		result = tx.Model(&models.PaymentWebhookEvent{}).
+			Where("gateway = ? AND event_id = ? AND processed_at IS NULL", event.Gateway, event.EventID).
+			Where("claimed_until IS NULL OR claimed_until < ?", now).
+			Update("claimed_until", claimedUntil)
+		if result.Error != nil {
+			return result.Error
+		}
+		claimed = result.RowsAffected == 1
+
+		var stored models.PaymentWebhookEvent
+		if err := tx.Where("gateway = ? AND event_id = ?", event.Gateway, event.EventID).First(&stored).Error; err != nil {
+			return err
+		}
+		*event = stored
+		return nil
+	})
+	return claimed, err
+}
+
+func (r *GormSubscriptionRepository) FinishWebhookEvent(id uuid.UUID, processErr error) error {
+	now := time.Now()
+	updates := map[string]interface{}{"processed_at": &now, "last_error": "", "claimed_until": nil, "updated_at": now}
+	if processErr != nil {
+		updates = map[string]interface{}{"last_error": processErr.Error(), "claimed_until": nil, "updated_at": now}
+	}
+	result := r.db.Model(&models.PaymentWebhookEvent{}).Where("id = ?", id).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormSubscriptionRepository) OpenDunningCase(dunningCase *models.DunningCase) (bool, error) {
+	opened := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		dunningCase.Status = models.DunningStatusOpen
+		dunningCase.Failures = 1
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(dunningCase)
+		if result.Error != nil || result.RowsAffected == 1 {
+			opened = result.Error == nil
+			return result.Error
+		}
+
+		// Another failure of a subscription already in dunning
+		now := time.Now()
+		query := tx.Model(&models.DunningCase{}).Where("subscription_id = ? AND status = ?", dunningCase.SubscriptionID, models.DunningStatusOpen)
+		if err := query.Updates(map[string]interface{}{
+			"failures":       gorm.Expr("failures + 1"),
+			"failure_reason": dunningCase.FailureReason,
+			"next_notice_at": now,
+			"updated_at":     now,
+		}).Error; err != nil {
+			return err
+		}
+		var open models.DunningCase
+		if err := tx.Where("subscription_id = ? AND status = ?", dunningCase.SubscriptionID, models.DunningStatusOpen).First(&open).Error; err != nil {
+			return err
+		}
+		*dunningCase = open
+		return nil
+	})
+	return opened, err
+}
+
+func (r *GormSubscriptionRepository) GetOpenDunningCase(subscriptionID uuid.UUID) (*models.DunningCase, error) {
+	var cases []models.DunningCase
+	if err := r.db.Where("subscription_id = ? AND status = ?", subscriptionID, models.DunningStatusOpen).Limit(1).Find(&cases).Error; err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, nil
+	}
+	return &cases[0], nil
+}
+
+func (r *GormSubscriptionRepository) ListDueDunningCases(now time.Time, limit int) ([]models.DunningCase, error) {
+	var cases []models.DunningCase
+	err := r.db.Preload("User").
+		Where("status = ? AND next_notice_at <= ?", models.DunningStatusOpen, now).
+		Order("next_notice_at").
+		Limit(limit).
+		Find(&cases).Error
+	return cases, err
+}
+
+func (r *GormSubscriptionRepository) RecordDunningNotice(id uuid.UUID, nextNoticeAt *time.Time) error {
+	result := r.db.Model(&models.DunningCase{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"notices_sent":   gorm.Expr("notices_sent + 1"),
+		"next_notice_at": nextNoticeAt,
+		"updated_at":     time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormSubscriptionRepository) ResolveDunningCase(subscriptionID uuid.UUID, status string) (*models.DunningCase, error) {
+	var resolved *models.DunningCase
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var cases []models.DunningCase
+		if err := tx.Where("subscription_id = ? AND status = ?", subscriptionID, models.DunningStatusOpen).Limit(1).Find(&cases).Error; err != nil {
+			return err
+		}
+		if len(cases) == 0 {
+			return nil
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.DunningCase{}).Where("id = ? AND status = ?", cases[0].ID, models.DunningStatusOpen).Updates(map[string]interface{}{
+			"status":         status,
+			"next_notice_at": nil,
+			"resolved_at":    now,
+			"updated_at":     now,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			// Resolved meanwhile
+			return result.Error
+		}
+		resolved = &cases[0]
+		resolved.Status = status
+		resolved.NextNoticeAt = nil
+		resolved.ResolvedAt = &now
+		return nil
+	})
+	return resolved, err
+}
+
+func (r *GormSubscriptionRepository) DunningStats(since time.Time) (*DunningStats, error) {
+	var counts []struct {
+		Status string
+		Count  int
+	}
+	if err := r.db.Model(&models.DunningCase{}).Select("status, count(*) AS count").
+		Where("created_at >= ?", since).Group("status").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+
+	byStatus := make(map[string]int, len(counts))
+	for _, count := range counts {
+		byStatus[count.Status] = count.Count
+	}
+	return newDunningStats(byStatus), nil
+}
+
+func (r *GormSubscriptionRepository) CreateReferral(referral *models.Referral) error {
+	result := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(referral)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (r *GormSubscriptionRepository) GetReferral(referredID uuid.UUID) (*models.Referral, error) {
+	var referrals []models.Referral
+	if err := r.db.Where("referred_id = ? AND status <> ?", referredID, models.ReferralStatusRejected).Limit(1).Find(&referrals).Error; err != nil {
+		return nil, err
+	}
+	if len(referrals) == 0 {
+		return nil, nil
+	}
+	return &referrals[0], nil
+}
+
+func (r *GormSubscriptionRepository) CountReferrals(referrerID uuid.UUID, since time.Time) (int, error) {
+	var count int64
+	err := r.db.Model(&models.Referral{}).
+		Where("referrer_id = ? AND created_at >= ? AND status <> ?", referrerID, since, models.ReferralStatusRejected).
+		Count(&count).Error
+	return int(count), err
+}
+
+func (r *GormSubscriptionRepository) DeviceReferred(deviceID string) (bool, error) {
+	var count int64
+	err := r.db.Model(&models.Referral{}).
+		Where("device_id = ? AND status <> ?", deviceID, models.ReferralStatusRejected).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (r *GormSubscriptionRepository) RewardReferral(id uuid.UUID) error {
+	now := time.Now()
+	result := r.db.Model(&models.Referral{}).Where("id = ? AND status = ?", id, models.ReferralStatusPending).Updates(map[string]interface{}{
+		"status":      models.ReferralStatusRewarded,
+		"rewarded_at": now,
+		"updated_at":  now,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (r *GormSubscriptionRepository) ReferralStats(since time.Time) (*ReferralStats, error) {
+	var counts []referralCount
+	if err := r.db.Model(&models.Referral{}).Select("status, reject_reason, count(*) AS count").
+		Where("created_at >= ?", since).Group("status, reject_reason").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	return newReferralStats(counts), nil
+}
+
+func (r *GormSubscriptionRepository) CreateCoupon(coupon *models.Coupon) error {
+	result := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(coupon)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (r *GormSubscriptionRepository) GetCoupon(code string) (*models.Coupon, error) {
+	var coupon models.Coupon
+	if err := r.db.First(&coupon, "code = ?", code).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &coupon, nil
+}
+
+func (r *GormSubscriptionRepository) ListCoupons() ([]models.Coupon, error) {
+	var coupons []models.Coupon
+	err := r.db.Order("created_at DESC").Find(&coupons).Error
+	return coupons, err
+}
+
+func (r *GormSubscriptionRepository) DeactivateCoupon(code string) error {
+	result := r.db.Model(&models.Coupon{}).Where("code = ?", code).Updates(map[string]interface{}{
+		"active":     false,
+		"updated_at": time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormSubscriptionRepository) RedeemCoupon(redemption *models.CouponRedemption) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(redemption)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrConflict
+		}
+		result = tx.Model(&models.Coupon{}).Where("id = ?", redemption.CouponID).Updates(map[string]interface{}{
+			"uses":       gorm.Expr("uses + 1"),
+			"updated_at": time.Now(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (r *GormSubscriptionRepository) CouponRedeemed(couponID, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := r.db.Model(&models.CouponRedemption{}).Where("coupon_id = ? AND user_id = ?", couponID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+type GormAnalyticsRepository struct {
+	db *gorm.DB
+}
+
+func (r *GormAnalyticsRepository) Record(event *models.AnalyticsEvent) error {
+	// The once key's unique index drops repeats
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(event).Error
+}
+
+func (r *GormAnalyticsRepository) CohortActivity(from, to time.Time, nth int) ([]UserActivity, error) {
+	var users []models.User
+	if err := r.db.Select("id, created_at").Where("created_at >= ? AND created_at < ?", from, to).
+		Order("created_at").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	cohort := r.db.Model(&models.User{}).Select("id").Where("created_at >= ? AND created_at < ?", from, to)
+
+	var events []models.AnalyticsEvent
+	if err := r.db.Select("user_id, name, created_at").Where("user_id IN (?)", cohort).
+		Order("created_at").Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		UserID uuid.UUID
+		Count  int
+	}
+	if err := r.db.Model(&models.Transaction{}).Select("user_id, count(*) AS count").
+		Where("user_id IN (?)", cohort).Group("user_id").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	byUser := make(map[uuid.UUID]int, len(counts))
+	for _, count := range counts {
+		byUser[count.UserID] = count.Count
+	}
+
+	var nths []struct {
+		UserID    uuid.UUID
+		CreatedAt time.Time
+	}
+	if err := r.db.Raw(`SELECT user_id, created_at FROM (
+			SELECT user_id, created_at, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_at) AS n
+			FROM transactions WHERE user_id IN (?)
+		) ranked WHERE n = ?`, cohort, nth).Scan(&nths).Error; err != nil {
+		return nil, err
+	}
+	nthAt := make(map[uuid.UUID]time.Time, len(nths))
+	for _, transaction := range nths {
+		nthAt[transaction.UserID] = transaction.CreatedAt
+	}
+
+	return newUserActivity(users, events, byUser, nthAt), nil
+}
+
+func (r *GormAnalyticsRepository) TransactionActivity(from, to time.Time) (*TransactionActivity, error) {
+	var activity TransactionActivity
+	if err := r.db.Model(&models.Transaction{}).Select("count(*) AS transactions, count(DISTINCT user_id) AS users").
+		Where("created_at >= ? AND created_at < ?", from, to).Scan(&activity).Error; err != nil {
+		return nil, err
+	}
+	return &activity, nil
+}
+
+// recordEvent appends to the billing history. The timestamp is set here rather than by the
+// database, whose clock resolution may not keep events of one request in order.
+func recordEvent(tx *gorm.DB, event models.SubscriptionEvent) error {
+	event.CreatedAt = time.Now()
+	return tx.Create(&event).Error
+}
+
+// mirrorOnUser copies subscription state onto the user row
+func mirrorOnUser(tx *gorm.DB, userID uuid.UUID, columns map[string]interface{}) error {
+	result := tx.Model(&models.User{}).Where("id = ?", userID).Updates(columns)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// notFound maps GORM's missing-record error to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,1240 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"project-ara/internal/models"
+)
+
+// NewMemory returns repositories that keep everything in process memory, for tests
+// and local experiments. Records are copied in and out so callers can't mutate them.
+func NewMemory() *Repositories {
+	store := &memoryStore{
+		users:       make(map[uuid.UUID]models.User),
+		pending:     make(map[uuid.UUID]models.PendingTransaction),
+		attachments: make(map[uuid.UUID]uuid.UUID),
+	}
+	return &Repositories{
+		Users:         &MemoryUserRepository{store},
+		Transactions:  &MemoryTransactionRepository{store},
+		Subscriptions: &MemorySubscriptionRepository{store},
+		Analytics:     &MemoryAnalyticsRepository{store},
+	}
+}
+
+// memoryStore is shared by the repositories so they see each other's writes
+type memoryStore struct {
+	mu            sync.Mutex
+	users         map[uuid.UUID]models.User
+	transactions  []models.Transaction
+	pending       map[uuid.UUID]models.PendingTransaction // By user
+	attachments   map[uuid.UUID]uuid.UUID                 // Attachment → transaction
+	subscriptions []models.Subscription
+	payments      []models.Payment
+	events        []models.SubscriptionEvent
+	webhookEvents []models.PaymentWebhookEvent
+	dunningCases  []models.DunningCase
+	referrals     []models.Referral
+	coupons       []models.Coupon
+	redemptions   []models.CouponRedemption
+	analytics     []models.AnalyticsEvent
+}
+
+type MemoryUserRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryUserRepository) Create(user *models.User) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user.ID == uuid.Nil {
+		user.ID = uuid.New()
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	if user.SubscriptionStatus == "" {
+		user.SubscriptionStatus = models.SubscriptionStatusTrial
+	}
+	if user.Channel == "" {
+		user.Channel = "whatsapp"
+	}
+	// Mirror the unique indexes of the users table
+	for _, existing := range s.users {
+		if existing.ID == user.ID ||
+			user.PhoneNumber != "" && existing.PhoneNumber == user.PhoneNumber ||
+			user.TelegramChatID != "" && existing.TelegramChatID == user.TelegramChatID {
+			return fmt.Errorf("user already exists")
+		}
+	}
+
+	stored := *user
+	stored.Transactions = nil
+	s.users[user.ID] = stored
+	return nil
+}
+
+func (r *MemoryUserRepository) GetByID(id uuid.UUID) (*models.User, error) {
+	return r.find(func(u *models.User) bool { return u.ID == id })
+}
+
+func (r *MemoryUserRepository) GetByPhoneNumber(phoneNumber string) (*models.User, error) {
+	return r.find(func(u *models.User) bool { return u.PhoneNumber == phoneNumber })
+}
+
+func (r *MemoryUserRepository) GetByTelegramChatID(chatID string) (*models.User, error) {
+	return r.find(func(u *models.User) bool { return u.TelegramChatID == chatID })
+}
+
+func (r *MemoryUserRepository) find(match func(*models.User) bool) (*models.User, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if match(&user) {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryUserRepository) IncrementTrialTransactions(id uuid.UUID) error {
+	return r.store.updateUser(id, func(u *models.User) {
+		u.TrialTransactionsCount++
+	})
+}
+
+func (r *MemoryUserRepository) RecordInbound(phoneNumber string, at time.Time) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, user := range s.users {
+		if user.PhoneNumber != phoneNumber {
+			continue
+		}
+		if user.LastInboundAt == nil || user.LastInboundAt.Before(at) {
+			user.LastInboundAt = &at
+			s.users[id] = user
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) SetReferralCode(id uuid.UUID, code string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.ReferralCode == code && user.ID != id {
+			return ErrConflict
+		}
+	}
+	if user, ok := s.users[id]; ok {
+		user.ReferralCode = code
+		s.users[id] = user
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) GetByReferralCode(code string) (*models.User, error) {
+	return r.find(func(u *models.User) bool { return u.ReferralCode != "" && u.ReferralCode == code })
+}
+
+func (r *MemoryUserRepository) AddBonusTransactions(id uuid.UUID, count int) error {
+	return r.store.updateUser(id, func(u *models.User) {
+		u.BonusTransactions += count
+	})
+}
+
+func (r *MemoryUserRepository) SetConversionVariant(id uuid.UUID, variant string) error {
+	return r.store.updateUser(id, func(u *models.User) {
+		u.ConversionVariant = variant
+	})
+}
+
+func (r *MemoryUserRepository) SetMEIActivity(id uuid.UUID, activity string) error {
+	return r.store.updateUser(id, func(u *models.User) {
+		u.MEIActivity = activity
+	})
+}
+
+func (r *MemoryUserRepository) ListBySubscriptionStatus(statuses []string, afterID uuid.UUID, limit int) ([]models.User, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []models.User
+	for _, user := range s.users {
+		if slices.Contains(statuses, user.SubscriptionStatus) && user.ID.String() > afterID.String() {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID.String() < users[j].ID.String() })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// updateUser applies change to a stored user; a missing user is a no-op, like an UPDATE
+func (s *memoryStore) updateUser(id uuid.UUID, change func(*models.User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil
+	}
+	change(&user)
+	s.users[id] = user
+	return nil
+}
+
+type MemoryTransactionRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryTransactionRepository) Create(transaction *models.Transaction) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if transaction.ID == uuid.Nil {
+		transaction.ID = uuid.New()
+	}
+	if transaction.CreatedAt.IsZero() {
+		transaction.CreatedAt = time.Now()
+	}
+	for _, existing := range s.transactions {
+		if existing.ID == transaction.ID {
+			return fmt.Errorf("transaction already exists")
+		}
+	}
+
+	stored := *transaction
+	stored.User = models.User{}
+	s.transactions = append(s.transactions, stored)
+	return nil
+}
+
+func (r *MemoryTransactionRepository) GetByID(id uuid.UUID) (*models.Transaction, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, transaction := range s.transactions {
+		if transaction.ID == id {
+			return &transaction, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryTransactionRepository) Correct(id uuid.UUID, amount float64, description string, correctionData json.RawMessage, at time.Time) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.transactions {
+		if s.transactions[i].ID != id {
+			continue
+		}
+		data := append(json.RawMessage(nil), correctionData...)
+		s.transactions[i].Amount = amount
+		s.transactions[i].Description = description
+		s.transactions[i].CorrectedAt = &at
+		s.transactions[i].CorrectionData = &data
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (r *MemoryTransactionRepository) LinkAttachment(attachmentID, transactionID uuid.UUID) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attachments[attachmentID] = transactionID
+	return nil
+}
+
+// filter returns copies of the user's transactions that match, newest first
+func (r *MemoryTransactionRepository) filter(userID uuid.UUID, match func(*models.Transaction) bool) []models.Transaction {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []models.Transaction
+	for _, transaction := range s.transactions {
+		if transaction.UserID == userID && match(&transaction) {
+			result = append(result, transaction)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+func (r *MemoryTransactionRepository) ListByUser(userID uuid.UUID, limit int) ([]models.Transaction, error) {
+	transactions := r.filter(userID, func(*models.Transaction) bool { return true })
+	if limit > 0 && len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions, nil
+}
+
+func (r *MemoryTransactionRepository) ListBetween(userID uuid.UUID, from, to time.Time) ([]models.Transaction, error) {
+	return r.filter(userID, func(t *models.Transaction) bool {
+		return !t.CreatedAt.Before(from) && t.CreatedAt.Before(to)
+	}), nil
+}
+
+func (r *MemoryTransactionRepository) FindLatestByMediaSHA256(userID uuid.UUID, mediaSHA256 string) (*models.Transaction, error) {
+	return first(r.filter(userID, func(t *models.Transaction) bool { return t.MediaSHA256 == mediaSHA256 })), nil
+}
+
+func (r *MemoryTransactionRepository) FindLatestByExternalRef(userID uuid.UUID, externalRef string) (*models.Transaction, error) {
+	return first(r.filter(userID, func(t *models.Transaction) bool { return t.ExternalRef == externalRef })), nil
+}
+
+func first(transactions []models.Transaction) *models.Transaction {
+	if len(transactions) == 0 {
+		return nil
+	}
+	return &transactions[0]
+}
+
+func (r *MemoryTransactionRepository) Balance(userID uuid.UUID) (float64, error) {
+	balance := 0.0
+	for _, transaction := range r.filter(userID, func(*models.Transaction) bool { return true }) {
+		switch transaction.TransactionType {
+		case models.TransactionTypeIncome:
+			balance += transaction.Amount
+		case models.TransactionTypeExpense:
+			balance -= transaction.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (r *MemoryTransactionRepository) TopCategories(userID uuid.UUID, since time.Time, limit int) ([]CategorySummary, error) {
+	type key struct{ description, transactionType string }
+	totals := make(map[key]*CategorySummary)
+	var order []key
+	for _, transaction := range r.filter(userID, func(t *models.Transaction) bool { return !t.CreatedAt.Before(since) }) {
+		k := key{transaction.Description, string(transaction.TransactionType)}
+		if totals[k] == nil {
+			totals[k] = &CategorySummary{Description: k.description, TransactionType: k.transactionType}
+			order = append(order, k)
+		}
+		totals[k].Count++
+		totals[k].TotalAmount += transaction.Amount
+	}
+
+	results := make([]CategorySummary, 0, len(order))
+	for _, k := range order {
+		results = append(results, *totals[k])
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].TotalAmount > results[j].TotalAmount })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (r *MemoryTransactionRepository) FrequentDescriptions(userID uuid.UUID, since time.Time, limit int) ([]string, error) {
+	counts := make(map[string]int)
+	var descriptions []string
+	for _, transaction := range r.filter(userID, func(t *models.Transaction) bool {
+		return !t.CreatedAt.Before(since) && t.Description != ""
+	}) {
+		if counts[transaction.Description] == 0 {
+			descriptions = append(descriptions, transaction.Description)
+		}
+		counts[transaction.Description]++
+	}
+
+	sort.SliceStable(descriptions, func(i, j int) bool { return counts[descriptions[i]] > counts[descriptions[j]] })
+	if len(descriptions) > limit {
+		descriptions = descriptions[:limit]
+	}
+	return descriptions, nil
+}
+
+func (r *MemoryTransactionRepository) ReplacePending(pending *models.PendingTransaction) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pending.ID == uuid.Nil {
+		pending.ID = uuid.New()
+	}
+	if pending.CreatedAt.IsZero() {
+		pending.CreatedAt = time.Now()
+	}
+	s.pending[pending.UserID] = *pending
+	return nil
+}
+
+func (r *MemoryTransactionRepository) GetPending(userID uuid.UUID, now time.Time) (*models.PendingTransaction, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.pending[userID]
+	if !ok || !pending.ExpiresAt.After(now) {
+		return nil, nil
+	}
+	return &pending, nil
+}
+
+func (r *MemoryTransactionRepository) DeletePending(userID uuid.UUID) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, userID)
+	return nil
+}
+
+type MemorySubscriptionRepository struct {
+	store *memoryStore
+}
+
+// Atomically restores what the subscription repository and the users held before fn when
+// it fails. Changes other callers made meanwhile are rolled back with them, which is fine
+// for the tests and local runs the memory store is for.
+func (r *MemorySubscriptionRepository) Atomically(fn func(SubscriptionRepository) error) error {
+	s := r.store
+	s.mu.Lock()
+	users := make(map[uuid.UUID]models.User, len(s.users))
+	for id, user := range s.users {
+		users[id] = user
+	}
+	subscriptions := slices.Clone(s.subscriptions)
+	payments := slices.Clone(s.payments)
+	events := slices.Clone(s.events)
+	webhookEvents := slices.Clone(s.webhookEvents)
+	dunningCases := slices.Clone(s.dunningCases)
+	referrals := slices.Clone(s.referrals)
+	coupons := slices.Clone(s.coupons)
+	redemptions := slices.Clone(s.redemptions)
+	s.mu.Unlock()
+
+	err := fn(r)
+	if err != nil {
+		s.mu.Lock()
+		s.users = users
+		s.subscriptions = subscriptions
+		s.payments = payments
+		s.events = events
+		s.webhookEvents = webhookEvents
+		s.dunningCases = dunningCases
+		s.referrals = referrals
+		s.coupons = coupons
+		s.redemptions = redemptions
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (r *MemorySubscriptionRepository) Create(subscription *models.Subscription, reason string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[subscription.UserID]
+	if !ok {
+		return ErrNotFound
+	}
+	if subscription.ID == uuid.Nil {
+		subscription.ID = uuid.New()
+	}
+	now := time.Now()
+	if subscription.CreatedAt.IsZero() {
+		subscription.CreatedAt = now
+	}
+	subscription.UpdatedAt = now
+	if subscription.Currency == "" {
+		subscription.Currency = "BRL"
+	}
+	stored := *subscription
+	stored.User = models.User{}
+	s.subscriptions = append(s.subscriptions, stored)
+
+	from := user.SubscriptionStatus
+	periodEnd := subscription.CurrentPeriodEnd
+	if subscription.Status != models.SubscriptionStatusPending {
+		user.SubscriptionStatus = subscription.Status
+		user.SubscriptionExpiresAt = &periodEnd
+		s.users[user.ID] = user
+	}
+
+	price := subscription.Price
+	s.addEvent(models.SubscriptionEvent{
+		UserID:         subscription.UserID,
+		SubscriptionID: &stored.ID,
+		Type:           models.SubscriptionEventStatusChanged,
+		FromStatus:     from,
+		ToStatus:       subscription.Status,
+		Amount:         &price,
+		PeriodEnd:      &periodEnd,
+		Reason:         reason,
+	})
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) GetByID(id uuid.UUID) (*models.Subscription, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.subscriptionIndex(id); i >= 0 {
+		subscription := s.subscriptions[i]
+		return &subscription, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemorySubscriptionRepository) GetCurrent(userID uuid.UUID) (*models.Subscription, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := s.latestSubscription(userID, func(status string) bool {
+		return status == models.SubscriptionStatusActive || status == models.SubscriptionStatusGracePeriod
+	})
+	if running != nil {
+		return running, nil
+	}
+	return s.latestSubscription(userID, func(status string) bool { return status != models.SubscriptionStatusPending }), nil
+}
+
+func (r *MemorySubscriptionRepository) GetPending(userID uuid.UUID) (*models.Subscription, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.latestSubscription(userID, func(status string) bool { return status == models.SubscriptionStatusPending }), nil
+}
+
+func (r *MemorySubscriptionRepository) GetByGatewaySubscriptionID(gateway, gatewaySubscriptionID string) (*models.Subscription, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, subscription := range s.subscriptions {
+		if subscription.Gateway == gateway && subscription.GatewaySubscriptionID == gatewaySubscriptionID {
+			return &subscription, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemorySubscriptionRepository) SaveGatewayDetails(subscription *models.Subscription) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.subscriptionIndex(subscription.ID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	stored := &s.subscriptions[i]
+	stored.PaymentMethod = subscription.PaymentMethod
+	stored.Gateway = subscription.Gateway
+	stored.GatewayCustomerID = subscription.GatewayCustomerID
+	stored.GatewaySubscriptionID = subscription.GatewaySubscriptionID
+	stored.CheckoutURL = subscription.CheckoutURL
+	stored.PixCode = subscription.PixCode
+	stored.PixExpiresAt = subscription.PixExpiresAt
+	stored.UpdatedAt = time.Now()
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) Transition(subscriptionID uuid.UUID, from, to, reason string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.subscriptionIndex(subscriptionID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	subscription := &s.subscriptions[i]
+	if subscription.Status != from {
+		return ErrConflict
+	}
+	now := time.Now()
+	subscription.Status = to
+	subscription.UpdatedAt = now
+	if to == models.SubscriptionStatusCancelled {
+		subscription.CancelledAt = &now
+	}
+
+	if user, ok := s.users[subscription.UserID]; ok && mirrorsTransition(from, to) {
+		user.SubscriptionStatus = to
+		if from == models.SubscriptionStatusPending {
+			periodEnd := subscription.CurrentPeriodEnd
+			user.SubscriptionExpiresAt = &periodEnd
+		}
+		s.users[user.ID] = user
+	}
+	s.addEvent(models.SubscriptionEvent{
+		UserID:         subscription.UserID,
+		SubscriptionID: &subscription.ID,
+		Type:           models.SubscriptionEventStatusChanged,
+		FromStatus:     from,
+		ToStatus:       to,
+		Reason:         reason,
+	})
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) ExtendPeriod(subscriptionID uuid.UUID, start, end time.Time, reason string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.subscriptionIndex(subscriptionID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	subscription := &s.subscriptions[i]
+	subscription.CurrentPeriodStart = start
+	subscription.CurrentPeriodEnd = end
+	subscription.UpdatedAt = time.Now()
+
+	if user, ok := s.users[subscription.UserID]; ok && subscription.Status != models.SubscriptionStatusPending {
+		user.SubscriptionExpiresAt = &end
+		s.users[user.ID] = user
+	}
+	s.addEvent(models.SubscriptionEvent{
+		UserID:         subscription.UserID,
+		SubscriptionID: &subscription.ID,
+		Type:           models.SubscriptionEventPeriodChanged,
+		PeriodEnd:      &end,
+		Reason:         reason,
+	})
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) ListLapsed(status string, endedBefore time.Time, limit int) ([]models.Subscription, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lapsed []models.Subscription
+	for _, subscription := range s.subscriptions {
+		if subscription.Status == status && subscription.CurrentPeriodEnd.Before(endedBefore) {
+			subscription.User = s.users[subscription.UserID]
+			lapsed = append(lapsed, subscription)
+		}
+	}
+	sort.Slice(lapsed, func(i, j int) bool { return lapsed[i].CurrentPeriodEnd.Before(lapsed[j].CurrentPeriodEnd) })
+	if len(lapsed) > limit {
+		lapsed = lapsed[:limit]
+	}
+	return lapsed, nil
+}
+
+func (r *MemorySubscriptionRepository) SavePayment(payment *models.Payment, reason string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	fromStatus := ""
+	payment.UpdatedAt = now
+	if payment.Currency == "" {
+		payment.Currency = "BRL"
+	}
+	stored := false
+	for i := range s.payments {
+		existing := &s.payments[i]
+		if existing.Gateway == payment.Gateway && existing.GatewayPaymentID == payment.GatewayPaymentID {
+			fromStatus = string(existing.Status)
+			payment.ID = existing.ID
+			payment.CreatedAt = existing.CreatedAt
+			*existing = *payment
+			existing.User = models.User{}
+			stored = true
+			break
+		}
+	}
+	if !stored {
+		if payment.ID == uuid.Nil {
+			payment.ID = uuid.New()
+		}
+		if payment.CreatedAt.IsZero() {
+			payment.CreatedAt = now
+		}
+		copied := *payment
+		copied.User = models.User{}
+		s.payments = append(s.payments, copied)
+	}
+
+	amount := payment.Amount
+	s.addEvent(models.SubscriptionEvent{
+		UserID:         payment.UserID,
+		SubscriptionID: payment.SubscriptionID,
+		PaymentID:      &payment.ID,
+		Type:           models.SubscriptionEventPayment,
+		FromStatus:     fromStatus,
+		ToStatus:       string(payment.Status),
+		Amount:         &amount,
+		PeriodEnd:      payment.PeriodEnd,
+		Reason:         reason,
+	})
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) GetPaymentByGatewayID(gateway, gatewayPaymentID string) (*models.Payment, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, payment := range s.payments {
+		if payment.Gateway == gateway && payment.GatewayPaymentID == gatewayPaymentID {
+			return &payment, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemorySubscriptionRepository) ClaimWebhookEvent(event *models.PaymentWebhookEvent, claimedUntil time.Time) (bool, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for i := range s.webhookEvents {
+		stored := &s.webhookEvents[i]
+		if stored.Gateway == event.Gateway && stored.EventID == event.EventID {
+			stored.Attempts++
+			stored.UpdatedAt = now
+			claimed := stored.ProcessedAt == nil && (stored.ClaimedUntil == nil || stored.ClaimedUntil.Before(now))
+			if claimed {
+				stored.ClaimedUntil = &claimedUntil
+			}
+			*event = *stored
+			return claimed, nil
+		}
+	}
+
+	if event.ID == uuid.Nil {
+		event.ID = uuid.New()
+	}
+	event.Attempts = 1
+	event.ClaimedUntil = &claimedUntil
+	event.CreatedAt = now
+	event.UpdatedAt = now
+	s.webhookEvents = append(s.webhookEvents, *event)
+	return true, nil
+}
+
+func (r *MemorySubscriptionRepository) FinishWebhookEvent(id uuid.UUID, processErr error) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.webhookEvents {
+		stored := &s.webhookEvents[i]
+		if stored.ID != id {
+			continue
+		}
+		now := time.Now()
+		stored.UpdatedAt = now
+		stored.ClaimedUntil = nil
+		if processErr != nil {
+			stored.LastError = processErr.Error()
+			return nil
+		}
+		stored.ProcessedAt = &now
+		stored.LastError = ""
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (r *MemorySubscriptionRepository) OpenDunningCase(dunningCase *models.DunningCase) (bool, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if open := s.openDunningCase(dunningCase.SubscriptionID); open != nil {
+		open.Failures++
+		open.FailureReason = dunningCase.FailureReason
+		open.NextNoticeAt = &now
+		open.UpdatedAt = now
+		*dunningCase = *open
+		return false, nil
+	}
+	if s.subscriptionIndex(dunningCase.SubscriptionID) < 0 {
+		return false, ErrNotFound
+	}
+
+	if dunningCase.ID == uuid.Nil {
+		dunningCase.ID = uuid.New()
+	}
+	dunningCase.Status = models.DunningStatusOpen
+	dunningCase.Failures = 1
+	if dunningCase.CreatedAt.IsZero() {
+		dunningCase.CreatedAt = now
+	}
+	dunningCase.UpdatedAt = now
+	s.dunningCases = append(s.dunningCases, *dunningCase)
+	return true, nil
+}
+
+func (r *MemorySubscriptionRepository) GetOpenDunningCase(subscriptionID uuid.UUID) (*models.DunningCase, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if open := s.openDunningCase(subscriptionID); open != nil {
+		found := *open
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *MemorySubscriptionRepository) ListDueDunningCases(now time.Time, limit int) ([]models.DunningCase, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cases []models.DunningCase
+	for _, dunningCase := range s.dunningCases {
+		if dunningCase.Status == models.DunningStatusOpen && dunningCase.NextNoticeAt != nil && !dunningCase.NextNoticeAt.After(now) {
+			dunningCase.User = s.users[dunningCase.UserID]
+			cases = append(cases, dunningCase)
+		}
+	}
+	sort.SliceStable(cases, func(i, j int) bool { return cases[i].NextNoticeAt.Before(*cases[j].NextNoticeAt) })
+	if len(cases) > limit {
+		cases = cases[:limit]
+	}
+	return cases, nil
+}
+
+func (r *MemorySubscriptionRepository) RecordDunningNotice(id uuid.UUID, nextNoticeAt *time.Time) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.dunningCases {
+		dunningCase := &s.dunningCases[i]
+		if dunningCase.ID == id {
+			dunningCase.NoticesSent++
+			dunningCase.NextNoticeAt = nextNoticeAt
+			dunningCase.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *MemorySubscriptionRepository) ResolveDunningCase(subscriptionID uuid.UUID, status string) (*models.DunningCase, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := s.openDunningCase(subscriptionID)
+	if open == nil {
+		return nil, nil
+	}
+	now := time.Now()
+	open.Status = status
+	open.NextNoticeAt = nil
+	open.ResolvedAt = &now
+	open.UpdatedAt = now
+	resolved := *open
+	return &resolved, nil
+}
+
+func (r *MemorySubscriptionRepository) DunningStats(since time.Time) (*DunningStats, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byStatus := make(map[string]int)
+	for _, dunningCase := range s.dunningCases {
+		if !dunningCase.CreatedAt.Before(since) {
+			byStatus[dunningCase.Status]++
+		}
+	}
+	return newDunningStats(byStatus), nil
+}
+
+func (r *MemorySubscriptionRepository) CreateReferral(referral *models.Referral) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if referral.Status == "" {
+		referral.Status = models.ReferralStatusPending
+	}
+	if referral.Status != models.ReferralStatusRejected && s.referral(referral.ReferredID) != nil {
+		return ErrConflict
+	}
+	if referral.ID == uuid.Nil {
+		referral.ID = uuid.New()
+	}
+	now := time.Now()
+	if referral.CreatedAt.IsZero() {
+		referral.CreatedAt = now
+	}
+	referral.UpdatedAt = now
+	s.referrals = append(s.referrals, *referral)
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) GetReferral(referredID uuid.UUID) (*models.Referral, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if referral := s.referral(referredID); referral != nil {
+		found := *referral
+		return &found, nil
+	}
+	return nil, nil
+}
+
+// referral returns the user's referral that wasn't rejected. Callers hold mu.
+func (s *memoryStore) referral(referredID uuid.UUID) *models.Referral {
+	for i := range s.referrals {
+		referral := &s.referrals[i]
+		if referral.ReferredID == referredID && referral.Status != models.ReferralStatusRejected {
+			return referral
+		}
+	}
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) CountReferrals(referrerID uuid.UUID, since time.Time) (int, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, referral := range s.referrals {
+		if referral.ReferrerID == referrerID && !referral.CreatedAt.Before(since) && referral.Status != models.ReferralStatusRejected {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *MemorySubscriptionRepository) DeviceReferred(deviceID string) (bool, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, referral := range s.referrals {
+		if referral.DeviceID == deviceID && referral.Status != models.ReferralStatusRejected {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MemorySubscriptionRepository) RewardReferral(id uuid.UUID) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.referrals {
+		referral := &s.referrals[i]
+		if referral.ID != id {
+			continue
+		}
+		if referral.Status != models.ReferralStatusPending {
+			return ErrConflict
+		}
+		now := time.Now()
+		referral.Status = models.ReferralStatusRewarded
+		referral.RewardedAt = &now
+		referral.UpdatedAt = now
+		return nil
+	}
+	return ErrConflict
+}
+
+func (r *MemorySubscriptionRepository) ReferralStats(since time.Time) (*ReferralStats, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var counts []referralCount
+	for _, referral := range s.referrals {
+		if !referral.CreatedAt.Before(since) {
+			counts = append(counts, referralCount{Status: referral.Status, RejectReason: referral.RejectReason, Count: 1})
+		}
+	}
+	return newReferralStats(counts), nil
+}
+
+func (r *MemorySubscriptionRepository) CreateCoupon(coupon *models.Coupon) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.coupon(coupon.Code) != nil {
+		return ErrConflict
+	}
+	if coupon.ID == uuid.Nil {
+		coupon.ID = uuid.New()
+	}
+	now := time.Now()
+	if coupon.CreatedAt.IsZero() {
+		coupon.CreatedAt = now
+	}
+	coupon.UpdatedAt = now
+	s.coupons = append(s.coupons, *coupon)
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) GetCoupon(code string) (*models.Coupon, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if coupon := s.coupon(code); coupon != nil {
+		found := *coupon
+		return &found, nil
+	}
+	return nil, ErrNotFound
+}
+
+// coupon returns the coupon with the code, or nil. Callers hold mu.
+func (s *memoryStore) coupon(code string) *models.Coupon {
+	for i := range s.coupons {
+		if s.coupons[i].Code == code {
+			return &s.coupons[i]
+		}
+	}
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) ListCoupons() ([]models.Coupon, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	coupons := append([]models.Coupon(nil), s.coupons...)
+	sort.SliceStable(coupons, func(i, j int) bool { return coupons[i].CreatedAt.After(coupons[j].CreatedAt) })
+	return coupons, nil
+}
+
+func (r *MemorySubscriptionRepository) DeactivateCoupon(code string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	coupon := s.coupon(code)
+	if coupon == nil {
+		return ErrNotFound
+	}
+	coupon.Active = false
+	coupon.UpdatedAt = time.Now()
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) RedeemCoupon(redemption *models.CouponRedemption) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, redeemed := range s.redemptions {
+		if redeemed.CouponID == redemption.CouponID && redeemed.UserID == redemption.UserID {
+			return ErrConflict
+		}
+	}
+	var coupon *models.Coupon
+	for i := range s.coupons {
+		if s.coupons[i].ID == redemption.CouponID {
+			coupon = &s.coupons[i]
+		}
+	}
+	if coupon == nil {
+		return ErrNotFound
+	}
+
+	if redemption.ID == uuid.Nil {
+		redemption.ID = uuid.New()
+	}
+	if redemption.CreatedAt.IsZero() {
+		redemption.CreatedAt = time.Now()
+	}
+	s.redemptions = append(s.redemptions, *redemption)
+	coupon.Uses++
+	coupon.UpdatedAt = time.Now()
+	return nil
+}
+
+func (r *MemorySubscriptionRepository) CouponRedeemed(couponID, userID uuid.UUID) (bool, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, redeemed := range s.redemptions {
+		if redeemed.CouponID == couponID && redeemed.UserID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MemorySubscriptionRepository) ListPayments(userID uuid.UUID) ([]models.Payment, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var payments []models.Payment
+	for _, payment := range s.payments {
+		if payment.UserID == userID {
+			payments = append(payments, payment)
+		}
+	}
+	sort.SliceStable(payments, func(i, j int) bool { return payments[i].CreatedAt.After(payments[j].CreatedAt) })
+	return payments, nil
+}
+
+func (r *MemorySubscriptionRepository) Events(userID uuid.UUID) ([]models.SubscriptionEvent, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []models.SubscriptionEvent
+	for _, event := range s.events {
+		if event.UserID == userID {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+type MemoryAnalyticsRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryAnalyticsRepository) Record(event *models.AnalyticsEvent) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.OnceKey != "" {
+		for _, existing := range s.analytics {
+			if existing.UserID == event.UserID && existing.OnceKey == event.OnceKey {
+				return nil
+			}
+		}
+	}
+	if event.ID == uuid.Nil {
+		event.ID = uuid.New()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	s.analytics = append(s.analytics, *event)
+	return nil
+}
+
+func (r *MemoryAnalyticsRepository) CohortActivity(from, to time.Time, nth int) ([]UserActivity, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []models.User
+	for _, user := range s.users {
+		if !user.CreatedAt.Before(from) && user.CreatedAt.Before(to) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].CreatedAt.Before(users[j].CreatedAt) })
+
+	events := append([]models.AnalyticsEvent(nil), s.analytics...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+
+	transactions := append([]models.Transaction(nil), s.transactions...)
+	sort.SliceStable(transactions, func(i, j int) bool { return transactions[i].CreatedAt.Before(transactions[j].CreatedAt) })
+	counts := make(map[uuid.UUID]int)
+	nthAt := make(map[uuid.UUID]time.Time)
+	for _, transaction := range transactions {
+		counts[transaction.UserID]++
+		if counts[transaction.UserID] == nth {
+			nthAt[transaction.UserID] = transaction.CreatedAt
+		}
+	}
+	return newUserActivity(users, events, counts, nthAt), nil
+}
+
+func (r *MemoryAnalyticsRepository) TransactionActivity(from, to time.Time) (*TransactionActivity, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	activity := &TransactionActivity{}
+	users := make(map[uuid.UUID]bool)
+	for _, transaction := range s.transactions {
+		if !transaction.CreatedAt.Before(from) && transaction.CreatedAt.Before(to) {
+			activity.Transactions++
+			users[transaction.UserID] = true
+		}
+	}
+	activity.Users = len(users)
+	return activity, nil
+}
+
+// latestSubscription returns the user's newest subscription whose status matches. Callers hold mu.
+func (s *memoryStore) latestSubscription(userID uuid.UUID, matches func(status string) bool) *models.Subscription {
+	var latest *models.Subscription
+	for i := range s.subscriptions {
+		subscription := s.subscriptions[i]
+		if subscription.UserID == userID && matches(subscription.Status) && (latest == nil || !subscription.CreatedAt.Before(latest.CreatedAt)) {
+			latest = &subscription
+		}
+	}
+	return latest
+}
+
+// openDunningCase returns the subscription's open case in the store. Callers hold mu.
+func (s *memoryStore) openDunningCase(subscriptionID uuid.UUID) *models.DunningCase {
+	for i := range s.dunningCases {
+		if s.dunningCases[i].SubscriptionID == subscriptionID && s.dunningCases[i].Status == models.DunningStatusOpen {
+			return &s.dunningCases[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) subscriptionIndex(id uuid.UUID) int {
+	for i := range s.subscriptions {
+		if s.subscriptions[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) addEvent(event models.SubscriptionEvent) {
+	event.ID = uuid.New()
+	event.CreatedAt = time.Now()
+	s.events = append(s.events, event)
+}
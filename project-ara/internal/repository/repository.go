@@ -0,0 +1,297 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"project-ara/internal/models"
+)
+
+// ErrNotFound is returned when a record doesn't exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned when a record isn't in the state a conditional update expected
+var ErrConflict = errors.New("record changed concurrently")
+
+// UserRepository stores users and their trial usage
+type UserRepository interface {
+	Create(user *models.User) error
+	GetByID(id uuid.UUID) (*models.User, error)
+	GetByPhoneNumber(phoneNumber string) (*models.User, error)
+	GetByTelegramChatID(chatID string) (*models.User, error)
+	IncrementTrialTransactions(id uuid.UUID) error
+	// RecordInbound stores when the user last wrote, never moving the timestamp backwards
+	RecordInbound(phoneNumber string, at time.Time) error
+	// SetReferralCode gives the user a referral code. It returns ErrConflict when another
+	// user has the code.
+	SetReferralCode(id uuid.UUID, code string) error
+	GetByReferralCode(code string) (*models.User, error)
+	AddBonusTransactions(id uuid.UUID, count int) error
+	SetConversionVariant(id uuid.UUID, variant string) error
+	SetMEIActivity(id uuid.UUID, activity string) error
+	// ListBySubscriptionStatus returns a page of the users in any of the statuses, by ID:
+	// those after afterID, uuid.Nil for the first page
+	ListBySubscriptionStatus(statuses []string, afterID uuid.UUID, limit int) ([]models.User, error)
+}
+
+// TransactionRepository stores transactions and the duplicates waiting for confirmation
+type TransactionRepository interface {
+	Create(transaction *models.Transaction) error
+	GetByID(id uuid.UUID) (*models.Transaction, error)
+	// Correct overwrites amount and description, keeping the originals in correctionData
+	Correct(id uuid.UUID, amount float64, description string, correctionData json.RawMessage, at time.Time) error
+	LinkAttachment(attachmentID, transactionID uuid.UUID) error
+
+	// ListByUser returns the user's latest transactions, newest first
+	ListByUser(userID uuid.UUID, limit int) ([]models.Transaction, error)
+	// ListBetween returns the user's transactions created in [from, to), newest first
+	ListBetween(userID uuid.UUID, from, to time.Time) ([]models.Transaction, error)
+	// FindLatestByMediaSHA256 and FindLatestByExternalRef return nil when nothing matches
+	FindLatestByMediaSHA256(userID uuid.UUID, mediaSHA256 string) (*models.Transaction, error)
+	FindLatestByExternalRef(userID uuid.UUID, externalRef string) (*models.Transaction, error)
+
+	Balance(userID uuid.UUID) (float64, error)
+	// TopCategories groups transactions since a date by description and type, largest total first
+	TopCategories(userID uuid.UUID, since time.Time, limit int) ([]CategorySummary, error)
+	// FrequentDescriptions returns the most used non-empty descriptions since a date
+	FrequentDescriptions(userID uuid.UUID, since time.Time, limit int) ([]string, error)
+
+	// ReplacePending stores a pending duplicate, dropping any earlier one of the same user
+	ReplacePending(pending *models.PendingTransaction) error
+	// GetPending returns the user's latest pending duplicate unexpired at now, or nil
+	GetPending(userID uuid.UUID, now time.Time) (*models.PendingTransaction, error)
+	DeletePending(userID uuid.UUID) error
+}
+
+// SubscriptionRepository stores users' paid subscriptions, their payments and the billing
+// events of both. Every change also updates the user's subscription_status and
+// subscription_expires_at, which mirror their latest subscription. Pending subscriptions,
+// whose checkout hasn't been paid, aren't mirrored until they become active.
+type SubscriptionRepository interface {
+	// Atomically runs fn against a repository whose changes are kept only if fn returns nil
+	Atomically(fn func(SubscriptionRepository) error) error
+	// Create stores a new subscription as the user's current one and records the event
+	Create(subscription *models.Subscription, reason string) error
+	GetByID(id uuid.UUID) (*models.Subscription, error)
+	// GetCurrent returns the user's running subscription (active or in its grace period),
+	// else their latest one that isn't pending, or nil when they never subscribed
+	GetCurrent(userID uuid.UUID) (*models.Subscription, error)
+	// GetPending returns the user's latest pending subscription, or nil
+	GetPending(userID uuid.UUID) (*models.Subscription, error)
+	// GetByGatewaySubscriptionID returns nil when the gateway subscription is unknown
+	GetByGatewaySubscriptionID(gateway, gatewaySubscriptionID string) (*models.Subscription, error)
+	// SaveGatewayDetails stores the subscription's payment method, gateway IDs, checkout URL
+	// and Pix code
+	SaveGatewayDetails(subscription *models.Subscription) error
+	// Transition moves a subscription from one status to another and records the event.
+	// It returns ErrConflict if the subscription's status isn't from anymore.
+	Transition(subscriptionID uuid.UUID, from, to, reason string) error
+	// ExtendPeriod sets the subscription's current period and records the event
+	ExtendPeriod(subscriptionID uuid.UUID, start, end time.Time, reason string) error
+	// ListLapsed returns subscriptions in status whose period ended before the cutoff,
+	// oldest first, with their users loaded
+	ListLapsed(status string, endedBefore time.Time, limit int) ([]models.Subscription, error)
+
+	// SavePayment stores a payment, or updates the one with the same gateway payment ID,
+	// and records the event
+	SavePayment(payment *models.Payment, reason string) error
+	// GetPaymentByGatewayID returns nil when the gateway payment is unknown
+	GetPaymentByGatewayID(gateway, gatewayPaymentID string) (*models.Payment, error)
+	// ListPayments returns the user's payments, newest first
+	ListPayments(userID uuid.UUID) ([]models.Payment, error)
+	// Events returns the user's billing events, oldest first
+	Events(userID uuid.UUID) ([]models.SubscriptionEvent, error)
+
+	// ClaimWebhookEvent stores a gateway notification the first time it's delivered, counts
+	// the deliveries and claims the event for the caller to process until claimedUntil. On
+	// redeliveries, event is loaded with the stored one. It reports false, claiming nothing,
+	// when the event was already processed or another delivery's claim hasn't run out.
+	ClaimWebhookEvent(event *models.PaymentWebhookEvent, claimedUntil time.Time) (bool, error)
+	// FinishWebhookEvent marks the event processed, or keeps the error that left it
+	// unprocessed; either way it releases the claim
+	FinishWebhookEvent(id uuid.UUID, processErr error) error
+
+	// OpenDunningCase stores a case for a failed charge of the subscription. When the
+	// subscription already has an open case, that one counts another failure, is due a
+	// notice now and is loaded into dunningCase. It reports whether a case was opened.
+	OpenDunningCase(dunningCase *models.DunningCase) (bool, error)
+	// GetOpenDunningCase returns the subscription's open case, or nil
+	GetOpenDunningCase(subscriptionID uuid.UUID) (*models.DunningCase, error)
+	// ListDueDunningCases returns open cases whose next notice is due at now, oldest first,
+	// with their users loaded
+	ListDueDunningCases(now time.Time, limit int) ([]models.DunningCase, error)
+	// RecordDunningNotice counts a notice sent and schedules the next, nil for none
+	RecordDunningNotice(id uuid.UUID, nextNoticeAt *time.Time) error
+	// ResolveDunningCase closes the subscription's open case as recovered or churned and
+	// returns it, or nil when there was none
+	ResolveDunningCase(subscriptionID uuid.UUID, status string) (*models.DunningCase, error)
+	// DunningStats counts the cases opened since a date by how they ended
+	DunningStats(since time.Time) (*DunningStats, error)
+
+	// CreateReferral stores a referral. It returns ErrConflict when the referred user
+	// already has a referral that wasn't rejected.
+	CreateReferral(referral *models.Referral) error
+	// GetReferral returns the referral of the referred user that wasn't rejected, or nil
+	GetReferral(referredID uuid.UUID) (*models.Referral, error)
+	// CountReferrals counts the referrals of the referrer made since a date that weren't rejected
+	CountReferrals(referrerID uuid.UUID, since time.Time) (int, error)
+	// DeviceReferred reports whether a referral that wasn't rejected was claimed from the device
+	DeviceReferred(deviceID string) (bool, error)
+	// RewardReferral marks a pending referral rewarded. It returns ErrConflict if the
+	// referral isn't pending anymore.
+	RewardReferral(id uuid.UUID) error
+	// ReferralStats counts the referrals made since a date by how they ended
+	ReferralStats(since time.Time) (*ReferralStats, error)
+
+	// CreateCoupon stores a coupon. It returns ErrConflict when the code is taken.
+	CreateCoupon(coupon *models.Coupon) error
+	GetCoupon(code string) (*models.Coupon, error)
+	// ListCoupons returns every coupon, newest first
+	ListCoupons() ([]models.Coupon, error)
+	// DeactivateCoupon stops a coupon from being used
+	DeactivateCoupon(code string) error
+	// RedeemCoupon stores the redemption and counts a use of its coupon. It returns
+	// ErrConflict when the user already redeemed the coupon.
+	RedeemCoupon(redemption *models.CouponRedemption) error
+	// CouponRedeemed reports whether the user redeemed the coupon
+	CouponRedeemed(couponID, userID uuid.UUID) (bool, error)
+}
+
+// AnalyticsRepository stores the analytics events the services emit, and reads the user
+// activity the funnel reports are built from
+type AnalyticsRepository interface {
+	// Record stores an event. An event with a once key that the user already has isn't
+	// stored again.
+	Record(event *models.AnalyticsEvent) error
+	// CohortActivity returns the activity of the users who signed up in [from, to), oldest
+	// signup first, with when their nth transaction was logged
+	CohortActivity(from, to time.Time, nth int) ([]UserActivity, error)
+	// TransactionActivity counts the transactions logged in [from, to) and the users who
+	// logged them
+	TransactionActivity(from, to time.Time) (*TransactionActivity, error)
+}
+
+// DunningStats counts dunning cases by status. RecoveryRate is the share of the closed
+// cases that were recovered.
+type DunningStats struct {
+	Opened       int     `json:"opened"`
+	Open         int     `json:"open"`
+	Recovered    int     `json:"recovered"`
+	Churned      int     `json:"churned"`
+	RecoveryRate float64 `json:"recovery_rate"`
+}
+
+// ReferralStats counts referrals by status, and the rejected ones by reason
+type ReferralStats struct {
+	Referred   int            `json:"referred"`
+	Pending    int            `json:"pending"`
+	Rewarded   int            `json:"rewarded"`
+	Rejected   int            `json:"rejected"`
+	RejectedBy map[string]int `json:"rejected_by"`
+}
+
+// UserActivity is how far a user went: when they first had each analytics event, by
+// name, and how many transactions they logged
+type UserActivity struct {
+	UserID           uuid.UUID
+	SignedUpAt       time.Time
+	FirstEvents      map[string]time.Time
+	Transactions     int
+	NthTransactionAt *time.Time // Nil when they logged fewer
+}
+
+// TransactionActivity counts transactions and the users who logged them
+type TransactionActivity struct {
+	Transactions int `json:"transactions"`
+	Users        int `json:"users"`
+}
+
+// CategorySummary totals the transactions sharing a description and type
+type CategorySummary struct {
+	Description     string  `json:"description"`
+	TransactionType string  `json:"transaction_type"`
+	Count           int     `json:"count"`
+	TotalAmount     float64 `json:"total_amount"`
+}
+
+func newDunningStats(byStatus map[string]int) *DunningStats {
+	stats := &DunningStats{
+		Open:      byStatus[models.DunningStatusOpen],
+		Recovered: byStatus[models.DunningStatusRecovered],
+		Churned:   byStatus[models.DunningStatusChurned],
+	}
+	stats.Opened = stats.Open + stats.Recovered + stats.Churned
+	if closed := stats.Recovered + stats.Churned; closed > 0 {
+		stats.RecoveryRate = float64(stats.Recovered) / float64(closed)
+	}
+	return stats
+}
+
+// referralCount counts the referrals of a status and reject reason
+type referralCount struct {
+	Status       string
+	RejectReason string
+	Count        int
+}
+
+func newReferralStats(counts []referralCount) *ReferralStats {
+	stats := &ReferralStats{RejectedBy: make(map[string]int)}
+	for _, count := range counts {
+		switch count.Status {
+		case models.ReferralStatusPending:
+			stats.Pending += count.Count
+		case models.ReferralStatusRewarded:
+			stats.Rewarded += count.Count
+		case models.ReferralStatusRejected:
+			stats.Rejected += count.Count
+			stats.RejectedBy[count.RejectReason] += count.Count
+		}
+	}
+	stats.Referred = stats.Pending + stats.Rewarded
+	return stats
+}
+
+// newUserActivity puts together the activity of a cohort from its users, oldest signup
+// first, their events, oldest first, their transaction counts and when they logged their
+// nth transaction
+func newUserActivity(users []models.User, events []models.AnalyticsEvent, counts map[uuid.UUID]int, nth map[uuid.UUID]time.Time) []UserActivity {
+	activity := make([]UserActivity, len(users))
+	byUser := make(map[uuid.UUID]*UserActivity, len(users))
+	for i, user := range users {
+		activity[i] = UserActivity{
+			UserID:       user.ID,
+			SignedUpAt:   user.CreatedAt,
+			FirstEvents:  make(map[string]time.Time),
+			Transactions: counts[user.ID],
+		}
+		if at, ok := nth[user.ID]; ok {
+			activity[i].NthTransactionAt = &at
+		}
+		byUser[user.ID] = &activity[i]
+	}
+	for _, event := range events {
+		if user := byUser[event.UserID]; user != nil {
+			if _, seen := user.FirstEvents[event.Name]; !seen {
+				user.FirstEvents[event.Name] = event.CreatedAt
+			}
+		}
+	}
+	return activity
+}
+
+// Repositories bundles the repositories of one backend
+type Repositories struct {
+	Users         UserRepository
+	Transactions  TransactionRepository
+	Subscriptions SubscriptionRepository
+	Analytics     AnalyticsRepository
+}
+
+// mirrorsTransition reports whether a status change is copied onto the user. A pending
+// subscription only shows on the user once it's paid; an abandoned checkout never does.
+func mirrorsTransition(from, to string) bool {
+	return from != models.SubscriptionStatusPending || to == models.SubscriptionStatusActive
+}
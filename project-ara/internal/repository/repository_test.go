@@ -0,0 +1,779 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/testdb"
+)
+
+// The contract suite runs against every implementation. The GORM repositories are
+// checked on SQLite and, when TEST_DATABASE_URL is set, on Postgres.
+func TestContract(t *testing.T) {
+	backends := map[string]func(t *testing.T) *Repositories{
+		"memory": func(t *testing.T) *Repositories { return NewMemory() },
+		"sqlite": func(t *testing.T) *Repositories { return NewGorm(testdb.SQLite(t)) },
+		"postgres": func(t *testing.T) *Repositories {
+			return NewGorm(testdb.Postgres(t))
+		},
+	}
+
+	tests := map[string]func(t *testing.T, repos *Repositories){
+		"users":                 testUsers,
+		"users by subscription": testUsersBySubscriptionStatus,
+		"transactions":          testTransactions,
+		"transaction queries":   testTransactionQueries,
+		"pending transactions":  testPendingTransactions,
+		"subscriptions":         testSubscriptions,
+		"pending subscriptions": testPendingSubscriptions,
+		"payments":              testPayments,
+		"lapsed subscriptions":  testLapsedSubscriptions,
+		"webhook events":        testWebhookEvents,
+		"atomic changes":        testAtomically,
+		"dunning cases":         testDunningCases,
+		"referrals":             testReferrals,
+		"coupons":               testCoupons,
+		"analytics":             testAnalytics,
+	}
+
+	for backend, open := range backends {
+		t.Run(backend, func(t *testing.T) {
+			for name, test := range tests {
+				t.Run(name, func(t *testing.T) {
+					test(t, open(t))
+				})
+			}
+		})
+	}
+}
+
+func createUser(t *testing.T, repos *Repositories, phone string) *models.User {
+	user := &models.User{PhoneNumber: phone, Channel: "whatsapp", SubscriptionStatus: "trial"}
+	require.NoError(t, repos.Users.Create(user))
+	require.NotEqual(t, uuid.Nil, user.ID)
+	return user
+}
+
+func createTransaction(t *testing.T, repos *Repositories, userID uuid.UUID, amount float64, kind models.TransactionType, description string, at time.Time) *models.Transaction {
+	transaction := &models.Transaction{
+		UserID:          userID,
+		Amount:          amount,
+		TransactionType: kind,
+		Description:     description,
+		Source:          models.TransactionSourceText,
+		CreatedAt:       at,
+	}
+	require.NoError(t, repos.Transactions.Create(transaction))
+	return transaction
+}
+
+func testUsers(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511911110000")
+
+	found, err := repos.Users.GetByPhoneNumber("5511911110000")
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	assert.Equal(t, "trial", found.SubscriptionStatus)
+
+	_, err = repos.Users.GetByPhoneNumber("5511900000000")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = repos.Users.GetByID(uuid.New())
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Phone numbers and Telegram chats are unique, but users of the other channel don't clash
+	assert.Error(t, repos.Users.Create(&models.User{PhoneNumber: "5511911110000"}))
+	telegram := &models.User{TelegramChatID: "42", Channel: "telegram"}
+	require.NoError(t, repos.Users.Create(telegram))
+	require.NoError(t, repos.Users.Create(&models.User{TelegramChatID: "43", Channel: "telegram"}))
+	found, err = repos.Users.GetByTelegramChatID("42")
+	require.NoError(t, err)
+	assert.Equal(t, telegram.ID, found.ID)
+
+	require.NoError(t, repos.Users.IncrementTrialTransactions(user.ID))
+	require.NoError(t, repos.Users.IncrementTrialTransactions(user.ID))
+	found, err = repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, found.TrialTransactionsCount)
+
+	// The inbound timestamp only moves forward
+	later := time.Now().Truncate(time.Second)
+	require.NoError(t, repos.Users.RecordInbound(user.PhoneNumber, later))
+	require.NoError(t, repos.Users.RecordInbound(user.PhoneNumber, later.Add(-time.Hour)))
+	found, err = repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found.LastInboundAt)
+	assert.True(t, found.LastInboundAt.Equal(later))
+
+	require.NoError(t, repos.Users.SetReferralCode(user.ID, "ARA2345AB"))
+	assert.ErrorIs(t, repos.Users.SetReferralCode(telegram.ID, "ARA2345AB"), ErrConflict)
+	found, err = repos.Users.GetByReferralCode("ARA2345AB")
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	_, err = repos.Users.GetByReferralCode("ARA9999ZZ")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, repos.Users.AddBonusTransactions(user.ID, 20))
+	found, err = repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 20, found.BonusTransactions)
+
+	require.NoError(t, repos.Users.SetConversionVariant(user.ID, "value"))
+	found, err = repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "value", found.ConversionVariant)
+
+	require.NoError(t, repos.Users.SetMEIActivity(user.ID, models.MEIActivityServices))
+	found, err = repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.MEIActivityServices, found.MEIActivity)
+}
+
+func testUsersBySubscriptionStatus(t *testing.T, repos *Repositories) {
+	statuses := []string{models.SubscriptionStatusActive, models.SubscriptionStatusGracePeriod}
+	var want []uuid.UUID
+	for i, status := range []string{"active", "trial", "grace_period", "active", "expired"} {
+		user := &models.User{PhoneNumber: fmt.Sprintf("551193333000%d", i), SubscriptionStatus: status}
+		require.NoError(t, repos.Users.Create(user))
+		if slices.Contains(statuses, status) {
+			want = append(want, user.ID)
+		}
+	}
+	slices.SortFunc(want, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+
+	var got []uuid.UUID
+	for afterID := uuid.Nil; ; {
+		page, err := repos.Users.ListBySubscriptionStatus(statuses, afterID, 2)
+		require.NoError(t, err)
+		for _, user := range page {
+			got = append(got, user.ID)
+		}
+		if len(page) < 2 {
+			break
+		}
+		afterID = page[len(page)-1].ID
+	}
+	assert.Equal(t, want, got)
+}
+
+func testTransactions(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511922220000")
+	now := time.Now().Truncate(time.Second)
+
+	transaction := createTransaction(t, repos, user.ID, 50, models.TransactionTypeIncome, "Bolo", now)
+	require.NotEqual(t, uuid.Nil, transaction.ID)
+
+	found, err := repos.Transactions.GetByID(transaction.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 50.0, found.Amount)
+	assert.Equal(t, "Bolo", found.Description)
+	_, err = repos.Transactions.GetByID(uuid.New())
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	data := json.RawMessage(`{"original_amount":50}`)
+	require.NoError(t, repos.Transactions.Correct(transaction.ID, 55, "Bolo de cenoura", data, now))
+	found, err = repos.Transactions.GetByID(transaction.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 55.0, found.Amount)
+	assert.Equal(t, "Bolo de cenoura", found.Description)
+	require.NotNil(t, found.CorrectedAt)
+	require.NotNil(t, found.CorrectionData)
+	assert.JSONEq(t, string(data), string(*found.CorrectionData))
+	assert.ErrorIs(t, repos.Transactions.Correct(uuid.New(), 1, "", data, now), ErrNotFound)
+
+	assert.NoError(t, repos.Transactions.LinkAttachment(uuid.New(), transaction.ID))
+}
+
+func testTransactionQueries(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511933330000")
+	other := createUser(t, repos, "5511933339999")
+	now := time.Now().Truncate(time.Second)
+
+	createTransaction(t, repos, user.ID, 100, models.TransactionTypeIncome, "Bolo", now.Add(-48*time.Hour))
+	createTransaction(t, repos, user.ID, 30, models.TransactionTypeExpense, "Farinha", now.Add(-2*time.Hour))
+	recent := createTransaction(t, repos, user.ID, 40, models.TransactionTypeIncome, "Bolo", now.Add(-time.Hour))
+	createTransaction(t, repos, other.ID, 999, models.TransactionTypeIncome, "Bolo", now)
+
+	latest, err := repos.Transactions.ListByUser(user.ID, 2)
+	require.NoError(t, err)
+	require.Len(t, latest, 2)
+	assert.Equal(t, recent.ID, latest[0].ID)
+
+	between, err := repos.Transactions.ListBetween(user.ID, now.Add(-3*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, between, 1, "the end of the range is exclusive")
+	assert.Equal(t, "Farinha", between[0].Description)
+
+	balance, err := repos.Transactions.Balance(user.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 110, balance, 0.001)
+
+	categories, err := repos.Transactions.TopCategories(user.ID, now.Add(-72*time.Hour), 5)
+	require.NoError(t, err)
+	require.Len(t, categories, 2)
+	assert.Equal(t, CategorySummary{Description: "Bolo", TransactionType: "income", Count: 2, TotalAmount: 140}, categories[0])
+
+	descriptions, err := repos.Transactions.FrequentDescriptions(user.ID, now.Add(-72*time.Hour), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bolo"}, descriptions)
+
+	// Lookups by evidence return the newest match of the same user only
+	evidence := &models.Transaction{UserID: user.ID, Amount: 10, TransactionType: models.TransactionTypeExpense,
+		Source: models.TransactionSourceImage, MediaSHA256: "abc", ExternalRef: "E123", CreatedAt: now}
+	require.NoError(t, repos.Transactions.Create(evidence))
+
+	match, err := repos.Transactions.FindLatestByMediaSHA256(user.ID, "abc")
+	require.NoError(t, err)
+	require.NotNil(t, match)
+	assert.Equal(t, evidence.ID, match.ID)
+	match, err = repos.Transactions.FindLatestByExternalRef(user.ID, "E123")
+	require.NoError(t, err)
+	require.NotNil(t, match)
+	match, err = repos.Transactions.FindLatestByExternalRef(other.ID, "E123")
+	require.NoError(t, err)
+	assert.Nil(t, match)
+}
+
+func testPendingTransactions(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511944440000")
+	now := time.Now()
+
+	pending, err := repos.Transactions.GetPending(user.ID, now)
+	require.NoError(t, err)
+	assert.Nil(t, pending)
+
+	newPending := func(amount float64) *models.PendingTransaction {
+		return &models.PendingTransaction{
+			UserID: user.ID, Amount: amount, TransactionType: models.TransactionTypeIncome,
+			Source: models.TransactionSourceText, DuplicateOfID: uuid.New(), MatchReason: "fuzzy",
+			CreatedAt: now, ExpiresAt: now.Add(30 * time.Minute),
+		}
+	}
+	require.NoError(t, repos.Transactions.ReplacePending(newPending(10)))
+	require.NoError(t, repos.Transactions.ReplacePending(newPending(20)))
+
+	pending, err = repos.Transactions.GetPending(user.ID, now)
+	require.NoError(t, err)
+	require.NotNil(t, pending)
+	assert.Equal(t, 20.0, pending.Amount)
+
+	// Expired ones are invisible
+	pending, err = repos.Transactions.GetPending(user.ID, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Nil(t, pending)
+
+	require.NoError(t, repos.Transactions.DeletePending(user.ID))
+	pending, err = repos.Transactions.GetPending(user.ID, now)
+	require.NoError(t, err)
+	assert.Nil(t, pending)
+}
+
+func createSubscription(t *testing.T, repos *Repositories, userID uuid.UUID, periodEnd time.Time) *models.Subscription {
+	subscription := &models.Subscription{
+		UserID:             userID,
+		Plan:               "monthly",
+		Price:              9.90,
+		Status:             models.SubscriptionStatusActive,
+		PaymentMethod:      "pix",
+		CurrentPeriodStart: periodEnd.AddDate(0, 0, -30),
+		CurrentPeriodEnd:   periodEnd,
+	}
+	require.NoError(t, repos.Subscriptions.Create(subscription, "subscribed"))
+	return subscription
+}
+
+func testSubscriptions(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511955550000")
+	periodEnd := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+
+	current, err := repos.Subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	assert.Nil(t, current)
+
+	subscription := createSubscription(t, repos, user.ID, periodEnd)
+	require.NotEqual(t, uuid.Nil, subscription.ID)
+
+	// The user mirrors the subscription
+	found, err := repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "active", found.SubscriptionStatus)
+	require.NotNil(t, found.SubscriptionExpiresAt)
+	assert.True(t, found.SubscriptionExpiresAt.Equal(periodEnd))
+
+	current, err = repos.Subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	assert.Equal(t, subscription.ID, current.ID)
+	assert.InDelta(t, 9.90, current.Price, 0.001)
+
+	newEnd := periodEnd.AddDate(0, 0, 30)
+	require.NoError(t, repos.Subscriptions.ExtendPeriod(subscription.ID, periodEnd, newEnd, "renewed"))
+	require.NoError(t, repos.Subscriptions.Transition(subscription.ID, "active", "cancelled", "cancelled"))
+	found, err = repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "cancelled", found.SubscriptionStatus)
+	assert.True(t, found.SubscriptionExpiresAt.Equal(newEnd))
+	current, err = repos.Subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.NotNil(t, current.CancelledAt)
+	assert.True(t, current.CurrentPeriodEnd.Equal(newEnd))
+
+	assert.ErrorIs(t, repos.Subscriptions.Transition(uuid.New(), "active", "cancelled", "cancelled"), ErrNotFound)
+	assert.ErrorIs(t, repos.Subscriptions.Transition(subscription.ID, "active", "cancelled", "cancelled"), ErrConflict)
+	assert.ErrorIs(t, repos.Subscriptions.Create(&models.Subscription{UserID: uuid.New(), Plan: "monthly", Status: "active"}, "subscribed"), ErrNotFound)
+
+	events, err := repos.Subscriptions.Events(user.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, models.SubscriptionEventStatusChanged, events[0].Type)
+	assert.Equal(t, "trial", events[0].FromStatus)
+	assert.Equal(t, "active", events[0].ToStatus)
+	assert.Equal(t, models.SubscriptionEventPeriodChanged, events[1].Type)
+	assert.Equal(t, "cancelled", events[2].ToStatus)
+	require.NotNil(t, events[2].SubscriptionID)
+	assert.Equal(t, subscription.ID, *events[2].SubscriptionID)
+
+	// A running subscription is current even when an ended one is newer
+	running := &models.Subscription{UserID: user.ID, Plan: "monthly", Price: 9.90, Status: "active",
+		CurrentPeriodStart: periodEnd.AddDate(0, 0, -30), CurrentPeriodEnd: periodEnd, CreatedAt: time.Now().Add(-time.Hour)}
+	require.NoError(t, repos.Subscriptions.Create(running, "subscribed"))
+	current, err = repos.Subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	assert.Equal(t, running.ID, current.ID)
+}
+
+func testPendingSubscriptions(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511955551111")
+	now := time.Now().Truncate(time.Second)
+
+	// A checkout that was never paid leaves the user on trial
+	abandoned := &models.Subscription{UserID: user.ID, Plan: "monthly", Price: 9.90, Status: "pending",
+		CurrentPeriodStart: now, CurrentPeriodEnd: now.AddDate(0, 0, 30), CreatedAt: now.Add(-time.Hour)}
+	require.NoError(t, repos.Subscriptions.Create(abandoned, "checkout_started"))
+	require.NoError(t, repos.Subscriptions.Transition(abandoned.ID, "pending", "cancelled", "checkout_abandoned"))
+
+	pending := &models.Subscription{UserID: user.ID, Plan: "monthly", Price: 9.90, Status: "pending",
+		CurrentPeriodStart: now, CurrentPeriodEnd: now.AddDate(0, 0, 30), CreatedAt: now}
+	require.NoError(t, repos.Subscriptions.Create(pending, "checkout_started"))
+	pending.Gateway = "mercadopago"
+	pending.GatewayCustomerID = "cus-1"
+	pending.GatewaySubscriptionID = "pre-1"
+	pending.CheckoutURL = "https://mp.example/checkout/pre-1"
+	pixExpiresAt := now.Add(24 * time.Hour)
+	pending.PixCode = "00020101021226..."
+	pending.PixExpiresAt = &pixExpiresAt
+	require.NoError(t, repos.Subscriptions.SaveGatewayDetails(pending))
+	require.NoError(t, repos.Subscriptions.ExtendPeriod(pending.ID, now, now.AddDate(0, 0, 31), "checkout_started"))
+
+	found, err := repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "trial", found.SubscriptionStatus)
+	assert.Nil(t, found.SubscriptionExpiresAt)
+
+	current, err := repos.Subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	assert.Equal(t, abandoned.ID, current.ID, "pending subscriptions aren't current")
+
+	got, err := repos.Subscriptions.GetPending(user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, pending.ID, got.ID)
+	assert.Equal(t, "https://mp.example/checkout/pre-1", got.CheckoutURL)
+	assert.Equal(t, "cus-1", got.GatewayCustomerID)
+	assert.Equal(t, "00020101021226...", got.PixCode)
+	require.NotNil(t, got.PixExpiresAt)
+	assert.WithinDuration(t, pixExpiresAt, *got.PixExpiresAt, time.Second)
+
+	got, err = repos.Subscriptions.GetByGatewaySubscriptionID("mercadopago", "pre-1")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, pending.ID, got.ID)
+	got, err = repos.Subscriptions.GetByGatewaySubscriptionID("pagarme", "pre-1")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	assert.ErrorIs(t, repos.Subscriptions.SaveGatewayDetails(&models.Subscription{ID: uuid.New()}), ErrNotFound)
+
+	// Once paid, it shows on the user with its period
+	require.NoError(t, repos.Subscriptions.Transition(pending.ID, "pending", "active", "payment_approved"))
+	found, err = repos.Users.GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "active", found.SubscriptionStatus)
+	require.NotNil(t, found.SubscriptionExpiresAt)
+	assert.True(t, found.SubscriptionExpiresAt.Equal(now.AddDate(0, 0, 31)))
+	got, err = repos.Subscriptions.GetPending(user.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func testPayments(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511955559999")
+	subscription := createSubscription(t, repos, user.ID, time.Now().AddDate(0, 0, 30))
+
+	payment, err := repos.Subscriptions.GetPaymentByGatewayID("mercadopago", "123")
+	require.NoError(t, err)
+	assert.Nil(t, payment)
+
+	pending := &models.Payment{SubscriptionID: &subscription.ID, UserID: user.ID, Gateway: "mercadopago",
+		GatewayPaymentID: "123", Amount: 9.90, Status: models.PaymentStatusPending, Method: "pix"}
+	require.NoError(t, repos.Subscriptions.SavePayment(pending, "payment_created"))
+
+	// The same gateway payment is updated, not duplicated
+	paidAt := time.Now().Truncate(time.Second)
+	approved := &models.Payment{SubscriptionID: &subscription.ID, UserID: user.ID, Gateway: "mercadopago",
+		GatewayPaymentID: "123", Amount: 9.90, Status: models.PaymentStatusApproved, Method: "pix", PaidAt: &paidAt}
+	require.NoError(t, repos.Subscriptions.SavePayment(approved, "payment_approved"))
+	assert.Equal(t, pending.ID, approved.ID)
+
+	payments, err := repos.Subscriptions.ListPayments(user.ID)
+	require.NoError(t, err)
+	require.Len(t, payments, 1)
+	assert.Equal(t, models.PaymentStatusApproved, payments[0].Status)
+	require.NotNil(t, payments[0].PaidAt)
+	assert.True(t, payments[0].PaidAt.Equal(paidAt))
+
+	payment, err = repos.Subscriptions.GetPaymentByGatewayID("mercadopago", "123")
+	require.NoError(t, err)
+	require.NotNil(t, payment)
+	assert.Equal(t, pending.ID, payment.ID)
+	payment, err = repos.Subscriptions.GetPaymentByGatewayID("pagarme", "123")
+	require.NoError(t, err)
+	assert.Nil(t, payment)
+
+	events, err := repos.Subscriptions.Events(user.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, models.SubscriptionEventPayment, events[2].Type)
+	assert.Equal(t, "pending", events[2].FromStatus)
+	assert.Equal(t, "approved", events[2].ToStatus)
+	require.NotNil(t, events[2].PaymentID)
+	assert.Equal(t, pending.ID, *events[2].PaymentID)
+}
+
+func testLapsedSubscriptions(t *testing.T, repos *Repositories) {
+	now := time.Now()
+	for i, phone := range []string{"5511966660001", "5511966660002", "5511966660003"} {
+		user := createUser(t, repos, phone)
+		createSubscription(t, repos, user.ID, now.Add(time.Duration(i-2)*time.Hour))
+	}
+	createUser(t, repos, "5511966660004") // Trial, never expires
+
+	lapsed, err := repos.Subscriptions.ListLapsed("active", now, 10)
+	require.NoError(t, err)
+	require.Len(t, lapsed, 2)
+	assert.Equal(t, "5511966660001", lapsed[0].User.PhoneNumber)
+	assert.Equal(t, "5511966660002", lapsed[1].User.PhoneNumber)
+
+	lapsed, err = repos.Subscriptions.ListLapsed("active", now, 1)
+	require.NoError(t, err)
+	assert.Len(t, lapsed, 1)
+
+	lapsed, err = repos.Subscriptions.ListLapsed("grace_period", now, 10)
+	require.NoError(t, err)
+	assert.Empty(t, lapsed)
+}
+
+func testWebhookEvents(t *testing.T, repos *Repositories) {
+	event := func() *models.PaymentWebhookEvent {
+		return &models.PaymentWebhookEvent{Gateway: "mercadopago", EventID: "12345", Type: "payment", PaymentID: "1234567",
+			Status: models.PaymentStatusApproved, Payload: json.RawMessage(`{"id": 12345}`)}
+	}
+	claimedUntil := time.Now().Add(time.Minute)
+
+	first := event()
+	claimed, err := repos.Subscriptions.ClaimWebhookEvent(first, claimedUntil)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, 1, first.Attempts)
+
+	// A delivery while the first is being processed doesn't get it
+	concurrent := event()
+	claimed, err = repos.Subscriptions.ClaimWebhookEvent(concurrent, claimedUntil)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Nil(t, concurrent.ProcessedAt)
+	assert.Equal(t, 2, concurrent.Attempts)
+
+	// A failed attempt leaves the event to be processed on the next delivery
+	require.NoError(t, repos.Subscriptions.FinishWebhookEvent(first.ID, errors.New("subscription not found")))
+	second := event()
+	claimed, err = repos.Subscriptions.ClaimWebhookEvent(second, claimedUntil)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, 3, second.Attempts)
+	assert.Equal(t, "subscription not found", second.LastError)
+
+	require.NoError(t, repos.Subscriptions.FinishWebhookEvent(second.ID, nil))
+	third := event()
+	claimed, err = repos.Subscriptions.ClaimWebhookEvent(third, claimedUntil)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Empty(t, third.LastError)
+	require.NotNil(t, third.ProcessedAt)
+
+	// Event IDs are per gateway, and a claim that ran out can be taken over
+	other := event()
+	other.Gateway = "pagarme"
+	claimed, err = repos.Subscriptions.ClaimWebhookEvent(other, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	assert.NotEqual(t, first.ID, other.ID)
+	retry := event()
+	retry.Gateway = "pagarme"
+	claimed, err = repos.Subscriptions.ClaimWebhookEvent(retry, claimedUntil)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	assert.ErrorIs(t, repos.Subscriptions.FinishWebhookEvent(uuid.New(), nil), ErrNotFound)
+}
+
+func testAtomically(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511955553333")
+	subscription := createSubscription(t, repos, user.ID, time.Now().Add(time.Hour))
+	periodEnd := time.Now().AddDate(0, 1, 0).Truncate(time.Second)
+	payment := func(id string) *models.Payment {
+		return &models.Payment{UserID: user.ID, SubscriptionID: &subscription.ID, Gateway: "mercadopago",
+			GatewayPaymentID: id, Amount: 9.90, Status: models.PaymentStatusApproved}
+	}
+
+	failure := errors.New("payment not saved")
+	err := repos.Subscriptions.Atomically(func(tx SubscriptionRepository) error {
+		require.NoError(t, tx.ExtendPeriod(subscription.ID, subscription.CurrentPeriodEnd, periodEnd, "payment_approved"))
+		require.NoError(t, tx.SavePayment(payment("111"), "payment_approved"))
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	stored, err := repos.Subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, subscription.CurrentPeriodEnd, stored.CurrentPeriodEnd, time.Second)
+	saved, err := repos.Subscriptions.GetPaymentByGatewayID("mercadopago", "111")
+	require.NoError(t, err)
+	assert.Nil(t, saved)
+
+	require.NoError(t, repos.Subscriptions.Atomically(func(tx SubscriptionRepository) error {
+		if err := tx.ExtendPeriod(subscription.ID, subscription.CurrentPeriodEnd, periodEnd, "payment_approved"); err != nil {
+			return err
+		}
+		return tx.SavePayment(payment("222"), "payment_approved")
+	}))
+	stored, err = repos.Subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, periodEnd, stored.CurrentPeriodEnd, time.Second)
+	saved, err = repos.Subscriptions.GetPaymentByGatewayID("mercadopago", "222")
+	require.NoError(t, err)
+	assert.NotNil(t, saved)
+}
+
+func testDunningCases(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511955554444")
+	now := time.Now().Truncate(time.Second)
+	subscription := createSubscription(t, repos, user.ID, now.Add(time.Hour))
+
+	noticeAt := now.Add(-time.Minute)
+	dunningCase := &models.DunningCase{UserID: user.ID, SubscriptionID: subscription.ID, FailureReason: "cc_rejected_insufficient_amount",
+		NextNoticeAt: &noticeAt, GraceEndsAt: now.Add(72 * time.Hour)}
+	opened, err := repos.Subscriptions.OpenDunningCase(dunningCase)
+	require.NoError(t, err)
+	assert.True(t, opened)
+	assert.Equal(t, models.DunningStatusOpen, dunningCase.Status)
+
+	due, err := repos.Subscriptions.ListDueDunningCases(now, 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, dunningCase.ID, due[0].ID)
+	assert.Equal(t, user.PhoneNumber, due[0].User.PhoneNumber)
+
+	next := now.Add(24 * time.Hour)
+	require.NoError(t, repos.Subscriptions.RecordDunningNotice(dunningCase.ID, &next))
+	due, err = repos.Subscriptions.ListDueDunningCases(now, 10)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	// Another failure of the same subscription is due a notice again
+	again := &models.DunningCase{UserID: user.ID, SubscriptionID: subscription.ID, FailureReason: "cc_rejected_call_for_authorize",
+		GraceEndsAt: now.Add(72 * time.Hour)}
+	opened, err = repos.Subscriptions.OpenDunningCase(again)
+	require.NoError(t, err)
+	assert.False(t, opened)
+	assert.Equal(t, dunningCase.ID, again.ID)
+	assert.Equal(t, 2, again.Failures)
+	assert.Equal(t, 1, again.NoticesSent)
+	assert.Equal(t, "cc_rejected_call_for_authorize", again.FailureReason)
+	due, err = repos.Subscriptions.ListDueDunningCases(time.Now().Add(time.Second), 10)
+	require.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	resolved, err := repos.Subscriptions.ResolveDunningCase(subscription.ID, models.DunningStatusRecovered)
+	require.NoError(t, err)
+	require.NotNil(t, resolved)
+	assert.Equal(t, models.DunningStatusRecovered, resolved.Status)
+	assert.NotNil(t, resolved.ResolvedAt)
+	open, err := repos.Subscriptions.GetOpenDunningCase(subscription.ID)
+	require.NoError(t, err)
+	assert.Nil(t, open)
+	resolved, err = repos.Subscriptions.ResolveDunningCase(subscription.ID, models.DunningStatusChurned)
+	require.NoError(t, err)
+	assert.Nil(t, resolved, "nothing left to resolve")
+
+	// Once resolved, a new failure opens a new case
+	churning := &models.DunningCase{UserID: user.ID, SubscriptionID: subscription.ID, GraceEndsAt: now.Add(72 * time.Hour)}
+	opened, err = repos.Subscriptions.OpenDunningCase(churning)
+	require.NoError(t, err)
+	assert.True(t, opened)
+	open, err = repos.Subscriptions.GetOpenDunningCase(subscription.ID)
+	require.NoError(t, err)
+	require.NotNil(t, open)
+	assert.Equal(t, churning.ID, open.ID)
+	_, err = repos.Subscriptions.ResolveDunningCase(subscription.ID, models.DunningStatusChurned)
+	require.NoError(t, err)
+
+	stats, err := repos.Subscriptions.DunningStats(now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, &DunningStats{Opened: 2, Recovered: 1, Churned: 1, RecoveryRate: 0.5}, stats)
+	stats, err = repos.Subscriptions.DunningStats(now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, stats.Opened)
+}
+
+func testReferrals(t *testing.T, repos *Repositories) {
+	referrer := createUser(t, repos, "5511966660000")
+	referred := createUser(t, repos, "5511966661111")
+	other := createUser(t, repos, "5511966662222")
+	since := time.Now().Add(-time.Hour)
+
+	// Rejected claims are kept, and don't stop a later one
+	rejected := &models.Referral{ReferrerID: referred.ID, ReferredID: referred.ID, Code: "ARA2345CD",
+		Status: models.ReferralStatusRejected, RejectReason: models.ReferralRejectedSelf}
+	require.NoError(t, repos.Subscriptions.CreateReferral(rejected))
+	found, err := repos.Subscriptions.GetReferral(referred.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	referral := &models.Referral{ReferrerID: referrer.ID, ReferredID: referred.ID, Code: "ARA2345AB", DeviceID: "device-1", Status: models.ReferralStatusPending}
+	require.NoError(t, repos.Subscriptions.CreateReferral(referral))
+	again := &models.Referral{ReferrerID: other.ID, ReferredID: referred.ID, Code: "ARA2345EF", Status: models.ReferralStatusPending}
+	assert.ErrorIs(t, repos.Subscriptions.CreateReferral(again), ErrConflict)
+
+	found, err = repos.Subscriptions.GetReferral(referred.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, referral.ID, found.ID)
+	assert.Equal(t, models.ReferralStatusPending, found.Status)
+
+	count, err := repos.Subscriptions.CountReferrals(referrer.ID, since)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = repos.Subscriptions.CountReferrals(referred.ID, since)
+	require.NoError(t, err)
+	assert.Zero(t, count, "rejected referrals don't count")
+
+	used, err := repos.Subscriptions.DeviceReferred("device-1")
+	require.NoError(t, err)
+	assert.True(t, used)
+	used, err = repos.Subscriptions.DeviceReferred("device-2")
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	require.NoError(t, repos.Subscriptions.RewardReferral(referral.ID))
+	assert.ErrorIs(t, repos.Subscriptions.RewardReferral(referral.ID), ErrConflict, "rewarded once")
+	found, err = repos.Subscriptions.GetReferral(referred.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ReferralStatusRewarded, found.Status)
+	assert.NotNil(t, found.RewardedAt)
+
+	stats, err := repos.Subscriptions.ReferralStats(since)
+	require.NoError(t, err)
+	assert.Equal(t, &ReferralStats{Referred: 1, Rewarded: 1, Rejected: 1, RejectedBy: map[string]int{models.ReferralRejectedSelf: 1}}, stats)
+}
+
+func testCoupons(t *testing.T, repos *Repositories) {
+	user := createUser(t, repos, "5511977770000")
+	subscription := createSubscription(t, repos, user.ID, time.Now().Add(time.Hour))
+
+	expiresAt := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	coupon := &models.Coupon{Code: "BEMVINDO", Kind: models.CouponKindPercentage, Value: 20, ExpiresAt: &expiresAt, MaxUses: 100, Active: true}
+	require.NoError(t, repos.Subscriptions.CreateCoupon(coupon))
+	assert.ErrorIs(t, repos.Subscriptions.CreateCoupon(&models.Coupon{Code: "BEMVINDO", Kind: models.CouponKindFixed, Value: 1, Active: true}), ErrConflict)
+	require.NoError(t, repos.Subscriptions.CreateCoupon(&models.Coupon{Code: "FEIRA", Kind: models.CouponKindFixed, Value: 2, Active: true}))
+
+	found, err := repos.Subscriptions.GetCoupon("BEMVINDO")
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, found.Value)
+	assert.True(t, found.Active)
+	require.NotNil(t, found.ExpiresAt)
+	assert.True(t, found.ExpiresAt.Equal(expiresAt))
+	_, err = repos.Subscriptions.GetCoupon("NADA")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	coupons, err := repos.Subscriptions.ListCoupons()
+	require.NoError(t, err)
+	assert.Len(t, coupons, 2)
+
+	redemption := &models.CouponRedemption{CouponID: coupon.ID, UserID: user.ID, SubscriptionID: subscription.ID, Discount: 1.98}
+	require.NoError(t, repos.Subscriptions.RedeemCoupon(redemption))
+	again := &models.CouponRedemption{CouponID: coupon.ID, UserID: user.ID, SubscriptionID: subscription.ID, Discount: 1.98}
+	assert.ErrorIs(t, repos.Subscriptions.RedeemCoupon(again), ErrConflict, "once per user")
+	redeemed, err := repos.Subscriptions.CouponRedeemed(coupon.ID, user.ID)
+	require.NoError(t, err)
+	assert.True(t, redeemed)
+	found, err = repos.Subscriptions.GetCoupon("BEMVINDO")
+	require.NoError(t, err)
+	assert.Equal(t, 1, found.Uses)
+
+	require.NoError(t, repos.Subscriptions.DeactivateCoupon("BEMVINDO"))
+	found, err = repos.Subscriptions.GetCoupon("BEMVINDO")
+	require.NoError(t, err)
+	assert.False(t, found.Active)
+	assert.ErrorIs(t, repos.Subscriptions.DeactivateCoupon("NADA"), ErrNotFound)
+}
+
+func testAnalytics(t *testing.T, repos *Repositories) {
+	now := time.Now()
+	early := createUser(t, repos, "5511988880000")
+	late := createUser(t, repos, "5511988881111")
+	for i := 0; i < 3; i++ {
+		createTransaction(t, repos, early.ID, 10, models.TransactionTypeIncome, "Bolo", now.Add(time.Duration(i-3)*time.Minute))
+	}
+	createTransaction(t, repos, late.ID, 10, models.TransactionTypeIncome, "Bolo", now.Add(-time.Minute))
+
+	record := func(user *models.User, name, onceKey string) {
+		t.Helper()
+		require.NoError(t, repos.Analytics.Record(&models.AnalyticsEvent{UserID: user.ID, Name: name, OnceKey: onceKey, Properties: json.RawMessage(`{}`)}))
+	}
+	record(early, models.AnalyticsFirstTransaction, models.AnalyticsFirstTransaction)
+	record(early, models.AnalyticsConversionMessageSent, "")
+	record(early, models.AnalyticsConversionMessageSent, "")
+	record(early, models.AnalyticsFirstTransaction, models.AnalyticsFirstTransaction) // Once per user: dropped
+	record(late, models.AnalyticsFirstTransaction, models.AnalyticsFirstTransaction)
+
+	activity, err := repos.Analytics.CohortActivity(now.Add(-time.Hour), now.Add(time.Hour), 3)
+	require.NoError(t, err)
+	require.Len(t, activity, 2)
+	assert.Equal(t, early.ID, activity[0].UserID)
+	assert.Equal(t, 3, activity[0].Transactions)
+	require.NotNil(t, activity[0].NthTransactionAt)
+	assert.WithinDuration(t, now.Add(-time.Minute), *activity[0].NthTransactionAt, time.Second)
+	assert.Len(t, activity[0].FirstEvents, 2)
+	assert.Equal(t, 1, activity[1].Transactions)
+	assert.Nil(t, activity[1].NthTransactionAt)
+	assert.Contains(t, activity[1].FirstEvents, models.AnalyticsFirstTransaction)
+
+	activity, err = repos.Analytics.CohortActivity(now.Add(time.Hour), now.Add(2*time.Hour), 3)
+	require.NoError(t, err)
+	assert.Empty(t, activity)
+
+	transactions, err := repos.Analytics.TransactionActivity(now.Add(-150*time.Second), now)
+	require.NoError(t, err)
+	assert.Equal(t, &TransactionActivity{Transactions: 3, Users: 2}, transactions)
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+// Cohort periods of the funnel report
+const (
+	CohortWeek  = "week"
+	CohortMonth = "month"
+)
+
+// funnelSteps are the events the funnel report counts users through, in order
+var funnelSteps = []string{
+	models.AnalyticsFirstTransaction,
+	models.AnalyticsTrialWarningShown,
+	models.AnalyticsTrialExhausted,
+	models.AnalyticsConversionMessageSent,
+	models.AnalyticsSubscribed,
+	models.AnalyticsChurned,
+}
+
+// onceEvents are recorded the first time only: they mark how far a user got
+var onceEvents = map[string]bool{
+	models.AnalyticsUserCreated:       true,
+	models.AnalyticsFirstTransaction:  true,
+	models.AnalyticsTrialWarningShown: true,
+	models.AnalyticsTrialExhausted:    true,
+}
+
+// AnalyticsService keeps the event log of the conversion funnel and reports on it. Tracking
+// is best effort: failures are logged rather than returned, so they never break what the
+// user is doing, and a nil service tracks nothing.
+type AnalyticsService struct {
+	events repository.AnalyticsRepository
+	users  repository.UserRepository
+	plans  *PlanCatalog
+}
+
+// NewAnalyticsService creates the service; the reports measure users against the trial
+// of plans
+func NewAnalyticsService(events repository.AnalyticsRepository, users repository.UserRepository, plans *PlanCatalog) *AnalyticsService {
+	return &AnalyticsService{events: events, users: users, plans: plans}
+}
+
+// Track records an event of the user, with properties that may be nil
+func (s *AnalyticsService) Track(userID uuid.UUID, name string, properties map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	if properties == nil {
+		properties = map[string]interface{}{}
+	}
+	payload, err := json.Marshal(properties)
+	if err != nil {
+		logrus.Errorf("Failed to encode analytics event %s of user %s: %v", name, userID, err)
+		return
+	}
+
+	event := &models.AnalyticsEvent{UserID: userID, Name: name, Properties: payload}
+	if onceEvents[name] {
+		event.OnceKey = name
+	}
+	if err := s.events.Record(event); err != nil {
+		logrus.Errorf("Failed to record analytics event %s of user %s: %v", name, userID, err)
+	}
+}
+
+// TrackTransaction records the steps a new transaction of the user takes them to: their
+// first transaction, and the last one of a trial user's free transactions
+func (s *AnalyticsService) TrackTransaction(userID uuid.UUID) {
+	if s == nil {
+		return
+	}
+	user, err := s.users.GetByID(userID)
+	if err != nil {
+		logrus.Errorf("Failed to track the transaction of user %s: %v", userID, err)
+		return
+	}
+
+	if user.TrialTransactionsCount == 1 {
+		s.Track(user.ID, models.AnalyticsFirstTransaction, nil)
+	}
+	if user.SubscriptionStatus == models.SubscriptionStatusTrial && user.TrialTransactionsCount >= s.plans.Trial.Limit(user) {
+		s.Track(user.ID, models.AnalyticsTrialExhausted, map[string]interface{}{"transactions": user.TrialTransactionsCount})
+	}
+}
+
+// FunnelReport follows the users who signed up in [From, To), by cohort of the week or
+// month they signed up in. The trial is the catalog's, without referral bonuses.
+type FunnelReport struct {
+	From              time.Time      `json:"from"`
+	To                time.Time      `json:"to"`
+	Period            string         `json:"period"`
+	TrialTransactions int            `json:"trial_transactions"`
+	Total             CohortFunnel   `json:"total"`
+	Cohorts           []CohortFunnel `json:"cohorts"`
+}
+
+// CohortFunnel is how far the users of a cohort went. Users still in their trial count
+// where they are now, so the drop-off of recent cohorts isn't final.
+type CohortFunnel struct {
+	Cohort string       `json:"cohort"` // First day of the week, or the month
+	Users  int          `json:"users"`
+	Steps  []FunnelStep `json:"steps"`
+
+	// The KPIs: the share of users who subscribed, of users who stopped short of the trial's
+	// transactions without subscribing, and of users who logged them all but didn't subscribe
+	ConversionRate          float64 `json:"conversion_rate"`
+	DropOffBeforeLimit      float64 `json:"drop_off_before_limit"`
+	NonConversionAfterLimit float64 `json:"non_conversion_after_limit"`
+
+	ReachedLimit int            `json:"reached_limit"`
+	DaysToLimit  *DaysToLimit   `json:"days_to_limit,omitempty"` // Nil when no one reached it
+	DropOff      []DropOffPoint `json:"drop_off"`
+}
+
+// FunnelStep counts the users who got to an event. Rate is their share of the cohort.
+type FunnelStep struct {
+	Event string  `json:"event"`
+	Users int     `json:"users"`
+	Rate  float64 `json:"rate"`
+}
+
+// DaysToLimit is how long users took from signing up to logging the trial's transactions
+type DaysToLimit struct {
+	Median  float64 `json:"median"`
+	Average float64 `json:"average"`
+}
+
+// DropOffPoint counts the users who didn't subscribe by how many transactions they logged
+type DropOffPoint struct {
+	Transactions string `json:"transactions"` // Range, like "10-24" or "50+"
+	Users        int    `json:"users"`
+}
+
+// FunnelReport builds the funnel of the users who signed up in [from, to), by cohorts of
+// period (CohortWeek or CohortMonth)
+func (s *AnalyticsService) FunnelReport(from, to time.Time, period string) (*FunnelReport, error) {
+	if period != CohortWeek && period != CohortMonth {
+		return nil, fmt.Errorf("unknown cohort period: %s", period)
+	}
+	limit := s.plans.Trial.Transactions
+	activity, err := s.events.CohortActivity(from, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cohort activity: %w", err)
+	}
+
+	report := &FunnelReport{From: from, To: to, Period: period, TrialTransactions: limit, Cohorts: []CohortFunnel{}}
+	var cohort []repository.UserActivity
+	for i, user := range activity {
+		cohort = append(cohort, user)
+		name := cohortName(user.SignedUpAt, period)
+		if i == len(activity)-1 || cohortName(activity[i+1].SignedUpAt, period) != name {
+			report.Cohorts = append(report.Cohorts, s.cohortFunnel(name, cohort))
+			cohort = nil
+		}
+	}
+	report.Total = s.cohortFunnel("total", activity)
+	return report, nil
+}
+
+// cohortFunnel sums up the activity of a cohort's users
+func (s *AnalyticsService) cohortFunnel(name string, users []repository.UserActivity) CohortFunnel {
+	trial := s.plans.Trial
+	boundaries := dropOffBoundaries(trial)
+	funnel := CohortFunnel{Cohort: name, Users: len(users), Steps: make([]FunnelStep, len(funnelSteps))}
+	for i, event := range funnelSteps {
+		funnel.Steps[i].Event = event
+	}
+	funnel.DropOff = make([]DropOffPoint, len(boundaries))
+	for i := range boundaries {
+		funnel.DropOff[i].Transactions = dropOffLabel(boundaries, i)
+	}
+
+	var converted, stoppedShort, notConverted int
+	var daysToLimit []float64
+	for _, user := range users {
+		for i, event := range funnelSteps {
+			if _, ok := user.FirstEvents[event]; ok {
+				funnel.Steps[i].Users++
+			}
+		}
+		_, subscribed := user.FirstEvents[models.AnalyticsSubscribed]
+		reached := user.NthTransactionAt != nil
+		if reached {
+			funnel.ReachedLimit++
+			daysToLimit = append(daysToLimit, user.NthTransactionAt.Sub(user.SignedUpAt).Hours()/24)
+		}
+
+		switch {
+		case subscribed:
+			converted++
+			continue
+		case reached:
+			notConverted++
+		default:
+			stoppedShort++
+		}
+		// The last boundary the user's transactions got to
+		point := sort.SearchInts(boundaries, user.Transactions+1) - 1
+		funnel.DropOff[point].Users++
+	}
+
+	if funnel.Users > 0 {
+		for i := range funnel.Steps {
+			funnel.Steps[i].Rate = float64(funnel.Steps[i].Users) / float64(funnel.Users)
+		}
+		funnel.ConversionRate = float64(converted) / float64(funnel.Users)
+		funnel.DropOffBeforeLimit = float64(stoppedShort) / float64(funnel.Users)
+	}
+	if funnel.ReachedLimit > 0 {
+		funnel.NonConversionAfterLimit = float64(notConverted) / float64(funnel.ReachedLimit)
+		funnel.DaysToLimit = newDaysToLimit(daysToLimit)
+	}
+	return funnel
+}
+
+// dropOffBoundaries are the transaction counts each drop-off point starts at: none, one,
+// ten, half the trial, the warning and the end of the trial
+func dropOffBoundaries(trial TrialPolicy) []int {
+	candidates := []int{1, 10, trial.Transactions / 2, trial.WarnAt, trial.Transactions}
+	sort.Ints(candidates)
+	boundaries := []int{0}
+	for _, boundary := range candidates {
+		if boundary > boundaries[len(boundaries)-1] && boundary <= trial.Transactions {
+			boundaries = append(boundaries, boundary)
+		}
+	}
+	return boundaries
+}
+
+func dropOffLabel(boundaries []int, i int) string {
+	switch {
+	case i == len(boundaries)-1:
+		return fmt.Sprintf("%d+", boundaries[i])
+	case boundaries[i+1]-boundaries[i] == 1:
+		return fmt.Sprintf("%d", boundaries[i])
+	default:
+		return fmt.Sprintf("%d-%d", boundaries[i], boundaries[i+1]-1)
+	}
+}
+
+func newDaysToLimit(days []float64) *DaysToLimit {
+	sort.Float64s(days)
+	total := 0.0
+	for _, d := range days {
+		total += d
+	}
+	median := days[len(days)/2]
+	if len(days)%2 == 0 {
+		median = (days[len(days)/2-1] + days[len(days)/2]) / 2
+	}
+	return &DaysToLimit{Median: median, Average: total / float64(len(days))}
+}
+
+// cohortName names the week (by its Monday) or the month a user signed up in
+func cohortName(signedUpAt time.Time, period string) string {
+	if period == CohortMonth {
+		return signedUpAt.Format("2006-01")
+	}
+	monday := signedUpAt.AddDate(0, 0, -(int(signedUpAt.Weekday())+6)%7)
+	return monday.Format(time.DateOnly)
+}
+
+// MonthlyTransactions counts the transactions of a month and the users who logged them
+type MonthlyTransactions struct {
+	Month         string  `json:"month"`
+	Transactions  int     `json:"transactions"`
+	ActiveUsers   int     `json:"active_users"`
+	PerActiveUser float64 `json:"per_active_user"`
+}
+
+// TransactionsPerMonth counts the transactions of the last months, now's month included,
+// oldest first
+func (s *AnalyticsService) TransactionsPerMonth(now time.Time, months int) ([]MonthlyTransactions, error) {
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, 1-months, 0)
+	results := make([]MonthlyTransactions, 0, months)
+	for month := first; len(results) < months; month = month.AddDate(0, 1, 0) {
+		activity, err := s.events.TransactionActivity(month, month.AddDate(0, 1, 0))
+		if err != nil {
+			return nil, fmt.Errorf("failed to count transactions: %w", err)
+		}
+		result := MonthlyTransactions{Month: month.Format("2006-01"), Transactions: activity.Transactions, ActiveUsers: activity.Users}
+		if activity.Users > 0 {
+			result.PerActiveUser = float64(activity.Transactions) / float64(activity.Users)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+func TestAnalyticsFollowTheUserThroughTheFunnel(t *testing.T) {
+	subscriptionService, userService, transactionService, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	started := time.Now()
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511944440000")
+	require.NoError(t, err)
+	for i := 0; i < subscriptionService.Plans().Trial.Transactions; i++ {
+		_, err := transactionService.CreateTransactionFromInput(user.ID.String(), TransactionInput{
+			Amount: 10, Description: "Bolo", TransactionType: models.TransactionTypeIncome,
+			Source: models.TransactionSourceText, SkipDuplicateCheck: true,
+		})
+		require.NoError(t, err)
+	}
+	_, err = subscriptionService.reportingService.GenerateTrialStatusMessage(user.ID.String())
+	require.NoError(t, err)
+	_, err = subscriptionService.reportingService.GenerateConversionMessage(user.ID.String())
+	require.NoError(t, err)
+	subscribe(t, subscriptionService, gateway, user)
+	require.NoError(t, subscriptionService.CancelSubscription(user.ID.String()))
+
+	// Another user never gets past their third transaction
+	other, err := userService.GetOrCreateChannelUser(ChannelTelegram, "4242")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := transactionService.CreateTransaction(other.ID.String(), float64(i+1), "Café", models.TransactionTypeExpense, models.TransactionSourceText)
+		require.NoError(t, err)
+	}
+
+	report, err := subscriptionService.analytics.FunnelReport(started.Add(-time.Minute), time.Now().Add(time.Minute), CohortMonth)
+	require.NoError(t, err)
+	require.Len(t, report.Cohorts, 1)
+	total := report.Total
+	assert.Equal(t, 2, total.Users)
+	assert.Equal(t, []FunnelStep{
+		{Event: models.AnalyticsFirstTransaction, Users: 2, Rate: 1},
+		{Event: models.AnalyticsTrialWarningShown, Users: 1, Rate: 0.5},
+		{Event: models.AnalyticsTrialExhausted, Users: 1, Rate: 0.5},
+		{Event: models.AnalyticsConversionMessageSent, Users: 1, Rate: 0.5},
+		{Event: models.AnalyticsSubscribed, Users: 1, Rate: 0.5},
+		{Event: models.AnalyticsChurned, Users: 1, Rate: 0.5},
+	}, total.Steps)
+	assert.Equal(t, 0.5, total.ConversionRate)
+	assert.Equal(t, 0.5, total.DropOffBeforeLimit)
+	assert.Zero(t, total.NonConversionAfterLimit)
+	assert.Equal(t, 1, total.ReachedLimit)
+	require.NotNil(t, total.DaysToLimit)
+	assert.Less(t, total.DaysToLimit.Median, 0.01)
+	assert.Equal(t, []DropOffPoint{
+		{Transactions: "0"}, {Transactions: "1-9", Users: 1}, {Transactions: "10-24"},
+		{Transactions: "25-39"}, {Transactions: "40-49"}, {Transactions: "50+"},
+	}, total.DropOff)
+	assert.Equal(t, total.Steps, report.Cohorts[0].Steps)
+}
+
+func TestFunnelReportCohorts(t *testing.T) {
+	plans, err := LoadPlanCatalog("")
+	require.NoError(t, err)
+	repos := repository.NewMemory()
+	analytics := NewAnalyticsService(repos.Analytics, repos.Users, plans)
+
+	monday := time.Date(2025, time.June, 2, 9, 0, 0, 0, time.UTC)
+	signUp := func(at time.Time, transactions int, subscribed bool) {
+		t.Helper()
+		user := &models.User{PhoneNumber: uuid.NewString()[:13], CreatedAt: at}
+		require.NoError(t, repos.Users.Create(user))
+		for i := 0; i < transactions; i++ {
+			require.NoError(t, repos.Transactions.Create(&models.Transaction{
+				UserID: user.ID, Amount: 1, TransactionType: models.TransactionTypeIncome,
+				Source: models.TransactionSourceText, CreatedAt: at.Add(time.Duration(i) * time.Hour),
+			}))
+		}
+		if subscribed {
+			require.NoError(t, repos.Analytics.Record(&models.AnalyticsEvent{
+				UserID: user.ID, Name: models.AnalyticsSubscribed, Properties: json.RawMessage(`{}`), CreatedAt: at.Add(72 * time.Hour),
+			}))
+		}
+	}
+	signUp(monday, 50, true)                   // 49 hours to the 50th
+	signUp(monday.AddDate(0, 0, 6), 60, false) // Sunday, same week, and past the trial
+	signUp(monday.AddDate(0, 0, 7), 45, false)
+	signUp(monday.AddDate(0, 0, 8), 0, false)
+	signUp(monday.AddDate(0, 1, 0), 1, false) // After the report
+
+	report, err := analytics.FunnelReport(monday, monday.AddDate(0, 0, 14), CohortWeek)
+	require.NoError(t, err)
+	require.Len(t, report.Cohorts, 2)
+
+	first := report.Cohorts[0]
+	assert.Equal(t, "2025-06-02", first.Cohort)
+	assert.Equal(t, 2, first.Users)
+	assert.Equal(t, 2, first.ReachedLimit)
+	assert.Equal(t, 0.5, first.ConversionRate)
+	assert.Equal(t, 0.5, first.NonConversionAfterLimit)
+	assert.Zero(t, first.DropOffBeforeLimit)
+	assert.Equal(t, &DaysToLimit{Median: 49.0 / 24, Average: 49.0 / 24}, first.DaysToLimit)
+	assert.Equal(t, 1, first.DropOff[5].Users)
+
+	second := report.Cohorts[1]
+	assert.Equal(t, "2025-06-09", second.Cohort)
+	assert.Equal(t, 2, second.Users)
+	assert.Zero(t, second.ConversionRate)
+	assert.Equal(t, 1.0, second.DropOffBeforeLimit)
+	assert.Nil(t, second.DaysToLimit)
+	assert.Equal(t, 1, second.DropOff[0].Users)
+	assert.Equal(t, 1, second.DropOff[4].Users)
+
+	assert.Equal(t, 4, report.Total.Users)
+	assert.Equal(t, 0.25, report.Total.ConversionRate)
+
+	_, err = analytics.FunnelReport(monday, monday.AddDate(0, 0, 14), "day")
+	assert.Error(t, err)
+
+	months, err := analytics.TransactionsPerMonth(monday.AddDate(0, 1, 0), 3)
+	require.NoError(t, err)
+	assert.Equal(t, []MonthlyTransactions{
+		{Month: "2025-05"},
+		{Month: "2025-06", Transactions: 155, ActiveUsers: 3, PerActiveUser: 155.0 / 3},
+		{Month: "2025-07", Transactions: 1, ActiveUsers: 1, PerActiveUser: 1},
+	}, months)
+}
+
+func TestDropOffBoundaries(t *testing.T) {
+	for _, test := range []struct {
+		trial  TrialPolicy
+		labels []string
+	}{
+		{TrialPolicy{Transactions: 50, WarnAt: 40}, []string{"0", "1-9", "10-24", "25-39", "40-49", "50+"}},
+		{TrialPolicy{Transactions: 10, WarnAt: 8}, []string{"0", "1-4", "5-7", "8-9", "10+"}},
+		{TrialPolicy{Transactions: 2, WarnAt: 2}, []string{"0", "1", "2+"}},
+	} {
+		boundaries := dropOffBoundaries(test.trial)
+		var labels []string
+		for i := range boundaries {
+			labels = append(labels, dropOffLabel(boundaries, i))
+		}
+		assert.Equal(t, test.labels, labels)
+	}
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+// Messaging channels the bot is reachable on
+const (
+	ChannelWhatsApp = "whatsapp"
+	ChannelTelegram = "telegram"
+)
+
+// Channel is a messaging platform adapter. The conversation flow only talks to channels
+// through this interface and the channel-neutral message types below.
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, message OutgoingMessage) error
+	DownloadMedia(ctx context.Context, mediaID string, maxBytes int64) (*Media, error)
+}
+
+// Notifier sends proactive messages from the template registry, outside of a conversation.
+// WhatsAppService implements it.
+type Notifier interface {
+	SendNotification(to, templateName string, params map[string]string) error
+}
+
+type InboundMessageType string
+
+const (
+	InboundText        InboundMessageType = "text"
+	InboundAudio       InboundMessageType = "audio"
+	InboundImage       InboundMessageType = "image"
+	InboundInteractive InboundMessageType = "interactive"
+	InboundUnsupported InboundMessageType = "unsupported"
+)
+
+// InboundMessage is a message from a user on any channel
+type InboundMessage struct {
+	Channel    string
+	From       string // Address to reply to: phone number on WhatsApp, chat ID on Telegram
+	ID         string
+	ReceivedAt time.Time
+	Type       InboundMessageType
+	Text       string    // Text body or media caption
+	Media      *MediaRef // Audio or image to download through the channel
+	ReplyID    string    // ID of the tapped button or list row
+	ReplyTo    string    // ID of the message the user replied to, if any
+}
+
+// MediaRef identifies media on the channel it came from
+type MediaRef struct {
+	ID       string
+	MimeType string
+	SHA256   string
+}
+
+// Media is a downloaded media file
+type Media struct {
+	Data     []byte
+	MimeType string
+	SHA256   string
+}
+
+// OutgoingMessage is a reply to a user. Text is the body (or the caption of Image);
+// at most one of Buttons, List and Image is set.
+type OutgoingMessage struct {
+	To      string
+	Text    string
+	Buttons []Button
+	List    *ListMenu
+	Image   *OutgoingImage
+	ReplyTo string // Quote this inbound message ID, where the channel supports it
+}
+
+// Button is a quick-reply option
+type Button struct {
+	ID    string
+	Title string
+}
+
+// ListMenu is a menu of options grouped in sections
+type ListMenu struct {
+	ButtonLabel string // Label of the button that opens the menu
+	Sections    []ListSection
+}
+
+type ListSection struct {
+	Title string
+	Rows  []ListRow
+}
+
+type ListRow struct {
+	ID          string
+	Title       string
+	Description string
+}
+
+type OutgoingImage struct {
+	Data     []byte
+	MimeType string
+}
+
+// Chat is the conversation with one user on one channel
+type Chat struct {
+	Channel Channel
+	To      string
+}
+
+func (c Chat) SendText(text string) error {
+	return c.Channel.Send(context.Background(), OutgoingMessage{To: c.To, Text: text})
+}
+
+func (c Chat) SendButtons(body string, buttons []Button) error {
+	return c.Channel.Send(context.Background(), OutgoingMessage{To: c.To, Text: body, Buttons: buttons})
+}
+
+func (c Chat) SendList(body, buttonLabel string, sections []ListSection) error {
+	return c.Channel.Send(context.Background(), OutgoingMessage{To: c.To, Text: body, List: &ListMenu{ButtonLabel: buttonLabel, Sections: sections}})
+}
+
+func (c Chat) SendImage(data []byte, mimeType, caption string) error {
+	return c.Channel.Send(context.Background(), OutgoingMessage{To: c.To, Text: caption, Image: &OutgoingImage{Data: data, MimeType: mimeType}})
+}
+
+func (c Chat) DownloadMedia(ctx context.Context, media *MediaRef, maxBytes int64) (*Media, error) {
+	downloaded, err := c.Channel.DownloadMedia(ctx, media.ID, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	// The webhook's metadata is more reliable than what the download reports
+	if media.MimeType != "" {
+		downloaded.MimeType = media.MimeType
+	}
+	if media.SHA256 != "" {
+		downloaded.SHA256 = media.SHA256
+	}
+	return downloaded, nil
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"project-ara/internal/models"
+)
+
+//go:embed das_mei.json
+var defaultDASTable []byte
+
+// ErrNoDASValues is returned for months before the first year of the DAS table
+var ErrNoDASValues = errors.New("no DAS values for the month")
+
+// DASYear holds the values the DAS-MEI of a year's months is computed from: the INSS is a
+// share of the minimum wage, and the ICMS (commerce and industry) and ISS (services) are
+// fixed amounts
+type DASYear struct {
+	Year        int     `json:"year"`
+	MinimumWage float64 `json:"minimum_wage"`
+	INSSRate    float64 `json:"inss_rate"`
+	ICMS        float64 `json:"icms"`
+	ISS         float64 `json:"iss"`
+}
+
+// DASTable is the versioned table of DAS-MEI values, one row per year. Each January's new
+// minimum wage is a new row and a new version.
+type DASTable struct {
+	Version string    `json:"version"`
+	Years   []DASYear `json:"years"`
+}
+
+// LoadDASTable reads the DAS table from path, or the embedded das_mei.json when path is
+// empty
+func LoadDASTable(path string) (*DASTable, error) {
+	data := defaultDASTable
+	if path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DAS table: %w", err)
+		}
+		data = fileData
+	}
+
+	var table DASTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("failed to parse DAS table: %w", err)
+	}
+	if table.Version == "" || len(table.Years) == 0 {
+		return nil, errors.New("invalid DAS table: no version or years")
+	}
+	sort.Slice(table.Years, func(i, j int) bool { return table.Years[i].Year < table.Years[j].Year })
+	for i, year := range table.Years {
+		if year.MinimumWage <= 0 || year.INSSRate <= 0 || year.INSSRate >= 1 || year.ICMS < 0 || year.ISS < 0 {
+			return nil, fmt.Errorf("invalid DAS values for %d: %+v", year.Year, year)
+		}
+		if i > 0 && table.Years[i-1].Year == year.Year {
+			return nil, fmt.Errorf("invalid DAS table: %d listed twice", year.Year)
+		}
+	}
+	return &table, nil
+}
+
+// DASAmount is the DAS-MEI of a month, due on the 20th of the next. Activity is the MEI's
+// activity type; when it's unknown, ICMS and ISS are both zero and Total is the INSS alone.
+type DASAmount struct {
+	Month        time.Time `json:"month"` // First day of the month the DAS is for
+	DueDate      time.Time `json:"due_date"`
+	Activity     string    `json:"activity,omitempty"`
+	INSS         float64   `json:"inss"`
+	ICMS         float64   `json:"icms"`
+	ISS          float64   `json:"iss"`
+	Total        float64   `json:"total"`
+	TableVersion string    `json:"table_version"`
+	Estimated    bool      `json:"estimated"` // The table has no row for the month's year yet, so the latest one was used
+}
+
+// Amount computes the DAS-MEI of the month that contains month for an activity type
+func (t *DASTable) Amount(month time.Time, activity string) (*DASAmount, error) {
+	first := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+	values, exact, err := t.year(first.Year())
+	if err != nil {
+		return nil, err
+	}
+
+	amount := &DASAmount{
+		Month:        first,
+		DueDate:      first.AddDate(0, 1, 19),
+		Activity:     activity,
+		INSS:         roundCents(values.MinimumWage * values.INSSRate),
+		TableVersion: t.Version,
+		Estimated:    !exact,
+	}
+	switch activity {
+	case models.MEIActivityCommerce:
+		amount.ICMS = values.ICMS
+	case models.MEIActivityServices:
+		amount.ISS = values.ISS
+	case models.MEIActivityCommerceAndServices:
+		amount.ICMS = values.ICMS
+		amount.ISS = values.ISS
+	}
+	amount.Total = roundCents(amount.INSS + amount.ICMS + amount.ISS)
+	return amount, nil
+}
+
+// year returns the values of a year, or those of the latest year before it when the table
+// wasn't updated yet
+func (t *DASTable) year(year int) (DASYear, bool, error) {
+	for i := len(t.Years) - 1; i >= 0; i-- {
+		if t.Years[i].Year <= year {
+			return t.Years[i], t.Years[i].Year == year, nil
+		}
+	}
+	return DASYear{}, false, fmt.Errorf("%w: %d", ErrNoDASValues, year)
+}
+
+// Name names the DAS by its month, as in "DAS-MEI de junho"
+func (a *DASAmount) Name() string {
+	return dasName(a.Month)
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
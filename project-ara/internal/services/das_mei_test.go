@@ -0,0 +1,88 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+)
+
+func TestDASAmount(t *testing.T) {
+	table, err := LoadDASTable("")
+	require.NoError(t, err)
+
+	june := time.Date(2025, time.June, 12, 0, 0, 0, 0, time.UTC)
+	amount, err := table.Amount(june, models.MEIActivityServices)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, time.June, 1, 0, 0, 0, 0, time.UTC), amount.Month)
+	assert.Equal(t, time.Date(2025, time.July, 20, 0, 0, 0, 0, time.UTC), amount.DueDate)
+	assert.Equal(t, 75.90, amount.INSS)
+	assert.Zero(t, amount.ICMS)
+	assert.Equal(t, 5.0, amount.ISS)
+	assert.Equal(t, 80.90, amount.Total)
+	assert.Equal(t, "DAS-MEI de junho", amount.Name())
+	assert.False(t, amount.Estimated)
+
+	for activity, total := range map[string]float64{
+		models.MEIActivityCommerce:            76.90,
+		models.MEIActivityCommerceAndServices: 81.90,
+		"":                                    75.90, // INSS only
+	} {
+		amount, err := table.Amount(june, activity)
+		require.NoError(t, err)
+		assert.Equal(t, total, amount.Total, activity)
+	}
+
+	// December's DAS is due in January, and each year has its minimum wage
+	amount, err = table.Amount(time.Date(2025, time.December, 1, 0, 0, 0, 0, time.UTC), models.MEIActivityCommerce)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, time.January, 20, 0, 0, 0, 0, time.UTC), amount.DueDate)
+	amount, err = table.Amount(time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC), models.MEIActivityCommerce)
+	require.NoError(t, err)
+	assert.Equal(t, 81.05, amount.INSS)
+	assert.Equal(t, 82.05, amount.Total)
+
+	// Until the table has the year, the latest values are an estimate
+	amount, err = table.Amount(time.Date(2099, time.March, 1, 0, 0, 0, 0, time.UTC), models.MEIActivityCommerce)
+	require.NoError(t, err)
+	assert.True(t, amount.Estimated)
+	assert.Equal(t, table.Years[len(table.Years)-1].ICMS, amount.ICMS)
+
+	_, err = table.Amount(time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC), models.MEIActivityCommerce)
+	assert.True(t, errors.Is(err, ErrNoDASValues))
+}
+
+func TestDASTableFile(t *testing.T) {
+	write := func(table string) string {
+		path := filepath.Join(t.TempDir(), "das_mei.json")
+		require.NoError(t, os.WriteFile(path, []byte(table), 0o644))
+		return path
+	}
+
+	table, err := LoadDASTable(write(`{"version": "test", "years": [
+		{"year": 2031, "minimum_wage": 2000, "inss_rate": 0.05, "icms": 1, "iss": 5},
+		{"year": 2030, "minimum_wage": 1900, "inss_rate": 0.05, "icms": 1, "iss": 5}
+	]}`))
+	require.NoError(t, err)
+	assert.Equal(t, 2030, table.Years[0].Year)
+	amount, err := table.Amount(time.Date(2031, time.May, 1, 0, 0, 0, 0, time.UTC), models.MEIActivityServices)
+	require.NoError(t, err)
+	assert.Equal(t, 105.0, amount.Total)
+	assert.Equal(t, "test", amount.TableVersion)
+
+	for _, invalid := range []string{
+		`{"years": [{"year": 2030, "minimum_wage": 1900, "inss_rate": 0.05}]}`,
+		`{"version": "test", "years": []}`,
+		`{"version": "test", "years": [{"year": 2030, "minimum_wage": 1900, "inss_rate": 5}]}`,
+		`{"version": "test", "years": [{"year": 2030, "minimum_wage": 1900, "inss_rate": 0.05}, {"year": 2030, "minimum_wage": 2000, "inss_rate": 0.05}]}`,
+	} {
+		_, err := LoadDASTable(write(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
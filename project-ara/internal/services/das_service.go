@@ -0,0 +1,365 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+// JobDASReminderSweep enqueues the month's DAS reminders; JobDASReminder sends one
+const (
+	JobDASReminderSweep = "das_reminder_sweep"
+	JobDASReminder      = "das_reminder"
+)
+
+// DASDescription describes the expense of a DAS payment. Categories group transactions by
+// description, so every DAS paid lands in the same one.
+const DASDescription = "DAS-MEI"
+
+// defaultDASReminderDays is how many days before the 20th reminders start
+const defaultDASReminderDays = 5
+
+var (
+	ErrMEIActivityUnknown = errors.New("MEI activity unknown")
+	ErrDASAlreadyPaid     = errors.New("DAS already paid this month")
+)
+
+// dasActivityNames are the MEI activity types as users type them after "das"
+var dasActivityNames = map[string]string{
+	"comércio":            models.MEIActivityCommerce,
+	"comercio":            models.MEIActivityCommerce,
+	"indústria":           models.MEIActivityCommerce,
+	"industria":           models.MEIActivityCommerce,
+	"serviços":            models.MEIActivityServices,
+	"servicos":            models.MEIActivityServices,
+	"comércio e serviços": models.MEIActivityCommerceAndServices,
+	"comercio e servicos": models.MEIActivityCommerceAndServices,
+	"ambos":               models.MEIActivityCommerceAndServices,
+}
+
+// dasPaymentPrefixes start the message of a user reporting their DAS paid
+var dasPaymentPrefixes = []string{"paguei o das", "paguei das", "das pago"}
+
+// DASService computes each MEI's monthly DAS, reminds subscribers to pay it before it's due
+// on the 20th and logs its payment as an expense
+type DASService struct {
+	table              *DASTable
+	users              repository.UserRepository
+	transactions       repository.TransactionRepository
+	transactionService *TransactionService
+	entitlements       *EntitlementService
+	notifier           Notifier
+	reminderDays       int
+}
+
+// NewDASService creates the service. Reminders start DAS_REMINDER_DAYS days before the
+// 20th; notifier may be nil, and then none is sent.
+func NewDASService(table *DASTable, users repository.UserRepository, transactions repository.TransactionRepository, transactionService *TransactionService, entitlements *EntitlementService, notifier Notifier) *DASService {
+	reminderDays := envInt("DAS_REMINDER_DAYS", defaultDASReminderDays)
+	if reminderDays >= 20 {
+		logrus.Warnf("DAS_REMINDER_DAYS must be less than 20, using %d", defaultDASReminderDays)
+		reminderDays = defaultDASReminderDays
+	}
+	return &DASService{
+		table:              table,
+		users:              users,
+		transactions:       transactions,
+		transactionService: transactionService,
+		entitlements:       entitlements,
+		notifier:           notifier,
+		reminderDays:       reminderDays,
+	}
+}
+
+// RegisterJobs schedules the daily sweep that enqueues the reminders, in the morning in
+// Brazil, and the handler that sends them
+func (s *DASService) RegisterJobs(scheduler *JobScheduler) error {
+	scheduler.Handle(JobDASReminder, func(ctx context.Context, job models.Job) error {
+		var payload dasReminderPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid DAS reminder payload: %w", err)
+		}
+		_, err := s.SendReminder(payload.UserID, time.Now())
+		return err
+	})
+	return scheduler.Every(JobDASReminderSweep, "CRON_TZ=America/Sao_Paulo 0 9 * * *", func(ctx context.Context, job models.Job) error {
+		enqueued, err := s.EnqueueReminders(ctx, scheduler, time.Now())
+		if enqueued > 0 {
+			logrus.Infof("DAS sweep enqueued %d reminders", enqueued)
+		}
+		return err
+	})
+}
+
+type dasReminderPayload struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+// EnqueueReminders enqueues a reminder for every user who may have the tax reminders, once
+// a month, on the days before the 20th. Whether they do is checked when it's sent.
+// Returns how many reminders were enqueued.
+func (s *DASService) EnqueueReminders(ctx context.Context, scheduler *JobScheduler, now time.Time) (int, error) {
+	if now.Day() >= 20 || now.Day() < 20-s.reminderDays {
+		return 0, nil
+	}
+	statuses := []string{models.SubscriptionStatusActive, models.SubscriptionStatusGracePeriod}
+	if slices.Contains(s.entitlements.plans.Trial.Features, FeatureTaxReminders) {
+		statuses = append(statuses, models.SubscriptionStatusTrial)
+	}
+
+	enqueued := 0
+	afterID := uuid.Nil
+	for {
+		users, err := s.users.ListBySubscriptionStatus(statuses, afterID, sweepBatchSize)
+		if err != nil {
+			return enqueued, fmt.Errorf("failed to list users: %w", err)
+		}
+		for _, user := range users {
+			if ctx.Err() != nil {
+				return enqueued, ctx.Err()
+			}
+			if user.PhoneNumber == "" {
+				continue
+			}
+			key := fmt.Sprintf("das-reminder:%s:%s", now.Format("2006-01"), user.ID)
+			added, err := scheduler.EnqueueOnce(key, JobDASReminder, dasReminderPayload{UserID: user.ID}, now)
+			if err != nil {
+				return enqueued, err
+			}
+			if added {
+				enqueued++
+			}
+		}
+		if len(users) < sweepBatchSize {
+			return enqueued, nil
+		}
+		afterID = users[len(users)-1].ID
+	}
+}
+
+// SendReminder sends the user the amount of the DAS due this month, unless their plan
+// doesn't include the tax reminders, they already logged its payment or it's past due.
+// Reports whether it was sent.
+func (s *DASService) SendReminder(userID uuid.UUID, now time.Time) (bool, error) {
+	user, err := s.users.GetByID(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get user: %w", err)
+	}
+	if s.notifier == nil || user.PhoneNumber == "" {
+		return false, nil
+	}
+	if err := s.entitlements.CheckUser(user, FeatureTaxReminders); err != nil {
+		var locked *FeatureLockedError
+		if errors.As(err, &locked) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	amount, err := s.table.Amount(dasMonthDueIn(now), user.MEIActivity)
+	if err != nil {
+		return false, err
+	}
+	if !now.Before(amount.DueDate.AddDate(0, 0, 1)) {
+		return false, nil
+	}
+	paid, err := s.paidIn(user.ID, now)
+	if err != nil || paid {
+		return false, err
+	}
+
+	label, err := s.amountLabel(amount)
+	if err != nil {
+		return false, err
+	}
+	if amount.Estimated {
+		label += " (estimado)"
+	}
+	params := map[string]string{
+		"das":      amount.Name(),
+		"due_date": amount.DueDate.Format("02/01"),
+		"amount":   label,
+	}
+	if err := s.notifier.SendNotification(user.PhoneNumber, "das_reminder", params); err != nil {
+		return false, fmt.Errorf("failed to send DAS reminder to user %s: %w", user.ID, err)
+	}
+	return true, nil
+}
+
+// DASMessage tells the user the DAS due this month: its components, total and due date,
+// and whether they logged its payment. Without their activity type, it gives the range of
+// totals and asks for it.
+func (s *DASService) DASMessage(user *models.User, now time.Time) (string, error) {
+	amount, err := s.table.Amount(dasMonthDueIn(now), user.MEIActivity)
+	if err != nil {
+		return "", err
+	}
+	paid, err := s.paidIn(user.ID, now)
+	if err != nil {
+		return "", err
+	}
+
+	var message strings.Builder
+	due := "vence"
+	if !paid && !now.Before(amount.DueDate.AddDate(0, 0, 1)) {
+		due = "venceu"
+	}
+	message.WriteString(fmt.Sprintf("🧾 *%s*: %s em %s\n\n", amount.Name(), due, amount.DueDate.Format("02/01")))
+	message.WriteString(fmt.Sprintf("INSS: R$ %s\n", formatPrice(amount.INSS)))
+	if amount.ICMS > 0 {
+		message.WriteString(fmt.Sprintf("ICMS: R$ %s\n", formatPrice(amount.ICMS)))
+	}
+	if amount.ISS > 0 {
+		message.WriteString(fmt.Sprintf("ISS: R$ %s\n", formatPrice(amount.ISS)))
+	}
+
+	label, err := s.amountLabel(amount)
+	if err != nil {
+		return "", err
+	}
+	if user.MEIActivity == "" {
+		message.WriteString("ICMS/ISS: depende da sua atividade\n")
+	}
+	message.WriteString(fmt.Sprintf("*Total: %s*\n", label))
+	if amount.Estimated {
+		message.WriteString(fmt.Sprintf("_Valor estimado: ainda não tenho os valores de %d._\n", amount.Month.Year()))
+	}
+
+	switch {
+	case user.MEIActivity == "":
+		message.WriteString("\nPara eu calcular o valor certo, me diga sua atividade: responda *DAS COMÉRCIO*, *DAS SERVIÇOS* ou *DAS COMÉRCIO E SERVIÇOS*.")
+	case paid:
+		message.WriteString("\n✅ Você já registrou o pagamento deste mês.")
+	default:
+		message.WriteString("\nDepois de pagar, responda *PAGUEI O DAS* que eu registro a despesa.")
+	}
+	return message.String(), nil
+}
+
+// amountLabel is the DAS total, or without the activity type the range of totals from
+// commerce only to commerce and services
+func (s *DASService) amountLabel(amount *DASAmount) (string, error) {
+	if amount.Activity != "" {
+		return "R$ " + formatPrice(amount.Total), nil
+	}
+	lowest, err := s.table.Amount(amount.Month, models.MEIActivityCommerce)
+	if err != nil {
+		return "", err
+	}
+	highest, err := s.table.Amount(amount.Month, models.MEIActivityCommerceAndServices)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("de R$ %s a R$ %s", formatPrice(lowest.Total), formatPrice(highest.Total)), nil
+}
+
+// SetActivity records the user's MEI activity type, which decides the ICMS and ISS of
+// their DAS
+func (s *DASService) SetActivity(user *models.User, activity string) error {
+	if err := s.users.SetMEIActivity(user.ID, activity); err != nil {
+		return fmt.Errorf("failed to set MEI activity: %w", err)
+	}
+	user.MEIActivity = activity
+	return nil
+}
+
+// RecordPayment logs the DAS due this month as an expense of amount, or of the amount
+// computed for the user when amount is zero. Returns ErrDASAlreadyPaid when this month's
+// is already logged, and ErrMEIActivityUnknown when the amount can't be computed.
+func (s *DASService) RecordPayment(user *models.User, amount float64, now time.Time) (*models.Transaction, *DASAmount, error) {
+	paid, err := s.paidIn(user.ID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if paid {
+		return nil, nil, ErrDASAlreadyPaid
+	}
+
+	due, err := s.table.Amount(dasMonthDueIn(now), user.MEIActivity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if amount <= 0 {
+		if user.MEIActivity == "" {
+			return nil, nil, ErrMEIActivityUnknown
+		}
+		amount = due.Total
+	}
+
+	transaction, err := s.transactionService.CreateTransactionFromInput(user.ID.String(), TransactionInput{
+		Amount:             amount,
+		Description:        DASDescription,
+		TransactionType:    models.TransactionTypeExpense,
+		Source:             models.TransactionSourceText,
+		SkipDuplicateCheck: true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return transaction, due, nil
+}
+
+// paidIn reports whether the user logged a DAS payment in now's month
+func (s *DASService) paidIn(userID uuid.UUID, now time.Time) (bool, error) {
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	transactions, err := s.transactions.ListBetween(userID, from, from.AddDate(0, 1, 0))
+	if err != nil {
+		return false, fmt.Errorf("failed to list transactions: %w", err)
+	}
+	for _, transaction := range transactions {
+		if transaction.TransactionType == models.TransactionTypeExpense && transaction.Description == DASDescription {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dasMonthDueIn returns the month whose DAS is due in now's month: the one before
+func dasMonthDueIn(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0)
+}
+
+// ParseMEIActivity reads the activity type of "das comércio", "das serviços" or "das
+// comércio e serviços", already lowercased
+func ParseMEIActivity(command string) (string, bool) {
+	name, found := strings.CutPrefix(command, "das ")
+	if !found {
+		return "", false
+	}
+	activity, ok := dasActivityNames[strings.TrimSpace(name)]
+	return activity, ok
+}
+
+// ParseDASPayment reads "paguei o das", already lowercased, with the amount paid when the
+// user gives one, as in "paguei o das de R$ 80,90". The amount is zero when they don't.
+func ParseDASPayment(command string) (float64, bool) {
+	for _, prefix := range dasPaymentPrefixes {
+		rest, found := strings.CutPrefix(command, prefix)
+		if !found || (rest != "" && rest[0] != ' ') {
+			continue
+		}
+		for _, field := range strings.Fields(strings.ReplaceAll(rest, "r$", " ")) {
+			value := field
+			if strings.Contains(value, ",") {
+				// 1.234,56 is written the Brazilian way
+				value = strings.ReplaceAll(strings.ReplaceAll(value, ".", ""), ",", ".")
+			}
+			if amount, err := strconv.ParseFloat(value, 64); err == nil && amount > 0 {
+				return amount, true
+			}
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/testdb"
+)
+
+func newMemoryDASService(t *testing.T) (*DASService, *SubscriptionService, *UserService, *fakeNotifier, func(*models.User) *models.Subscription) {
+	subscriptionService, userService, transactionService, notifier, gateway := newMemorySubscriptionServiceWithGateway(t)
+	table, err := LoadDASTable("")
+	require.NoError(t, err)
+	entitlements := NewEntitlementService(subscriptionService.subscriptions, userService, subscriptionService.Plans())
+	das := NewDASService(table, userService.users, transactionService.transactions, transactionService, entitlements, notifier)
+	return das, subscriptionService, userService, notifier, func(user *models.User) *models.Subscription {
+		return subscribe(t, subscriptionService, gateway, user)
+	}
+}
+
+func TestDASRemindersBeforeThe20th(t *testing.T) {
+	das, _, userService, notifier, subscribeUser := newMemoryDASService(t)
+	subscriber, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511944440000")
+	require.NoError(t, err)
+	subscribeUser(subscriber)
+	trialUser, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511944440001")
+	require.NoError(t, err)
+	scheduler := NewJobScheduler(testdb.SQLite(t))
+	ctx := context.Background()
+
+	// Reminders go out in the five days before the 20th, once a month, to subscribers
+	enqueued, err := das.EnqueueReminders(ctx, scheduler, time.Date(2026, time.July, 14, 9, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Zero(t, enqueued)
+	now := time.Date(2026, time.July, 16, 9, 0, 0, 0, time.UTC)
+	enqueued, err = das.EnqueueReminders(ctx, scheduler, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, enqueued)
+	enqueued, err = das.EnqueueReminders(ctx, scheduler, now.AddDate(0, 0, 1))
+	require.NoError(t, err)
+	assert.Zero(t, enqueued)
+
+	// Without the activity, the reminder gives the range of amounts
+	sent, err := das.SendReminder(subscriber.ID, now)
+	require.NoError(t, err)
+	require.True(t, sent)
+	reminder := notifier.sent[len(notifier.sent)-1]
+	assert.Equal(t, "das_reminder", reminder.template)
+	assert.Equal(t, map[string]string{"das": "DAS-MEI de junho", "due_date": "20/07", "amount": "de R$ 82,05 a R$ 87,05"}, reminder.params)
+
+	require.NoError(t, das.SetActivity(subscriber, models.MEIActivityServices))
+	_, err = das.SendReminder(subscriber.ID, now)
+	require.NoError(t, err)
+	assert.Equal(t, "R$ 86,05", notifier.sent[len(notifier.sent)-1].params["amount"])
+
+	// The trial doesn't include the reminders
+	sent, err = das.SendReminder(trialUser.ID, now)
+	require.NoError(t, err)
+	assert.False(t, sent)
+
+	// Nor are they sent once the DAS is paid, or past due
+	sent, err = das.SendReminder(subscriber.ID, now.AddDate(0, 0, 5))
+	require.NoError(t, err)
+	assert.False(t, sent)
+	require.NoError(t, das.transactions.Create(&models.Transaction{
+		UserID:          subscriber.ID,
+		Amount:          86.05,
+		Description:     DASDescription,
+		TransactionType: models.TransactionTypeExpense,
+		Source:          models.TransactionSourceText,
+		CreatedAt:       now.Add(time.Hour),
+	}))
+	sent, err = das.SendReminder(subscriber.ID, now.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.False(t, sent)
+	message, err := das.DASMessage(subscriber, now.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Contains(t, message, "ISS: R$ 5,00")
+	assert.Contains(t, message, "*Total: R$ 86,05*")
+	assert.Contains(t, message, "já registrou o pagamento")
+}
+
+func TestRecordDASPayment(t *testing.T) {
+	das, _, userService, _, _ := newMemoryDASService(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511944440002")
+	require.NoError(t, err)
+	now := time.Now()
+
+	// The amount is needed while the activity is unknown
+	_, _, err = das.RecordPayment(user, 0, now)
+	assert.True(t, errors.Is(err, ErrMEIActivityUnknown))
+
+	transaction, due, err := das.RecordPayment(user, 80.90, now)
+	require.NoError(t, err)
+	assert.Equal(t, 80.90, transaction.Amount)
+	assert.Equal(t, DASDescription, transaction.Description)
+	assert.Equal(t, models.TransactionTypeExpense, transaction.TransactionType)
+	assert.Equal(t, dasMonthDueIn(now), due.Month)
+	_, _, err = das.RecordPayment(user, 80.90, now)
+	assert.True(t, errors.Is(err, ErrDASAlreadyPaid))
+
+	// With it, the amount defaults to the computed one
+	other, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511944440003")
+	require.NoError(t, err)
+	require.NoError(t, das.SetActivity(other, models.MEIActivityCommerce))
+	transaction, due, err = das.RecordPayment(other, 0, now)
+	require.NoError(t, err)
+	assert.Equal(t, due.Total, transaction.Amount)
+}
+
+func TestParseDASCommands(t *testing.T) {
+	for command, expected := range map[string]float64{
+		"paguei o das":             0,
+		"paguei das":               0,
+		"das pago":                 0,
+		"paguei o das de r$ 80,90": 80.90,
+		"paguei o das 81.05":       81.05,
+		"paguei o das de junho":    0,
+		"paguei o das 1.234,56 ok": 1234.56,
+	} {
+		amount, ok := ParseDASPayment(command)
+		assert.True(t, ok, command)
+		assert.Equal(t, expected, amount, command)
+	}
+	for _, command := range []string{"paguei o dasher", "das", "paguei o aluguel"} {
+		_, ok := ParseDASPayment(command)
+		assert.False(t, ok, command)
+	}
+
+	activity, ok := ParseMEIActivity("das comércio e serviços")
+	assert.True(t, ok)
+	assert.Equal(t, models.MEIActivityCommerceAndServices, activity)
+	activity, ok = ParseMEIActivity("das servicos")
+	assert.True(t, ok)
+	assert.Equal(t, models.MEIActivityServices, activity)
+	_, ok = ParseMEIActivity("das agro")
+	assert.False(t, ok)
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+const (
+	DuplicateReasonMediaHash   = "media_hash"
+	DuplicateReasonExternalRef = "external_ref"
+	DuplicateReasonFuzzy       = "fuzzy"
+)
+
+var (
+	// NFC-e access keys are 44 digits, usually printed in groups of four
+	nfceKeyPattern = regexp.MustCompile(`(?:\d{4}[ .]?){10}\d{4}`)
+	// Pix end-to-end IDs: "E" + 8-digit ISPB + yyyyMMddHHmm + 11 alphanumerics
+	pixE2EPattern = regexp.MustCompile(`\bE\d{8}\d{12}[A-Za-z0-9]{11}\b`)
+)
+
+// DuplicateMatch describes an existing transaction that a new one appears to repeat
+type DuplicateMatch struct {
+	Existing *models.Transaction `json:"existing"`
+	Reason   string              `json:"reason"`
+}
+
+// DuplicateTransactionError is returned when a transaction is suspected to be a duplicate
+type DuplicateTransactionError struct {
+	Match *DuplicateMatch
+}
+
+func (e *DuplicateTransactionError) Error() string {
+	return fmt.Sprintf("possible duplicate of transaction %s (%s)", e.Match.Existing.ID, e.Match.Reason)
+}
+
+type DuplicateDetector struct {
+	transactions        repository.TransactionRepository
+	window              time.Duration
+	similarityThreshold float64
+}
+
+func NewDuplicateDetector(transactions repository.TransactionRepository) *DuplicateDetector {
+	window := 30 * time.Minute
+	if minutes, err := strconv.Atoi(os.Getenv("DUPLICATE_WINDOW_MINUTES")); err == nil && minutes > 0 {
+		window = time.Duration(minutes) * time.Minute
+	}
+
+	return &DuplicateDetector{
+		transactions:        transactions,
+		window:              window,
+		similarityThreshold: 0.5,
+	}
+}
+
+// FindDuplicate looks for an existing transaction of the same user that the candidate repeats.
+// Exact identifiers (media hash, NFC-e key, Pix E2E ID) are checked first, then a fuzzy
+// match on amount, time proximity and description similarity. The fuzzy match only pairs a
+// receipt with something the user said: two sales told one after the other are two sales.
+func (d *DuplicateDetector) FindDuplicate(candidate *models.Transaction) (*DuplicateMatch, error) {
+	if candidate.MediaSHA256 != "" {
+		existing, err := d.transactions.FindLatestByMediaSHA256(candidate.UserID, candidate.MediaSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up duplicate: %w", err)
+		}
+		if existing != nil {
+			return &DuplicateMatch{Existing: existing, Reason: DuplicateReasonMediaHash}, nil
+		}
+	}
+
+	if candidate.ExternalRef != "" {
+		existing, err := d.transactions.FindLatestByExternalRef(candidate.UserID, candidate.ExternalRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up duplicate: %w", err)
+		}
+		if existing != nil {
+			return &DuplicateMatch{Existing: existing, Reason: DuplicateReasonExternalRef}, nil
+		}
+	}
+
+	createdAt := candidate.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	recent, err := d.transactions.ListBetween(candidate.UserID, createdAt.Add(-d.window), createdAt.Add(d.window))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recent transactions: %w", err)
+	}
+
+	for i := range recent {
+		if isFuzzyDuplicate(candidate, &recent[i], d.similarityThreshold) {
+			return &DuplicateMatch{Existing: &recent[i], Reason: DuplicateReasonFuzzy}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func isFuzzyDuplicate(candidate, existing *models.Transaction, threshold float64) bool {
+	if isReceipt(candidate) == isReceipt(existing) {
+		return false
+	}
+	if candidate.TransactionType != existing.TransactionType {
+		return false
+	}
+	if math.Abs(candidate.Amount-existing.Amount) >= 0.005 {
+		return false
+	}
+	// Two different pieces of evidence with their own identifiers are different payments
+	if candidate.ExternalRef != "" && existing.ExternalRef != "" && candidate.ExternalRef != existing.ExternalRef {
+		return false
+	}
+	return descriptionSimilarity(candidate.Description, existing.Description) >= threshold
+}
+
+// isReceipt tells transactions read from a photo from those the user texted or said
+func isReceipt(transaction *models.Transaction) bool {
+	return transaction.Source == models.TransactionSourceImage
+}
+
+// descriptionSimilarity returns the Jaccard similarity of the normalized word sets
+// of two descriptions. A description with no words is like no other.
+func descriptionSimilarity(a, b string) float64 {
+	wordsA := normalizeWords(a)
+	wordsB := normalizeWords(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	setA := make(map[string]bool, len(wordsA))
+	for _, w := range wordsA {
+		setA[w] = true
+	}
+	setB := make(map[string]bool, len(wordsB))
+	for _, w := range wordsB {
+		setB[w] = true
+	}
+
+	intersection := 0
+	for w := range setA {
+		if setB[w] {
+			intersection++
+		}
+	}
+
+	union := len(setA) + len(setB) - intersection
+	return float64(intersection) / float64(union)
+}
+
+var accentReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a",
+	"é", "e", "ê", "e",
+	"í", "i",
+	"ó", "o", "ô", "o", "õ", "o",
+	"ú", "u", "ü", "u",
+	"ç", "c",
+)
+
+// stopWords are ignored when comparing descriptions
+var stopWords = map[string]bool{
+	"de": true, "da": true, "do": true, "das": true, "dos": true,
+	"e": true, "a": true, "o": true, "as": true, "os": true,
+	"em": true, "no": true, "na": true, "com": true, "para": true, "pra": true,
+	"um": true, "uma": true, "r": true, "reais": true,
+}
+
+func normalizeWords(text string) []string {
+	text = accentReplacer.Replace(strings.ToLower(text))
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+
+	words := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if stopWords[f] {
+			continue
+		}
+		words = append(words, f)
+	}
+	return words
+}
+
+// ExtractExternalReference finds a Pix end-to-end ID or an NFC-e access key in text
+// extracted from a receipt or a forwarded payment confirmation
+func ExtractExternalReference(text string) string {
+	if match := pixE2EPattern.FindString(text); match != "" {
+		return strings.ToUpper(match)
+	}
+	if match := nfceKeyPattern.FindString(text); match != "" {
+		return strings.NewReplacer(" ", "", ".", "").Replace(match)
+	}
+	return ""
+}
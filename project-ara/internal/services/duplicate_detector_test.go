@@ -0,0 +1,100 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+func TestDescriptionSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, descriptionSimilarity("Venda de cachorro-quente", "venda cachorro quente"))
+	assert.InDelta(t, 2.0/3, descriptionSimilarity("Compra de pão", "compra pao na padaria"), 0.001)
+	assert.Less(t, descriptionSimilarity("Venda de bolo", "Compra de gás"), 0.5)
+	// Neither a missing description nor a single shared word makes two transactions alike
+	assert.Equal(t, 0.0, descriptionSimilarity("", "Venda de bolo"))
+	assert.Less(t, descriptionSimilarity("Venda", "Venda de bolo de pote no parque"), 0.5)
+}
+
+func TestIsFuzzyDuplicate(t *testing.T) {
+	existing := &models.Transaction{Amount: 45, TransactionType: models.TransactionTypeIncome, Description: "Venda de cachorro-quente", Source: models.TransactionSourceImage}
+	told := func(amount float64, transactionType models.TransactionType, description string) *models.Transaction {
+		return &models.Transaction{Amount: amount, TransactionType: transactionType, Description: description, Source: models.TransactionSourceVoice}
+	}
+
+	assert.True(t, isFuzzyDuplicate(told(45, models.TransactionTypeIncome, "venda cachorro quente"), existing, 0.5))
+	assert.False(t, isFuzzyDuplicate(told(46, models.TransactionTypeIncome, "venda cachorro quente"), existing, 0.5))
+	assert.False(t, isFuzzyDuplicate(told(45, models.TransactionTypeExpense, "venda cachorro quente"), existing, 0.5))
+	assert.False(t, isFuzzyDuplicate(told(45, models.TransactionTypeIncome, ""), existing, 0.5))
+
+	// Two receipts, or two messages, are two sales
+	receipt := told(45, models.TransactionTypeIncome, "venda cachorro quente")
+	receipt.Source = models.TransactionSourceImage
+	assert.False(t, isFuzzyDuplicate(receipt, existing, 0.5))
+	message := told(45, models.TransactionTypeIncome, "venda cachorro quente")
+	message.Source = models.TransactionSourceText
+	assert.False(t, isFuzzyDuplicate(message, told(45, models.TransactionTypeIncome, "venda cachorro quente"), 0.5))
+}
+
+func TestFindDuplicate(t *testing.T) {
+	repos := repository.NewMemory()
+	detector := NewDuplicateDetector(repos.Transactions)
+	userID := uuid.New()
+	now := time.Now()
+	create := func(transaction models.Transaction) *models.Transaction {
+		transaction.UserID = userID
+		transaction.TransactionType = models.TransactionTypeIncome
+		require.NoError(t, repos.Transactions.Create(&transaction))
+		return &transaction
+	}
+	candidate := func(transaction models.Transaction) *models.Transaction {
+		transaction.UserID = userID
+		transaction.TransactionType = models.TransactionTypeIncome
+		transaction.CreatedAt = now
+		return &transaction
+	}
+
+	photo := create(models.Transaction{Amount: 30, Description: "Venda de marmitas", Source: models.TransactionSourceImage,
+		MediaSHA256: "abc123", ExternalRef: "E00000000202401011200ABCDEFGHIJK", CreatedAt: now.Add(-10 * time.Minute)})
+	create(models.Transaction{Amount: 15, Description: "Bolo de pote", Source: models.TransactionSourceText, CreatedAt: now.Add(-5 * time.Minute)})
+	create(models.Transaction{Amount: 20, Description: "Cachorro-quente", Source: models.TransactionSourceImage, CreatedAt: now.Add(-2 * time.Hour)})
+
+	tests := map[string]struct {
+		candidate *models.Transaction
+		reason    string // Empty when it isn't a duplicate
+	}{
+		"same photo": {candidate(models.Transaction{Amount: 99, Source: models.TransactionSourceImage, MediaSHA256: "abc123"}), DuplicateReasonMediaHash},
+		"same receipt": {candidate(models.Transaction{Amount: 30, Description: "Pix", Source: models.TransactionSourceImage,
+			ExternalRef: "E00000000202401011200ABCDEFGHIJK"}), DuplicateReasonExternalRef},
+		"photo told by voice":      {candidate(models.Transaction{Amount: 30, Description: "Marmitas", Source: models.TransactionSourceVoice}), DuplicateReasonFuzzy},
+		"another sale told":        {candidate(models.Transaction{Amount: 15, Description: "Bolo de pote", Source: models.TransactionSourceText}), ""},
+		"another receipt":          {candidate(models.Transaction{Amount: 30, Description: "Venda de marmitas", Source: models.TransactionSourceImage}), ""},
+		"told without description": {candidate(models.Transaction{Amount: 30, Source: models.TransactionSourceVoice}), ""},
+		"photo from hours ago":     {candidate(models.Transaction{Amount: 20, Description: "Cachorro-quente", Source: models.TransactionSourceText}), ""},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			match, err := detector.FindDuplicate(test.candidate)
+			require.NoError(t, err)
+			if test.reason == "" {
+				assert.Nil(t, match)
+				return
+			}
+			require.NotNil(t, match)
+			assert.Equal(t, test.reason, match.Reason)
+			assert.Equal(t, photo.ID, match.Existing.ID)
+		})
+	}
+}
+
+func TestExtractExternalReference(t *testing.T) {
+	assert.Equal(t, "E00000000202401011200ABCDEFGHIJK", ExtractExternalReference("ID da transação: E00000000202401011200abcdefghijk"))
+	assert.Equal(t, "35240112345678000190650010000012341000012345",
+		ExtractExternalReference("Chave de acesso: 3524 0112 3456 7800 0190 6500 1000 0012 3410 0001 2345"))
+	assert.Equal(t, "", ExtractExternalReference("vendi 3 cachorros-quentes por 30 reais"))
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+// Feature is a capability that only some plans include. The catalog lists each plan's
+// features, and the trial's.
+type Feature string
+
+const (
+	FeatureAdvancedReports    Feature = "advanced_reports"
+	FeatureAutoCategorization Feature = "auto_categorization"
+	FeatureCloudBackup        Feature = "cloud_backup"
+	FeatureTaxReminders       Feature = "tax_reminders"
+)
+
+// FeatureInfo is how a feature is presented to users
+type FeatureInfo struct {
+	Name  string // As listed among a plan's benefits
+	Pitch string // What the user gets, to complete "<Name> ..."
+}
+
+var featureInfo = map[Feature]FeatureInfo{
+	FeatureAdvancedReports: {
+		Name:  "Relatórios avançados",
+		Pitch: "mostra seu relatório completo, com saldo, para onde vai o seu dinheiro e recomendações para o seu negócio",
+	},
+	FeatureAutoCategorization: {
+		Name:  "Categorização automática",
+		Pitch: "agrupa suas vendas e despesas por categoria, sem você precisar organizar nada",
+	},
+	FeatureCloudBackup: {
+		Name:  "Backup na nuvem",
+		Pitch: "guarda seus recibos e áudios com segurança, para você consultar quando precisar",
+	},
+	FeatureTaxReminders: {
+		Name:  "Lembretes de impostos",
+		Pitch: "avisa no WhatsApp antes do vencimento do DAS-MEI, com o valor a pagar",
+	},
+}
+
+// Info returns how the feature is presented to users
+func (f Feature) Info() FeatureInfo {
+	return featureInfo[f]
+}
+
+func knownFeature(feature Feature) bool {
+	_, ok := featureInfo[feature]
+	return ok
+}
+
+// FeatureLockedError is returned when the user's plan doesn't include a feature.
+// Upgrade is the plan to offer them, nil when none is on sale.
+type FeatureLockedError struct {
+	Feature    Feature
+	Upgrade    *Plan
+	Subscribed bool // The user pays for a plan without the feature
+}
+
+func (e *FeatureLockedError) Error() string {
+	return fmt.Sprintf("feature %s is not included in the user's plan", e.Feature)
+}
+
+// EntitlementService decides which features each user has, from the plan they pay for
+// or, without one, from the trial
+type EntitlementService struct {
+	subscriptions repository.SubscriptionRepository
+	userService   *UserService
+	plans         *PlanCatalog
+}
+
+func NewEntitlementService(subscriptions repository.SubscriptionRepository, userService *UserService, plans *PlanCatalog) *EntitlementService {
+	return &EntitlementService{
+		subscriptions: subscriptions,
+		userService:   userService,
+		plans:         plans,
+	}
+}
+
+// Features lists the features the user has. A subscription in its grace period still
+// grants its plan's features.
+func (s *EntitlementService) Features(user *models.User) ([]Feature, error) {
+	if !user.HasActiveSubscription(time.Now()) {
+		return s.plans.Trial.Features, nil
+	}
+	current, err := s.subscriptions.GetCurrent(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	if current == nil {
+		return s.plans.Trial.Features, nil
+	}
+	return s.plans.PlanOf(current).Features, nil
+}
+
+// Check returns a *FeatureLockedError when the user doesn't have the feature
+func (s *EntitlementService) Check(userID string, feature Feature) error {
+	user, err := s.userService.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	return s.CheckUser(user, feature)
+}
+
+// CheckUser is Check for a user already loaded
+func (s *EntitlementService) CheckUser(user *models.User, feature Feature) error {
+	granted, err := s.Features(user)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(granted, feature) {
+		return nil
+	}
+
+	locked := &FeatureLockedError{Feature: feature, Subscribed: user.HasActiveSubscription(time.Now())}
+	if plan, ok := s.UpgradePlan(feature); ok {
+		locked.Upgrade = &plan
+	}
+	return locked
+}
+
+// UpgradePlan returns the plan to offer for a feature: the default plan when it includes
+// it, else the plan on sale with the lowest monthly price that does
+func (s *EntitlementService) UpgradePlan(feature Feature) (Plan, bool) {
+	if plan := s.plans.Default(); slices.Contains(plan.Features, feature) {
+		return plan, true
+	}
+	var cheapest Plan
+	found := false
+	for _, plan := range s.plans.Available() {
+		if !slices.Contains(plan.Features, feature) {
+			continue
+		}
+		if !found || plan.Price/float64(plan.IntervalMonths) < cheapest.Price/float64(cheapest.IntervalMonths) {
+			cheapest, found = plan, true
+		}
+	}
+	return cheapest, found
+}
+
+// LockedMessage explains to the user what a locked feature does and how to get it
+func (s *EntitlementService) LockedMessage(locked *FeatureLockedError) string {
+	info := locked.Feature.Info()
+	message := fmt.Sprintf("🔒 *%s* %s, e é um recurso exclusivo para assinantes.", info.Name, info.Pitch)
+	switch {
+	case locked.Upgrade == nil:
+		message += "\n\nEle ainda não está disponível para assinatura."
+	case locked.Subscribed:
+		message += fmt.Sprintf("\n\nEle está disponível no plano %s (%s).", locked.Upgrade.Name, locked.Upgrade.PriceLabel())
+	default:
+		message += fmt.Sprintf("\n\nAssine o %s por %s e libere na hora, junto com as transações ilimitadas. 💎", locked.Upgrade.Name, locked.Upgrade.PriceLabel())
+	}
+	return message
+}
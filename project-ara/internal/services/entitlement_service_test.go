@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+)
+
+func TestEntitlementsFollowTheUsersPlan(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	entitlements := NewEntitlementService(subscriptionService.subscriptions, userService, subscriptionService.Plans())
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511955550000")
+	require.NoError(t, err)
+
+	// Trial users are offered the default plan
+	err = entitlements.Check(user.ID.String(), FeatureAdvancedReports)
+	var locked *FeatureLockedError
+	require.True(t, errors.As(err, &locked))
+	require.NotNil(t, locked.Upgrade)
+	assert.Equal(t, "monthly", locked.Upgrade.ID)
+	assert.False(t, locked.Subscribed)
+	assert.Contains(t, entitlements.LockedMessage(locked), "Assine o Premium mensal por R$ 9,90/mês")
+
+	subscription := subscribe(t, subscriptionService, gateway, user)
+	for _, feature := range []Feature{FeatureAdvancedReports, FeatureAutoCategorization, FeatureCloudBackup, FeatureTaxReminders} {
+		assert.NoError(t, entitlements.Check(user.ID.String(), feature), feature)
+	}
+
+	// The features last through the grace period, not after it
+	end := time.Now().Add(-time.Hour)
+	require.NoError(t, subscriptionService.subscriptions.ExtendPeriod(subscription.ID, end.AddDate(0, 0, -30), end, "test"))
+	_, err = subscriptionService.SweepExpiredSubscriptions(context.Background())
+	require.NoError(t, err)
+	assert.NoError(t, entitlements.Check(user.ID.String(), FeatureCloudBackup))
+
+	end = time.Now().Add(-models.SubscriptionGracePeriod - time.Hour)
+	require.NoError(t, subscriptionService.subscriptions.ExtendPeriod(subscription.ID, end.AddDate(0, 0, -30), end, "test"))
+	_, err = subscriptionService.SweepExpiredSubscriptions(context.Background())
+	require.NoError(t, err)
+	assert.Error(t, entitlements.Check(user.ID.String(), FeatureCloudBackup))
+}
+
+func TestEntitlementsOfTieredPlans(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	plans, err := LoadPlanCatalog(writePlans(t, `{
+		"trial": {"transactions": 50, "prompt_at": 45, "warn_at": 40, "features": ["cloud_backup"]},
+		"default_plan": "basic",
+		"plans": [
+			{"id": "basic", "name": "Básico", "tier": "basic", "price": 4.90, "interval_months": 1, "period_days": 30, "features": ["cloud_backup"]},
+			{"id": "pro_annual", "name": "Pro anual", "tier": "pro", "price": 199, "interval_months": 12, "period_days": 365, "features": ["cloud_backup", "advanced_reports"]},
+			{"id": "pro", "name": "Pro", "tier": "pro", "price": 19.90, "interval_months": 1, "period_days": 30, "features": ["cloud_backup", "advanced_reports"]}
+		]
+	}`))
+	require.NoError(t, err)
+	subscriptionService.plans = plans
+	entitlements := NewEntitlementService(subscriptionService.subscriptions, userService, plans)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511955551111")
+	require.NoError(t, err)
+
+	assert.NoError(t, entitlements.Check(user.ID.String(), FeatureCloudBackup), "included in the trial")
+
+	// The cheapest plan per month that includes the feature is offered
+	subscribe(t, subscriptionService, gateway, user)
+	err = entitlements.Check(user.ID.String(), FeatureAdvancedReports)
+	var locked *FeatureLockedError
+	require.True(t, errors.As(err, &locked))
+	assert.Equal(t, "pro_annual", locked.Upgrade.ID)
+	assert.True(t, locked.Subscribed)
+	assert.Contains(t, entitlements.LockedMessage(locked), "disponível no plano Pro anual (R$ 199,00/ano)")
+
+	// Nothing on sale unlocks it
+	err = entitlements.Check(user.ID.String(), FeatureAutoCategorization)
+	require.True(t, errors.As(err, &locked))
+	assert.Nil(t, locked.Upgrade)
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"project-ara/internal/models"
+)
+
+// Variants of the conversion message, A/B tested by listing them in the catalog's
+// conversion_variants. Both show the same stats and deadlines; they differ in what leads.
+const (
+	ConversionVariantValue     = "value"     // What the Ara already did for the user
+	ConversionVariantDeadlines = "deadlines" // The tax deadlines coming up
+)
+
+func knownConversionVariant(variant string) bool {
+	return variant == ConversionVariantValue || variant == ConversionVariantDeadlines
+}
+
+// conversionDeadlineDays is how far ahead the conversion message looks for tax deadlines
+const conversionDeadlineDays = 45
+
+// minutesSaved estimates the bookkeeping time a transaction logged with the Ara saves,
+// against writing it down by hand; a receipt also spares copying and filing the paper
+var minutesSaved = map[models.TransactionSource]int{
+	models.TransactionSourceText:  2,
+	models.TransactionSourceVoice: 2,
+	models.TransactionSourceImage: 5,
+}
+
+// ConversionMessage is the message asking a trial user to subscribe, built from what they
+// logged during the trial
+type ConversionMessage struct {
+	Variant      string          `json:"variant"`
+	Text         string          `json:"text"`
+	Usage        *UsageStats     `json:"usage"`
+	MinutesSaved int             `json:"minutes_saved"`
+	Obligations  []MEIObligation `json:"obligations"`
+}
+
+// GenerateConversionMessage writes the conversion message around the value the user already
+// got from the trial: revenue logged, receipts captured, time saved and their best day of
+// sales, and the tax deadlines coming up. The variant shown is recorded on the user and in
+// the conversion_message_sent event, so the funnel can be compared between variants.
+func (s *FinancialReportingService) GenerateConversionMessage(userID string) (*ConversionMessage, error) {
+	user, err := s.userService.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	usage, err := s.transactionService.GetUsageStats(userID, user.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	conversion := &ConversionMessage{
+		Variant:     s.plans.ConversionVariant(user),
+		Usage:       usage,
+		Obligations: UpcomingMEIObligations(time.Now(), conversionDeadlineDays),
+	}
+	for source, count := range usage.BySource {
+		conversion.MinutesSaved += minutesSaved[source] * count
+	}
+	if user.ConversionVariant != conversion.Variant {
+		if err := s.userService.SetConversionVariant(user, conversion.Variant); err != nil {
+			return nil, err
+		}
+	}
+
+	var message strings.Builder
+	switch conversion.Variant {
+	case ConversionVariantDeadlines:
+		message.WriteString("⏰ **Não perca os prazos do seu MEI!**\n\n")
+		writeObligations(&message, conversion.Obligations)
+		message.WriteString("Com o Ara Premium, suas vendas e despesas estão sempre em dia quando o prazo chegar.\n\n")
+		if usage.Transactions > 0 {
+			message.WriteString(fmt.Sprintf("📊 No teste você já registrou R$ %s em vendas", formatPrice(usage.Revenue)))
+			if conversion.MinutesSaved > 0 {
+				message.WriteString(" e economizou " + formatTimeSaved(conversion.MinutesSaved) + " de anotações")
+			}
+			message.WriteString(".\n\n")
+		}
+	default:
+		message.WriteString("🚀 **Veja o que o Ara já fez pelo seu negócio**\n\n")
+		if usage.Transactions > 0 {
+			message.WriteString(fmt.Sprintf("Desde %s, você:\n", usage.Since.Format("02/01")))
+			message.WriteString(fmt.Sprintf("💰 registrou R$ %s em vendas\n", formatPrice(usage.Revenue)))
+			if receipts := usage.BySource[models.TransactionSourceImage]; receipts > 0 {
+				message.WriteString(fmt.Sprintf("🧾 guardou %s\n", plural(receipts, "recibo", "recibos")))
+			}
+			message.WriteString(fmt.Sprintf("⏱️ economizou %s de anotações\n", formatTimeSaved(conversion.MinutesSaved)))
+			if usage.BestDay != nil {
+				message.WriteString(fmt.Sprintf("🏆 teve o melhor dia de vendas em %s (%s), com R$ %s\n",
+					usage.BestDay.Format("02/01"), weekdayNames[usage.BestDay.Weekday()], formatPrice(usage.BestDaySales)))
+			}
+			message.WriteString("\n")
+		}
+		writeObligations(&message, conversion.Obligations)
+	}
+
+	message.WriteString("**Benefícios Premium:**\n")
+	message.WriteString("✅ Transações ilimitadas\n")
+	for _, feature := range s.plans.Default().Features {
+		message.WriteString("✅ " + feature.Info().Name + "\n")
+	}
+	message.WriteString("✅ Suporte prioritário\n\n")
+
+	message.WriteString(fmt.Sprintf("💎 **Apenas %s**\n", s.plans.Default().PriceLabel()))
+	message.WriteString("Menos que um café por dia! ☕\n\n")
+
+	message.WriteString("Para assinar, responda: *ASSINAR*")
+	for _, plan := range s.plans.Available() {
+		if plan.ID == s.plans.DefaultPlan || plan.Keyword == "" {
+			continue
+		}
+		message.WriteString(fmt.Sprintf("\n%s por %s", plan.Name, plan.PriceLabel()))
+		if discount := s.plans.Discount(plan); discount >= 0.01 {
+			message.WriteString(fmt.Sprintf(" (%.0f%% de desconto)", discount*100))
+		}
+		message.WriteString(fmt.Sprintf(": responda *ASSINAR %s*", strings.ToUpper(plan.Keyword)))
+	}
+
+	conversion.Text = message.String()
+	s.analytics.Track(user.ID, models.AnalyticsConversionMessageSent, map[string]interface{}{
+		"variant":      conversion.Variant,
+		"transactions": usage.Transactions,
+	})
+	return conversion, nil
+}
+
+func writeObligations(message *strings.Builder, obligations []MEIObligation) {
+	if len(obligations) == 0 {
+		return
+	}
+	message.WriteString("📅 **Próximos prazos do MEI:**\n")
+	for _, obligation := range obligations {
+		message.WriteString(fmt.Sprintf("• %s: %s\n", obligation.DueDate.Format("02/01"), obligation.Name))
+	}
+	message.WriteString("\n")
+}
+
+// formatTimeSaved writes minutes as "cerca de 40 minutos" or, from an hour, in half hours
+func formatTimeSaved(minutes int) string {
+	if minutes < 60 {
+		return "cerca de " + plural(minutes, "minuto", "minutos")
+	}
+	hours := math.Round(float64(minutes)/30) / 2
+	label := strings.TrimSuffix(strings.Replace(fmt.Sprintf("%.1f", hours), ".", ",", 1), ",0")
+	if hours < 2 {
+		return "cerca de " + label + " hora"
+	}
+	return "cerca de " + label + " horas"
+}
+
+// plural writes a count with its noun, such as "1 recibo" or "3 recibos"
+func plural(count int, one, many string) string {
+	if count == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", count, many)
+}
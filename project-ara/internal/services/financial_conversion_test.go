@@ -0,0 +1,123 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+)
+
+func TestUpcomingMEIObligations(t *testing.T) {
+	date := func(month time.Month, day int) time.Time {
+		return time.Date(2025, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	// The DAS of the month before is due on the 20th, the due day included
+	assert.Equal(t, []MEIObligation{
+		{Name: "DAS-MEI de junho", DueDate: date(time.July, 20)},
+		{Name: "DAS-MEI de julho", DueDate: date(time.August, 20)},
+	}, UpcomingMEIObligations(date(time.July, 20).Add(15*time.Hour), 45))
+	assert.Equal(t, []MEIObligation{
+		{Name: "DAS-MEI de dezembro", DueDate: time.Date(2026, time.January, 20, 0, 0, 0, 0, time.UTC)},
+	}, UpcomingMEIObligations(date(time.December, 21), 30))
+
+	// The yearly declaration is due with May's DAS
+	assert.Equal(t, []MEIObligation{
+		{Name: "DAS-MEI de abril", DueDate: date(time.May, 20)},
+		{Name: "Declaração anual do MEI de 2024 (DASN-SIMEI)", DueDate: date(time.May, 31)},
+	}, UpcomingMEIObligations(date(time.May, 1), 30))
+}
+
+func TestGetUsageStats(t *testing.T) {
+	_, userService, transactionService := newMemorySubscriptionService(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511922221111")
+	require.NoError(t, err)
+
+	stats, err := transactionService.GetUsageStats(user.ID.String(), user.CreatedAt)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Transactions)
+	assert.Nil(t, stats.BestDay)
+
+	for _, input := range []TransactionInput{
+		{Amount: 120, TransactionType: models.TransactionTypeIncome, Source: models.TransactionSourceVoice},
+		{Amount: 30.5, TransactionType: models.TransactionTypeIncome, Source: models.TransactionSourceText},
+		{Amount: 80, TransactionType: models.TransactionTypeExpense, Source: models.TransactionSourceImage},
+	} {
+		input.SkipDuplicateCheck = true
+		_, err := transactionService.CreateTransactionFromInput(user.ID.String(), input)
+		require.NoError(t, err)
+	}
+
+	stats, err = transactionService.GetUsageStats(user.ID.String(), user.CreatedAt)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Transactions)
+	assert.Equal(t, 150.5, stats.Revenue)
+	assert.Equal(t, 80.0, stats.Expenses)
+	assert.Equal(t, map[models.TransactionSource]int{models.TransactionSourceText: 1, models.TransactionSourceVoice: 1, models.TransactionSourceImage: 1}, stats.BySource)
+	require.NotNil(t, stats.BestDay)
+	assert.Equal(t, time.Now().Format(time.DateOnly), stats.BestDay.Format(time.DateOnly))
+	assert.Equal(t, 150.5, stats.BestDaySales)
+}
+
+func TestConversionMessageShowsTheTrialsValue(t *testing.T) {
+	subscriptionService, userService, transactionService := newMemorySubscriptionService(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511922222222")
+	require.NoError(t, err)
+	for i := 0; i < 12; i++ {
+		source := models.TransactionSourceText
+		if i%3 == 0 {
+			source = models.TransactionSourceImage
+		}
+		_, err := transactionService.CreateTransactionFromInput(user.ID.String(), TransactionInput{
+			Amount:             100,
+			TransactionType:    models.TransactionTypeIncome,
+			Source:             source,
+			SkipDuplicateCheck: true,
+		})
+		require.NoError(t, err)
+	}
+
+	// The variant is picked once and recorded
+	conversion, err := subscriptionService.reportingService.GenerateConversionMessage(user.ID.String())
+	require.NoError(t, err)
+	assert.Contains(t, []string{ConversionVariantValue, ConversionVariantDeadlines}, conversion.Variant)
+	assert.Equal(t, 4*5+8*2, conversion.MinutesSaved)
+	assert.NotEmpty(t, conversion.Obligations)
+	assert.Contains(t, conversion.Text, "R$ 1200,00 em vendas")
+	assert.Contains(t, conversion.Text, "DAS-MEI de ")
+	assert.Contains(t, conversion.Text, "*ASSINAR ANUAL*")
+	found, err := userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, conversion.Variant, found.ConversionVariant)
+
+	require.NoError(t, userService.SetConversionVariant(found, ConversionVariantValue))
+	conversion, err = subscriptionService.reportingService.GenerateConversionMessage(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, ConversionVariantValue, conversion.Variant)
+	assert.Contains(t, conversion.Text, "🧾 guardou 4 recibos")
+	assert.Contains(t, conversion.Text, "⏱️ economizou cerca de 36 minutos de anotações")
+	assert.Contains(t, conversion.Text, "🏆 teve o melhor dia de vendas em ")
+
+	// A variant that is no longer tested is replaced
+	subscriptionService.Plans().ConversionVariants = []string{ConversionVariantDeadlines}
+	conversion, err = subscriptionService.reportingService.GenerateConversionMessage(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, ConversionVariantDeadlines, conversion.Variant)
+	assert.Contains(t, conversion.Text, "Não perca os prazos do seu MEI")
+}
+
+func TestFormatTimeSaved(t *testing.T) {
+	for minutes, want := range map[int]string{
+		1:   "cerca de 1 minuto",
+		40:  "cerca de 40 minutos",
+		75:  "cerca de 1,5 hora",
+		100: "cerca de 1,5 hora",
+		110: "cerca de 2 horas",
+		200: "cerca de 3,5 horas",
+	} {
+		assert.Equal(t, want, formatTimeSaved(minutes), minutes)
+	}
+}
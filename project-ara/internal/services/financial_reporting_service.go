@@ -11,12 +11,19 @@ import (
 type FinancialReportingService struct {
 	transactionService *TransactionService
 	userService        *UserService
+	plans              *PlanCatalog
+	analytics          *AnalyticsService
 }
 
-func NewFinancialReportingService(transactionService *TransactionService, userService *UserService) *FinancialReportingService {
+// NewFinancialReportingService creates the service; the trial and prices in its messages
+// come from plans, and analytics, which may be nil, records the trial warnings and
+// conversion messages it writes
+func NewFinancialReportingService(transactionService *TransactionService, userService *UserService, plans *PlanCatalog, analytics *AnalyticsService) *FinancialReportingService {
 	return &FinancialReportingService{
 		transactionService: transactionService,
 		userService:        userService,
+		plans:              plans,
+		analytics:          analytics,
 	}
 }
 
@@ -73,79 +80,85 @@ func (s *FinancialReportingService) GenerateDetailedReport(userID string, period
 	return report, nil
 }
 
-// GenerateTrialStatusMessage creates a message about user's trial status
-func (s *FinancialReportingService) GenerateTrialStatusMessage(userID string) (string, error) {
-	user, err := s.userService.GetUserByID(userID)
+// GenerateDetailedReportMessage writes the detailed report of a period for the chat: the
+// summary, the balance, where the money goes and recommendations
+func (s *FinancialReportingService) GenerateDetailedReportMessage(userID string, period string) (string, error) {
+	report, err := s.GenerateDetailedReport(userID, period)
 	if err != nil {
-		return "", fmt.Errorf("failed to get user: %w", err)
+		return "", err
 	}
 
-	remainingTransactions := 50 - user.TrialTransactionsCount
-
-	if user.SubscriptionStatus == "active" {
-		return "✅ Sua assinatura está ativa! Você pode registrar transações ilimitadas.", nil
-	}
-
-	if remainingTransactions <= 0 {
-		return "⚠️ Você atingiu o limite de 50 transações do período de teste. Para continuar usando o Ara, assine o plano premium por apenas R$ 9,90/mês e tenha transações ilimitadas! 💰", nil
+	var message strings.Builder
+	message.WriteString(s.formatConversationalSummary(report.Summary, report.User, period))
+	message.WriteString(fmt.Sprintf("💳 **Saldo atual:** R$ %s\n", formatPrice(report.CurrentBalance)))
+	if len(report.TopCategories) > 0 {
+		message.WriteString("\n🏷️ **Principais categorias:**\n")
+		writeCategories(&message, report.TopCategories)
 	}
-
-	if remainingTransactions <= 10 {
-		return fmt.Sprintf("⚠️ Você tem apenas %d transações restantes no período de teste. Considere assinar o plano premium por R$ 9,90/mês para transações ilimitadas! 💰", remainingTransactions), nil
+	message.WriteString("\n💡 **Recomendações:**\n")
+	for _, recommendation := range report.Trends.Recommendations {
+		message.WriteString("• " + recommendation + "\n")
 	}
-
-	return fmt.Sprintf("📊 Você tem %d transações restantes no período de teste.", remainingTransactions), nil
+	return strings.TrimSuffix(message.String(), "\n"), nil
 }
 
-// GenerateConversionMessage creates a compelling conversion message
-func (s *FinancialReportingService) GenerateConversionMessage(userID string) (string, error) {
-	_, err := s.userService.GetUserByID(userID)
+// GenerateCategoriesMessage lists where the user's money came from and went in a period,
+// grouped by category
+func (s *FinancialReportingService) GenerateCategoriesMessage(userID string, period string) (string, error) {
+	categories, err := s.transactionService.GetTopCategories(userID, period, 5)
 	if err != nil {
-		return "", fmt.Errorf("failed to get user: %w", err)
+		return "", fmt.Errorf("failed to get top categories: %w", err)
 	}
-
-	// Get user's financial performance
-	todaySummary, err := s.transactionService.GetPeriodSummary(userID, "today")
-	if err != nil {
-		return "", fmt.Errorf("failed to get today's summary: %w", err)
+	if len(categories) == 0 {
+		return "🏷️ Você ainda não registrou transações neste período.", nil
 	}
 
-	weekSummary, err := s.transactionService.GetPeriodSummary(userID, "week")
-	if err != nil {
-		return "", fmt.Errorf("failed to get week's summary: %w", err)
+	var message strings.Builder
+	message.WriteString("🏷️ **Suas principais categorias:**\n\n")
+	writeCategories(&message, categories)
+	return strings.TrimSuffix(message.String(), "\n"), nil
+}
+
+func writeCategories(message *strings.Builder, categories []CategorySummary) {
+	for i, category := range categories {
+		kind := "entrada"
+		if category.TransactionType == string(models.TransactionTypeExpense) {
+			kind = "saída"
+		}
+		transactions := fmt.Sprintf("%d transações", category.Count)
+		if category.Count == 1 {
+			transactions = "1 transação"
+		}
+		message.WriteString(fmt.Sprintf("%d. %s (%s): R$ %s em %s\n", i+1, category.Description, kind, formatPrice(category.TotalAmount), transactions))
 	}
+}
 
-	balance, err := s.transactionService.GetUserBalance(userID)
+// GenerateTrialStatusMessage creates a message about user's trial status
+func (s *FinancialReportingService) GenerateTrialStatusMessage(userID string) (string, error) {
+	user, err := s.userService.GetUserByID(userID)
 	if err != nil {
-		return "", fmt.Errorf("failed to get balance: %w", err)
+		return "", fmt.Errorf("failed to get user: %w", err)
 	}
 
-	message := "🚀 **Ara Premium - Transforme seu negócio!**\n\n"
-	message += "Veja como o Ara está ajudando você:\n\n"
+	trial := s.plans.Trial
+	remainingTransactions := trial.Remaining(user)
+	price := s.plans.Default().PriceLabel()
 
-	if todaySummary.Profit > 0 {
-		message += fmt.Sprintf("💰 Hoje: R$ %.2f de lucro\n", todaySummary.Profit)
+	if user.SubscriptionStatus == models.SubscriptionStatusActive {
+		return "✅ Sua assinatura está ativa! Você pode registrar transações ilimitadas.", nil
 	}
 
-	if weekSummary.Profit > 0 {
-		message += fmt.Sprintf("📈 Esta semana: R$ %.2f de lucro\n", weekSummary.Profit)
+	if remainingTransactions <= 0 {
+		s.analytics.Track(user.ID, models.AnalyticsTrialWarningShown, map[string]interface{}{"remaining": 0})
+		return fmt.Sprintf("⚠️ Você atingiu o limite de %d transações do período de teste. Para continuar usando o Ara, assine o plano premium por apenas %s e tenha transações ilimitadas! 💰", trial.Limit(user), price), nil
 	}
 
-	message += fmt.Sprintf("💳 Saldo atual: R$ %.2f\n\n", balance)
-
-	message += "**Benefícios Premium:**\n"
-	message += "✅ Transações ilimitadas\n"
-	message += "✅ Relatórios avançados\n"
-	message += "✅ Categorização automática\n"
-	message += "✅ Backup na nuvem\n"
-	message += "✅ Suporte prioritário\n\n"
-
-	message += "💎 **Apenas R$ 9,90/mês**\n"
-	message += "Menos que um café por dia! ☕\n\n"
-
-	message += "Para assinar, responda: *ASSINAR*"
+	if remainingTransactions <= trial.Transactions-trial.WarnAt {
+		s.analytics.Track(user.ID, models.AnalyticsTrialWarningShown, map[string]interface{}{"remaining": remainingTransactions})
+		return fmt.Sprintf("⚠️ Você tem apenas %d transações restantes no período de teste. Considere assinar o plano premium por %s para transações ilimitadas! 💰", remainingTransactions, price), nil
+	}
 
-	return message, nil
+	return fmt.Sprintf("📊 Você tem %d transações restantes no período de teste.", remainingTransactions), nil
 }
 
 // formatConversationalSummary formats the summary in conversational Portuguese
@@ -188,8 +201,8 @@ func (s *FinancialReportingService) formatConversationalSummary(summary *PeriodS
 	message.WriteString(fmt.Sprintf("\n📝 **Total de transações:** %d\n", summary.TransactionCount))
 
 	// Trial status
-	if user.SubscriptionStatus == "trial" {
-		remaining := 50 - user.TrialTransactionsCount
+	if user.SubscriptionStatus == models.SubscriptionStatusTrial {
+		remaining := s.plans.Trial.Remaining(user)
 		message.WriteString(fmt.Sprintf("\n🎯 **Transações restantes no teste:** %d\n", remaining))
 	}
 
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"project-ara/internal/models"
+)
+
+// JobHandler runs one job. A returned error (or a panic) is retried with backoff until the
+// job's MaxAttempts is reached.
+type JobHandler func(ctx context.Context, job models.Job) error
+
+// JobPurgeHistory deletes old job_runs rows
+const JobPurgeHistory = "purge_job_history"
+
+// JobScheduler runs recurring (cron) and one-off delayed jobs stored in the jobs table.
+// Every replica may run one: due jobs are claimed with SKIP LOCKED under a lease, so each
+// run happens on a single replica, and a replica that dies mid-run only delays the job
+// until its lease expires.
+type JobScheduler struct {
+	db          *gorm.DB
+	worker      string
+	lease       time.Duration
+	pollEvery   time.Duration
+	batchSize   int
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	historyDays int
+
+	mu        sync.RWMutex
+	handlers  map[string]JobHandler
+	schedules map[string]string // Recurring job name -> cron spec
+}
+
+func NewJobScheduler(db *gorm.DB) *JobScheduler {
+	hostname, _ := os.Hostname()
+	s := &JobScheduler{
+		db:          db,
+		worker:      fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		lease:       time.Duration(envInt("JOB_TIMEOUT_SECONDS", 600)) * time.Second,
+		pollEvery:   time.Duration(envInt("JOB_POLL_INTERVAL_SECONDS", 5)) * time.Second,
+		batchSize:   10,
+		maxAttempts: envInt("JOB_MAX_ATTEMPTS", 5),
+		baseBackoff: 30 * time.Second,
+		maxBackoff:  time.Hour,
+		historyDays: envInt("JOB_HISTORY_DAYS", 30),
+		handlers:    make(map[string]JobHandler),
+		schedules:   make(map[string]string),
+	}
+	if err := s.Every(JobPurgeHistory, "@daily", s.purgeHistory); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Handle registers the handler of a one-off job
+func (s *JobScheduler) Handle(name string, handler JobHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[name] = handler
+}
+
+// Every registers a recurring job. spec is a standard 5-field cron expression or a
+// descriptor such as "@hourly" or "@every 15m"; prefix it with "CRON_TZ=America/Sao_Paulo"
+// to schedule in local time. The schedule is stored by SyncSchedules.
+func (s *JobScheduler) Every(name, spec string, handler JobHandler) error {
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return fmt.Errorf("invalid schedule %q for job %s: %w", spec, name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[name] = handler
+	s.schedules[name] = spec
+	return nil
+}
+
+// Enqueue schedules a one-off job to run at runAt with payload marshalled as JSON
+func (s *JobScheduler) Enqueue(name string, payload interface{}, runAt time.Time) (*models.Job, error) {
+	job, err := s.newJob("", name, payload, runAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(job).Error; err != nil {
+		return nil, fmt.Errorf("failed to enqueue job %s: %w", name, err)
+	}
+	return job, nil
+}
+
+// EnqueueOnce is Enqueue keyed by key: while a job with that key exists, in any state,
+// nothing is enqueued and false is returned. Keys like "das-reminder:2025-07:<user>" make
+// enqueueing from several replicas or repeated sweeps safe.
+func (s *JobScheduler) EnqueueOnce(key, name string, payload interface{}, runAt time.Time) (bool, error) {
+	job, err := s.newJob(key, name, payload, runAt)
+	if err != nil {
+		return false, err
+	}
+	result := s.db.Clauses(uniqueKeyConflict()).Create(job)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to enqueue job %s: %w", name, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// SyncSchedules stores the registered recurring jobs, keeping the next run of those whose
+// schedule didn't change. Safe to run from every replica at start.
+func (s *JobScheduler) SyncSchedules() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for name, spec := range s.schedules {
+		schedule, _ := cron.ParseStandard(spec)
+		next := schedule.Next(now)
+
+		job, err := s.newJob(recurringKey(name), name, nil, next)
+		if err != nil {
+			return err
+		}
+		job.Schedule = spec
+		if err := s.db.Clauses(uniqueKeyConflict()).Create(job).Error; err != nil {
+			return fmt.Errorf("failed to schedule job %s: %w", name, err)
+		}
+		if err := s.db.Model(&models.Job{}).
+			Where("unique_key = ? AND schedule <> ?", recurringKey(name), spec).
+			Updates(map[string]interface{}{"schedule": spec, "run_at": next}).Error; err != nil {
+			return fmt.Errorf("failed to reschedule job %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Run syncs the schedules and then polls for due jobs until ctx is cancelled
+func (s *JobScheduler) Run(ctx context.Context) {
+	if err := s.SyncSchedules(); err != nil {
+		logrus.Errorf("Job scheduler: %v", err)
+	}
+
+	ticker := time.NewTicker(s.pollEvery)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.RunDue(ctx); err != nil {
+			logrus.Errorf("Job scheduler: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue claims and runs one batch of due jobs, returning how many ran
+func (s *JobScheduler) RunDue(ctx context.Context) (int, error) {
+	jobs, err := s.claim()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, job := range jobs {
+		if ctx.Err() != nil {
+			// The rest are picked up again when their lease expires
+			return i, nil
+		}
+		s.runOne(ctx, job)
+	}
+
+	return len(jobs), nil
+}
+
+// claim leases due jobs that this scheduler has a handler for. A job whose lease expired
+// (its replica crashed) is claimable again and counts as another attempt.
+func (s *JobScheduler) claim() ([]models.Job, error) {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.handlers))
+	for name := range s.handlers {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+
+	// SQLite, used in tests, has a single writer and no row locks
+	lock := "FOR UPDATE SKIP LOCKED"
+	if s.db.Dialector.Name() == "sqlite" {
+		lock = ""
+	}
+
+	now := time.Now()
+	var jobs []models.Job
+	err := s.db.Raw(`
+		UPDATE jobs SET status = ?, locked_until = ?, locked_by = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE name IN ? AND ((status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?))
+			ORDER BY run_at
+			LIMIT ?
+			`+lock+`
+		)
+		RETURNING *`,
+		models.JobStatusRunning, now.Add(s.lease), s.worker, now,
+		names, models.JobStatusScheduled, now, models.JobStatusRunning, now,
+		s.batchSize,
+	).Scan(&jobs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim jobs: %w", err)
+	}
+
+	return jobs, nil
+}
+
+func (s *JobScheduler) runOne(ctx context.Context, job models.Job) {
+	s.mu.RLock()
+	handler := s.handlers[job.Name]
+	s.mu.RUnlock()
+
+	started := time.Now()
+	runCtx, cancel := context.WithTimeout(ctx, s.lease)
+	err := safeRun(runCtx, handler, job)
+	cancel()
+	finished := time.Now()
+
+	run := &models.JobRun{
+		JobID:      job.ID,
+		Name:       job.Name,
+		Attempt:    job.Attempts,
+		Status:     models.JobRunSucceeded,
+		Worker:     s.worker,
+		StartedAt:  started,
+		FinishedAt: finished,
+	}
+	if err != nil {
+		run.Status = models.JobRunFailed
+		run.Error = err.Error()
+	}
+	if err := s.db.Create(run).Error; err != nil {
+		logrus.Errorf("Job scheduler: failed to record run of %s: %v", job.Name, err)
+	}
+
+	updates := map[string]interface{}{
+		"locked_until": nil,
+		"locked_by":    "",
+		"last_run_at":  started,
+		"updated_at":   finished,
+	}
+	switch {
+	case err == nil:
+		updates["last_error"] = ""
+		if job.IsRecurring() {
+			updates["status"] = models.JobStatusScheduled
+			updates["run_at"] = s.nextRun(job, finished)
+			updates["attempts"] = 0
+		} else {
+			updates["status"] = models.JobStatusDone
+		}
+	case job.Attempts < job.MaxAttempts:
+		logrus.Warnf("Job %s (%s) failed on attempt %d: %v", job.Name, job.ID, job.Attempts, err)
+		updates["last_error"] = err.Error()
+		updates["status"] = models.JobStatusScheduled
+		updates["run_at"] = finished.Add(s.retryDelay(job.Attempts))
+	default:
+		logrus.Errorf("Giving up on job %s (%s) after %d attempts: %v", job.Name, job.ID, job.Attempts, err)
+		updates["last_error"] = err.Error()
+		if job.IsRecurring() {
+			// Skip to the next occurrence
+			updates["status"] = models.JobStatusScheduled
+			updates["run_at"] = s.nextRun(job, finished)
+			updates["attempts"] = 0
+		} else {
+			updates["status"] = models.JobStatusFailed
+		}
+	}
+
+	// Only while we still hold the lease; if it expired another replica owns the job now
+	result := s.db.Model(&models.Job{}).Where("id = ? AND locked_by = ?", job.ID, s.worker).Updates(updates)
+	if result.Error != nil {
+		logrus.Errorf("Job scheduler: failed to update job %s: %v", job.ID, result.Error)
+	} else if result.RowsAffected == 0 {
+		logrus.Warnf("Job %s (%s) outlived its lease", job.Name, job.ID)
+	}
+}
+
+func (s *JobScheduler) nextRun(job models.Job, after time.Time) time.Time {
+	schedule, err := cron.ParseStandard(job.Schedule)
+	if err != nil {
+		logrus.Errorf("Job %s has an invalid schedule %q: %v", job.Name, job.Schedule, err)
+		return after.Add(24 * time.Hour)
+	}
+	return schedule.Next(after)
+}
+
+// retryDelay is the exponential backoff after the given number of attempts, with up to 20% jitter
+func (s *JobScheduler) retryDelay(attempts int) time.Duration {
+	delay := s.baseBackoff
+	for i := 1; i < attempts && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+func (s *JobScheduler) newJob(key, name string, payload interface{}, runAt time.Time) (*models.Job, error) {
+	data := []byte("{}")
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, fmt.Errorf("failed to marshal payload of job %s: %w", name, err)
+		}
+	}
+	return &models.Job{
+		UniqueKey:   key,
+		Name:        name,
+		Payload:     data,
+		Status:      models.JobStatusScheduled,
+		RunAt:       runAt,
+		MaxAttempts: s.maxAttempts,
+	}, nil
+}
+
+// purgeHistory keeps JOB_HISTORY_DAYS of job_runs, plus finished one-off jobs without a
+// unique key, which nothing looks up again
+func (s *JobScheduler) purgeHistory(ctx context.Context, job models.Job) error {
+	cutoff := time.Now().AddDate(0, 0, -s.historyDays)
+	runs := s.db.WithContext(ctx).Where("started_at < ?", cutoff).Delete(&models.JobRun{})
+	if runs.Error != nil {
+		return fmt.Errorf("failed to purge job history: %w", runs.Error)
+	}
+	jobs := s.db.WithContext(ctx).
+		Where("status IN ? AND (unique_key IS NULL OR unique_key = '') AND updated_at < ?",
+			[]models.JobStatus{models.JobStatusDone, models.JobStatusFailed}, cutoff).
+		Delete(&models.Job{})
+	if jobs.Error != nil {
+		return fmt.Errorf("failed to purge finished jobs: %w", jobs.Error)
+	}
+	logrus.Infof("Purged %d job runs and %d finished jobs", runs.RowsAffected, jobs.RowsAffected)
+	return nil
+}
+
+// safeRun turns a panicking handler into a failed attempt
+func safeRun(ctx context.Context, handler JobHandler, job models.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return handler(ctx, job)
+}
+
+func recurringKey(name string) string {
+	return "cron:" + name
+}
+
+func uniqueKeyConflict() clause.OnConflict {
+	return clause.OnConflict{
+		Columns:     []clause.Column{{Name: "unique_key"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "unique_key <> ''"}}},
+		DoNothing:   true,
+	}
+}
+
+// ListJobs returns the stored jobs, next to run first, each with its latest runs
+func (s *JobScheduler) ListJobs(limit, runsPerJob int) ([]models.Job, map[string][]models.JobRun, error) {
+	var jobs []models.Job
+	if err := s.db.Order("run_at").Limit(limit).Find(&jobs).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	runs := make(map[string][]models.JobRun, len(jobs))
+	for _, job := range jobs {
+		var jobRuns []models.JobRun
+		if err := s.db.Where("job_id = ?", job.ID).Order("started_at DESC").Limit(runsPerJob).
+			Find(&jobRuns).Error; err != nil {
+			return nil, nil, fmt.Errorf("failed to list runs of job %s: %w", job.ID, err)
+		}
+		runs[job.ID.String()] = jobRuns
+	}
+
+	return jobs, runs, nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/testdb"
+)
+
+func TestJobSchedulerRunsRecurringJobs(t *testing.T) {
+	db := testdb.SQLite(t)
+	scheduler := NewJobScheduler(db)
+
+	runs := 0
+	require.NoError(t, scheduler.Every("tick", "@every 1h", func(ctx context.Context, job models.Job) error {
+		runs++
+		return nil
+	}))
+	assert.Error(t, scheduler.Every("broken", "every day", nil))
+
+	require.NoError(t, scheduler.SyncSchedules())
+	require.NoError(t, scheduler.SyncSchedules())
+	var count int64
+	db.Model(&models.Job{}).Where("name = ?", "tick").Count(&count)
+	assert.EqualValues(t, 1, count, "syncing twice keeps one row per recurring job")
+
+	// Not due yet
+	ran, err := scheduler.RunDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, ran)
+
+	db.Model(&models.Job{}).Where("name = ?", "tick").Update("run_at", time.Now().Add(-time.Minute))
+	ran, err = scheduler.RunDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, ran)
+	assert.Equal(t, 1, runs)
+
+	var job models.Job
+	require.NoError(t, db.Where("name = ?", "tick").First(&job).Error)
+	assert.Equal(t, models.JobStatusScheduled, job.Status)
+	assert.Equal(t, 0, job.Attempts)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), job.RunAt, time.Minute)
+
+	var history []models.JobRun
+	require.NoError(t, db.Where("job_id = ?", job.ID).Find(&history).Error)
+	require.Len(t, history, 1)
+	assert.Equal(t, models.JobRunSucceeded, history[0].Status)
+}
+
+func TestJobSchedulerRetriesOneOffJobs(t *testing.T) {
+	db := testdb.SQLite(t)
+	scheduler := NewJobScheduler(db)
+	scheduler.Handle("flaky", func(ctx context.Context, job models.Job) error {
+		if job.Attempts < 2 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	})
+
+	job, err := scheduler.Enqueue("flaky", map[string]string{"user": "1"}, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+
+	_, err = scheduler.RunDue(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, db.First(job, "id = ?", job.ID).Error)
+	assert.Equal(t, models.JobStatusScheduled, job.Status)
+	assert.Equal(t, "temporary failure", job.LastError)
+	assert.True(t, job.RunAt.After(time.Now().Add(20*time.Second)), "retried with backoff")
+
+	db.Model(job).Update("run_at", time.Now().Add(-time.Second))
+	_, err = scheduler.RunDue(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, db.First(job, "id = ?", job.ID).Error)
+	assert.Equal(t, models.JobStatusDone, job.Status)
+	assert.Equal(t, 2, job.Attempts)
+	assert.JSONEq(t, `{"user":"1"}`, string(job.Payload))
+
+	var history []models.JobRun
+	require.NoError(t, db.Where("job_id = ?", job.ID).Order("attempt").Find(&history).Error)
+	require.Len(t, history, 2)
+	assert.Equal(t, models.JobRunFailed, history[0].Status)
+	assert.Equal(t, models.JobRunSucceeded, history[1].Status)
+}
+
+func TestJobSchedulerGivesUpAfterMaxAttempts(t *testing.T) {
+	db := testdb.SQLite(t)
+	scheduler := NewJobScheduler(db)
+	scheduler.Handle("doomed", func(ctx context.Context, job models.Job) error {
+		panic("boom")
+	})
+
+	job, err := scheduler.Enqueue("doomed", nil, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	for i := 0; i < job.MaxAttempts; i++ {
+		db.Model(job).Update("run_at", time.Now().Add(-time.Second))
+		_, err := scheduler.RunDue(context.Background())
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, db.First(job, "id = ?", job.ID).Error)
+	assert.Equal(t, models.JobStatusFailed, job.Status)
+	assert.Contains(t, job.LastError, "panic: boom")
+}
+
+func TestJobSchedulerEnqueueOnce(t *testing.T) {
+	db := testdb.SQLite(t)
+	scheduler := NewJobScheduler(db)
+
+	created, err := scheduler.EnqueueOnce("reminder:2025-07", "reminder", nil, time.Now())
+	require.NoError(t, err)
+	assert.True(t, created)
+	created, err = scheduler.EnqueueOnce("reminder:2025-07", "reminder", nil, time.Now())
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	// Jobs without a handler here are left for a replica that has one
+	ran, err := scheduler.RunDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, ran)
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"project-ara/internal/models"
+	"project-ara/internal/storage"
+)
+
+var (
+	receiptRequestPattern = regexp.MustCompile(`(?i)(^|\s)(mand[ae]|envi[ae]|mostr[ae]|quero ver|cad[eê])\s.*\b(foto|recibo|comprovante|nota)`)
+	receiptDatePattern    = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})(?:/(\d{2,4}))?\b`)
+)
+
+// MediaArchiveService keeps receipts and voice notes as fiscal evidence, encrypted
+// in the media store and linked to the transactions they produced
+type MediaArchiveService struct {
+	db    *gorm.DB
+	store storage.Storage
+}
+
+func NewMediaArchiveService(db *gorm.DB, store storage.Storage) *MediaArchiveService {
+	return &MediaArchiveService{db: db, store: store}
+}
+
+// Archive stores a media file for the user. The same media sent twice by the same
+// user is archived once.
+func (s *MediaArchiveService) Archive(ctx context.Context, userID string, kind models.AttachmentKind, media *Media) (*models.Attachment, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	mediaSHA256 := media.SHA256
+	if mediaSHA256 == "" {
+		mediaSHA256 = hashMedia(media.Data)
+	}
+
+	existing, err := s.FindByHash(userID, mediaSHA256)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+
+	attachment := &models.Attachment{
+		ID:          uuid.New(),
+		UserID:      userUUID,
+		Kind:        kind,
+		MimeType:    media.MimeType,
+		MediaSHA256: mediaSHA256,
+		SizeBytes:   int64(len(media.Data)),
+		CreatedAt:   time.Now(),
+	}
+	attachment.StorageKey = fmt.Sprintf("users/%s/%s/%s", userUUID, attachment.CreatedAt.Format("2006/01"), attachment.ID)
+
+	if err := s.store.Put(ctx, attachment.StorageKey, media.Data, media.MimeType); err != nil {
+		return nil, fmt.Errorf("failed to store media: %w", err)
+	}
+
+	if err := s.db.Create(attachment).Error; err != nil {
+		// Don't leave orphaned objects behind
+		s.store.Delete(ctx, attachment.StorageKey)
+		return nil, fmt.Errorf("failed to save attachment: %w", err)
+	}
+
+	return attachment, nil
+}
+
+// FindByHash returns the user's attachment with the given media hash, or nil
+func (s *MediaArchiveService) FindByHash(userID, mediaSHA256 string) (*models.Attachment, error) {
+	if mediaSHA256 == "" {
+		return nil, nil
+	}
+
+	var attachments []models.Attachment
+	if err := s.db.Where("user_id = ? AND media_sha256 = ?", userID, mediaSHA256).
+		Limit(1).
+		Find(&attachments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+
+	return &attachments[0], nil
+}
+
+// GetAttachment returns an attachment's metadata
+func (s *MediaArchiveService) GetAttachment(attachmentID string) (*models.Attachment, error) {
+	attachmentUUID, err := uuid.Parse(attachmentID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attachment ID: %w", err)
+	}
+
+	var attachment models.Attachment
+	if err := s.db.Where("id = ?", attachmentUUID).First(&attachment).Error; err != nil {
+		return nil, fmt.Errorf("attachment not found: %w", err)
+	}
+
+	return &attachment, nil
+}
+
+// GetAttachmentContent decrypts and returns the archived media
+func (s *MediaArchiveService) GetAttachmentContent(ctx context.Context, attachment *models.Attachment) ([]byte, error) {
+	data, err := s.store.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media: %w", err)
+	}
+	return data, nil
+}
+
+// GetTransactionAttachments lists the media linked to a transaction
+func (s *MediaArchiveService) GetTransactionAttachments(transactionID string) ([]models.Attachment, error) {
+	transactionUUID, err := uuid.Parse(transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction ID: %w", err)
+	}
+
+	var attachments []models.Attachment
+	if err := s.db.Where("transaction_id = ?", transactionUUID).
+		Order("created_at").
+		Find(&attachments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get attachments: %w", err)
+	}
+
+	return attachments, nil
+}
+
+// FindReceipts returns the receipt photos of transactions the user logged on the given day
+func (s *MediaArchiveService) FindReceipts(userID string, day time.Time) ([]models.Attachment, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	end := start.AddDate(0, 0, 1)
+
+	var attachments []models.Attachment
+	if err := s.db.Where("user_id = ? AND kind = ? AND created_at >= ? AND created_at < ?",
+		userUUID, models.AttachmentKindImage, start, end).
+		Order("created_at").
+		Find(&attachments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get receipts: %w", err)
+	}
+
+	return attachments, nil
+}
+
+// ParseReceiptRequest recognizes requests like "mande a foto do recibo de ontem" and
+// returns the day being asked for (today when no day is mentioned)
+func ParseReceiptRequest(text string, now time.Time) (time.Time, bool) {
+	if !receiptRequestPattern.MatchString(text) {
+		return time.Time{}, false
+	}
+
+	lower := strings.ToLower(text)
+	switch {
+	case strings.Contains(lower, "anteontem"):
+		return now.AddDate(0, 0, -2), true
+	case strings.Contains(lower, "ontem"):
+		return now.AddDate(0, 0, -1), true
+	}
+
+	if match := receiptDatePattern.FindStringSubmatch(text); match != nil {
+		day, _ := strconv.Atoi(match[1])
+		month, _ := strconv.Atoi(match[2])
+		year := now.Year()
+		if match[3] != "" {
+			year, _ = strconv.Atoi(match[3])
+			if year < 100 {
+				year += 2000
+			}
+		}
+		date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, now.Location())
+		if date.Day() == day && date.Month() == time.Month(month) {
+			return date, true
+		}
+	}
+
+	return now, true
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"project-ara/internal/models"
+)
+
+// MediaCache stores transcripts and OCR extractions keyed by media hash and
+// provider/model version, so reprocessing the same media doesn't call paid APIs again
+type MediaCache struct {
+	db  *gorm.DB
+	ttl time.Duration
+}
+
+func NewMediaCache(db *gorm.DB) *MediaCache {
+	ttl := 30 * 24 * time.Hour
+	if hours, err := strconv.Atoi(os.Getenv("MEDIA_CACHE_TTL_HOURS")); err == nil && hours > 0 {
+		ttl = time.Duration(hours) * time.Hour
+	}
+
+	return &MediaCache{db: db, ttl: ttl}
+}
+
+// Get returns an unexpired artifact, or nil on a cache miss
+func (c *MediaCache) Get(mediaSHA256 string, kind models.MediaArtifactKind, provider, modelVersion string) (*models.MediaArtifact, error) {
+	if c == nil || mediaSHA256 == "" {
+		return nil, nil
+	}
+
+	var artifacts []models.MediaArtifact
+	if err := c.db.Where("media_sha256 = ? AND kind = ? AND provider = ? AND model_version = ? AND expires_at > ?",
+		mediaSHA256, kind, provider, modelVersion, time.Now()).
+		Limit(1).
+		Find(&artifacts).Error; err != nil {
+		return nil, fmt.Errorf("failed to read media cache: %w", err)
+	}
+	if len(artifacts) == 0 {
+		return nil, nil
+	}
+
+	return &artifacts[0], nil
+}
+
+// Put stores a result, refreshing the content and TTL of an existing artifact with the same key
+func (c *MediaCache) Put(mediaSHA256 string, kind models.MediaArtifactKind, provider, modelVersion string, content interface{}) (*models.MediaArtifact, error) {
+	if c == nil || mediaSHA256 == "" {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal media artifact: %w", err)
+	}
+
+	// An upsert, so two workers processing the same media at once don't race on the key
+	now := time.Now()
+	artifact := models.MediaArtifact{
+		MediaSHA256:  mediaSHA256,
+		Kind:         kind,
+		Provider:     provider,
+		ModelVersion: modelVersion,
+		Content:      data,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(c.ttl),
+	}
+	if err := c.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "media_sha256"}, {Name: "kind"}, {Name: "provider"}, {Name: "model_version"}},
+		DoUpdates: clause.AssignmentColumns([]string{"content", "expires_at"}),
+	}).Create(&artifact).Error; err != nil {
+		return nil, fmt.Errorf("failed to store media artifact: %w", err)
+	}
+
+	// On a refresh, the stored artifact keeps its ID
+	if err := c.db.Where("media_sha256 = ? AND kind = ? AND provider = ? AND model_version = ?",
+		mediaSHA256, kind, provider, modelVersion).First(&artifact).Error; err != nil {
+		return nil, fmt.Errorf("failed to read media cache: %w", err)
+	}
+
+	return &artifact, nil
+}
+
+// PurgeExpired deletes expired artifacts that no transaction references; referenced
+// artifacts are kept as the audit trail of how the transaction was extracted
+func (c *MediaCache) PurgeExpired() (int64, error) {
+	result := c.db.Where("expires_at <= ? AND id NOT IN (?)", time.Now(),
+		c.db.Model(&models.Transaction{}).Select("media_artifact_id").Where("media_artifact_id IS NOT NULL")).
+		Delete(&models.MediaArtifact{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to purge media cache: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// JobPurgeMediaCache runs PurgeExpired nightly
+const JobPurgeMediaCache = "purge_media_cache"
+
+// RegisterJobs schedules the nightly purge of expired artifacts
+func (c *MediaCache) RegisterJobs(scheduler *JobScheduler) error {
+	return scheduler.Every(JobPurgeMediaCache, "0 4 * * *", func(ctx context.Context, job models.Job) error {
+		purged, err := c.PurgeExpired()
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Purged %d expired media artifacts", purged)
+		return nil
+	})
+}
+
+// hashMedia returns the hex SHA-256 of downloaded media, used when the webhook didn't carry one
+func hashMedia(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
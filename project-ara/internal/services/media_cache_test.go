@@ -0,0 +1,90 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+	"project-ara/internal/testdb"
+)
+
+func TestMediaCacheStoresAndRefreshesArtifacts(t *testing.T) {
+	cache := NewMediaCache(testdb.SQLite(t))
+
+	artifact, err := cache.Get("abc123", models.MediaArtifactTranscript, "openai", "whisper-1")
+	require.NoError(t, err)
+	assert.Nil(t, artifact)
+
+	stored, err := cache.Put("abc123", models.MediaArtifactTranscript, "openai", "whisper-1", "vendi um bolo")
+	require.NoError(t, err)
+	artifact, err = cache.Get("abc123", models.MediaArtifactTranscript, "openai", "whisper-1")
+	require.NoError(t, err)
+	require.NotNil(t, artifact)
+	assert.Equal(t, stored.ID, artifact.ID)
+	assert.JSONEq(t, `"vendi um bolo"`, string(artifact.Content))
+
+	// Storing the same key again refreshes the artifact in place
+	refreshed, err := cache.Put("abc123", models.MediaArtifactTranscript, "openai", "whisper-1", "vendi dois bolos")
+	require.NoError(t, err)
+	assert.Equal(t, stored.ID, refreshed.ID)
+	assert.JSONEq(t, `"vendi dois bolos"`, string(refreshed.Content))
+	var count int64
+	require.NoError(t, cache.db.Model(&models.MediaArtifact{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+
+	// Another model's result is another artifact
+	other, err := cache.Put("abc123", models.MediaArtifactTranscript, "openai", "whisper-2", "vendi um bolo")
+	require.NoError(t, err)
+	assert.NotEqual(t, stored.ID, other.ID)
+
+	// Expired artifacts are misses
+	require.NoError(t, cache.db.Model(&models.MediaArtifact{}).Where("id = ?", stored.ID).
+		Update("expires_at", time.Now().Add(-time.Hour)).Error)
+	artifact, err = cache.Get("abc123", models.MediaArtifactTranscript, "openai", "whisper-1")
+	require.NoError(t, err)
+	assert.Nil(t, artifact)
+
+	// A nil cache, or media without a hash, caches nothing
+	var disabled *MediaCache
+	artifact, err = disabled.Put("abc123", models.MediaArtifactOCR, "openai", "gpt-4o-mini", "recibo")
+	require.NoError(t, err)
+	assert.Nil(t, artifact)
+	artifact, err = cache.Put("", models.MediaArtifactOCR, "openai", "gpt-4o-mini", "recibo")
+	require.NoError(t, err)
+	assert.Nil(t, artifact)
+}
+
+func TestMediaCachePurgeKeepsReferencedArtifacts(t *testing.T) {
+	db := testdb.SQLite(t)
+	cache := NewMediaCache(db)
+	repos := repository.NewGorm(db)
+
+	put := func(hash string, expiresAt time.Time) *models.MediaArtifact {
+		artifact, err := cache.Put(hash, models.MediaArtifactOCR, "openai", "gpt-4o-mini", TransactionData{Amount: 10})
+		require.NoError(t, err)
+		require.NoError(t, db.Model(artifact).Update("expires_at", expiresAt).Error)
+		return artifact
+	}
+	put("expired", time.Now().Add(-time.Hour))
+	referenced := put("referenced", time.Now().Add(-time.Hour))
+	fresh := put("fresh", time.Now().Add(time.Hour))
+
+	user := &models.User{PhoneNumber: "5511944440000", Channel: "whatsapp", SubscriptionStatus: "trial"}
+	require.NoError(t, repos.Users.Create(user))
+	require.NoError(t, repos.Transactions.Create(&models.Transaction{UserID: user.ID, Amount: 10, TransactionType: models.TransactionTypeExpense,
+		Source: models.TransactionSourceImage, MediaArtifactID: &referenced.ID}))
+
+	purged, err := cache.PurgeExpired()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	var remaining []models.MediaArtifact
+	require.NoError(t, db.Order("media_sha256").Find(&remaining).Error)
+	require.Len(t, remaining, 2)
+	assert.Equal(t, fresh.ID, remaining[0].ID)
+	assert.Equal(t, referenced.ID, remaining[1].ID)
+}
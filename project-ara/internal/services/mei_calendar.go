@@ -0,0 +1,51 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+// monthNames are the months in Portuguese, January first
+var monthNames = [...]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"}
+
+// weekdayNames are the days of the week in Portuguese, Sunday first
+var weekdayNames = [...]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"}
+
+// MEIObligation is a tax deadline every MEI has
+type MEIObligation struct {
+	Name    string    `json:"name"`
+	DueDate time.Time `json:"due_date"`
+}
+
+// UpcomingMEIObligations lists the MEI deadlines from now to days ahead, soonest first: the
+// monthly DAS, due on the 20th for the month before, and the yearly declaration of the
+// year before (DASN-SIMEI), due on May 31
+func UpcomingMEIObligations(now time.Time, days int) []MEIObligation {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	until := today.AddDate(0, 0, days)
+
+	var obligations []MEIObligation
+	for month := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location()); !month.After(until); month = month.AddDate(0, 1, 0) {
+		if due := month.AddDate(0, 0, 19); !due.Before(today) && !due.After(until) {
+			reference := month.AddDate(0, -1, 0)
+			obligations = append(obligations, MEIObligation{
+				Name:    dasName(reference),
+				DueDate: due,
+			})
+		}
+		if month.Month() == time.May {
+			if due := month.AddDate(0, 0, 30); !due.Before(today) && !due.After(until) {
+				obligations = append(obligations, MEIObligation{
+					Name:    fmt.Sprintf("Declaração anual do MEI de %d (DASN-SIMEI)", month.Year()-1),
+					DueDate: due,
+				})
+			}
+		}
+	}
+	return obligations
+}
+
+// dasName names the DAS-MEI of a month, as in "DAS-MEI de junho"
+func dasName(month time.Time) string {
+	return fmt.Sprintf("DAS-MEI de %s", monthNames[month.Month()-1])
+}
@@ -14,6 +14,8 @@ type TransactionData struct {
 	Type        string // "income" or "expense"
 	Description string
 	Date        string // ISO8601 or empty for today
+	ExternalRef string // NFC-e access key or Pix E2E ID found on a receipt, if any
+	Text        string // What was read on a receipt, for extractions from a photo
 }
 
 type NLPService struct {
@@ -1,34 +1,184 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"project-ara/internal/models"
 )
 
+// OCROptions tunes a single receipt extraction
+type OCROptions struct {
+	MediaSHA256 string // Hash from the webhook, used as the cache key
+}
+
+// OCRResult is a receipt extraction together with the cached artifact that holds it
+type OCRResult struct {
+	Data        *TransactionData
+	MediaSHA256 string
+	ArtifactID  *uuid.UUID
+	Cached      bool
+}
+
+const defaultOCRBaseURL = "https://api.openai.com/v1"
+
 type OCRService struct {
 	openaiAPIKey string
+	baseURL      string
+	model        string
+	cache        *MediaCache
 }
 
-func NewOCRService() *OCRService {
+func NewOCRService(cache *MediaCache) *OCRService {
+	model := os.Getenv("OCR_MODEL")
+	if model == "" {
+		model = "gpt-4o-mini"
+	}
+	baseURL := strings.TrimRight(os.Getenv("OCR_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = defaultOCRBaseURL
+	}
+
 	return &OCRService{
 		openaiAPIKey: os.Getenv("OPENAI_API_KEY"),
+		baseURL:      baseURL,
+		model:        model,
+		cache:        cache,
 	}
 }
 
-// ExtractReceipt uses OpenAI Vision API to extract transaction data from a receipt image URL
+// ExtractReceipt uses the OpenAI vision models to extract transaction data from a receipt image URL
 func (s *OCRService) ExtractReceipt(ctx context.Context, imageURL string) (*TransactionData, error) {
-	if s.openaiAPIKey == "" {
+	result, err := s.ExtractReceiptWithOptions(ctx, imageURL, OCROptions{})
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+// ExtractReceiptData extracts a receipt from downloaded image bytes
+func (s *OCRService) ExtractReceiptData(ctx context.Context, data []byte, mimeType string, opts OCROptions) (*OCRResult, error) {
+	if opts.MediaSHA256 == "" {
+		opts.MediaSHA256 = hashMedia(data)
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	// Vision APIs accept inline images as data URLs
+	dataURL := "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	return s.ExtractReceiptWithOptions(ctx, dataURL, opts)
+}
+
+// ExtractReceiptWithOptions extracts a receipt, answering from the media cache
+// when the same image was processed before
+func (s *OCRService) ExtractReceiptWithOptions(ctx context.Context, imageURL string, opts OCROptions) (*OCRResult, error) {
+	artifact, err := s.cache.Get(opts.MediaSHA256, models.MediaArtifactOCR, "openai", s.model)
+	if err != nil {
+		return nil, err
+	}
+	if artifact != nil {
+		var data TransactionData
+		if err := json.Unmarshal(artifact.Content, &data); err != nil {
+			return nil, fmt.Errorf("failed to decode cached extraction: %w", err)
+		}
+		return &OCRResult{Data: &data, MediaSHA256: opts.MediaSHA256, ArtifactID: &artifact.ID, Cached: true}, nil
+	}
+
+	data, err := s.extract(ctx, imageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &OCRResult{Data: data, MediaSHA256: opts.MediaSHA256}
+	artifact, err = s.cache.Put(opts.MediaSHA256, models.MediaArtifactOCR, "openai", s.model, data)
+	if err != nil {
+		return nil, err
+	}
+	if artifact != nil {
+		result.ArtifactID = &artifact.ID
+	}
+
+	return result, nil
+}
+
+func (s *OCRService) extract(ctx context.Context, imageURL string) (*TransactionData, error) {
+	if s.openaiAPIKey == "" && s.baseURL == defaultOCRBaseURL {
 		return nil, fmt.Errorf("OPENAI_API_KEY not set")
 	}
 
-	// For MVP, we'll simulate the call (OpenAI Vision API is not public for images yet)
-	// In production, use Google Cloud Vision or Gemini Vision API
-	// Here, just return a stub for now
-	return &TransactionData{
-		Amount:      45.00,
-		Type:        "income",
-		Description: "Venda de cachorro-quente",
-		Date:        "",
-	}, nil
+	// Call OpenAI API (Chat Completions with the image attached)
+	body := map[string]interface{}{
+		"model": s.model,
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": "Você é um assistente financeiro para MEIs brasileiros. Leia recibos, notas fiscais e comprovantes de Pix. Responda apenas em JSON."},
+			{"role": "user", "content": []map[string]interface{}{
+				{"type": "text", "text": receiptPrompt},
+				{"type": "image_url", "image_url": map[string]string{"url": imageURL}},
+			}},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+		"max_tokens":      800,
+	}
+	jsonBody, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+"/chat/completions", bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	if s.openaiAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.openaiAPIKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call OCR API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("OCR API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode OCR response: %w", err)
+	}
+	if len(result.Choices) == 0 {
+		return nil, fmt.Errorf("no choices from OpenAI")
+	}
+
+	var data TransactionData
+	if err := json.Unmarshal([]byte(result.Choices[0].Message.Content), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse model output: %w", err)
+	}
+
+	// An identifier printed on the receipt tells a repeated photo of it apart from another
+	// sale of the same amount
+	if data.ExternalRef == "" {
+		data.ExternalRef = ExtractExternalReference(data.Text)
+	}
+	return &data, nil
 }
+
+const receiptPrompt = `Extraia a transação do recibo na imagem. Responda em JSON com os campos ` +
+	`"Amount" (valor total, float), "Type" ("income" para vendas e Pix recebidos, "expense" para compras e Pix enviados), ` +
+	`"Description" (descrição curta), "Date" (AAAA-MM-DD, ou vazio) e "Text" (todo o texto impresso no recibo, ` +
+	`incluindo a chave de acesso da NFC-e ou o ID da transação Pix, se houver).`
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+func TestReceiptReferenceFlagsARepeatedPhoto(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		var request struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Content json.RawMessage `json:"content"`
+			} `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, "gpt-4o-mini", request.Model)
+		require.Len(t, request.Messages, 2)
+		assert.Contains(t, string(request.Messages[1].Content), "data:image/jpeg;base64,")
+
+		// Both photos show the same Pix receipt
+		content, _ := json.Marshal(map[string]interface{}{
+			"Amount":      45,
+			"Type":        "income",
+			"Description": "Pix recebido",
+			"Text":        "Comprovante Pix\nValor: R$ 45,00\nID da transação: E00000000202401011200abcdefghijk",
+		})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"content": string(content)}}},
+		})
+	}))
+	defer server.Close()
+
+	t.Setenv("OCR_BASE_URL", server.URL+"/v1")
+	t.Setenv("OCR_MODEL", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	s := NewOCRService(nil)
+
+	first, err := s.ExtractReceiptData(context.Background(), []byte("primeira foto"), "image/jpeg", OCROptions{})
+	require.NoError(t, err)
+	assert.Contains(t, first.Data.Text, "Comprovante Pix")
+	assert.Equal(t, "E00000000202401011200ABCDEFGHIJK", first.Data.ExternalRef)
+	second, err := s.ExtractReceiptData(context.Background(), []byte("segunda foto"), "image/jpeg", OCROptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, first.MediaSHA256, second.MediaSHA256)
+
+	// The second photo isn't the same file, but it is the same receipt
+	repos := repository.NewMemory()
+	userID := uuid.New()
+	saved := &models.Transaction{UserID: userID, Amount: first.Data.Amount, TransactionType: models.TransactionTypeIncome,
+		Source: models.TransactionSourceImage, MediaSHA256: first.MediaSHA256, ExternalRef: first.Data.ExternalRef}
+	require.NoError(t, repos.Transactions.Create(saved))
+	match, err := NewDuplicateDetector(repos.Transactions).FindDuplicate(&models.Transaction{UserID: userID, Amount: 45,
+		TransactionType: models.TransactionTypeIncome, Description: "Pix recebido", Source: models.TransactionSourceImage,
+		MediaSHA256: second.MediaSHA256, ExternalRef: second.Data.ExternalRef})
+	require.NoError(t, err)
+	require.NotNil(t, match)
+	assert.Equal(t, DuplicateReasonExternalRef, match.Reason)
+	assert.Equal(t, saved.ID, match.Existing.ID)
+}
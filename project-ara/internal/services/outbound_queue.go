@@ -0,0 +1,226 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"project-ara/internal/models"
+)
+
+// OutboundQueue is the outbox of WhatsApp messages waiting to be delivered by the OutboundSender
+type OutboundQueue struct {
+	db *gorm.DB
+}
+
+func NewOutboundQueue(db *gorm.DB) *OutboundQueue {
+	return &OutboundQueue{db: db}
+}
+
+// Enqueue stores a message for delivery as soon as the rate limits allow
+func (q *OutboundQueue) Enqueue(response WhatsAppResponse) error {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbound message: %w", err)
+	}
+
+	message := &models.OutboundMessage{
+		To:            response.To,
+		MessageType:   response.Type,
+		Payload:       payload,
+		Status:        models.OutboundStatusQueued,
+		NextAttemptAt: time.Now(),
+	}
+	if err := q.db.Create(message).Error; err != nil {
+		return fmt.Errorf("failed to enqueue outbound message: %w", err)
+	}
+
+	return nil
+}
+
+// Claim leases up to limit due messages, oldest first. Rows are locked with SKIP LOCKED so
+// several senders can share the outbox; a lease that expires (crashed sender) is claimable again.
+func (q *OutboundQueue) Claim(limit int, lease time.Duration) ([]models.OutboundMessage, error) {
+	// SQLite, used in tests, has a single writer and no row locks
+	lock := "FOR UPDATE SKIP LOCKED"
+	if q.db.Dialector.Name() == "sqlite" {
+		lock = ""
+	}
+
+	now := time.Now()
+	var messages []models.OutboundMessage
+	err := q.db.Raw(`
+		UPDATE outbound_messages SET status = ?, locked_until = ?
+		WHERE id IN (
+			SELECT id FROM outbound_messages
+			WHERE (status = ? AND next_attempt_at <= ?) OR (status = ? AND locked_until < ?)
+			ORDER BY created_at
+			LIMIT ?
+			`+lock+`
+		)
+		RETURNING *`,
+		models.OutboundStatusSending, now.Add(lease),
+		models.OutboundStatusQueued, now, models.OutboundStatusSending, now,
+		limit,
+	).Scan(&messages).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbound messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// ReserveSend takes the next send to a number when interval has passed since the last one,
+// and otherwise returns how long until it has. The reservation is a conditional upsert, so
+// of senders racing for a number only one gets it.
+func (q *OutboundQueue) ReserveSend(to string, interval time.Duration) (time.Duration, error) {
+	now := time.Now()
+	result := q.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "phone_number"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_sent_at"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Lte{Column: clause.Column{Table: "outbound_recipients", Name: "last_sent_at"}, Value: now.Add(-interval)}}},
+	}).Create(&models.OutboundRecipient{PhoneNumber: to, LastSentAt: now})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to reserve outbound send: %w", result.Error)
+	}
+	if result.RowsAffected == 1 {
+		return 0, nil
+	}
+
+	var recipient models.OutboundRecipient
+	if err := q.db.Where("phone_number = ?", to).First(&recipient).Error; err != nil {
+		return 0, fmt.Errorf("failed to read outbound recipient: %w", err)
+	}
+	// Another sender's clock may be a little ahead; wait at least a moment
+	return max(interval-now.Sub(recipient.LastSentAt), time.Millisecond), nil
+}
+
+// MarkSent records a message accepted by WhatsApp and its wamid
+func (q *OutboundQueue) MarkSent(id uuid.UUID, wamid string, attempts int) error {
+	now := time.Now()
+	return q.update(id, map[string]interface{}{
+		"status":       models.OutboundStatusSent,
+		"wamid":        wamid,
+		"attempts":     attempts,
+		"sent_at":      now,
+		"locked_until": nil,
+		"last_error":   "",
+	})
+}
+
+// Retry puts a message back in the queue after a temporary failure
+func (q *OutboundQueue) Retry(id uuid.UUID, attempts int, at time.Time, reason string) error {
+	return q.update(id, map[string]interface{}{
+		"status":          models.OutboundStatusQueued,
+		"attempts":        attempts,
+		"next_attempt_at": at,
+		"locked_until":    nil,
+		"last_error":      reason,
+	})
+}
+
+// Defer puts a message back in the queue without counting an attempt, e.g. when
+// the per-number rate limit doesn't allow sending it yet
+func (q *OutboundQueue) Defer(id uuid.UUID, at time.Time) error {
+	return q.update(id, map[string]interface{}{
+		"status":          models.OutboundStatusQueued,
+		"next_attempt_at": at,
+		"locked_until":    nil,
+	})
+}
+
+// MarkFailed gives up on a message
+func (q *OutboundQueue) MarkFailed(id uuid.UUID, attempts int, reason string) error {
+	return q.update(id, map[string]interface{}{
+		"status":       models.OutboundStatusFailed,
+		"attempts":     attempts,
+		"failed_at":    time.Now(),
+		"locked_until": nil,
+		"last_error":   reason,
+	})
+}
+
+func (q *OutboundQueue) update(id uuid.UUID, fields map[string]interface{}) error {
+	if err := q.db.Model(&models.OutboundMessage{}).Where("id = ?", id).Updates(fields).Error; err != nil {
+		return fmt.Errorf("failed to update outbound message: %w", err)
+	}
+	return nil
+}
+
+// ApplyStatus updates the delivery state from a statuses webhook event. Receipts may
+// arrive out of order, so a message never moves back (e.g. from read to delivered).
+func (q *OutboundQueue) ApplyStatus(status WhatsAppStatus) error {
+	if status.ID == "" {
+		return nil
+	}
+
+	var message models.OutboundMessage
+	if err := q.db.Where("wamid = ?", status.ID).First(&message).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			// Sent before the outbox existed, or by another tool on the same number
+			return nil
+		}
+		return fmt.Errorf("failed to find outbound message: %w", err)
+	}
+
+	at := status.At()
+	fields := map[string]interface{}{}
+	switch models.OutboundStatus(status.Status) {
+	case models.OutboundStatusSent:
+		if message.SentAt == nil {
+			fields["sent_at"] = at
+		}
+	case models.OutboundStatusDelivered:
+		fields["delivered_at"] = at
+	case models.OutboundStatusRead:
+		fields["read_at"] = at
+		if message.DeliveredAt == nil {
+			fields["delivered_at"] = at
+		}
+	case models.OutboundStatusFailed:
+		fields["failed_at"] = at
+		fields["last_error"] = status.ErrorDetail()
+	default:
+		return nil
+	}
+	if deliveryRank(models.OutboundStatus(status.Status)) > deliveryRank(message.Status) {
+		fields["status"] = status.Status
+	}
+
+	return q.update(message.ID, fields)
+}
+
+// deliveryRank orders delivery states so late receipts don't overwrite newer ones
+func deliveryRank(status models.OutboundStatus) int {
+	switch status {
+	case models.OutboundStatusSent:
+		return 1
+	case models.OutboundStatusDelivered:
+		return 2
+	case models.OutboundStatusRead:
+		return 3
+	case models.OutboundStatusFailed:
+		return 4
+	}
+	return 0
+}
+
+// ListUndelivered returns messages sent before the cutoff that never reached the user's phone
+func (q *OutboundQueue) ListUndelivered(before time.Time, limit int) ([]models.OutboundMessage, error) {
+	var messages []models.OutboundMessage
+	err := q.db.Where("(status IN ? AND created_at < ?) OR status = ?",
+		[]models.OutboundStatus{models.OutboundStatusQueued, models.OutboundStatusSending, models.OutboundStatusSent}, before,
+		models.OutboundStatusFailed).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&messages).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list undelivered messages: %w", err)
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/testdb"
+)
+
+func enqueueText(t *testing.T, queue *OutboundQueue, to, body string) {
+	t.Helper()
+	require.NoError(t, queue.Enqueue(WhatsAppResponse{MessagingProduct: "whatsapp", To: to, Type: "text", Text: &WhatsAppText{Body: body}}))
+}
+
+func TestOutboundQueueClaimsDueMessagesOnce(t *testing.T) {
+	queue := NewOutboundQueue(testdb.SQLite(t))
+	enqueueText(t, queue, "5511911110000", "primeira")
+	enqueueText(t, queue, "5511922220000", "segunda")
+	enqueueText(t, queue, "5511933330000", "terceira")
+
+	claimed, err := queue.Claim(2, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	for _, message := range claimed {
+		assert.Equal(t, models.OutboundStatusSending, message.Status)
+		require.NotNil(t, message.LockedUntil)
+	}
+
+	// Leased messages aren't claimed again while their lease runs
+	rest, err := queue.Claim(10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, rest, 1)
+	assert.Equal(t, "5511933330000", rest[0].To)
+	none, err := queue.Claim(10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	// A deferred message waits for its time, and an expired lease frees a message again
+	require.NoError(t, queue.Defer(rest[0].ID, time.Now().Add(time.Hour)))
+	require.NoError(t, queue.db.Model(&models.OutboundMessage{}).Where("id = ?", claimed[0].ID).
+		Update("locked_until", time.Now().Add(-time.Second)).Error)
+	again, err := queue.Claim(10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	assert.Equal(t, claimed[0].ID, again[0].ID)
+}
+
+func TestOutboundQueueRetriesLater(t *testing.T) {
+	queue := NewOutboundQueue(testdb.SQLite(t))
+	enqueueText(t, queue, "5511911110000", "oi")
+	claimed, err := queue.Claim(10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+
+	require.NoError(t, queue.Retry(claimed[0].ID, 1, time.Now().Add(time.Hour), "429 too many requests"))
+	due, err := queue.Claim(10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	var message models.OutboundMessage
+	require.NoError(t, queue.db.First(&message, "id = ?", claimed[0].ID).Error)
+	assert.Equal(t, models.OutboundStatusQueued, message.Status)
+	assert.Equal(t, 1, message.Attempts)
+	assert.Equal(t, "429 too many requests", message.LastError)
+	assert.Nil(t, message.LockedUntil)
+
+	require.NoError(t, queue.Retry(claimed[0].ID, 2, time.Now().Add(-time.Second), "timeout"))
+	due, err = queue.Claim(10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, 2, due[0].Attempts)
+}
+
+func TestOutboundQueueAppliesDeliveryReceipts(t *testing.T) {
+	queue := NewOutboundQueue(testdb.SQLite(t))
+	enqueueText(t, queue, "5511911110000", "oi")
+	claimed, err := queue.Claim(10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.NoError(t, queue.MarkSent(claimed[0].ID, "wamid.abc", 1))
+
+	receipt := func(status string, at time.Time) WhatsAppStatus {
+		return WhatsAppStatus{ID: "wamid.abc", Status: status, Timestamp: strconv.FormatInt(at.Unix(), 10)}
+	}
+	stored := func() models.OutboundMessage {
+		var message models.OutboundMessage
+		require.NoError(t, queue.db.First(&message, "id = ?", claimed[0].ID).Error)
+		return message
+	}
+
+	readAt := time.Now().Truncate(time.Second)
+	require.NoError(t, queue.ApplyStatus(receipt("read", readAt)))
+	message := stored()
+	assert.Equal(t, models.OutboundStatusRead, message.Status)
+	require.NotNil(t, message.ReadAt)
+	require.NotNil(t, message.DeliveredAt)
+	assert.True(t, readAt.Equal(*message.DeliveredAt))
+
+	// A late delivered receipt records its time but doesn't move the message back
+	deliveredAt := readAt.Add(-time.Minute)
+	require.NoError(t, queue.ApplyStatus(receipt("delivered", deliveredAt)))
+	message = stored()
+	assert.Equal(t, models.OutboundStatusRead, message.Status)
+	assert.True(t, deliveredAt.Equal(*message.DeliveredAt))
+
+	// Receipts of messages the outbox didn't send are ignored
+	unknown := receipt("delivered", readAt)
+	unknown.ID = "wamid.other"
+	assert.NoError(t, queue.ApplyStatus(unknown))
+}
+
+func TestOutboundSendsToANumberAreSpacedAcrossSenders(t *testing.T) {
+	db := testdb.SQLite(t)
+	server, worker := NewOutboundQueue(db), NewOutboundQueue(db)
+
+	wait, err := server.ReserveSend("5511911110000", time.Minute)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// The worker sees the server's send
+	wait, err = worker.ReserveSend("5511911110000", time.Minute)
+	require.NoError(t, err)
+	assert.Greater(t, wait, 50*time.Second)
+	assert.LessOrEqual(t, wait, time.Minute)
+
+	wait, err = worker.ReserveSend("5511922220000", time.Minute)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	require.NoError(t, db.Model(&models.OutboundRecipient{}).Where("phone_number = ?", "5511911110000").
+		Update("last_sent_at", time.Now().Add(-2*time.Minute)).Error)
+	wait, err = worker.ReserveSend("5511911110000", time.Minute)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+}
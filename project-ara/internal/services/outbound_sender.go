@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"project-ara/internal/models"
+)
+
+// OutboundSender delivers queued messages, retrying temporary failures with exponential
+// backoff while keeping under the global and per-number rate limits. The global limit is
+// per sender; the per-number one is kept in the outbox and holds across processes.
+type OutboundSender struct {
+	queue       *OutboundQueue
+	whatsapp    *WhatsAppService
+	global      *rateLimiter
+	perNumber   time.Duration
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	pollEvery   time.Duration
+	batchSize   int
+}
+
+func NewOutboundSender(queue *OutboundQueue, whatsapp *WhatsAppService) *OutboundSender {
+	return &OutboundSender{
+		queue:       queue,
+		whatsapp:    whatsapp,
+		global:      newRateLimiter(envInt("OUTBOUND_GLOBAL_RATE_PER_SECOND", 20)),
+		perNumber:   time.Duration(envInt("OUTBOUND_PER_NUMBER_INTERVAL_MS", 1000)) * time.Millisecond,
+		maxAttempts: envInt("OUTBOUND_MAX_ATTEMPTS", 8),
+		baseBackoff: 2 * time.Second,
+		maxBackoff:  10 * time.Minute,
+		pollEvery:   500 * time.Millisecond,
+		batchSize:   50,
+	}
+}
+
+// Run polls the outbox until ctx is cancelled
+func (s *OutboundSender) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.pollEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := s.ProcessBatch(ctx); err != nil {
+			logrus.Errorf("Outbound sender: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessBatch claims and sends one batch of due messages
+func (s *OutboundSender) ProcessBatch(ctx context.Context) error {
+	messages, err := s.queue.Claim(s.batchSize, time.Minute)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if ctx.Err() != nil {
+			// Leave the rest for the next run; their lease expires on its own
+			return nil
+		}
+		s.sendOne(ctx, message)
+	}
+
+	return nil
+}
+
+func (s *OutboundSender) sendOne(ctx context.Context, message models.OutboundMessage) {
+	var response WhatsAppResponse
+	if err := json.Unmarshal(message.Payload, &response); err != nil {
+		s.fail(message, message.Attempts, "invalid payload: "+err.Error())
+		return
+	}
+
+	if err := s.global.Wait(ctx); err != nil {
+		return
+	}
+	// Reserved right before sending, so the number's sends are spaced as they go out
+	wait, err := s.queue.ReserveSend(message.To, s.perNumber)
+	if err != nil {
+		logrus.Errorf("Outbound sender: %v", err)
+		wait = s.perNumber
+	}
+	if wait > 0 {
+		if err := s.queue.Defer(message.ID, time.Now().Add(wait)); err != nil {
+			logrus.Errorf("Outbound sender: %v", err)
+		}
+		return
+	}
+
+	attempts := message.Attempts + 1
+	wamid, err := s.whatsapp.deliver(ctx, response)
+	if err == nil {
+		if err := s.queue.MarkSent(message.ID, wamid, attempts); err != nil {
+			logrus.Errorf("Outbound sender: %v", err)
+		}
+		return
+	}
+
+	var apiErr *WhatsAppAPIError
+	if errors.As(err, &apiErr) && !apiErr.Temporary() {
+		s.fail(message, attempts, err.Error())
+		return
+	}
+	if attempts >= s.maxAttempts {
+		s.fail(message, attempts, err.Error())
+		return
+	}
+
+	delay := s.retryDelay(attempts)
+	if apiErr != nil && apiErr.RetryAfter > delay {
+		delay = apiErr.RetryAfter
+	}
+	if err := s.queue.Retry(message.ID, attempts, time.Now().Add(delay), err.Error()); err != nil {
+		logrus.Errorf("Outbound sender: %v", err)
+	}
+}
+
+func (s *OutboundSender) fail(message models.OutboundMessage, attempts int, reason string) {
+	logrus.Warnf("Giving up on outbound message %s to %s: %s", message.ID, message.To, reason)
+	if err := s.queue.MarkFailed(message.ID, attempts, reason); err != nil {
+		logrus.Errorf("Outbound sender: %v", err)
+	}
+}
+
+// retryDelay is the exponential backoff after the given number of attempts, with up to 20% jitter
+func (s *OutboundSender) retryDelay(attempts int) time.Duration {
+	delay := s.baseBackoff
+	for i := 1; i < attempts && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// rateLimiter spaces sends evenly so there are at most perSecond per second
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		perSecond = 1
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// Wait blocks until the next send is allowed
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func envInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,29 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryDelayBacksOffExponentially(t *testing.T) {
+	s := NewOutboundSender(nil, nil)
+
+	for attempts, base := range map[int]time.Duration{
+		1:  2 * time.Second,
+		2:  4 * time.Second,
+		4:  16 * time.Second,
+		20: 10 * time.Minute,
+	} {
+		delay := s.retryDelay(attempts)
+		assert.GreaterOrEqual(t, delay, base, "attempt %d", attempts)
+		assert.LessOrEqual(t, delay, base+base/5, "attempt %d", attempts)
+	}
+}
+
+func TestStatusReceiptsNeverMoveBack(t *testing.T) {
+	assert.Greater(t, deliveryRank("read"), deliveryRank("delivered"))
+	assert.Greater(t, deliveryRank("delivered"), deliveryRank("sent"))
+	assert.Greater(t, deliveryRank("sent"), deliveryRank("sending"))
+}
@@ -0,0 +1,270 @@
+package services
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+
+	"project-ara/internal/models"
+)
+
+//go:embed plans.json
+var defaultPlans []byte
+
+// ErrUnknownPlan is returned when a subscription is asked for a plan the catalog doesn't sell
+var ErrUnknownPlan = errors.New("unknown plan")
+
+// Plan is a subscription plan. Its price is what new subscriptions pay: a subscription
+// keeps the price it was sold at through its renewals.
+type Plan struct {
+	ID             string    `json:"id"`      // Stored on subscriptions, so never reuse one
+	Name           string    `json:"name"`    // Shown to users and on gateway charges
+	Keyword        string    `json:"keyword"` // "assinar <keyword>" picks the plan in the chat
+	Tier           string    `json:"tier"`
+	Price          float64   `json:"price"`
+	Currency       string    `json:"currency"`
+	IntervalMonths int       `json:"interval_months"` // Between the gateway's recurring charges
+	PeriodDays     int       `json:"period_days"`     // Access each payment buys
+	Features       []Feature `json:"features"`        // Besides unlimited transactions
+	Retired        bool      `json:"retired"`         // Not sold anymore; its subscriptions still renew
+}
+
+// PriceLabel is the plan's price per billing interval, such as "R$ 9,90/mês"
+func (p Plan) PriceLabel() string {
+	return priceLabel(p.Price, p.IntervalMonths)
+}
+
+// TrialPolicy is how many transactions users log for free, and when they are asked to
+// subscribe
+type TrialPolicy struct {
+	Transactions int `json:"transactions"`
+	PromptAt     int `json:"prompt_at"` // Count from which users are prompted to subscribe
+	WarnAt       int `json:"warn_at"`   // Count from which trial status messages suggest subscribing
+
+	Features []Feature `json:"features"` // Usually none: they're what subscribing unlocks
+}
+
+// Limit is how many free transactions the user has: the trial's and those they earned
+func (p TrialPolicy) Limit(user *models.User) int {
+	return p.Transactions + user.BonusTransactions
+}
+
+// Remaining is how many free transactions the user has left
+func (p TrialPolicy) Remaining(user *models.User) int {
+	return max(p.Limit(user)-user.TrialTransactionsCount, 0)
+}
+
+// ReferralPolicy is what referring the Ara earns. When a referred user pays for a
+// subscription the first time, they and their referrer each get RewardDays more of the
+// subscription they have running or, without one, RewardTransactions more free
+// transactions. Referrals are off when neither is set.
+type ReferralPolicy struct {
+	RewardDays         int `json:"reward_days"`
+	RewardTransactions int `json:"reward_transactions"`
+	ClaimWithinDays    int `json:"claim_within_days"` // After signing up, for a code to be accepted
+	MaxPerMonth        int `json:"max_per_month"`     // Referrals a user can make in 30 days
+}
+
+// Enabled reports whether referrals earn anything
+func (p ReferralPolicy) Enabled() bool {
+	return p.RewardDays > 0 || p.RewardTransactions > 0
+}
+
+// PlanCatalog is what the Ara sells: the plans and the free trial
+type PlanCatalog struct {
+	Trial       TrialPolicy    `json:"trial"`
+	Referral    ReferralPolicy `json:"referral"`
+	DefaultPlan string         `json:"default_plan"`
+	Plans       []Plan         `json:"plans"`
+
+	// ConversionVariants are the conversion messages being A/B tested; users are split
+	// evenly between them. Only the value message is shown when empty.
+	ConversionVariants []string `json:"conversion_variants"`
+
+	byID map[string]Plan
+}
+
+// LoadPlanCatalog loads the catalog from path, or the built-in one when path is empty
+func LoadPlanCatalog(path string) (*PlanCatalog, error) {
+	data := defaultPlans
+	if path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read plans file: %w", err)
+		}
+		data = fileData
+	}
+
+	var catalog PlanCatalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse plans: %w", err)
+	}
+
+	trial := catalog.Trial
+	if trial.Transactions <= 0 || trial.PromptAt < 0 || trial.PromptAt > trial.Transactions || trial.WarnAt < 0 || trial.WarnAt > trial.Transactions {
+		return nil, fmt.Errorf("invalid trial policy: %+v", trial)
+	}
+	if err := checkFeatures(trial.Features); err != nil {
+		return nil, fmt.Errorf("invalid trial policy: %w", err)
+	}
+	referral := catalog.Referral
+	if referral.RewardDays < 0 || referral.RewardTransactions < 0 || referral.Enabled() && (referral.ClaimWithinDays <= 0 || referral.MaxPerMonth <= 0) {
+		return nil, fmt.Errorf("invalid referral policy: %+v", referral)
+	}
+
+	if len(catalog.ConversionVariants) == 0 {
+		catalog.ConversionVariants = []string{ConversionVariantValue}
+	}
+	seen := make(map[string]bool, len(catalog.ConversionVariants))
+	for _, variant := range catalog.ConversionVariants {
+		if !knownConversionVariant(variant) || seen[variant] {
+			return nil, fmt.Errorf("invalid conversion variant: %q", variant)
+		}
+		seen[variant] = true
+	}
+
+	catalog.byID = make(map[string]Plan, len(catalog.Plans))
+	for i := range catalog.Plans {
+		plan := &catalog.Plans[i]
+		if plan.ID == "" || plan.Name == "" {
+			return nil, fmt.Errorf("plan without id or name")
+		}
+		if _, ok := catalog.byID[plan.ID]; ok {
+			return nil, fmt.Errorf("duplicate plan: %s", plan.ID)
+		}
+		if plan.Price <= 0 || plan.IntervalMonths <= 0 || plan.PeriodDays <= 0 {
+			return nil, fmt.Errorf("plan %s needs a price, interval_months and period_days", plan.ID)
+		}
+		if err := checkFeatures(plan.Features); err != nil {
+			return nil, fmt.Errorf("invalid plan %s: %w", plan.ID, err)
+		}
+		if plan.Currency == "" {
+			plan.Currency = "BRL"
+		}
+		plan.Keyword = strings.ToLower(plan.Keyword)
+		catalog.byID[plan.ID] = *plan
+	}
+
+	if plan, ok := catalog.byID[catalog.DefaultPlan]; !ok || plan.Retired {
+		return nil, fmt.Errorf("default plan %q isn't sold", catalog.DefaultPlan)
+	}
+	return &catalog, nil
+}
+
+// Default returns the plan sold when the user doesn't pick one
+func (c *PlanCatalog) Default() Plan {
+	return c.byID[c.DefaultPlan]
+}
+
+// Plan returns a plan by ID, retired ones included
+func (c *PlanCatalog) Plan(id string) (Plan, error) {
+	plan, ok := c.byID[id]
+	if !ok {
+		return Plan{}, fmt.Errorf("%w: %s", ErrUnknownPlan, id)
+	}
+	return plan, nil
+}
+
+// ForSale returns the plan to sell a new subscription of: the default plan when id is
+// empty. Retired plans aren't sold.
+func (c *PlanCatalog) ForSale(id string) (Plan, error) {
+	if id == "" {
+		return c.Default(), nil
+	}
+	plan, err := c.Plan(id)
+	if err == nil && plan.Retired {
+		return Plan{}, fmt.Errorf("%w: %s is retired", ErrUnknownPlan, id)
+	}
+	return plan, err
+}
+
+// ByKeyword returns the plan sold under a chat keyword
+func (c *PlanCatalog) ByKeyword(keyword string) (Plan, bool) {
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+	for _, plan := range c.Available() {
+		if plan.Keyword != "" && plan.Keyword == keyword {
+			return plan, true
+		}
+	}
+	return Plan{}, false
+}
+
+// Available lists the plans on sale, in catalog order
+func (c *PlanCatalog) Available() []Plan {
+	var available []Plan
+	for _, plan := range c.Plans {
+		if !plan.Retired {
+			available = append(available, plan)
+		}
+	}
+	return available
+}
+
+// ConversionVariant returns the conversion message variant the user is shown: the one they
+// were shown before while it's still tested, else one picked from their ID, so a user
+// always sees the same one
+func (c *PlanCatalog) ConversionVariant(user *models.User) string {
+	for _, variant := range c.ConversionVariants {
+		if variant == user.ConversionVariant {
+			return variant
+		}
+	}
+	hash := fnv.New32a()
+	hash.Write(user.ID[:])
+	return c.ConversionVariants[hash.Sum32()%uint32(len(c.ConversionVariants))]
+}
+
+// PlanOf returns the plan a subscription was sold under. Subscriptions of plans that were
+// removed from the catalog renew like the default plan.
+func (c *PlanCatalog) PlanOf(subscription *models.Subscription) Plan {
+	if plan, ok := c.byID[subscription.Plan]; ok {
+		return plan
+	}
+	return c.Default()
+}
+
+// PriceLabel is what the subscription costs per billing interval, at the price it was sold
+func (c *PlanCatalog) PriceLabel(subscription *models.Subscription) string {
+	return priceLabel(subscription.Price, c.PlanOf(subscription).IntervalMonths)
+}
+
+// Discount is how much cheaper a plan is per month than the monthly plan of its tier, as
+// a fraction; zero when there is no monthly plan to compare with
+func (c *PlanCatalog) Discount(plan Plan) float64 {
+	for _, monthly := range c.Available() {
+		if monthly.Tier == plan.Tier && monthly.IntervalMonths == 1 && monthly.Currency == plan.Currency {
+			discount := 1 - plan.Price/float64(plan.IntervalMonths)/monthly.Price
+			return max(discount, 0)
+		}
+	}
+	return 0
+}
+
+func checkFeatures(features []Feature) error {
+	for _, feature := range features {
+		if !knownFeature(feature) {
+			return fmt.Errorf("unknown feature %q", feature)
+		}
+	}
+	return nil
+}
+
+func priceLabel(price float64, intervalMonths int) string {
+	switch intervalMonths {
+	case 1:
+		return "R$ " + formatPrice(price) + "/mês"
+	case 12:
+		return "R$ " + formatPrice(price) + "/ano"
+	default:
+		return fmt.Sprintf("R$ %s a cada %d meses", formatPrice(price), intervalMonths)
+	}
+}
+
+// formatPrice writes an amount the Brazilian way, with a decimal comma
+func formatPrice(price float64) string {
+	return strings.Replace(fmt.Sprintf("%.2f", price), ".", ",", 1)
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+)
+
+func TestLoadPlanCatalog(t *testing.T) {
+	plans, err := LoadPlanCatalog("")
+	require.NoError(t, err)
+	assert.Equal(t, TrialPolicy{Transactions: 50, PromptAt: 45, WarnAt: 40, Features: []Feature{}}, plans.Trial)
+	assert.Equal(t, "monthly", plans.Default().ID)
+	assert.Equal(t, "R$ 9,90/mês", plans.Default().PriceLabel())
+
+	annual, ok := plans.ByKeyword(" Anual")
+	require.True(t, ok)
+	assert.Equal(t, "R$ 99,00/ano", annual.PriceLabel())
+	assert.InDelta(t, 0.1667, plans.Discount(annual), 0.0001)
+	assert.Zero(t, plans.Discount(plans.Default()))
+
+	// A subscription keeps its price and renews like its plan
+	subscription := &models.Subscription{Plan: "annual", Price: 89}
+	assert.Equal(t, "R$ 89,00/ano", plans.PriceLabel(subscription))
+	subscription.Plan = "removed"
+	assert.Equal(t, plans.Default(), plans.PlanOf(subscription))
+
+	user := &models.User{TrialTransactionsCount: 52}
+	assert.Zero(t, plans.Trial.Remaining(user))
+	user.BonusTransactions = 20
+	assert.Equal(t, 70, plans.Trial.Limit(user))
+	assert.Equal(t, 18, plans.Trial.Remaining(user))
+
+	assert.Equal(t, ReferralPolicy{RewardDays: 30, RewardTransactions: 20, ClaimWithinDays: 7, MaxPerMonth: 20}, plans.Referral)
+	assert.Equal(t, "1 mês grátis de Premium (quem ainda não assina ganha 20 transações grátis a mais)", plans.Referral.RewardSummary())
+	assert.Equal(t, []string{ConversionVariantValue, ConversionVariantDeadlines}, plans.ConversionVariants)
+}
+
+// writePlans writes a catalog for LoadPlanCatalog and returns its path
+func writePlans(t *testing.T, catalog string) string {
+	path := filepath.Join(t.TempDir(), "plans.json")
+	require.NoError(t, os.WriteFile(path, []byte(catalog), 0o644))
+	return path
+}
+
+func TestPlanCatalogFile(t *testing.T) {
+	plans, err := LoadPlanCatalog(writePlans(t, `{
+		"trial": {"transactions": 30, "prompt_at": 25, "warn_at": 20},
+		"default_plan": "pro",
+		"plans": [
+			{"id": "monthly", "name": "Premium mensal", "keyword": "mensal", "tier": "premium", "price": 9.90, "interval_months": 1, "period_days": 30, "retired": true},
+			{"id": "basic", "name": "Básico", "keyword": "basico", "tier": "basic", "price": 4.90, "interval_months": 1, "period_days": 30},
+			{"id": "pro", "name": "Pro", "keyword": "pro", "tier": "pro", "price": 19.90, "interval_months": 1, "period_days": 30}
+		]
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, 30, plans.Trial.Transactions)
+	assert.False(t, plans.Referral.Enabled())
+	assert.Equal(t, []string{ConversionVariantValue}, plans.ConversionVariants)
+	assert.Equal(t, "BRL", plans.Default().Currency)
+	assert.Len(t, plans.Available(), 2)
+
+	// Retired plans still renew, but aren't sold
+	_, err = plans.Plan("monthly")
+	assert.NoError(t, err)
+	_, err = plans.ForSale("monthly")
+	assert.ErrorIs(t, err, ErrUnknownPlan)
+	_, ok := plans.ByKeyword("mensal")
+	assert.False(t, ok)
+	_, err = plans.ForSale("enterprise")
+	assert.ErrorIs(t, err, ErrUnknownPlan)
+
+	for name, catalog := range map[string]string{
+		"no trial":            `{"default_plan": "a", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30}]}`,
+		"prompt past end":     `{"trial": {"transactions": 10, "prompt_at": 11}, "default_plan": "a", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30}]}`,
+		"free plan":           `{"trial": {"transactions": 10}, "default_plan": "a", "plans": [{"id": "a", "name": "A", "interval_months": 1, "period_days": 30}]}`,
+		"duplicate plan":      `{"trial": {"transactions": 10}, "default_plan": "a", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30}, {"id": "a", "name": "B", "price": 2, "interval_months": 1, "period_days": 30}]}`,
+		"missing default":     `{"trial": {"transactions": 10}, "default_plan": "b", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30}]}`,
+		"retired default":     `{"trial": {"transactions": 10}, "default_plan": "a", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30, "retired": true}]}`,
+		"unknown feature":     `{"trial": {"transactions": 10}, "default_plan": "a", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30, "features": ["teleport"]}]}`,
+		"unlimited referrals": `{"trial": {"transactions": 10}, "referral": {"reward_days": 30, "claim_within_days": 7}, "default_plan": "a", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30}]}`,
+		"unknown variant":     `{"trial": {"transactions": 10}, "conversion_variants": ["value", "fomo"], "default_plan": "a", "plans": [{"id": "a", "name": "A", "price": 1, "interval_months": 1, "period_days": 30}]}`,
+		"not a catalog":       `[]`,
+	} {
+		_, err := LoadPlanCatalog(writePlans(t, catalog))
+		assert.Error(t, err, name)
+	}
+}
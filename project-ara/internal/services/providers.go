@@ -0,0 +1,23 @@
+package services
+
+import "context"
+
+// The AI providers the conversation depends on. NLPService, VoiceService and OCRService
+// are the production implementations; tests substitute scripted fakes.
+
+// TransactionExtractor turns free text into a transaction
+type TransactionExtractor interface {
+	ExtractTransaction(ctx context.Context, text string) (*TransactionData, error)
+}
+
+// Transcriber turns a voice note into text
+type Transcriber interface {
+	TranscribeAudioData(ctx context.Context, data []byte, opts TranscriptionOptions) (*TranscriptionResult, error)
+	MaxBytes() int64
+	MaxDurationSeconds() int
+}
+
+// ReceiptReader extracts a transaction from a receipt photo
+type ReceiptReader interface {
+	ExtractReceiptData(ctx context.Context, data []byte, mimeType string, opts OCROptions) (*OCRResult, error)
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+var (
+	// ErrInvalidCoupon is returned for coupons that can't be created or used
+	ErrInvalidCoupon = errors.New("invalid coupon")
+	// ErrCouponExists is returned when a coupon is created with a code that is taken
+	ErrCouponExists = errors.New("coupon code already exists")
+)
+
+// Reasons a coupon can't be used
+const (
+	CouponUnknown         = "unknown"
+	CouponInactive        = "inactive"
+	CouponExpired         = "expired"
+	CouponUsedUp          = "used_up"
+	CouponAlreadyRedeemed = "already_redeemed"
+	CouponTooLarge        = "too_large" // It would make the plan free
+)
+
+// CouponError is returned when a coupon can't be used on a subscription
+type CouponError struct {
+	Code   string
+	Reason string // One of the Coupon* reasons
+}
+
+func (e *CouponError) Error() string {
+	return fmt.Sprintf("coupon %s can't be used: %s", e.Code, e.Reason)
+}
+
+func (e *CouponError) Unwrap() error {
+	return ErrInvalidCoupon
+}
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// normalizeCouponCode is how coupon codes are stored: users type them in any case
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// CreateCoupon validates and stores a coupon created by an admin
+func (s *SubscriptionService) CreateCoupon(coupon *models.Coupon) error {
+	coupon.Code = normalizeCouponCode(coupon.Code)
+	if !couponCodePattern.MatchString(coupon.Code) {
+		return fmt.Errorf("%w: the code must have 3 to 32 letters, digits, - or _", ErrInvalidCoupon)
+	}
+	switch coupon.Kind {
+	case models.CouponKindPercentage:
+		if coupon.Value <= 0 || coupon.Value >= 100 {
+			return fmt.Errorf("%w: a percentage must be between 0 and 100", ErrInvalidCoupon)
+		}
+	case models.CouponKindFixed:
+		if coupon.Value <= 0 {
+			return fmt.Errorf("%w: the amount off must be positive", ErrInvalidCoupon)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidCoupon, coupon.Kind)
+	}
+	if coupon.MaxUses < 0 {
+		return fmt.Errorf("%w: max_uses can't be negative", ErrInvalidCoupon)
+	}
+	if coupon.ExpiresAt != nil && !coupon.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: it would be expired already", ErrInvalidCoupon)
+	}
+
+	coupon.Uses = 0
+	coupon.Active = true
+	err := s.subscriptions.CreateCoupon(coupon)
+	if errors.Is(err, repository.ErrConflict) {
+		return ErrCouponExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create coupon: %w", err)
+	}
+	return nil
+}
+
+// ListCoupons returns every coupon with how often it was used, newest first
+func (s *SubscriptionService) ListCoupons() ([]models.Coupon, error) {
+	coupons, err := s.subscriptions.ListCoupons()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list coupons: %w", err)
+	}
+	return coupons, nil
+}
+
+// DeactivateCoupon stops a coupon from being used on new checkouts. Subscriptions sold
+// with it keep their price.
+func (s *SubscriptionService) DeactivateCoupon(code string) error {
+	return s.subscriptions.DeactivateCoupon(normalizeCouponCode(code))
+}
+
+// applyCoupon checks that the user can use a coupon on a plan and returns it with the
+// discounted price
+func (s *SubscriptionService) applyCoupon(user *models.User, code string, plan Plan) (*models.Coupon, float64, error) {
+	code = normalizeCouponCode(code)
+	coupon, err := s.subscriptions.GetCoupon(code)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, 0, &CouponError{Code: code, Reason: CouponUnknown}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get coupon: %w", err)
+	}
+
+	switch {
+	case !coupon.Active:
+		return nil, 0, &CouponError{Code: code, Reason: CouponInactive}
+	case coupon.ExpiresAt != nil && !time.Now().Before(*coupon.ExpiresAt):
+		return nil, 0, &CouponError{Code: code, Reason: CouponExpired}
+	case coupon.MaxUses > 0 && coupon.Uses >= coupon.MaxUses:
+		return nil, 0, &CouponError{Code: code, Reason: CouponUsedUp}
+	}
+	redeemed, err := s.subscriptions.CouponRedeemed(coupon.ID, user.ID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to check coupon: %w", err)
+	}
+	if redeemed {
+		return nil, 0, &CouponError{Code: code, Reason: CouponAlreadyRedeemed}
+	}
+
+	price := discountedPrice(coupon, plan.Price)
+	if price <= 0 {
+		return nil, 0, &CouponError{Code: code, Reason: CouponTooLarge}
+	}
+	return coupon, price, nil
+}
+
+// discountedPrice is a price after the coupon, in cents
+func discountedPrice(coupon *models.Coupon, price float64) float64 {
+	if coupon.Kind == models.CouponKindPercentage {
+		price *= 1 - coupon.Value/100
+	} else {
+		price -= coupon.Value
+	}
+	return math.Round(price*100) / 100
+}
+
+// redeemCoupon counts the use of the coupon a paid checkout was sold with. A checkout
+// started before the coupon ran out is honored.
+func (s *SubscriptionService) redeemCoupon(subscription *models.Subscription) {
+	if subscription.CouponID == nil {
+		return
+	}
+	redemption := &models.CouponRedemption{
+		CouponID:       *subscription.CouponID,
+		UserID:         subscription.UserID,
+		SubscriptionID: subscription.ID,
+		Discount:       max(s.plans.PlanOf(subscription).Price-subscription.Price, 0),
+	}
+	if err := s.subscriptions.RedeemCoupon(redemption); err != nil && !errors.Is(err, repository.ErrConflict) {
+		logrus.Errorf("Failed to redeem the coupon of subscription %s: %v", subscription.ID, err)
+	}
+}
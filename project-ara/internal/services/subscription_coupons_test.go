@@ -0,0 +1,134 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/payments"
+	"project-ara/internal/pix"
+	"project-ara/internal/repository"
+)
+
+func TestCreateCoupon(t *testing.T) {
+	subscriptionService, _, _ := newMemorySubscriptionService(t)
+
+	coupon := &models.Coupon{Code: " lancamento ", Kind: models.CouponKindPercentage, Value: 50, Uses: 7}
+	require.NoError(t, subscriptionService.CreateCoupon(coupon))
+	assert.Equal(t, "LANCAMENTO", coupon.Code)
+	assert.Zero(t, coupon.Uses)
+	assert.True(t, coupon.Active)
+	err := subscriptionService.CreateCoupon(&models.Coupon{Code: "Lancamento", Kind: models.CouponKindFixed, Value: 1})
+	assert.ErrorIs(t, err, ErrCouponExists)
+
+	past := time.Now().Add(-time.Hour)
+	for name, invalid := range map[string]*models.Coupon{
+		"short code":     {Code: "AB", Kind: models.CouponKindFixed, Value: 1},
+		"spaced code":    {Code: "BLACK FRIDAY", Kind: models.CouponKindFixed, Value: 1},
+		"unknown kind":   {Code: "FREE", Kind: "free", Value: 1},
+		"whole price":    {Code: "ALL", Kind: models.CouponKindPercentage, Value: 100},
+		"negative value": {Code: "NEG", Kind: models.CouponKindFixed, Value: -1},
+		"negative uses":  {Code: "USES", Kind: models.CouponKindFixed, Value: 1, MaxUses: -1},
+		"expired":        {Code: "OLD", Kind: models.CouponKindFixed, Value: 1, ExpiresAt: &past},
+	} {
+		assert.ErrorIs(t, subscriptionService.CreateCoupon(invalid), ErrInvalidCoupon, name)
+	}
+
+	require.NoError(t, subscriptionService.DeactivateCoupon("lancamento"))
+	assert.ErrorIs(t, subscriptionService.DeactivateCoupon("NONE"), repository.ErrNotFound)
+	coupons, err := subscriptionService.ListCoupons()
+	require.NoError(t, err)
+	require.Len(t, coupons, 1)
+	assert.False(t, coupons[0].Active)
+}
+
+func TestCouponDiscountsTheSubscription(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511933330000")
+	require.NoError(t, err)
+	require.NoError(t, subscriptionService.CreateCoupon(&models.Coupon{Code: "METADE", Kind: models.CouponKindPercentage, Value: 50, MaxUses: 1}))
+
+	// The checkout without the coupon isn't reused for the one with it
+	full, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "")
+	require.NoError(t, err)
+	discounted, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "metade")
+	require.NoError(t, err)
+	assert.NotEqual(t, full.ID, discounted.ID)
+	assert.Equal(t, 4.95, discounted.Price)
+	require.NotNil(t, discounted.CouponID)
+	code, err := pix.Parse(discounted.PixCode)
+	require.NoError(t, err)
+	assert.Equal(t, 4.95, code.Amount)
+	again, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "METADE")
+	require.NoError(t, err)
+	assert.Equal(t, discounted.ID, again.ID)
+
+	// The coupon is used once the checkout is paid, and renewals keep the price
+	coupons, err := subscriptionService.ListCoupons()
+	require.NoError(t, err)
+	assert.Zero(t, coupons[0].Uses)
+	pay(t, subscriptionService, gateway, discounted.CheckoutURL[strings.LastIndex(discounted.CheckoutURL, "/")+1:], models.PaymentStatusApproved)
+	coupons, err = subscriptionService.ListCoupons()
+	require.NoError(t, err)
+	assert.Equal(t, 1, coupons[0].Uses)
+	require.NoError(t, subscriptionService.RenewSubscription(user.ID.String()))
+	current, err := subscriptionService.subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 4.95, current.Price)
+	assert.Equal(t, "R$ 4,95/mês", subscriptionService.Plans().PriceLabel(current))
+
+	// It's used up now
+	other, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511933331111")
+	require.NoError(t, err)
+	_, err = subscriptionService.CreateSubscription(other.ID.String(), "", payments.MethodPix, "METADE")
+	var couponErr *CouponError
+	require.ErrorAs(t, err, &couponErr)
+	assert.Equal(t, CouponUsedUp, couponErr.Reason)
+	assert.ErrorIs(t, err, ErrInvalidCoupon)
+}
+
+func TestCouponsThatCantBeUsed(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511933332222")
+	require.NoError(t, err)
+	for _, coupon := range []*models.Coupon{
+		{Code: "DEZ", Kind: models.CouponKindFixed, Value: 10},
+		{Code: "PAUSADO", Kind: models.CouponKindFixed, Value: 2},
+		{Code: "ANUAL", Kind: models.CouponKindFixed, Value: 19},
+	} {
+		require.NoError(t, subscriptionService.CreateCoupon(coupon))
+	}
+	require.NoError(t, subscriptionService.DeactivateCoupon("PAUSADO"))
+	reason := func(planID, code string) string {
+		t.Helper()
+		_, err := subscriptionService.CreateSubscription(user.ID.String(), planID, payments.MethodPix, code)
+		var couponErr *CouponError
+		require.ErrorAs(t, err, &couponErr)
+		return couponErr.Reason
+	}
+
+	assert.Equal(t, CouponUnknown, reason("", "NADA"))
+	assert.Equal(t, CouponTooLarge, reason("", "DEZ"))
+	assert.Equal(t, CouponInactive, reason("", "PAUSADO"))
+
+	// A fixed discount comes off any plan's price
+	annual, err := subscriptionService.CreateSubscription(user.ID.String(), "annual", payments.MethodPix, "anual")
+	require.NoError(t, err)
+	assert.Equal(t, 80.0, annual.Price)
+
+	// Each user can use a coupon once
+	other, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511933333333")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, other)
+	require.NoError(t, subscriptionService.subscriptions.RedeemCoupon(&models.CouponRedemption{CouponID: *annual.CouponID, UserID: user.ID, SubscriptionID: subscription.ID}))
+	assert.Equal(t, CouponAlreadyRedeemed, reason("annual", "ANUAL"))
+
+	// The expiry is checked at checkout
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, subscriptionService.subscriptions.CreateCoupon(&models.Coupon{Code: "ONTEM", Kind: models.CouponKindFixed, Value: 2, ExpiresAt: &past, Active: true}))
+	assert.Equal(t, CouponExpired, reason("", "ONTEM"))
+}
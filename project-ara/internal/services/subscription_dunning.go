@@ -0,0 +1,250 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"project-ara/internal/models"
+	"project-ara/internal/payments"
+	"project-ara/internal/repository"
+)
+
+// JobSubscriptionDunning runs RunDunning
+const JobSubscriptionDunning = "subscription_dunning"
+
+// defaultDunningNoticeHours: right away, the next day, and half a day before the grace
+// period of a subscription that ended on the day of the failure runs out
+const defaultDunningNoticeHours = "0,24,60"
+
+// DunningPolicy is when a user whose renewal charge failed is sent a new way to pay,
+// counted from the failure. Every further failed charge is answered right away as well.
+// Notices that would fall after the grace period aren't sent: by then the subscription is
+// downgraded.
+type DunningPolicy struct {
+	NoticeAfter []time.Duration
+}
+
+// ParseDunningPolicy reads a comma-separated list of hours after the failure, such as
+// "0,24,60"
+func ParseDunningPolicy(hours string) (DunningPolicy, error) {
+	var policy DunningPolicy
+	for _, field := range strings.Split(hours, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || value < 0 {
+			return DunningPolicy{}, fmt.Errorf("invalid dunning notice hours %q", field)
+		}
+		policy.NoticeAfter = append(policy.NoticeAfter, time.Duration(value*float64(time.Hour)))
+	}
+	sort.Slice(policy.NoticeAfter, func(i, j int) bool { return policy.NoticeAfter[i] < policy.NoticeAfter[j] })
+	return policy, nil
+}
+
+// nextNotice returns when the case's next scheduled notice is due after now, or nil when
+// the schedule is done
+func (p DunningPolicy) nextNotice(dunningCase *models.DunningCase, now time.Time) *time.Time {
+	for _, after := range p.NoticeAfter {
+		at := dunningCase.CreatedAt.Add(after)
+		if at.After(now) && at.Before(dunningCase.GraceEndsAt) {
+			return &at
+		}
+	}
+	return nil
+}
+
+// openDunning starts dunning a live subscription whose charge failed. The subscription
+// keeps working until its grace period ends; a failure of a subscription already in
+// dunning is only answered with a new notice.
+func (s *SubscriptionService) openDunning(subscription *models.Subscription, failureReason string) error {
+	now := time.Now()
+	dunningCase := &models.DunningCase{
+		UserID:         subscription.UserID,
+		SubscriptionID: subscription.ID,
+		FailureReason:  failureReason,
+		NextNoticeAt:   &now,
+		GraceEndsAt:    subscription.CurrentPeriodEnd.Add(models.SubscriptionGracePeriod),
+		CreatedAt:      now,
+	}
+	opened, err := s.subscriptions.OpenDunningCase(dunningCase)
+	if err != nil {
+		return err
+	}
+	if opened {
+		logrus.Infof("Subscription %s entered dunning (%s), downgrade on %s", subscription.ID, failureReason, dunningCase.GraceEndsAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// closeDunning ends the subscription's open dunning case, if there is one, as recovered
+// or churned, and returns it
+func (s *SubscriptionService) closeDunning(subscriptionID uuid.UUID, status string) *models.DunningCase {
+	closed, err := s.subscriptions.ResolveDunningCase(subscriptionID, status)
+	if err != nil {
+		logrus.Errorf("Failed to close dunning of subscription %s as %s: %v", subscriptionID, status, err)
+		return nil
+	}
+	if closed != nil {
+		logrus.Infof("Dunning of subscription %s %s after %d failed charges and %d notices", subscriptionID, status, closed.Failures, closed.NoticesSent)
+	}
+	return closed
+}
+
+// RunDunning sends the due notices of subscriptions in dunning, each with a new Pix code
+// and link to pay. Returns how many notices were sent.
+func (s *SubscriptionService) RunDunning(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		cases, err := s.subscriptions.ListDueDunningCases(time.Now(), sweepBatchSize)
+		if err != nil {
+			return sent, fmt.Errorf("failed to list dunning cases: %w", err)
+		}
+
+		for i := range cases {
+			if ctx.Err() != nil {
+				return sent, ctx.Err()
+			}
+			notified, err := s.sendDunningNotice(ctx, &cases[i])
+			if err != nil {
+				return sent, fmt.Errorf("failed to dun subscription %s: %w", cases[i].SubscriptionID, err)
+			}
+			if notified {
+				sent++
+			}
+		}
+
+		// Every listed case was rescheduled or closed, so the next page starts over
+		if len(cases) < sweepBatchSize {
+			return sent, nil
+		}
+	}
+}
+
+// sendDunningNotice sends the case's notice and schedules the next one. A case whose
+// subscription was renewed or ended meanwhile is closed instead.
+func (s *SubscriptionService) sendDunningNotice(ctx context.Context, dunningCase *models.DunningCase) (bool, error) {
+	subscription, err := s.subscriptions.GetByID(dunningCase.SubscriptionID)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case !isLive(subscription):
+		s.closeDunning(subscription.ID, models.DunningStatusChurned)
+		return false, nil
+	case subscription.CurrentPeriodEnd.Add(models.SubscriptionGracePeriod).After(dunningCase.GraceEndsAt):
+		// Paid for another period
+		s.closeDunning(subscription.ID, models.DunningStatusRecovered)
+		return false, nil
+	}
+
+	s.notifyPaymentFailed(ctx, dunningCase, subscription)
+	if err := s.subscriptions.RecordDunningNotice(dunningCase.ID, s.dunning.nextNotice(dunningCase, time.Now())); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// notifyPaymentFailed tells the user their charge failed, until when they can keep using
+// the Ara, and how to pay: a new Pix charge when the gateway can create one, else the
+// renewal page
+func (s *SubscriptionService) notifyPaymentFailed(ctx context.Context, dunningCase *models.DunningCase, subscription *models.Subscription) {
+	user := &dunningCase.User
+	if s.notifier == nil || user.PhoneNumber == "" {
+		return
+	}
+
+	template := "payment_failed"
+	params := map[string]string{
+		"amount":        formatPrice(subscription.Price),
+		"grace_ends_at": dunningCase.GraceEndsAt.Format("02/01/2006"),
+		"link":          s.RenewalLink(subscription.UserID.String()),
+	}
+	if s.gateway != nil {
+		if _, err := s.startRenewal(ctx, user, subscription, payments.MethodPix); err != nil {
+			logrus.Warnf("Failed to create a Pix charge for subscription %s in dunning: %v", subscription.ID, err)
+		} else {
+			template = "payment_failed_pix"
+			params["pix_code"] = subscription.PixCode
+			if subscription.CheckoutURL != "" {
+				params["link"] = subscription.CheckoutURL
+			}
+		}
+	}
+
+	if err := s.notifier.SendNotification(user.PhoneNumber, template, params); err != nil {
+		logrus.Errorf("Failed to notify user %s about their failed payment: %v", subscription.UserID, err)
+	}
+}
+
+// notifyLapsedOrChurned tells the user their subscription lapsed. A subscription in
+// dunning already gets notices of its own, and one that expires in dunning is churned
+// with a summary of what the user loses.
+func (s *SubscriptionService) notifyLapsedOrChurned(subscription *models.Subscription, status string) {
+	if status == models.SubscriptionStatusExpired {
+		if churned := s.closeDunning(subscription.ID, models.DunningStatusChurned); churned != nil {
+			s.notifyDowngraded(subscription)
+			return
+		}
+	} else if open, err := s.subscriptions.GetOpenDunningCase(subscription.ID); err == nil && open != nil {
+		return
+	}
+	s.notifyLapsed(subscription, status)
+}
+
+// notifyDowngraded tells a user whose renewal was never paid that the subscription ended
+func (s *SubscriptionService) notifyDowngraded(subscription *models.Subscription) {
+	user := subscription.User
+	if s.notifier == nil || user.PhoneNumber == "" {
+		return
+	}
+
+	params := map[string]string{
+		"summary": s.downgradeSummary(&user, subscription),
+		"link":    s.RenewalLink(subscription.UserID.String()),
+	}
+	if err := s.notifier.SendNotification(user.PhoneNumber, "subscription_downgraded", params); err != nil {
+		logrus.Errorf("Failed to notify user %s about their downgrade: %v", subscription.UserID, err)
+	}
+}
+
+// downgradeSummary sums up what the subscription gave the user and what stops without it
+func (s *SubscriptionService) downgradeSummary(user *models.User, subscription *models.Subscription) string {
+	var summary strings.Builder
+	period, err := s.transactionService.GetSummaryBetween(user.ID.String(), subscription.CreatedAt, time.Now())
+	if err != nil {
+		logrus.Warnf("Failed to sum up the subscription of user %s: %v", user.ID, err)
+	} else if period.TransactionCount > 0 {
+		transactions := fmt.Sprintf("%d transações", period.TransactionCount)
+		if period.TransactionCount == 1 {
+			transactions = "1 transação"
+		}
+		fmt.Fprintf(&summary, "Com o Premium, você registrou %s: R$ %s em entradas e R$ %s em saídas. ",
+			transactions, formatPrice(period.TotalIncome), formatPrice(period.TotalExpenses))
+	}
+
+	trial := s.plans.Trial
+	if user.IsTrialExpired(trial.Transactions) {
+		fmt.Fprintf(&summary, "Agora o registro de novas transações fica pausado, porque o plano gratuito vai até %d transações.", trial.Limit(user))
+	} else {
+		fmt.Fprintf(&summary, "Agora você volta ao plano gratuito, com mais %d transações até o limite de %d.", trial.Remaining(user), trial.Limit(user))
+	}
+	return summary.String()
+}
+
+// GetDunningStats counts the dunning cases opened in the last days by how they ended:
+// subscriptions recovered by a payment, churned by the downgrade, or still open
+func (s *SubscriptionService) GetDunningStats(days int) (*repository.DunningStats, error) {
+	if days <= 0 {
+		return nil, fmt.Errorf("invalid number of days: %d", days)
+	}
+	stats, err := s.subscriptions.DunningStats(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count dunning cases: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/pix"
+	"project-ara/internal/repository"
+)
+
+func TestParseDunningPolicy(t *testing.T) {
+	policy, err := ParseDunningPolicy("48, 0,12.5")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{0, 12*time.Hour + 30*time.Minute, 48 * time.Hour}, policy.NoticeAfter)
+
+	for _, hours := range []string{"", "1,,2", "-1", "dia"} {
+		_, err := ParseDunningPolicy(hours)
+		assert.Error(t, err, hours)
+	}
+
+	// Notices past the grace period are dropped
+	opened := time.Now()
+	dunningCase := &models.DunningCase{CreatedAt: opened, GraceEndsAt: opened.Add(24 * time.Hour)}
+	next := policy.nextNotice(dunningCase, opened)
+	require.NotNil(t, next)
+	assert.Equal(t, opened.Add(12*time.Hour+30*time.Minute), *next)
+	assert.Nil(t, policy.nextNotice(dunningCase, *next))
+}
+
+// templatesSent lists the notifications sent to the user, in order
+func templatesSent(notifier *fakeNotifier, user *models.User) []string {
+	var templates []string
+	for _, sent := range notifier.sent {
+		if sent.to == user.PhoneNumber {
+			templates = append(templates, sent.template)
+		}
+	}
+	return templates
+}
+
+func TestDunningRecoversAFailedRenewal(t *testing.T) {
+	subscriptionService, userService, _, notifier, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511966660000")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, user)
+
+	// The card renewal is refused: the user is sent a Pix code right away, and still logs
+	pay(t, subscriptionService, gateway, subscription.GatewaySubscriptionID, models.PaymentStatusFailed)
+	sent, err := subscriptionService.RunDunning(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	notice := notifier.sent[len(notifier.sent)-1]
+	assert.Equal(t, "payment_failed_pix", notice.template)
+	assert.Equal(t, "9,90", notice.params["amount"])
+	assert.Equal(t, subscription.CurrentPeriodEnd.Add(models.SubscriptionGracePeriod).Format("02/01/2006"), notice.params["grace_ends_at"])
+	_, err = pix.Parse(notice.params["pix_code"])
+	assert.NoError(t, err)
+
+	found, err := userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.True(t, found.CanCreateTransaction(subscriptionService.Plans().Trial.Transactions))
+
+	// Nothing more is due until the next day, unless another charge fails
+	sent, err = subscriptionService.RunDunning(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, sent)
+	pay(t, subscriptionService, gateway, subscription.GatewaySubscriptionID, models.PaymentStatusFailed)
+	sent, err = subscriptionService.RunDunning(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	// Paying the Pix recovers the subscription
+	dunned, err := subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	chargeID := dunned.CheckoutURL[strings.LastIndex(dunned.CheckoutURL, "/")+1:]
+	pay(t, subscriptionService, gateway, chargeID, models.PaymentStatusApproved)
+	open, err := subscriptionService.subscriptions.GetOpenDunningCase(subscription.ID)
+	require.NoError(t, err)
+	assert.Nil(t, open)
+
+	stats, err := subscriptionService.GetDunningStats(30)
+	require.NoError(t, err)
+	assert.Equal(t, &repository.DunningStats{Opened: 1, Recovered: 1, RecoveryRate: 1}, stats)
+	assert.Equal(t, []string{"subscription_activated", "payment_failed_pix", "payment_failed_pix", "subscription_activated"}, templatesSent(notifier, user))
+}
+
+func TestDunningDowngradesWhenTheGracePeriodEnds(t *testing.T) {
+	subscriptionService, userService, transactionService, notifier, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511966661111")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, user)
+	_, err = transactionService.CreateTransaction(user.ID.String(), 150, "venda", models.TransactionTypeIncome, models.TransactionSourceText)
+	require.NoError(t, err)
+
+	// The renewal fails on the day the period ends
+	end := time.Now().Add(-time.Hour)
+	require.NoError(t, subscriptionService.subscriptions.ExtendPeriod(subscription.ID, end.AddDate(0, 0, -30), end, "test"))
+	subscription, err = subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	pay(t, subscriptionService, gateway, subscription.GatewaySubscriptionID, models.PaymentStatusFailed)
+	_, err = subscriptionService.RunDunning(context.Background())
+	require.NoError(t, err)
+
+	// The sweep moves it to the grace period without a notice of its own: the user can log
+	_, err = subscriptionService.SweepExpiredSubscriptions(context.Background())
+	require.NoError(t, err)
+	found, err := userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusGracePeriod, found.SubscriptionStatus)
+	assert.True(t, found.CanCreateTransaction(subscriptionService.Plans().Trial.Transactions))
+
+	// Nobody paid: once the grace period is over, the user is downgraded
+	end = time.Now().Add(-models.SubscriptionGracePeriod - time.Hour)
+	require.NoError(t, subscriptionService.subscriptions.ExtendPeriod(subscription.ID, end.AddDate(0, 0, -30), end, "test"))
+	_, err = subscriptionService.SweepExpiredSubscriptions(context.Background())
+	require.NoError(t, err)
+	found, err = userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusExpired, found.SubscriptionStatus)
+
+	assert.Equal(t, []string{"subscription_activated", "payment_failed_pix", "subscription_downgraded"}, templatesSent(notifier, user))
+	downgrade := notifier.sent[len(notifier.sent)-1]
+	assert.Contains(t, downgrade.params["summary"], "registrou 1 transação: R$ 150,00 em entradas")
+	assert.Contains(t, downgrade.params["summary"], "com mais 49 transações")
+	assert.Contains(t, downgrade.params["link"], user.ID.String())
+
+	sent, err := subscriptionService.RunDunning(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, sent)
+	stats, err := subscriptionService.GetDunningStats(30)
+	require.NoError(t, err)
+	assert.Equal(t, &repository.DunningStats{Opened: 1, Churned: 1}, stats)
+}
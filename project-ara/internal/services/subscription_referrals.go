@@ -0,0 +1,332 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+// subscriptionReasonReferralReward is recorded on periods extended by a referral
+const subscriptionReasonReferralReward = "referral_reward"
+
+// Referral codes look like ARA-7K3Q9M. The alphabet leaves out characters that are easily
+// mistaken for others when read aloud or typed: 0/O and 1/I/L.
+const (
+	referralCodePrefix   = "ARA-"
+	referralCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	referralCodeLength   = 6
+)
+
+// referralCodePattern finds a referral code in a message, typed with or without the dash
+var referralCodePattern = regexp.MustCompile(`(?i)\bARA-?([2-9A-HJKMNP-Z]{6})\b`)
+
+var (
+	// ErrReferralsDisabled is returned when the catalog's referrals earn nothing
+	ErrReferralsDisabled = errors.New("referrals are disabled")
+	// ErrUnknownReferralCode is returned for a code no user has
+	ErrUnknownReferralCode = errors.New("unknown referral code")
+	// ErrAlreadyReferred is returned when the user was already referred by someone else
+	ErrAlreadyReferred = errors.New("user was already referred")
+)
+
+// ReferralRejectedError is returned when a referral fails the fraud checks. The claim is
+// kept, rejected, for review.
+type ReferralRejectedError struct {
+	Reason string // One of the models.ReferralRejected* reasons
+}
+
+func (e *ReferralRejectedError) Error() string {
+	return "referral rejected: " + e.Reason
+}
+
+// ReferralInvite is what a user shares to refer the Ara
+type ReferralInvite struct {
+	Code string `json:"code"`
+	// Link opens a chat with the Ara with a message carrying the code; empty when
+	// WHATSAPP_BUSINESS_NUMBER isn't set
+	Link   string         `json:"link,omitempty"`
+	Policy ReferralPolicy `json:"policy"`
+}
+
+// RewardSummary tells users what both sides of a referral earn, such as "1 mês grátis
+// de Premium"
+func (p ReferralPolicy) RewardSummary() string {
+	switch {
+	case p.RewardDays > 0 && p.RewardTransactions > 0:
+		return fmt.Sprintf("%s grátis de Premium (quem ainda não assina ganha %d transações grátis a mais)", rewardPeriod(p.RewardDays), p.RewardTransactions)
+	case p.RewardDays > 0:
+		return rewardPeriod(p.RewardDays) + " grátis de Premium"
+	default:
+		return fmt.Sprintf("%d transações grátis a mais", p.RewardTransactions)
+	}
+}
+
+// FindReferralCode returns the referral code in a message, such as the one the invite
+// link types for the referred user
+func FindReferralCode(text string) (string, bool) {
+	match := referralCodePattern.FindStringSubmatch(text)
+	if match == nil {
+		return "", false
+	}
+	return referralCodePrefix + strings.ToUpper(match[1]), true
+}
+
+func newReferralCode() (string, error) {
+	code := make([]byte, referralCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(referralCodeAlphabet))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate referral code: %w", err)
+		}
+		code[i] = referralCodeAlphabet[n.Int64()]
+	}
+	return referralCodePrefix + string(code), nil
+}
+
+// GetReferralInvite returns the user's referral code and the link to share it with
+func (s *SubscriptionService) GetReferralInvite(userID string) (*ReferralInvite, error) {
+	if !s.plans.Referral.Enabled() {
+		return nil, ErrReferralsDisabled
+	}
+	user, err := s.userService.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	code, err := s.userService.ReferralCode(user)
+	if err != nil {
+		return nil, err
+	}
+
+	invite := &ReferralInvite{Code: code, Policy: s.plans.Referral}
+	if s.businessNumber != "" {
+		text := "Oi! Quero testar o Ara. Meu código de indicação é " + code
+		// wa.me wants spaces as %20, not the + of query strings
+		invite.Link = "https://wa.me/" + s.businessNumber + "?text=" + strings.ReplaceAll(url.QueryEscape(text), "+", "%20")
+	}
+	return invite, nil
+}
+
+// ClaimReferral records that the user was referred by the owner of code. deviceID is a
+// fingerprint of the device the claim came from, when known (the signup page sends one;
+// chats don't). Claims that fail the fraud checks are stored rejected and returned as a
+// *ReferralRejectedError: codes of the user's own account or phone number, devices that
+// already claimed a referral, users who aren't starting out, and referrers past the
+// monthly limit. Repeating the claim of the same referrer is a no-op.
+func (s *SubscriptionService) ClaimReferral(userID, code, deviceID string) (*models.Referral, error) {
+	policy := s.plans.Referral
+	if !policy.Enabled() {
+		return nil, ErrReferralsDisabled
+	}
+	code, ok := FindReferralCode(code)
+	if !ok {
+		return nil, ErrUnknownReferralCode
+	}
+	user, err := s.userService.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	referrer, err := s.userService.GetUserByReferralCode(code)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrUnknownReferralCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.subscriptions.GetReferral(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referral: %w", err)
+	}
+	if existing != nil {
+		if existing.ReferrerID == referrer.ID {
+			return existing, nil
+		}
+		return nil, ErrAlreadyReferred
+	}
+
+	reason, err := s.referralFraud(referrer, user, deviceID, policy)
+	if err != nil {
+		return nil, err
+	}
+	referral := &models.Referral{
+		ReferrerID: referrer.ID,
+		ReferredID: user.ID,
+		Code:       code,
+		DeviceID:   deviceID,
+		Status:     models.ReferralStatusPending,
+	}
+	if reason != "" {
+		referral.Status = models.ReferralStatusRejected
+		referral.RejectReason = reason
+	}
+	err = s.subscriptions.CreateReferral(referral)
+	if errors.Is(err, repository.ErrConflict) {
+		return nil, ErrAlreadyReferred
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save referral: %w", err)
+	}
+
+	if reason != "" {
+		logrus.Warnf("Rejected referral of user %s by %s: %s", user.ID, referrer.ID, reason)
+		return nil, &ReferralRejectedError{Reason: reason}
+	}
+	return referral, nil
+}
+
+// referralFraud returns why a referral must be rejected, or "" when it looks genuine
+func (s *SubscriptionService) referralFraud(referrer, user *models.User, deviceID string, policy ReferralPolicy) (string, error) {
+	if referrer.ID == user.ID || samePhoneNumber(referrer.PhoneNumber, user.PhoneNumber) {
+		return models.ReferralRejectedSelf, nil
+	}
+	if deviceID != "" {
+		used, err := s.subscriptions.DeviceReferred(deviceID)
+		if err != nil {
+			return "", fmt.Errorf("failed to check device: %w", err)
+		}
+		if used {
+			return models.ReferralRejectedDevice, nil
+		}
+	}
+	// Only new users can be referred, and only before they ever paid
+	if time.Since(user.CreatedAt) > time.Duration(policy.ClaimWithinDays)*24*time.Hour || user.SubscriptionStatus != models.SubscriptionStatusTrial {
+		return models.ReferralRejectedNotNew, nil
+	}
+	referred, err := s.subscriptions.CountReferrals(referrer.ID, time.Now().AddDate(0, 0, -30))
+	if err != nil {
+		return "", fmt.Errorf("failed to count referrals: %w", err)
+	}
+	if referred >= policy.MaxPerMonth {
+		return models.ReferralRejectedLimit, nil
+	}
+	return "", nil
+}
+
+// samePhoneNumber compares Brazilian phone numbers, with or without the country code and
+// the ninth digit of mobile numbers: WhatsApp knows some users by the old eight digits
+func samePhoneNumber(a, b string) bool {
+	a, b = phoneNumberKey(a), phoneNumberKey(b)
+	return a != "" && a == b
+}
+
+// phoneNumberKey is the area code and last eight digits of a phone number
+func phoneNumberKey(phoneNumber string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phoneNumber)
+	if len(digits) >= 12 {
+		digits = strings.TrimPrefix(digits, "55")
+	}
+	if len(digits) < 10 {
+		return digits
+	}
+	return digits[:2] + digits[len(digits)-8:]
+}
+
+// rewardReferral rewards the referral of a user who just paid, the first time they pay.
+// Rewards are best effort: a failure is logged and doesn't fail the payment.
+func (s *SubscriptionService) rewardReferral(referredID uuid.UUID) {
+	if !s.plans.Referral.Enabled() {
+		return
+	}
+	referral, err := s.subscriptions.GetReferral(referredID)
+	if err != nil {
+		logrus.Errorf("Failed to get the referral of user %s: %v", referredID, err)
+		return
+	}
+	if referral == nil || referral.Status != models.ReferralStatusPending {
+		return
+	}
+	if err := s.subscriptions.RewardReferral(referral.ID); err != nil {
+		if !errors.Is(err, repository.ErrConflict) {
+			logrus.Errorf("Failed to reward referral %s: %v", referral.ID, err)
+		}
+		return
+	}
+
+	s.grantReferralReward(referral.ReferredID, "referral_reward_referred")
+	s.grantReferralReward(referral.ReferrerID, "referral_reward_referrer")
+}
+
+// grantReferralReward gives the user more days of the subscription they have running or,
+// without one, more free transactions, and tells them with template
+func (s *SubscriptionService) grantReferralReward(userID uuid.UUID, template string) {
+	policy := s.plans.Referral
+	current, err := s.subscriptions.GetCurrent(userID)
+	if err != nil {
+		logrus.Errorf("Failed to get the subscription of user %s to reward: %v", userID, err)
+		return
+	}
+
+	var reward string
+	switch {
+	case current != nil && isLive(current) && policy.RewardDays > 0:
+		end := current.CurrentPeriodEnd.AddDate(0, 0, policy.RewardDays)
+		if err := s.subscriptions.ExtendPeriod(current.ID, current.CurrentPeriodStart, end, subscriptionReasonReferralReward); err != nil {
+			logrus.Errorf("Failed to extend subscription %s as a referral reward: %v", current.ID, err)
+			return
+		}
+		reward = fmt.Sprintf("%s grátis de Premium: sua assinatura agora vai até %s", rewardPeriod(policy.RewardDays), end.Format("02/01/2006"))
+	case policy.RewardTransactions > 0:
+		if err := s.userService.AddBonusTransactions(userID, policy.RewardTransactions); err != nil {
+			logrus.Errorf("Failed to give user %s bonus transactions: %v", userID, err)
+			return
+		}
+		reward = fmt.Sprintf("%d transações grátis a mais para registrar", policy.RewardTransactions)
+	default:
+		return
+	}
+	logrus.Infof("User %s got a referral reward: %s", userID, reward)
+
+	if s.notifier == nil {
+		return
+	}
+	user, err := s.userService.GetUserByID(userID.String())
+	if err != nil || user.PhoneNumber == "" {
+		return
+	}
+	if err := s.notifier.SendNotification(user.PhoneNumber, template, map[string]string{"reward": reward}); err != nil {
+		logrus.Errorf("Failed to notify user %s about their referral reward: %v", userID, err)
+	}
+}
+
+// rewardPeriod writes a number of days as months when it is a whole number of them
+func rewardPeriod(days int) string {
+	switch {
+	case days == 30:
+		return "1 mês"
+	case days%30 == 0:
+		return fmt.Sprintf("%d meses", days/30)
+	case days == 1:
+		return "1 dia"
+	default:
+		return fmt.Sprintf("%d dias", days)
+	}
+}
+
+// GetReferralStats counts the referrals made in the last days by how they ended: still
+// waiting for the referred user to pay, rewarded, or rejected by the fraud checks
+func (s *SubscriptionService) GetReferralStats(days int) (*repository.ReferralStats, error) {
+	if days <= 0 {
+		return nil, fmt.Errorf("invalid number of days: %d", days)
+	}
+	stats, err := s.subscriptions.ReferralStats(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count referrals: %w", err)
+	}
+	return stats, nil
+}
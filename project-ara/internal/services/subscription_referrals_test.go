@@ -0,0 +1,183 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/repository"
+)
+
+func TestFindReferralCode(t *testing.T) {
+	for text, want := range map[string]string{
+		"Oi! Quero testar o Ara. Meu código de indicação é ARA-7K3Q9M": "ARA-7K3Q9M",
+		"ara7k3q9m":   "ARA-7K3Q9M",
+		"ARA-7K3Q9":   "",
+		"ARA-7K3Q0M":  "", // 0 isn't in the alphabet
+		"caracara":    "",
+		"vendi 30,00": "",
+	} {
+		code, ok := FindReferralCode(text)
+		assert.Equal(t, want != "", ok, text)
+		assert.Equal(t, want, code, text)
+	}
+
+	code, err := newReferralCode()
+	require.NoError(t, err)
+	found, ok := FindReferralCode(code)
+	require.True(t, ok)
+	assert.Equal(t, code, found)
+}
+
+func TestReferralRewardsBothSidesWhenTheReferredUserPays(t *testing.T) {
+	subscriptionService, userService, transactionService, notifier, gateway := newMemorySubscriptionServiceWithGateway(t)
+	subscriptionService.businessNumber = "5511955550000"
+	referrer, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511955551111")
+	require.NoError(t, err)
+	referred, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511955552222")
+	require.NoError(t, err)
+
+	invite, err := subscriptionService.GetReferralInvite(referrer.ID.String())
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(invite.Link, "https://wa.me/5511955550000?text=Oi%21%20Quero%20testar"), invite.Link)
+	assert.True(t, strings.HasSuffix(invite.Link, invite.Code), invite.Link)
+	again, err := subscriptionService.GetReferralInvite(referrer.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, invite.Code, again.Code)
+
+	// The code is found in whatever the invite link typed, and claiming it twice is harmless
+	referral, err := subscriptionService.ClaimReferral(referred.ID.String(), "Meu código de indicação é "+strings.ToLower(invite.Code), "")
+	require.NoError(t, err)
+	assert.Equal(t, models.ReferralStatusPending, referral.Status)
+	repeated, err := subscriptionService.ClaimReferral(referred.ID.String(), invite.Code, "")
+	require.NoError(t, err)
+	assert.Equal(t, referral.ID, repeated.ID)
+
+	// The referrer still on the trial earns transactions; the referred user, a free month
+	subscription := subscribe(t, subscriptionService, gateway, referred)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 60), subscription.CurrentPeriodEnd, time.Minute)
+	referrer, err = userService.GetUserByID(referrer.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, 20, referrer.BonusTransactions)
+	status, err := subscriptionService.CheckTrialStatus(referrer.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, 70, status.TrialTransactionLimit)
+	assert.Equal(t, []string{"subscription_activated", "referral_reward_referred"}, templatesSent(notifier, referred))
+	assert.Equal(t, []string{"referral_reward_referrer"}, templatesSent(notifier, referrer))
+
+	// Bonus transactions are on top of the trial's
+	for i := 0; i < 50; i++ {
+		_, err := transactionService.CreateTransaction(referrer.ID.String(), float64(i+1), "venda", models.TransactionTypeIncome, models.TransactionSourceText)
+		require.NoError(t, err)
+	}
+	canCreate, err := userService.CanUserCreateTransaction(referrer.ID.String())
+	require.NoError(t, err)
+	assert.True(t, canCreate)
+
+	// Renewals reward nothing more
+	require.NoError(t, subscriptionService.RenewSubscription(referred.ID.String()))
+	assert.Len(t, notifier.sent, 3)
+
+	stats, err := subscriptionService.GetReferralStats(30)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Referred)
+	assert.Equal(t, 1, stats.Rewarded)
+}
+
+func TestReferralExtendsTheReferrersSubscription(t *testing.T) {
+	subscriptionService, userService, _, notifier, gateway := newMemorySubscriptionServiceWithGateway(t)
+	referrer, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511955553333")
+	require.NoError(t, err)
+	paid := subscribe(t, subscriptionService, gateway, referrer)
+	referred, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511955554444")
+	require.NoError(t, err)
+
+	invite, err := subscriptionService.GetReferralInvite(referrer.ID.String())
+	require.NoError(t, err)
+	assert.Empty(t, invite.Link, "no business number")
+	_, err = subscriptionService.ClaimReferral(referred.ID.String(), invite.Code, "")
+	require.NoError(t, err)
+	subscribe(t, subscriptionService, gateway, referred)
+
+	current, err := subscriptionService.subscriptions.GetCurrent(referrer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, paid.CurrentPeriodEnd.AddDate(0, 0, 30), current.CurrentPeriodEnd)
+	notice := notifier.sent[len(notifier.sent)-1]
+	assert.Equal(t, "referral_reward_referrer", notice.template)
+	assert.Contains(t, notice.params["reward"], "1 mês grátis de Premium")
+}
+
+func TestReferralFraudChecks(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	newUser := func(phoneNumber string) *models.User {
+		user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, phoneNumber)
+		require.NoError(t, err)
+		return user
+	}
+	referrer := newUser("5511944440000")
+	invite, err := subscriptionService.GetReferralInvite(referrer.ID.String())
+	require.NoError(t, err)
+	rejected := func(user *models.User, deviceID string) string {
+		t.Helper()
+		_, err := subscriptionService.ClaimReferral(user.ID.String(), invite.Code, deviceID)
+		var rejection *ReferralRejectedError
+		require.ErrorAs(t, err, &rejection)
+		return rejection.Reason
+	}
+
+	// The referrer's own code, or another account on the same number without the ninth digit
+	assert.Equal(t, models.ReferralRejectedSelf, rejected(referrer, ""))
+	assert.Equal(t, models.ReferralRejectedSelf, rejected(newUser("551144440000"), ""))
+
+	// A second claim from the same device
+	_, err = subscriptionService.ClaimReferral(newUser("5511944441111").ID.String(), invite.Code, "device-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.ReferralRejectedDevice, rejected(newUser("5511944442222"), "device-1"))
+
+	// Users who already paid
+	subscriber := newUser("5511944443333")
+	subscribe(t, subscriptionService, gateway, subscriber)
+	assert.Equal(t, models.ReferralRejectedNotNew, rejected(subscriber, ""))
+
+	// Referrers past the monthly limit
+	subscriptionService.Plans().Referral.MaxPerMonth = 2
+	_, err = subscriptionService.ClaimReferral(newUser("5511944444444").ID.String(), invite.Code, "")
+	require.NoError(t, err)
+	assert.Equal(t, models.ReferralRejectedLimit, rejected(newUser("5511944445555"), ""))
+
+	// A rejected claim doesn't stop a genuine one from another referrer
+	other := newUser("5511944446666")
+	otherInvite, err := subscriptionService.GetReferralInvite(other.ID.String())
+	require.NoError(t, err)
+	late := newUser("5511944447777")
+	assert.Equal(t, models.ReferralRejectedLimit, rejected(late, ""))
+	_, err = subscriptionService.ClaimReferral(late.ID.String(), otherInvite.Code, "")
+	require.NoError(t, err)
+	_, err = subscriptionService.ClaimReferral(late.ID.String(), invite.Code, "")
+	assert.ErrorIs(t, err, ErrAlreadyReferred)
+
+	_, err = subscriptionService.ClaimReferral(late.ID.String(), "ARA-2222AA", "")
+	assert.ErrorIs(t, err, ErrUnknownReferralCode)
+
+	stats, err := subscriptionService.GetReferralStats(30)
+	require.NoError(t, err)
+	assert.Equal(t, &repository.ReferralStats{
+		Referred: 3,
+		Pending:  3,
+		Rejected: 6,
+		RejectedBy: map[string]int{
+			models.ReferralRejectedSelf:   2,
+			models.ReferralRejectedDevice: 1,
+			models.ReferralRejectedNotNew: 1,
+			models.ReferralRejectedLimit:  2,
+		},
+	}, stats)
+
+	subscriptionService.Plans().Referral = ReferralPolicy{}
+	_, err = subscriptionService.GetReferralInvite(other.ID.String())
+	assert.ErrorIs(t, err, ErrReferralsDisabled)
+}
@@ -1,49 +1,183 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
 	"project-ara/internal/models"
+	"project-ara/internal/payments"
+	"project-ara/internal/pix"
+	"project-ara/internal/repository"
+)
+
+// JobSubscriptionExpirySweep runs SweepExpiredSubscriptions
+const JobSubscriptionExpirySweep = "subscription_expiry_sweep"
+
+// manualGateway is recorded for payment webhooks that don't name their gateway
+const manualGateway = "manual"
+
+// checkoutTTL is how long a checkout link is offered again before a new one is created,
+// and how long Pix charges can be paid
+const checkoutTTL = 24 * time.Hour
+
+// pixReuseMargin is how long a Pix code must still be payable to be offered again
+const pixReuseMargin = 30 * time.Minute
+
+// webhookClaimTTL is how long a delivery has to process a webhook event before a
+// redelivery may take it over
+const webhookClaimTTL = 2 * time.Minute
+
+var (
+	// ErrNoPaymentGateway is returned when a subscription is sold without a gateway configured
+	ErrNoPaymentGateway = errors.New("no payment gateway configured")
+	// ErrUnknownGateway is returned for webhooks of a gateway that isn't the configured one
+	ErrUnknownGateway = errors.New("unknown payment gateway")
+	// ErrInvalidWebhook is returned for payment webhooks whose content can't be processed
+	ErrInvalidWebhook = errors.New("invalid payment webhook")
+	// ErrWebhookInProgress is returned for a redelivered webhook event while another
+	// delivery of it is being processed. The sender retries it later.
+	ErrWebhookInProgress = errors.New("payment webhook event already being processed")
 )
 
+// Reasons recorded in the billing history
+const (
+	subscriptionReasonSubscribed        = "subscribed"
+	subscriptionReasonCheckoutStarted   = "checkout_started"
+	subscriptionReasonCheckoutAbandoned = "checkout_abandoned"
+	subscriptionReasonCheckoutFailed    = "checkout_failed"
+	subscriptionReasonReplaced          = "replaced"
+	subscriptionReasonCancelled         = "cancelled"
+	subscriptionReasonRenewed           = "renewed"
+	subscriptionReasonPaymentApproved   = "payment_approved"
+	subscriptionReasonRefunded          = "refunded"
+	subscriptionReasonExpirySweep       = "expiry_sweep"
+)
+
+// sweepBatchSize is how many lapsed subscriptions the sweep loads at a time
+const sweepBatchSize = 100
+
 type SubscriptionService struct {
+	subscriptions      repository.SubscriptionRepository
 	userService        *UserService
 	transactionService *TransactionService
 	reportingService   *FinancialReportingService
+	plans              *PlanCatalog
+	notifier           Notifier
+	gateway            payments.PaymentGateway
+	renewalURL         string
+	payerEmailDomain   string
+	webhookSecret      string
+	businessNumber     string // The Ara's WhatsApp number, for referral links
+	dunning            DunningPolicy
+	analytics          *AnalyticsService
 }
 
-func NewSubscriptionService(userService *UserService, transactionService *TransactionService, reportingService *FinancialReportingService) *SubscriptionService {
+// NewSubscriptionService creates the service, which sells the plans of the catalog;
+// notifier tells users about lapsed and paid subscriptions and may be nil. Without a
+// gateway, subscriptions can't be sold. analytics, which may be nil too, records who
+// subscribes and churns.
+func NewSubscriptionService(subscriptions repository.SubscriptionRepository, userService *UserService, transactionService *TransactionService, reportingService *FinancialReportingService, plans *PlanCatalog, notifier Notifier, gateway payments.PaymentGateway, analytics *AnalyticsService) *SubscriptionService {
+	renewalURL := os.Getenv("SUBSCRIPTION_RENEWAL_URL")
+	if renewalURL == "" {
+		renewalURL = "https://ara.app/assinar"
+	}
+	// Gateways want a payer email and users only give us their phone
+	payerEmailDomain := os.Getenv("PAYMENT_PAYER_EMAIL_DOMAIN")
+	if payerEmailDomain == "" {
+		payerEmailDomain = "clientes.ara.app"
+	}
+
+	dunningHours := os.Getenv("DUNNING_NOTICE_HOURS")
+	if dunningHours == "" {
+		dunningHours = defaultDunningNoticeHours
+	}
+	dunning, err := ParseDunningPolicy(dunningHours)
+	if err != nil {
+		logrus.Warnf("Ignoring DUNNING_NOTICE_HOURS: %v", err)
+		dunning, _ = ParseDunningPolicy(defaultDunningNoticeHours)
+	}
+
 	return &SubscriptionService{
+		subscriptions:      subscriptions,
 		userService:        userService,
 		transactionService: transactionService,
 		reportingService:   reportingService,
+		plans:              plans,
+		notifier:           notifier,
+		gateway:            gateway,
+		renewalURL:         renewalURL,
+		payerEmailDomain:   payerEmailDomain,
+		webhookSecret:      os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+		analytics:          analytics,
+		businessNumber:     os.Getenv("WHATSAPP_BUSINESS_NUMBER"),
+		dunning:            dunning,
 	}
 }
 
+// RegisterJobs schedules the hourly expiry sweep and the dunning notices
+func (s *SubscriptionService) RegisterJobs(scheduler *JobScheduler) error {
+	err := scheduler.Every(JobSubscriptionExpirySweep, "@hourly", func(ctx context.Context, job models.Job) error {
+		moved, err := s.SweepExpiredSubscriptions(ctx)
+		if moved > 0 {
+			logrus.Infof("Subscription sweep moved %d lapsed subscriptions", moved)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return scheduler.Every(JobSubscriptionDunning, "@every 10m", func(ctx context.Context, job models.Job) error {
+		sent, err := s.RunDunning(ctx)
+		if sent > 0 {
+			logrus.Infof("Dunning sent %d payment notices", sent)
+		}
+		return err
+	})
+}
+
+// Plans returns the catalog of plans on sale and the trial policy
+func (s *SubscriptionService) Plans() *PlanCatalog {
+	return s.plans
+}
+
 // CheckTrialStatus checks if user should be prompted for subscription
 func (s *SubscriptionService) CheckTrialStatus(userID string) (*TrialStatus, error) {
 	user, err := s.userService.GetUserByID(userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
+	current, err := s.subscriptions.GetCurrent(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
 
+	trial := s.plans.Trial
 	status := &TrialStatus{
 		UserID:                      userID,
-		SubscriptionStatus:          user.SubscriptionStatus,
+		SubscriptionStatus:          subscriptionStatus(current),
 		TrialTransactionsCount:      user.TrialTransactionsCount,
-		RemainingTrialTransactions:  50 - user.TrialTransactionsCount,
-		IsTrialExpired:              user.IsTrialExpired(),
+		TrialTransactionLimit:       trial.Limit(user),
+		RemainingTrialTransactions:  trial.Remaining(user),
+		IsTrialExpired:              user.IsTrialExpired(trial.Transactions),
 		ShouldPromptForSubscription: false,
 	}
 
-	// Determine if we should prompt for subscription
-	if user.SubscriptionStatus == "trial" {
-		if user.TrialTransactionsCount >= 45 { // Prompt when 5 transactions remaining
+	// Determine if we should prompt for subscription, as close to the end of the free
+	// transactions with a bonus as without one
+	if status.SubscriptionStatus == models.SubscriptionStatusTrial {
+		if status.RemainingTrialTransactions <= trial.Transactions-trial.PromptAt {
 			status.ShouldPromptForSubscription = true
 		}
-		if user.TrialTransactionsCount >= 50 { // Trial expired
-			status.IsTrialExpired = true
+		if status.IsTrialExpired {
 			status.ShouldPromptForSubscription = true
 		}
 	}
@@ -51,82 +185,276 @@ func (s *SubscriptionService) CheckTrialStatus(userID string) (*TrialStatus, err
 	return status, nil
 }
 
-// CreateSubscription creates a new subscription for the user
-func (s *SubscriptionService) CreateSubscription(userID string, paymentMethod string) (*Subscription, error) {
+// CreateSubscription starts a checkout for a plan of the catalog (the default plan when
+// planID is empty) and returns the subscription, whose CheckoutURL is where the user pays.
+// A coupon, when couponCode isn't empty, discounts the price of a new subscription for as
+// long as it lasts; a coupon that can't be used is a *CouponError.
+// With payments.MethodPix the first period is a Pix charge instead, whose code is in
+// PixCode; other methods get the gateway's recurring checkout. Nothing is activated here:
+// a new subscription stays pending, and one in its grace period gets a renewal charge of
+// its own plan, until the gateway's webhook confirms the payment. A checkout opened in
+// the last day for the same plan, coupon and method is offered again.
+func (s *SubscriptionService) CreateSubscription(userID, planID, paymentMethod, couponCode string) (*models.Subscription, error) {
+	ctx := context.Background()
+	plan, err := s.plans.ForSale(planID)
+	if err != nil {
+		return nil, err
+	}
 	user, err := s.userService.GetUserByID(userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
+	current, err := s.subscriptions.GetCurrent(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
 
 	// Check if user already has active subscription
-	if user.SubscriptionStatus == "active" {
+	if current != nil && current.Status == models.SubscriptionStatusActive {
 		return nil, fmt.Errorf("user already has active subscription")
 	}
+	if s.gateway == nil {
+		return nil, ErrNoPaymentGateway
+	}
+	if current != nil && current.Status == models.SubscriptionStatusGracePeriod {
+		return s.startRenewal(ctx, user, current, paymentMethod)
+	}
 
-	// Calculate subscription expiry (30 days from now)
-	expiresAt := time.Now().AddDate(0, 0, 30)
+	price := plan.Price
+	var coupon *models.Coupon
+	if couponCode != "" {
+		coupon, price, err = s.applyCoupon(user, couponCode, plan)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// Update user subscription status
-	if err := s.userService.UpdateSubscriptionStatus(userID, "active"); err != nil {
-		return nil, fmt.Errorf("failed to update subscription status: %w", err)
+	pending, err := s.subscriptions.GetPending(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending subscription: %w", err)
+	}
+	if pending != nil {
+		if pending.Plan == plan.ID && sameCoupon(pending, coupon) && s.reusableCheckout(pending, paymentMethod) {
+			return pending, nil
+		}
+		err := s.subscriptions.Transition(pending.ID, models.SubscriptionStatusPending, models.SubscriptionStatusCancelled, subscriptionReasonCheckoutAbandoned)
+		if err != nil && !errors.Is(err, repository.ErrConflict) {
+			return nil, fmt.Errorf("failed to close previous checkout: %w", err)
+		}
 	}
 
-	// Update subscription expiry
-	if err := s.updateSubscriptionExpiry(userID, expiresAt); err != nil {
-		return nil, fmt.Errorf("failed to update subscription expiry: %w", err)
+	now := time.Now()
+	subscription := &models.Subscription{
+		UserID:             user.ID,
+		Plan:               plan.ID,
+		Price:              price,
+		Currency:           plan.Currency,
+		Status:             models.SubscriptionStatusPending,
+		PaymentMethod:      paymentMethod,
+		Gateway:            s.gateway.Name(),
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   now.AddDate(0, 0, plan.PeriodDays),
+	}
+	if coupon != nil {
+		subscription.CouponID = &coupon.ID
+	}
+	if err := s.subscriptions.Create(subscription, subscriptionReasonCheckoutStarted); err != nil {
+		return nil, fmt.Errorf("failed to create subscription: %w", err)
 	}
 
-	subscription := &Subscription{
-		UserID:        userID,
-		Status:        "active",
-		PaymentMethod: paymentMethod,
-		Amount:        9.90, // R$ 9,90/month
-		Currency:      "BRL",
-		CreatedAt:     time.Now(),
-		ExpiresAt:     expiresAt,
+	customerID, err := s.gatewayCustomer(ctx, user, current, pending)
+	if err == nil {
+		subscription.GatewayCustomerID = customerID
+		if paymentMethod == payments.MethodPix {
+			// Pix has no recurring charges: each period is paid with a charge of its own
+			err = s.charge(ctx, user, subscription, customerID, payments.MethodPix, "Ara - "+plan.Name)
+		} else {
+			err = s.checkout(ctx, user, subscription)
+		}
+	}
+	if err != nil {
+		// Don't leave behind a checkout nobody can pay
+		if cancelErr := s.subscriptions.Transition(subscription.ID, models.SubscriptionStatusPending, models.SubscriptionStatusCancelled, subscriptionReasonCheckoutFailed); cancelErr != nil {
+			logrus.Errorf("Failed to cancel subscription %s after checkout error: %v", subscription.ID, cancelErr)
+		}
+		return nil, fmt.Errorf("failed to create checkout: %w", err)
 	}
 
+	if err := s.subscriptions.SaveGatewayDetails(subscription); err != nil {
+		return nil, fmt.Errorf("failed to save checkout: %w", err)
+	}
 	return subscription, nil
 }
 
-// CancelSubscription cancels the user's subscription
+// sameCoupon reports whether a pending subscription was started with the coupon, or
+// without one when coupon is nil
+func sameCoupon(pending *models.Subscription, coupon *models.Coupon) bool {
+	if pending.CouponID == nil || coupon == nil {
+		return pending.CouponID == nil && coupon == nil
+	}
+	return *pending.CouponID == coupon.ID
+}
+
+// reusableCheckout reports whether the checkout of a pending subscription can be offered
+// again to pay with paymentMethod
+func (s *SubscriptionService) reusableCheckout(pending *models.Subscription, paymentMethod string) bool {
+	if pending.Gateway != s.gateway.Name() || time.Since(pending.CreatedAt) >= checkoutTTL {
+		return false
+	}
+	if paymentMethod == payments.MethodPix {
+		return pending.PixCode != "" && pending.PixExpiresAt != nil && time.Until(*pending.PixExpiresAt) > pixReuseMargin
+	}
+	return pending.PixCode == "" && pending.CheckoutURL != ""
+}
+
+// checkout creates the gateway's recurring subscription of a pending subscription
+func (s *SubscriptionService) checkout(ctx context.Context, user *models.User, subscription *models.Subscription) error {
+	plan := s.plans.PlanOf(subscription)
+	checkout, err := s.gateway.CreateSubscription(ctx, payments.SubscriptionRequest{
+		CustomerID:     subscription.GatewayCustomerID,
+		Reference:      subscription.ID.String(),
+		Description:    "Ara - " + plan.Name,
+		Amount:         subscription.Price,
+		Currency:       subscription.Currency,
+		IntervalMonths: plan.IntervalMonths,
+		PayerEmail:     s.payerEmail(user),
+		BackURL:        s.renewalURL,
+	})
+	if err != nil {
+		return err
+	}
+	subscription.GatewaySubscriptionID = checkout.ID
+	subscription.CheckoutURL = checkout.CheckoutURL
+	return nil
+}
+
+// charge creates a one-off charge of one period of the subscription, by Pix or at the
+// gateway's checkout, and keeps where to pay it on the subscription
+func (s *SubscriptionService) charge(ctx context.Context, user *models.User, subscription *models.Subscription, customerID, method, description string) error {
+	request := payments.ChargeRequest{
+		CustomerID:  customerID,
+		Reference:   subscription.ID.String(),
+		Description: description,
+		Amount:      subscription.Price,
+		Currency:    subscription.Currency,
+		Method:      method,
+		PayerEmail:  s.payerEmail(user),
+		ExpiresAt:   time.Now().Add(checkoutTTL),
+	}
+	charge, err := s.gateway.CreateCharge(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	subscription.CheckoutURL = charge.CheckoutURL
+	subscription.PixCode = ""
+	subscription.PixExpiresAt = nil
+	if method == payments.MethodPix {
+		// Never hand a user a code their bank would refuse
+		if _, err := pix.Parse(charge.PixCode); err != nil {
+			return fmt.Errorf("%s returned an unusable pix code: %w", s.gateway.Name(), err)
+		}
+		subscription.PixCode = charge.PixCode
+		subscription.PixExpiresAt = charge.ExpiresAt
+		if subscription.PixExpiresAt == nil {
+			subscription.PixExpiresAt = &request.ExpiresAt
+		}
+	}
+	return nil
+}
+
+// startRenewal charges one more period of a subscription in its grace period
+func (s *SubscriptionService) startRenewal(ctx context.Context, user *models.User, subscription *models.Subscription, paymentMethod string) (*models.Subscription, error) {
+	customerID, err := s.gatewayCustomer(ctx, user, subscription)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkout: %w", err)
+	}
+
+	method := payments.MethodCheckout
+	if paymentMethod == payments.MethodPix {
+		method = payments.MethodPix
+	}
+	if subscription.Gateway == "" || subscription.Gateway == manualGateway {
+		subscription.Gateway = s.gateway.Name()
+	}
+	if subscription.Gateway == s.gateway.Name() {
+		subscription.GatewayCustomerID = customerID
+	}
+	description := "Ara - renovação do " + s.plans.PlanOf(subscription).Name
+	if err := s.charge(ctx, user, subscription, customerID, method, description); err != nil {
+		return nil, fmt.Errorf("failed to create checkout: %w", err)
+	}
+
+	if err := s.subscriptions.SaveGatewayDetails(subscription); err != nil {
+		return nil, fmt.Errorf("failed to save checkout: %w", err)
+	}
+	return subscription, nil
+}
+
+// gatewayCustomer returns the user's customer ID at the gateway, registering them the
+// first time
+func (s *SubscriptionService) gatewayCustomer(ctx context.Context, user *models.User, known ...*models.Subscription) (string, error) {
+	for _, subscription := range known {
+		if subscription != nil && subscription.Gateway == s.gateway.Name() && subscription.GatewayCustomerID != "" {
+			return subscription.GatewayCustomerID, nil
+		}
+	}
+	return s.gateway.CreateCustomer(ctx, payments.Customer{
+		Reference: user.ID.String(),
+		Email:     s.payerEmail(user),
+		Phone:     user.PhoneNumber,
+	})
+}
+
+func (s *SubscriptionService) payerEmail(user *models.User) string {
+	return user.ID.String() + "@" + s.payerEmailDomain
+}
+
+// CancelSubscription cancels the user's subscription. A recurring subscription is
+// cancelled at the gateway first, or it would go on charging the user; when the gateway
+// refuses, the subscription stays active and the error is returned.
 func (s *SubscriptionService) CancelSubscription(userID string) error {
-	user, err := s.userService.GetUserByID(userID)
+	current, err := s.currentSubscription(userID)
 	if err != nil {
-		return fmt.Errorf("failed to get user: %w", err)
+		return err
 	}
 
-	if user.SubscriptionStatus != "active" {
+	if current == nil || current.Status != models.SubscriptionStatusActive {
 		return fmt.Errorf("user does not have active subscription")
 	}
 
+	if current.GatewaySubscriptionID != "" {
+		if s.gateway == nil || current.Gateway != s.gateway.Name() {
+			return fmt.Errorf("%w: subscription %s is billed by %s", ErrUnknownGateway, current.ID, current.Gateway)
+		}
+		if err := s.gateway.CancelSubscription(context.Background(), current.GatewaySubscriptionID); err != nil {
+			return fmt.Errorf("failed to cancel subscription at %s: %w", current.Gateway, err)
+		}
+	}
+
 	// Update subscription status to cancelled
-	if err := s.userService.UpdateSubscriptionStatus(userID, "cancelled"); err != nil {
+	if err := s.subscriptions.Transition(current.ID, current.Status, models.SubscriptionStatusCancelled, subscriptionReasonCancelled); err != nil {
 		return fmt.Errorf("failed to cancel subscription: %w", err)
 	}
+	s.closeDunning(current.ID, models.DunningStatusChurned)
+	s.trackChurned(current, subscriptionReasonCancelled)
 
 	return nil
 }
 
 // RenewSubscription renews the user's subscription
 func (s *SubscriptionService) RenewSubscription(userID string) error {
-	user, err := s.userService.GetUserByID(userID)
+	current, err := s.currentSubscription(userID)
 	if err != nil {
-		return fmt.Errorf("failed to get user: %w", err)
+		return err
 	}
 
-	if user.SubscriptionStatus != "active" {
+	// A subscription in its grace period can still be renewed
+	if current == nil || (current.Status != models.SubscriptionStatusActive && current.Status != models.SubscriptionStatusGracePeriod) {
 		return fmt.Errorf("user does not have active subscription")
 	}
 
-	// Extend subscription by 30 days
-	newExpiry := time.Now().AddDate(0, 0, 30)
-	if user.SubscriptionExpiresAt != nil && user.SubscriptionExpiresAt.After(time.Now()) {
-		// If subscription is still active, extend from current expiry
-		newExpiry = user.SubscriptionExpiresAt.AddDate(0, 0, 30)
-	}
-
-	if err := s.updateSubscriptionExpiry(userID, newExpiry); err != nil {
+	if err := s.renew(current, subscriptionReasonRenewed); err != nil {
 		return fmt.Errorf("failed to renew subscription: %w", err)
 	}
 
@@ -139,6 +467,10 @@ func (s *SubscriptionService) GetSubscriptionInfo(userID string) (*SubscriptionI
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
+	current, err := s.subscriptions.GetCurrent(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
 
 	// Get trial status
 	trialStatus, err := s.CheckTrialStatus(userID)
@@ -148,105 +480,576 @@ func (s *SubscriptionService) GetSubscriptionInfo(userID string) (*SubscriptionI
 
 	info := &SubscriptionInfo{
 		UserID:                     userID,
-		SubscriptionStatus:         user.SubscriptionStatus,
+		SubscriptionStatus:         subscriptionStatus(current),
 		TrialTransactionsCount:     user.TrialTransactionsCount,
 		RemainingTrialTransactions: trialStatus.RemainingTrialTransactions,
 		IsTrialExpired:             trialStatus.IsTrialExpired,
-		SubscriptionExpiresAt:      user.SubscriptionExpiresAt,
-		MonthlyPrice:               9.90,
-		Currency:                   "BRL",
+		MonthlyPrice:               s.plans.Default().Price,
+		Currency:                   s.plans.Default().Currency,
+	}
+	if current == nil {
+		return info, nil
 	}
 
-	// Calculate days until expiry
-	if user.SubscriptionExpiresAt != nil {
-		info.DaysUntilExpiry = int(user.SubscriptionExpiresAt.Sub(time.Now()).Hours() / 24)
+	info.SubscriptionID = current.ID.String()
+	info.Plan = current.Plan
+	info.MonthlyPrice = current.Price
+	info.Currency = current.Currency
+	info.CurrentPeriodStart = &current.CurrentPeriodStart
+	info.SubscriptionExpiresAt = &current.CurrentPeriodEnd
+	info.DaysUntilExpiry = int(time.Until(current.CurrentPeriodEnd).Hours() / 24)
+
+	payments, err := s.subscriptions.ListPayments(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payments: %w", err)
+	}
+	if len(payments) > 0 {
+		info.LastPayment = &payments[0]
 	}
 
 	return info, nil
 }
 
-// ProcessPaymentWebhook handles payment gateway webhooks
-func (s *SubscriptionService) ProcessPaymentWebhook(webhookData map[string]interface{}) error {
+// HandlePaymentWebhook processes a notification of the named gateway, whose signature the
+// gateway checks. Each event is applied once however often it's delivered. The subscription
+// is found by the reference we gave the gateway, or by the gateway's subscription ID for
+// renewals it charges on its own.
+func (s *SubscriptionService) HandlePaymentWebhook(ctx context.Context, gateway string, header http.Header, body []byte) error {
+	if s.gateway == nil || s.gateway.Name() != gateway {
+		return ErrUnknownGateway
+	}
+
+	event, err := s.gateway.ParseWebhook(ctx, header, body)
+	if errors.Is(err, payments.ErrIgnored) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s webhook: %w", gateway, err)
+	}
+
+	return s.processOnce(event, body, func() error {
+		var subscription *models.Subscription
+		if reference, err := uuid.Parse(event.Reference); err == nil {
+			subscription, err = s.subscriptions.GetByID(reference)
+			if err != nil && !errors.Is(err, repository.ErrNotFound) {
+				return fmt.Errorf("failed to get subscription: %w", err)
+			}
+		}
+		if subscription == nil && event.SubscriptionID != "" {
+			subscription, err = s.subscriptions.GetByGatewaySubscriptionID(event.Gateway, event.SubscriptionID)
+			if err != nil {
+				return fmt.Errorf("failed to get subscription: %w", err)
+			}
+		}
+		if subscription == nil {
+			return fmt.Errorf("no subscription for %s payment %s (reference %q)", gateway, event.PaymentID, event.Reference)
+		}
+
+		return s.applyPayment(subscription.UserID, subscription, event)
+	})
+}
+
+// ProcessPaymentWebhook handles payment notifications posted in our own format, for
+// payments taken outside a gateway. They must be signed with PAYMENT_WEBHOOK_SECRET (see
+// payments.SignManualWebhook). Every notification is kept as a payment, keyed by the
+// payment_id, so repeated notifications update it in place; event_id, when given, makes
+// redeliveries no-ops.
+func (s *SubscriptionService) ProcessPaymentWebhook(ctx context.Context, header http.Header, body []byte) error {
+	if err := payments.VerifyManualWebhook(s.webhookSecret, header, body); err != nil {
+		return err
+	}
+
+	var webhookData map[string]interface{}
+	if err := json.Unmarshal(body, &webhookData); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+
 	// Extract webhook data
 	userID, ok := webhookData["user_id"].(string)
 	if !ok {
-		return fmt.Errorf("invalid user_id in webhook data")
+		return fmt.Errorf("%w: invalid user_id", ErrInvalidWebhook)
 	}
 
 	paymentStatus, ok := webhookData["status"].(string)
 	if !ok {
-		return fmt.Errorf("invalid payment status in webhook data")
+		return fmt.Errorf("%w: invalid payment status", ErrInvalidWebhook)
 	}
 
-	_, ok = webhookData["payment_id"].(string)
+	paymentID, ok := webhookData["payment_id"].(string)
 	if !ok {
-		return fmt.Errorf("invalid payment_id in webhook data")
+		return fmt.Errorf("%w: invalid payment_id", ErrInvalidWebhook)
 	}
 
-	switch paymentStatus {
-	case "approved":
-		// Payment successful - activate subscription
-		if err := s.userService.UpdateSubscriptionStatus(userID, "active"); err != nil {
-			return fmt.Errorf("failed to activate subscription: %w", err)
+	event := &payments.WebhookEvent{
+		Gateway:   manualGateway,
+		PaymentID: paymentID,
+		Status:    models.PaymentStatus(paymentStatus),
+	}
+	if gateway, _ := webhookData["gateway"].(string); gateway != "" {
+		event.Gateway = gateway
+	}
+	event.EventID, _ = webhookData["event_id"].(string)
+	event.Method, _ = webhookData["payment_method"].(string)
+	event.Amount, _ = webhookData["amount"].(float64)
+	event.FailureReason, _ = webhookData["failure_reason"].(string)
+
+	return s.processOnce(event, body, func() error {
+		user, err := s.userService.GetUserByID(userID)
+		if err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+		current, err := s.subscriptions.GetCurrent(user.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+
+		return s.applyPayment(user.ID, current, event)
+	})
+}
+
+// processOnce runs apply for a webhook event unless an earlier delivery of it was already
+// processed, or is being processed. An event that fails stays unprocessed, so the sender's
+// retry applies it.
+func (s *SubscriptionService) processOnce(event *payments.WebhookEvent, body []byte, apply func() error) error {
+	eventID := event.EventID
+	if eventID == "" {
+		// Without an ID, a redelivery is the same payment in the same status
+		eventID = event.PaymentID + ":" + string(event.Status)
+	}
+	stored := &models.PaymentWebhookEvent{
+		Gateway:   event.Gateway,
+		EventID:   eventID,
+		Type:      event.Type,
+		PaymentID: event.PaymentID,
+		Status:    event.Status,
+		Payload:   json.RawMessage(body),
+	}
+	claimed, err := s.subscriptions.ClaimWebhookEvent(stored, time.Now().Add(webhookClaimTTL))
+	if err != nil {
+		return fmt.Errorf("failed to record webhook event: %w", err)
+	}
+	if !claimed && stored.ProcessedAt != nil {
+		logrus.Infof("Ignoring redelivered %s webhook event %s", event.Gateway, eventID)
+		return nil
+	}
+	if !claimed {
+		return fmt.Errorf("%w: %s event %s", ErrWebhookInProgress, event.Gateway, eventID)
+	}
+
+	applyErr := apply()
+	if err := s.subscriptions.FinishWebhookEvent(stored.ID, applyErr); err != nil {
+		logrus.Errorf("Failed to mark %s webhook event %s: %v", event.Gateway, eventID, err)
+	}
+	return applyErr
+}
+
+// paymentStatusOrder ranks payment statuses by how far along a payment is. Gateways don't
+// deliver notifications in order, and a payment never goes back.
+var paymentStatusOrder = map[models.PaymentStatus]int{
+	models.PaymentStatusPending:   0,
+	models.PaymentStatusFailed:    1,
+	models.PaymentStatusCancelled: 1,
+	models.PaymentStatusApproved:  2,
+	models.PaymentStatusRefunded:  3,
+}
+
+// applyPayment records a payment of the subscription (nil when the user has none) and
+// moves the subscription along: an approved payment activates or renews it and a refund
+// ends it. A failed charge changes nothing: what the user paid for runs until its end.
+// The subscription changes and the payment are stored together or not at all, so a
+// failure leaves nothing for the retry to apply twice.
+func (s *SubscriptionService) applyPayment(userID uuid.UUID, subscription *models.Subscription, event *payments.WebhookEvent) error {
+	activating := subscription != nil && subscription.Status == models.SubscriptionStatusPending
+	var paid *models.Subscription
+	err := s.inTransaction(func(tx *SubscriptionService) error {
+		var err error
+		paid, err = tx.recordPayment(userID, subscription, event)
+		return err
+	})
+	if err != nil || paid == nil {
+		return err
+	}
+
+	if activating && paid.ID == subscription.ID {
+		properties := map[string]interface{}{"plan": paid.Plan, "price": paid.Price}
+		if paid.CouponID != nil {
+			properties["coupon_id"] = paid.CouponID.String()
+		}
+		s.analytics.Track(userID, models.AnalyticsSubscribed, properties)
+	}
+	s.notifyActivated(paid)
+	s.rewardReferral(userID)
+	return nil
+}
+
+// inTransaction runs fn with a copy of the service whose subscription changes are kept
+// only if fn returns nil
+func (s *SubscriptionService) inTransaction(fn func(tx *SubscriptionService) error) error {
+	return s.subscriptions.Atomically(func(subscriptions repository.SubscriptionRepository) error {
+		tx := *s
+		tx.subscriptions = subscriptions
+		return fn(&tx)
+	})
+}
+
+// recordPayment does applyPayment's changes. It returns the subscription an approved
+// payment paid for, or nil when the payment paid for nothing new.
+func (s *SubscriptionService) recordPayment(userID uuid.UUID, subscription *models.Subscription, event *payments.WebhookEvent) (*models.Subscription, error) {
+	order, known := paymentStatusOrder[event.Status]
+	if !known {
+		return nil, fmt.Errorf("%w: unknown payment status %q", ErrInvalidWebhook, event.Status)
+	}
+	existing, err := s.subscriptions.GetPaymentByGatewayID(event.Gateway, event.PaymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+	if existing != nil && order <= paymentStatusOrder[existing.Status] {
+		// Repeated or stale notification
+		return nil, nil
+	}
+
+	payment := &models.Payment{
+		UserID:           userID,
+		Gateway:          event.Gateway,
+		GatewayPaymentID: event.PaymentID,
+		Amount:           event.Amount,
+		Status:           event.Status,
+		Method:           event.Method,
+	}
+	if subscription != nil {
+		payment.SubscriptionID = &subscription.ID
+	}
+	if payment.Amount == 0 {
+		payment.Amount = s.plans.Default().Price
+		if subscription != nil {
+			payment.Amount = subscription.Price
 		}
+	}
 
-		// Set subscription expiry
-		expiresAt := time.Now().AddDate(0, 0, 30)
-		if err := s.updateSubscriptionExpiry(userID, expiresAt); err != nil {
-			return fmt.Errorf("failed to set subscription expiry: %w", err)
+	switch event.Status {
+	case models.PaymentStatusApproved:
+		now := time.Now()
+		payment.PaidAt = &now
+
+		// Payment successful - activate subscription
+		switch {
+		case subscription != nil && subscription.Status == models.SubscriptionStatusPending:
+			err = s.activate(subscription)
+		case subscription != nil && isLive(subscription):
+			err = s.renew(subscription, subscriptionReasonPaymentApproved)
+		default:
+			// A payment of an abandoned checkout still buys a period: of the subscription
+			// the user has running, or of a new one of the checkout's plan
+			plan := s.plans.Default()
+			if subscription != nil {
+				plan = s.plans.PlanOf(subscription)
+			}
+			var current *models.Subscription
+			current, err = s.subscriptions.GetCurrent(userID)
+			if err == nil && current != nil && isLive(current) {
+				subscription = current
+				err = s.renew(subscription, subscriptionReasonPaymentApproved)
+			} else if err == nil {
+				subscription, err = s.newSubscription(userID, plan, event.Method, now, subscriptionReasonPaymentApproved)
+			}
 		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to activate subscription: %w", err)
+		}
+		subscription, err = s.subscriptions.GetByID(subscription.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get subscription: %w", err)
+		}
+		s.closeDunning(subscription.ID, models.DunningStatusRecovered)
+		payment.SubscriptionID = &subscription.ID
+		payment.PeriodStart = &subscription.CurrentPeriodStart
+		payment.PeriodEnd = &subscription.CurrentPeriodEnd
 
-	case "failed", "cancelled":
-		// Payment failed - keep user in trial or cancelled status
-		if err := s.userService.UpdateSubscriptionStatus(userID, "trial"); err != nil {
-			return fmt.Errorf("failed to revert subscription status: %w", err)
+	case models.PaymentStatusFailed, models.PaymentStatusCancelled:
+		// The subscription keeps the period already paid for and is dunned through its
+		// grace period. A pending checkout stays open.
+		payment.FailureReason = event.FailureReason
+		if subscription != nil && isLive(subscription) {
+			if err := s.openDunning(subscription, event.FailureReason); err != nil {
+				return nil, fmt.Errorf("failed to open dunning case: %w", err)
+			}
 		}
 
-	case "refunded":
+	case models.PaymentStatusRefunded:
 		// Payment refunded - cancel subscription
-		if err := s.userService.UpdateSubscriptionStatus(userID, "cancelled"); err != nil {
-			return fmt.Errorf("failed to cancel subscription: %w", err)
+		if err := s.end(subscription, subscriptionReasonRefunded); err != nil {
+			return nil, fmt.Errorf("failed to cancel subscription: %w", err)
+		}
+
+	case models.PaymentStatusPending:
+		// Nothing changes until the gateway confirms or refuses it
+	}
+
+	if err := s.subscriptions.SavePayment(payment, "payment_"+string(event.Status)); err != nil {
+		return nil, fmt.Errorf("failed to record payment: %w", err)
+	}
+
+	if event.Status != models.PaymentStatusApproved {
+		return nil, nil
+	}
+	return subscription, nil
+}
+
+// activate starts the first period of a paid checkout. A subscription the user still has
+// running is replaced, so only one is live at a time, and its paid days carry over. The
+// coupon the checkout was sold with, if any, counts as used.
+func (s *SubscriptionService) activate(subscription *models.Subscription) error {
+	current, err := s.subscriptions.GetCurrent(subscription.UserID)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if current != nil && isLive(current) {
+		if current.CurrentPeriodEnd.After(start) {
+			start = current.CurrentPeriodEnd
 		}
+		s.closeDunning(current.ID, models.DunningStatusRecovered)
+	}
+	if err := s.end(current, subscriptionReasonReplaced); err != nil {
+		return err
 	}
 
+	end := start.AddDate(0, 0, s.plans.PlanOf(subscription).PeriodDays)
+	if err := s.subscriptions.ExtendPeriod(subscription.ID, start, end, subscriptionReasonPaymentApproved); err != nil {
+		return err
+	}
+	if err := s.subscriptions.Transition(subscription.ID, models.SubscriptionStatusPending, models.SubscriptionStatusActive, subscriptionReasonPaymentApproved); err != nil {
+		return err
+	}
+	s.redeemCoupon(subscription)
 	return nil
 }
 
-// updateSubscriptionExpiry updates the subscription expiry date
-func (s *SubscriptionService) updateSubscriptionExpiry(userID string, expiresAt time.Time) error {
-	return s.userService.db.Model(&models.User{}).
-		Where("id = ?", userID).
-		Update("subscription_expires_at", expiresAt).
-		Error
+// trackChurned records that the user's subscription ended, cancelled or expired
+func (s *SubscriptionService) trackChurned(subscription *models.Subscription, reason string) {
+	s.analytics.Track(subscription.UserID, models.AnalyticsChurned, map[string]interface{}{"plan": subscription.Plan, "reason": reason})
+}
+
+// notifyActivated tells the user their payment went through
+func (s *SubscriptionService) notifyActivated(subscription *models.Subscription) {
+	if s.notifier == nil {
+		return
+	}
+	user, err := s.userService.GetUserByID(subscription.UserID.String())
+	if err != nil || user.PhoneNumber == "" {
+		return
+	}
+
+	params := map[string]string{"expires_at": subscription.CurrentPeriodEnd.Format("02/01/2006")}
+	if err := s.notifier.SendNotification(user.PhoneNumber, "subscription_activated", params); err != nil {
+		logrus.Errorf("Failed to notify user %s about their payment: %v", subscription.UserID, err)
+	}
+}
+
+// SweepExpiredSubscriptions moves lapsed subscriptions along: active ones past their period
+// enter the grace period, and those past the grace period expire. Each user is told on
+// WhatsApp, with a link to renew. Returns how many subscriptions changed status.
+func (s *SubscriptionService) SweepExpiredSubscriptions(ctx context.Context) (int, error) {
+	now := time.Now()
+	graceCutoff := now.Add(-models.SubscriptionGracePeriod)
+	moved := 0
+
+	steps := []struct {
+		from        string
+		endedBefore time.Time
+	}{
+		{models.SubscriptionStatusActive, now},
+		{models.SubscriptionStatusGracePeriod, graceCutoff},
+	}
+	for _, step := range steps {
+		for {
+			subscriptions, err := s.subscriptions.ListLapsed(step.from, step.endedBefore, sweepBatchSize)
+			if err != nil {
+				return moved, fmt.Errorf("failed to list lapsed subscriptions: %w", err)
+			}
+
+			for i := range subscriptions {
+				if ctx.Err() != nil {
+					return moved, ctx.Err()
+				}
+				subscription := &subscriptions[i]
+
+				// Straight to expired when the grace period is over too (the sweep didn't run for a while)
+				to := models.SubscriptionStatusExpired
+				if step.from == models.SubscriptionStatusActive && subscription.CurrentPeriodEnd.After(graceCutoff) {
+					to = models.SubscriptionStatusGracePeriod
+				}
+
+				err := s.subscriptions.Transition(subscription.ID, step.from, to, subscriptionReasonExpirySweep)
+				if errors.Is(err, repository.ErrConflict) {
+					// Renewed or cancelled meanwhile
+					continue
+				}
+				if err != nil {
+					return moved, fmt.Errorf("failed to update subscription %s: %w", subscription.ID, err)
+				}
+				moved++
+				if to == models.SubscriptionStatusExpired {
+					s.trackChurned(subscription, to)
+				}
+				s.notifyLapsedOrChurned(subscription, to)
+			}
+
+			// Every listed subscription left the status, so the next page starts over
+			if len(subscriptions) < sweepBatchSize {
+				break
+			}
+		}
+	}
+
+	return moved, nil
+}
+
+// notifyLapsed tells the user their subscription entered the grace period or expired
+func (s *SubscriptionService) notifyLapsed(subscription *models.Subscription, status string) {
+	user := subscription.User
+	if s.notifier == nil || user.PhoneNumber == "" {
+		return
+	}
+
+	template := "subscription_expired"
+	params := map[string]string{"link": s.RenewalLink(subscription.UserID.String())}
+	if status == models.SubscriptionStatusGracePeriod {
+		template = "subscription_grace_period"
+		params["expires_at"] = subscription.CurrentPeriodEnd.Format("02/01/2006")
+		params["grace_ends_at"] = subscription.CurrentPeriodEnd.Add(models.SubscriptionGracePeriod).Format("02/01/2006")
+	}
+
+	if err := s.notifier.SendNotification(user.PhoneNumber, template, params); err != nil {
+		logrus.Errorf("Failed to notify user %s about subscription status %s: %v", subscription.UserID, status, err)
+	}
+}
+
+// RenewalLink is the page where the user renews their subscription
+func (s *SubscriptionService) RenewalLink(userID string) string {
+	return s.renewalURL + "?" + url.Values{"user": {userID}}.Encode()
+}
+
+// GetBillingHistory returns the user's billing events, oldest first, and payments, newest first
+func (s *SubscriptionService) GetBillingHistory(userID string) (*BillingHistory, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	events, err := s.subscriptions.Events(userUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list billing events: %w", err)
+	}
+	payments, err := s.subscriptions.ListPayments(userUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payments: %w", err)
+	}
+
+	return &BillingHistory{Events: events, Payments: payments}, nil
+}
+
+func (s *SubscriptionService) currentSubscription(userID string) (*models.Subscription, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+	current, err := s.subscriptions.GetCurrent(userUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	return current, nil
+}
+
+func (s *SubscriptionService) newSubscription(userID uuid.UUID, plan Plan, paymentMethod string, start time.Time, reason string) (*models.Subscription, error) {
+	subscription := &models.Subscription{
+		UserID:             userID,
+		Plan:               plan.ID,
+		Price:              plan.Price,
+		Currency:           plan.Currency,
+		Status:             models.SubscriptionStatusActive,
+		PaymentMethod:      paymentMethod,
+		CurrentPeriodStart: start,
+		CurrentPeriodEnd:   start.AddDate(0, 0, plan.PeriodDays),
+	}
+	if err := s.subscriptions.Create(subscription, reason); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// renew starts a new period and reactivates a subscription in its grace period. The
+// period is extended first, so the sweep never sees it active and already lapsed.
+func (s *SubscriptionService) renew(subscription *models.Subscription, reason string) error {
+	// Extend subscription by a period of its plan, from the current end while it hasn't passed
+	start := time.Now()
+	if subscription.CurrentPeriodEnd.After(start) {
+		start = subscription.CurrentPeriodEnd
+	}
+	end := start.AddDate(0, 0, s.plans.PlanOf(subscription).PeriodDays)
+	if err := s.subscriptions.ExtendPeriod(subscription.ID, start, end, reason); err != nil {
+		return err
+	}
+	if subscription.Status == models.SubscriptionStatusActive {
+		return nil
+	}
+	return s.subscriptions.Transition(subscription.ID, subscription.Status, models.SubscriptionStatusActive, reason)
+}
+
+// end cancels a subscription that is still running; there's nothing to do for one that already ended
+func (s *SubscriptionService) end(subscription *models.Subscription, reason string) error {
+	if subscription == nil || !isLive(subscription) {
+		return nil
+	}
+	if err := s.subscriptions.Transition(subscription.ID, subscription.Status, models.SubscriptionStatusCancelled, reason); err != nil {
+		return err
+	}
+	s.closeDunning(subscription.ID, models.DunningStatusChurned)
+	return nil
+}
+
+// isLive reports whether a subscription is active or in its grace period
+func isLive(subscription *models.Subscription) bool {
+	return subscription.Status == models.SubscriptionStatusActive || subscription.Status == models.SubscriptionStatusGracePeriod
+}
+
+// subscriptionStatus is the status of the user's current subscription, or trial without one
+func subscriptionStatus(current *models.Subscription) string {
+	if current == nil {
+		return models.SubscriptionStatusTrial
+	}
+	return current.Status
 }
 
 type TrialStatus struct {
 	UserID                      string `json:"user_id"`
 	SubscriptionStatus          string `json:"subscription_status"`
 	TrialTransactionsCount      int    `json:"trial_transactions_count"`
+	TrialTransactionLimit       int    `json:"trial_transaction_limit"`
 	RemainingTrialTransactions  int    `json:"remaining_trial_transactions"`
 	IsTrialExpired              bool   `json:"is_trial_expired"`
 	ShouldPromptForSubscription bool   `json:"should_prompt_for_subscription"`
 }
 
-type Subscription struct {
-	UserID        string    `json:"user_id"`
-	Status        string    `json:"status"`
-	PaymentMethod string    `json:"payment_method"`
-	Amount        float64   `json:"amount"`
-	Currency      string    `json:"currency"`
-	CreatedAt     time.Time `json:"created_at"`
-	ExpiresAt     time.Time `json:"expires_at"`
+type SubscriptionInfo struct {
+	UserID                     string          `json:"user_id"`
+	SubscriptionStatus         string          `json:"subscription_status"`
+	SubscriptionID             string          `json:"subscription_id,omitempty"`
+	Plan                       string          `json:"plan,omitempty"`
+	TrialTransactionsCount     int             `json:"trial_transactions_count"`
+	RemainingTrialTransactions int             `json:"remaining_trial_transactions"`
+	IsTrialExpired             bool            `json:"is_trial_expired"`
+	CurrentPeriodStart         *time.Time      `json:"current_period_start,omitempty"`
+	SubscriptionExpiresAt      *time.Time      `json:"subscription_expires_at,omitempty"`
+	DaysUntilExpiry            int             `json:"days_until_expiry"`
+	MonthlyPrice               float64         `json:"monthly_price"`
+	Currency                   string          `json:"currency"`
+	LastPayment                *models.Payment `json:"last_payment,omitempty"`
 }
 
-type SubscriptionInfo struct {
-	UserID                     string     `json:"user_id"`
-	SubscriptionStatus         string     `json:"subscription_status"`
-	TrialTransactionsCount     int        `json:"trial_transactions_count"`
-	RemainingTrialTransactions int        `json:"remaining_trial_transactions"`
-	IsTrialExpired             bool       `json:"is_trial_expired"`
-	SubscriptionExpiresAt      *time.Time `json:"subscription_expires_at,omitempty"`
-	DaysUntilExpiry            int        `json:"days_until_expiry"`
-	MonthlyPrice               float64    `json:"monthly_price"`
-	Currency                   string     `json:"currency"`
+// BillingHistory is what a billing dispute needs: every status change, period change and
+// payment of the user
+type BillingHistory struct {
+	Events   []models.SubscriptionEvent `json:"events"`
+	Payments []models.Payment           `json:"payments"`
 }
@@ -0,0 +1,638 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"project-ara/internal/models"
+	"project-ara/internal/payments"
+	"project-ara/internal/pix"
+	"project-ara/internal/repository"
+	"project-ara/internal/testdb"
+)
+
+type sentNotification struct {
+	to       string
+	template string
+	params   map[string]string
+}
+
+type fakeNotifier struct {
+	sent []sentNotification
+}
+
+func (n *fakeNotifier) SendNotification(to, templateName string, params map[string]string) error {
+	n.sent = append(n.sent, sentNotification{to, templateName, params})
+	return nil
+}
+
+func newMemorySubscriptionService(t *testing.T) (*SubscriptionService, *UserService, *TransactionService) {
+	subscriptionService, userService, transactionService, _, _ := newMemorySubscriptionServiceWithGateway(t)
+	return subscriptionService, userService, transactionService
+}
+
+// newMemorySubscriptionServiceWithGateway sells subscriptions through a FakeServer, whose
+// payments tests deliver with pay
+func newMemorySubscriptionServiceWithGateway(t *testing.T) (*SubscriptionService, *UserService, *TransactionService, *fakeNotifier, *payments.FakeServer) {
+	return newSubscriptionServiceWithGateway(t, repository.NewMemory())
+}
+
+func newSubscriptionServiceWithGateway(t *testing.T, repos *repository.Repositories) (*SubscriptionService, *UserService, *TransactionService, *fakeNotifier, *payments.FakeServer) {
+	gateway := payments.NewFakeServer("")
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	plans, err := LoadPlanCatalog("")
+	require.NoError(t, err)
+	analyticsService := NewAnalyticsService(repos.Analytics, repos.Users, plans)
+	userService := NewUserService(repos.Users, plans, analyticsService)
+	transactionService := NewTransactionService(repos.Transactions, repos.Users, analyticsService)
+	reportingService := NewFinancialReportingService(transactionService, userService, plans, analyticsService)
+	notifier := &fakeNotifier{}
+	subscriptionService := NewSubscriptionService(repos.Subscriptions, userService, transactionService, reportingService, plans, notifier, payments.NewFakeGateway(server.URL), analyticsService)
+	return subscriptionService, userService, transactionService, notifier, gateway
+}
+
+// pay settles the checkout of a subscription at the fake gateway and delivers the webhook
+func pay(t *testing.T, subscriptionService *SubscriptionService, gateway *payments.FakeServer, checkoutID string, status models.PaymentStatus) {
+	t.Helper()
+	webhook, err := gateway.Pay(checkoutID, status)
+	require.NoError(t, err)
+	require.NoError(t, subscriptionService.HandlePaymentWebhook(context.Background(), payments.GatewayFake, webhook.Header, webhook.Body))
+}
+
+// postManualWebhook delivers a payment webhook in our own format, signed with the
+// service's secret
+func postManualWebhook(t *testing.T, subscriptionService *SubscriptionService, data map[string]interface{}) {
+	t.Helper()
+	subscriptionService.webhookSecret = "test-webhook-secret"
+	body, err := json.Marshal(data)
+	require.NoError(t, err)
+	header := http.Header{}
+	header.Set(payments.ManualSignatureHeader, payments.SignManualWebhook(subscriptionService.webhookSecret, body))
+	require.NoError(t, subscriptionService.ProcessPaymentWebhook(context.Background(), header, body))
+}
+
+// subscribe buys the monthly plan for the user
+func subscribe(t *testing.T, subscriptionService *SubscriptionService, gateway *payments.FakeServer, user *models.User) *models.Subscription {
+	t.Helper()
+	subscription, err := subscriptionService.CreateSubscription(user.ID.String(), "", "credit_card", "")
+	require.NoError(t, err)
+	pay(t, subscriptionService, gateway, subscription.GatewaySubscriptionID, models.PaymentStatusApproved)
+	subscription, err = subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	return subscription
+}
+
+func TestTrialUserSubscribesAfterLimit(t *testing.T) {
+	subscriptionService, userService, transactionService, notifier, gateway := newMemorySubscriptionServiceWithGateway(t)
+
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977770000")
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, err := transactionService.CreateTransactionFromInput(user.ID.String(), TransactionInput{
+			Amount:             float64(i + 1),
+			TransactionType:    models.TransactionTypeIncome,
+			Source:             models.TransactionSourceText,
+			SkipDuplicateCheck: true,
+		})
+		require.NoError(t, err)
+	}
+
+	status, err := subscriptionService.CheckTrialStatus(user.ID.String())
+	require.NoError(t, err)
+	assert.True(t, status.IsTrialExpired)
+	canCreate, err := userService.CanUserCreateTransaction(user.ID.String())
+	require.NoError(t, err)
+	assert.False(t, canCreate)
+
+	// Subscribing returns a checkout link; nothing changes until it's paid
+	subscription, err := subscriptionService.CreateSubscription(user.ID.String(), "", "credit_card", "")
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusPending, subscription.Status)
+	assert.Equal(t, payments.GatewayFake, subscription.Gateway)
+	assert.Contains(t, subscription.CheckoutURL, "/checkout/"+subscription.GatewaySubscriptionID)
+	canCreate, err = userService.CanUserCreateTransaction(user.ID.String())
+	require.NoError(t, err)
+	assert.False(t, canCreate)
+
+	// Asking again offers the same checkout
+	again, err := subscriptionService.CreateSubscription(user.ID.String(), "", "credit_card", "")
+	require.NoError(t, err)
+	assert.Equal(t, subscription.ID, again.ID)
+	assert.Equal(t, subscription.CheckoutURL, again.CheckoutURL)
+
+	// A refused card leaves the checkout open
+	pay(t, subscriptionService, gateway, subscription.GatewaySubscriptionID, models.PaymentStatusFailed)
+	status, err = subscriptionService.CheckTrialStatus(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusTrial, status.SubscriptionStatus)
+
+	pay(t, subscriptionService, gateway, subscription.GatewaySubscriptionID, models.PaymentStatusApproved)
+	info, err := subscriptionService.GetSubscriptionInfo(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, info.SubscriptionStatus)
+	assert.Equal(t, subscription.ID.String(), info.SubscriptionID)
+	require.NotNil(t, info.SubscriptionExpiresAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *info.SubscriptionExpiresAt, time.Minute)
+	require.NotNil(t, info.LastPayment)
+	assert.Equal(t, models.PaymentStatusApproved, info.LastPayment.Status)
+	require.Len(t, notifier.sent, 1)
+	assert.Equal(t, "subscription_activated", notifier.sent[0].template)
+
+	user, err = userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, "active", user.SubscriptionStatus)
+	require.NotNil(t, user.SubscriptionExpiresAt)
+	canCreate, err = userService.CanUserCreateTransaction(user.ID.String())
+	require.NoError(t, err)
+	assert.True(t, canCreate)
+
+	_, err = subscriptionService.CreateSubscription(user.ID.String(), "", "credit_card", "")
+	assert.Error(t, err, "already subscribed")
+}
+
+func TestPixSubscriptionIsPaidWithACharge(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977771111")
+	require.NoError(t, err)
+
+	subscription, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "")
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusPending, subscription.Status)
+	assert.Empty(t, subscription.GatewaySubscriptionID, "pix has no recurring subscription at the gateway")
+	code, err := pix.Parse(subscription.PixCode)
+	require.NoError(t, err)
+	assert.Equal(t, subscription.Price, code.Amount)
+	require.NotNil(t, subscription.PixExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(checkoutTTL), *subscription.PixExpiresAt, time.Minute)
+
+	// The same code is offered again, but asking for a card abandons it
+	again, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "")
+	require.NoError(t, err)
+	assert.Equal(t, subscription.ID, again.ID)
+	assert.Equal(t, subscription.PixCode, again.PixCode)
+	card, err := subscriptionService.CreateSubscription(user.ID.String(), "", "credit_card", "")
+	require.NoError(t, err)
+	assert.NotEqual(t, subscription.ID, card.ID)
+	assert.Empty(t, card.PixCode)
+	subscription, err = subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "")
+	require.NoError(t, err)
+	assert.NotEqual(t, card.ID, subscription.ID)
+
+	chargeID := subscription.CheckoutURL[strings.LastIndex(subscription.CheckoutURL, "/")+1:]
+	pay(t, subscriptionService, gateway, chargeID, models.PaymentStatusApproved)
+	info, err := subscriptionService.GetSubscriptionInfo(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, info.SubscriptionStatus)
+	assert.Equal(t, subscription.ID.String(), info.SubscriptionID)
+	require.NotNil(t, info.LastPayment)
+	assert.Equal(t, payments.MethodPix, info.LastPayment.Method)
+}
+
+func TestExpirySweepDowngradesLapsedSubscriptions(t *testing.T) {
+	subscriptionService, userService, _, notifier, gateway := newMemorySubscriptionServiceWithGateway(t)
+
+	lapse := func(user *models.User, expiredDaysAgo int) {
+		subscription, err := subscriptionService.subscriptions.GetCurrent(user.ID)
+		require.NoError(t, err)
+		end := time.Now().AddDate(0, 0, -expiredDaysAgo)
+		require.NoError(t, subscriptionService.subscriptions.ExtendPeriod(subscription.ID, end.AddDate(0, 0, -30), end, "test"))
+	}
+	subscriber := func(phone string, expiredDaysAgo int) *models.User {
+		user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, phone)
+		require.NoError(t, err)
+		subscribe(t, subscriptionService, gateway, user)
+		lapse(user, expiredDaysAgo)
+		return user
+	}
+	current := subscriber("5511977770001", -10)
+	lapsed := subscriber("5511977770002", 1)
+	longGone := subscriber("5511977770003", 10)
+
+	// Expiry is enforced before the sweep runs: past the grace period nothing can be logged
+	for i := 0; i < 50; i++ {
+		require.NoError(t, userService.users.IncrementTrialTransactions(longGone.ID))
+	}
+	canCreate, err := userService.CanUserCreateTransaction(longGone.ID.String())
+	require.NoError(t, err)
+	assert.False(t, canCreate)
+
+	notifier.sent = nil
+	moved, err := subscriptionService.SweepExpiredSubscriptions(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	statuses := map[*models.User]string{
+		current:  models.SubscriptionStatusActive,
+		lapsed:   models.SubscriptionStatusGracePeriod,
+		longGone: models.SubscriptionStatusExpired,
+	}
+	for user, status := range statuses {
+		found, err := userService.GetUserByID(user.ID.String())
+		require.NoError(t, err)
+		assert.Equal(t, status, found.SubscriptionStatus, user.PhoneNumber)
+	}
+
+	// The grace period still lets the user log transactions
+	canCreate, err = userService.CanUserCreateTransaction(lapsed.ID.String())
+	require.NoError(t, err)
+	assert.True(t, canCreate)
+
+	require.Len(t, notifier.sent, 2)
+	byPhone := map[string]sentNotification{}
+	for _, sent := range notifier.sent {
+		byPhone[sent.to] = sent
+	}
+	assert.Equal(t, "subscription_grace_period", byPhone[lapsed.PhoneNumber].template)
+	assert.Contains(t, byPhone[lapsed.PhoneNumber].params["link"], lapsed.ID.String())
+	assert.Equal(t, "subscription_expired", byPhone[longGone.PhoneNumber].template)
+
+	history, err := subscriptionService.GetBillingHistory(longGone.ID.String())
+	require.NoError(t, err)
+	last := history.Events[len(history.Events)-1]
+	assert.Equal(t, models.SubscriptionStatusActive, last.FromStatus)
+	assert.Equal(t, models.SubscriptionStatusExpired, last.ToStatus)
+	assert.Equal(t, "expiry_sweep", last.Reason)
+
+	// Once the grace period is over, the next sweep expires the lapsed subscription too
+	lapse(lapsed, 4)
+	moved, err = subscriptionService.SweepExpiredSubscriptions(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	found, err := userService.GetUserByID(lapsed.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusExpired, found.SubscriptionStatus)
+}
+
+func TestPaymentWebhooksAreRecorded(t *testing.T) {
+	subscriptionService, userService, _ := newMemorySubscriptionService(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977779999")
+	require.NoError(t, err)
+
+	webhook := func(paymentID, status string) {
+		postManualWebhook(t, subscriptionService, map[string]interface{}{
+			"user_id":    user.ID.String(),
+			"payment_id": paymentID,
+			"status":     status,
+			"amount":     9.90,
+			"gateway":    "mercadopago",
+		})
+	}
+	webhook("pay-1", "approved")
+	webhook("pay-1", "approved") // Repeated notification
+
+	info, err := subscriptionService.GetSubscriptionInfo(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, info.SubscriptionStatus)
+	assert.Equal(t, "monthly", info.Plan)
+	require.NotNil(t, info.LastPayment)
+	assert.Equal(t, "pay-1", info.LastPayment.GatewayPaymentID)
+	assert.Equal(t, models.PaymentStatusApproved, info.LastPayment.Status)
+	require.NotNil(t, info.LastPayment.PeriodEnd)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *info.LastPayment.PeriodEnd, time.Minute)
+
+	webhook("pay-1", "refunded")
+	status, err := subscriptionService.CheckTrialStatus(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusCancelled, status.SubscriptionStatus)
+
+	history, err := subscriptionService.GetBillingHistory(user.ID.String())
+	require.NoError(t, err)
+	require.Len(t, history.Payments, 1, "the refund updates the same payment")
+	assert.Equal(t, models.PaymentStatusRefunded, history.Payments[0].Status)
+	var reasons []string
+	for _, event := range history.Events {
+		reasons = append(reasons, event.Reason)
+	}
+	assert.Equal(t, []string{"payment_approved", "payment_approved", "refunded", "payment_refunded"}, reasons)
+}
+
+func TestUnsignedPaymentWebhooksAreRejected(t *testing.T) {
+	subscriptionService, userService, _ := newMemorySubscriptionService(t)
+	subscriptionService.webhookSecret = "test-webhook-secret"
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977776666")
+	require.NoError(t, err)
+
+	body := []byte(`{"user_id":"` + user.ID.String() + `","payment_id":"pay-1","status":"approved"}`)
+	err = subscriptionService.ProcessPaymentWebhook(context.Background(), http.Header{}, body)
+	assert.ErrorIs(t, err, payments.ErrInvalidSignature)
+
+	header := http.Header{}
+	header.Set(payments.ManualSignatureHeader, payments.SignManualWebhook("another-secret", body))
+	err = subscriptionService.ProcessPaymentWebhook(context.Background(), header, body)
+	assert.ErrorIs(t, err, payments.ErrInvalidSignature)
+
+	header.Set(payments.ManualSignatureHeader, payments.SignManualWebhook(subscriptionService.webhookSecret, []byte("{")))
+	err = subscriptionService.ProcessPaymentWebhook(context.Background(), header, []byte("{"))
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+
+	found, err := userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusTrial, found.SubscriptionStatus)
+}
+
+func TestRedeliveredWebhookIsAppliedOnce(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977775555")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, user)
+
+	webhook, err := gateway.Pay(subscription.GatewaySubscriptionID, models.PaymentStatusApproved)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, subscriptionService.HandlePaymentWebhook(context.Background(), payments.GatewayFake, webhook.Header, webhook.Body))
+	}
+
+	// One renewal: 30 days on top of the first period, not 90
+	renewed, err := subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, subscription.CurrentPeriodEnd.AddDate(0, 0, 30), renewed.CurrentPeriodEnd, time.Minute)
+	history, err := subscriptionService.GetBillingHistory(user.ID.String())
+	require.NoError(t, err)
+	assert.Len(t, history.Payments, 2)
+
+	tampered := webhook.Header.Clone()
+	tampered.Set("X-Fake-Signature", "sha256=00")
+	err = subscriptionService.HandlePaymentWebhook(context.Background(), payments.GatewayFake, tampered, webhook.Body)
+	assert.ErrorIs(t, err, payments.ErrInvalidSignature)
+}
+
+// failingPayments fails the next failures payments saved, in transactions too
+type failingPayments struct {
+	repository.SubscriptionRepository
+	failures *int
+}
+
+func (r failingPayments) Atomically(fn func(repository.SubscriptionRepository) error) error {
+	return r.SubscriptionRepository.Atomically(func(tx repository.SubscriptionRepository) error {
+		return fn(failingPayments{tx, r.failures})
+	})
+}
+
+func (r failingPayments) SavePayment(payment *models.Payment, reason string) error {
+	if *r.failures > 0 {
+		*r.failures--
+		return errors.New("connection reset")
+	}
+	return r.SubscriptionRepository.SavePayment(payment, reason)
+}
+
+func TestWebhookReplayedAfterAFailedPaymentSaveIsAppliedOnce(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newSubscriptionServiceWithGateway(t, repository.NewGorm(testdb.SQLite(t)))
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977775556")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, user)
+
+	failures := 1
+	subscriptionService.subscriptions = failingPayments{subscriptionService.subscriptions, &failures}
+	webhook, err := gateway.Pay(subscription.GatewaySubscriptionID, models.PaymentStatusApproved)
+	require.NoError(t, err)
+	err = subscriptionService.HandlePaymentWebhook(context.Background(), payments.GatewayFake, webhook.Header, webhook.Body)
+	require.Error(t, err)
+
+	// The failed delivery extended nothing
+	unchanged, err := subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, subscription.CurrentPeriodEnd, unchanged.CurrentPeriodEnd, time.Second)
+
+	// The gateway's retry renews once, and later ones are ignored
+	for i := 0; i < 2; i++ {
+		require.NoError(t, subscriptionService.HandlePaymentWebhook(context.Background(), payments.GatewayFake, webhook.Header, webhook.Body))
+	}
+	renewed, err := subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, subscription.CurrentPeriodEnd.AddDate(0, 0, 30), renewed.CurrentPeriodEnd, time.Minute)
+	history, err := subscriptionService.GetBillingHistory(user.ID.String())
+	require.NoError(t, err)
+	assert.Len(t, history.Payments, 2)
+}
+
+// refusingGateway fails to cancel subscriptions
+type refusingGateway struct {
+	payments.PaymentGateway
+}
+
+func (g refusingGateway) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	return errors.New("gateway unavailable")
+}
+
+func TestCancellingStopsTheGatewaySubscription(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977775557")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, user)
+
+	// While the gateway refuses, the subscription stays active
+	fake := subscriptionService.gateway
+	subscriptionService.gateway = refusingGateway{fake}
+	require.Error(t, subscriptionService.CancelSubscription(user.ID.String()))
+	current, err := subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, current.Status)
+
+	subscriptionService.gateway = fake
+	require.NoError(t, subscriptionService.CancelSubscription(user.ID.String()))
+	current, err = subscriptionService.subscriptions.GetByID(subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusCancelled, current.Status)
+
+	// The gateway doesn't charge the user anymore
+	_, err = gateway.Pay(subscription.GatewaySubscriptionID, models.PaymentStatusApproved)
+	assert.Error(t, err)
+}
+
+func TestFailedPaymentKeepsThePaidPeriod(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977774444")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, user)
+
+	// The card is refused on renewal: the month already paid for still counts
+	pay(t, subscriptionService, gateway, subscription.GatewaySubscriptionID, models.PaymentStatusFailed)
+	found, err := userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, found.SubscriptionStatus)
+	require.NotNil(t, found.SubscriptionExpiresAt)
+	assert.WithinDuration(t, subscription.CurrentPeriodEnd, *found.SubscriptionExpiresAt, time.Minute)
+
+	history, err := subscriptionService.GetBillingHistory(user.ID.String())
+	require.NoError(t, err)
+	require.Len(t, history.Payments, 2)
+	var failed *models.Payment
+	for i := range history.Payments {
+		if history.Payments[i].Status == models.PaymentStatusFailed {
+			failed = &history.Payments[i]
+		}
+	}
+	require.NotNil(t, failed)
+	assert.Equal(t, "cc_rejected_insufficient_amount", failed.FailureReason)
+}
+
+func TestStalePaymentNotificationsAreIgnored(t *testing.T) {
+	subscriptionService, userService, _ := newMemorySubscriptionService(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977773333")
+	require.NoError(t, err)
+
+	webhook := func(status string) {
+		postManualWebhook(t, subscriptionService, map[string]interface{}{
+			"user_id":    user.ID.String(),
+			"payment_id": "pay-7",
+			"status":     status,
+		})
+	}
+	webhook("approved")
+	// Delivered late, after the approval it preceded
+	webhook("pending")
+	webhook("failed")
+
+	history, err := subscriptionService.GetBillingHistory(user.ID.String())
+	require.NoError(t, err)
+	require.Len(t, history.Payments, 1)
+	assert.Equal(t, models.PaymentStatusApproved, history.Payments[0].Status)
+	found, err := userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, found.SubscriptionStatus)
+}
+
+func TestPayingAnAbandonedCheckoutExtendsTheSubscription(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977772222")
+	require.NoError(t, err)
+
+	// The user asked for a Pix code, then subscribed by card, and later paid the Pix too.
+	// The Pix checkout was closed when the card one opened, so the card subscription grows.
+	byPix, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "")
+	require.NoError(t, err)
+	byCard := subscribe(t, subscriptionService, gateway, user)
+	chargeID := byPix.CheckoutURL[strings.LastIndex(byPix.CheckoutURL, "/")+1:]
+	pay(t, subscriptionService, gateway, chargeID, models.PaymentStatusApproved)
+
+	current, err := subscriptionService.subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	assert.Equal(t, byCard.ID, current.ID)
+	assert.WithinDuration(t, byCard.CurrentPeriodEnd.AddDate(0, 0, 30), current.CurrentPeriodEnd, time.Minute)
+}
+
+func TestActivatingACheckoutCarriesOverPaidDays(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977771111")
+	require.NoError(t, err)
+
+	// A card checkout is opened, then a month is paid by other means before the card is
+	pending, err := subscriptionService.CreateSubscription(user.ID.String(), "", "credit_card", "")
+	require.NoError(t, err)
+	postManualWebhook(t, subscriptionService, map[string]interface{}{
+		"user_id":    user.ID.String(),
+		"payment_id": "boleto-1",
+		"status":     "approved",
+	})
+	paid, err := subscriptionService.subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	pay(t, subscriptionService, gateway, pending.GatewaySubscriptionID, models.PaymentStatusApproved)
+
+	current, err := subscriptionService.subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, pending.ID, current.ID)
+	assert.WithinDuration(t, paid.CurrentPeriodEnd.AddDate(0, 0, 30), current.CurrentPeriodEnd, time.Minute)
+}
+
+func TestGracePeriodRenewalIsChargedOnce(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977778888")
+	require.NoError(t, err)
+	subscription := subscribe(t, subscriptionService, gateway, user)
+
+	end := time.Now().AddDate(0, 0, -1)
+	require.NoError(t, subscriptionService.subscriptions.ExtendPeriod(subscription.ID, end.AddDate(0, 0, -30), end, "test"))
+	_, err = subscriptionService.SweepExpiredSubscriptions(context.Background())
+	require.NoError(t, err)
+
+	// The subscription in its grace period is renewed with a one-off charge, not replaced
+	renewal, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "")
+	require.NoError(t, err)
+	assert.Equal(t, subscription.ID, renewal.ID)
+	assert.Equal(t, models.SubscriptionStatusGracePeriod, renewal.Status)
+	require.NotEmpty(t, renewal.CheckoutURL)
+	assert.NotEqual(t, subscription.CheckoutURL, renewal.CheckoutURL)
+	assert.NotEmpty(t, renewal.PixCode)
+
+	chargeID := renewal.CheckoutURL[strings.LastIndex(renewal.CheckoutURL, "/")+1:]
+	pay(t, subscriptionService, gateway, chargeID, models.PaymentStatusApproved)
+	found, err := userService.GetUserByID(user.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, found.SubscriptionStatus)
+	require.NotNil(t, found.SubscriptionExpiresAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *found.SubscriptionExpiresAt, time.Minute)
+
+	history, err := subscriptionService.GetBillingHistory(user.ID.String())
+	require.NoError(t, err)
+	assert.Len(t, history.Payments, 2)
+}
+
+func TestAnnualPlanBuysAYear(t *testing.T) {
+	subscriptionService, userService, _, _, gateway := newMemorySubscriptionServiceWithGateway(t)
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977779999")
+	require.NoError(t, err)
+
+	// A checkout of another plan isn't offered again
+	monthly, err := subscriptionService.CreateSubscription(user.ID.String(), "", payments.MethodPix, "")
+	require.NoError(t, err)
+	annual, err := subscriptionService.CreateSubscription(user.ID.String(), "annual", payments.MethodPix, "")
+	require.NoError(t, err)
+	assert.NotEqual(t, monthly.ID, annual.ID)
+	assert.Equal(t, "annual", annual.Plan)
+	assert.Equal(t, 99.0, annual.Price)
+	code, err := pix.Parse(annual.PixCode)
+	require.NoError(t, err)
+	assert.Equal(t, 99.0, code.Amount)
+
+	chargeID := annual.CheckoutURL[strings.LastIndex(annual.CheckoutURL, "/")+1:]
+	pay(t, subscriptionService, gateway, chargeID, models.PaymentStatusApproved)
+	current, err := subscriptionService.subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, annual.ID, current.ID)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 365), current.CurrentPeriodEnd, time.Minute)
+
+	require.NoError(t, subscriptionService.RenewSubscription(user.ID.String()))
+	current, err = subscriptionService.subscriptions.GetCurrent(user.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 730), current.CurrentPeriodEnd, time.Minute)
+
+	_, err = subscriptionService.CreateSubscription(user.ID.String(), "lifetime", payments.MethodPix, "")
+	assert.ErrorIs(t, err, ErrUnknownPlan)
+}
+
+func TestTrialFollowsTheCatalog(t *testing.T) {
+	subscriptionService, userService, transactionService := newMemorySubscriptionService(t)
+	subscriptionService.Plans().Trial = TrialPolicy{Transactions: 3, PromptAt: 2, WarnAt: 1}
+	user, err := userService.GetOrCreateChannelUser(ChannelWhatsApp, "5511977770101")
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		status, err := subscriptionService.CheckTrialStatus(user.ID.String())
+		require.NoError(t, err)
+		assert.Equal(t, 3-i, status.RemainingTrialTransactions)
+		assert.Equal(t, i >= 2, status.ShouldPromptForSubscription, i)
+		_, err = transactionService.CreateTransaction(user.ID.String(), float64(i+1), "venda", models.TransactionTypeIncome, models.TransactionSourceText)
+		require.NoError(t, err)
+	}
+
+	canCreate, err := userService.CanUserCreateTransaction(user.ID.String())
+	require.NoError(t, err)
+	assert.False(t, canCreate)
+	message, err := subscriptionService.reportingService.GenerateTrialStatusMessage(user.ID.String())
+	require.NoError(t, err)
+	assert.Contains(t, message, "limite de 3 transações")
+	assert.Contains(t, message, "R$ 9,90/mês")
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TelegramUpdate is the subset of a Telegram Bot API update the bot understands
+type TelegramUpdate struct {
+	UpdateID      int64            `json:"update_id"`
+	Message       *TelegramMessage `json:"message,omitempty"`
+	CallbackQuery *struct {
+		ID      string           `json:"id"`
+		Data    string           `json:"data"`
+		Message *TelegramMessage `json:"message,omitempty"`
+	} `json:"callback_query,omitempty"`
+}
+
+type TelegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	Date      int64 `json:"date"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text    string         `json:"text"`
+	Caption string         `json:"caption"`
+	Voice   *TelegramFile  `json:"voice,omitempty"`
+	Audio   *TelegramFile  `json:"audio,omitempty"`
+	Photo   []TelegramFile `json:"photo,omitempty"`
+	Reply   *struct {
+		MessageID int64 `json:"message_id"`
+	} `json:"reply_to_message,omitempty"`
+}
+
+type TelegramFile struct {
+	FileID   string `json:"file_id"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
+}
+
+// ToInbound converts an update to the channel-neutral model. It reports false for
+// updates that aren't user messages (edits, joins...).
+func (u *TelegramUpdate) ToInbound() (InboundMessage, bool) {
+	if u.CallbackQuery != nil && u.CallbackQuery.Message != nil {
+		return InboundMessage{
+			Channel:    ChannelTelegram,
+			From:       strconv.FormatInt(u.CallbackQuery.Message.Chat.ID, 10),
+			ID:         u.CallbackQuery.ID,
+			ReceivedAt: time.Now(),
+			Type:       InboundInteractive,
+			ReplyID:    u.CallbackQuery.Data,
+		}, true
+	}
+
+	m := u.Message
+	if m == nil {
+		return InboundMessage{}, false
+	}
+
+	inbound := InboundMessage{
+		Channel:    ChannelTelegram,
+		From:       strconv.FormatInt(m.Chat.ID, 10),
+		ID:         strconv.FormatInt(m.MessageID, 10),
+		ReceivedAt: time.Unix(m.Date, 0),
+		Text:       m.Text,
+	}
+	if m.Reply != nil {
+		inbound.ReplyTo = strconv.FormatInt(m.Reply.MessageID, 10)
+	}
+
+	switch {
+	case m.Voice != nil:
+		inbound.Type = InboundAudio
+		inbound.Media = &MediaRef{ID: m.Voice.FileID, MimeType: m.Voice.MimeType}
+	case m.Audio != nil:
+		inbound.Type = InboundAudio
+		inbound.Media = &MediaRef{ID: m.Audio.FileID, MimeType: m.Audio.MimeType}
+	case len(m.Photo) > 0:
+		// Telegram sends every resolution; the last one is the largest
+		inbound.Type = InboundImage
+		inbound.Text = m.Caption
+		inbound.Media = &MediaRef{ID: m.Photo[len(m.Photo)-1].FileID, MimeType: "image/jpeg"}
+	case m.Text != "":
+		inbound.Type = InboundText
+	default:
+		inbound.Type = InboundUnsupported
+	}
+
+	return inbound, true
+}
+
+// TelegramService is the Telegram Bot API channel
+type TelegramService struct {
+	token         string
+	baseURL       string
+	webhookSecret string
+	client        *http.Client
+}
+
+func NewTelegramService() *TelegramService {
+	baseURL := strings.TrimRight(os.Getenv("TELEGRAM_API_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "https://api.telegram.org"
+	}
+
+	return &TelegramService{
+		token:         os.Getenv("TELEGRAM_BOT_TOKEN"),
+		baseURL:       baseURL,
+		webhookSecret: os.Getenv("TELEGRAM_WEBHOOK_SECRET"),
+		client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Enabled reports whether a bot token is configured
+func (t *TelegramService) Enabled() bool {
+	return t.token != ""
+}
+
+// Name identifies the Telegram channel
+func (t *TelegramService) Name() string {
+	return ChannelTelegram
+}
+
+// VerifyWebhook checks the X-Telegram-Bot-Api-Secret-Token header set with setWebhook
+func (t *TelegramService) VerifyWebhook(secretToken string) bool {
+	if t.webhookSecret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(secretToken), []byte(t.webhookSecret)) == 1
+}
+
+func (t *TelegramService) ParseUpdate(body []byte) (*TelegramUpdate, error) {
+	var update TelegramUpdate
+	if err := json.Unmarshal(body, &update); err != nil {
+		return nil, fmt.Errorf("failed to parse Telegram update: %w", err)
+	}
+	return &update, nil
+}
+
+// AnswerCallback acknowledges a tapped inline button so the client stops showing a spinner
+func (t *TelegramService) AnswerCallback(ctx context.Context, callbackID string) error {
+	return t.call(ctx, "answerCallbackQuery", map[string]interface{}{"callback_query_id": callbackID}, nil)
+}
+
+type telegramButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// Send delivers a channel-neutral message. Buttons and list rows become inline keyboard buttons.
+func (t *TelegramService) Send(ctx context.Context, message OutgoingMessage) error {
+	if message.Image != nil {
+		return t.sendPhoto(ctx, message)
+	}
+
+	request := map[string]interface{}{
+		"chat_id": message.To,
+		"text":    message.Text,
+	}
+	if replyTo, err := strconv.ParseInt(message.ReplyTo, 10, 64); err == nil {
+		request["reply_to_message_id"] = replyTo
+	}
+
+	var keyboard [][]telegramButton
+	if len(message.Buttons) > 0 {
+		row := make([]telegramButton, len(message.Buttons))
+		for i, button := range message.Buttons {
+			row[i] = telegramButton{Text: button.Title, CallbackData: button.ID}
+		}
+		keyboard = append(keyboard, row)
+	}
+	if message.List != nil {
+		for _, section := range message.List.Sections {
+			for _, row := range section.Rows {
+				keyboard = append(keyboard, []telegramButton{{Text: row.Title, CallbackData: row.ID}})
+			}
+		}
+	}
+	if len(keyboard) > 0 {
+		request["reply_markup"] = map[string]interface{}{"inline_keyboard": keyboard}
+	}
+
+	return t.call(ctx, "sendMessage", request, nil)
+}
+
+func (t *TelegramService) sendPhoto(ctx context.Context, message OutgoingMessage) error {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("chat_id", message.To)
+	if message.Text != "" {
+		writer.WriteField("caption", message.Text)
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="photo"; filename="photo"`)
+	header.Set("Content-Type", message.Image.MimeType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("failed to create upload form: %w", err)
+	}
+	if _, err := part.Write(message.Image.Data); err != nil {
+		return fmt.Errorf("failed to write upload form: %w", err)
+	}
+	writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.methodURL("sendPhoto"), &buf)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return t.do(req, nil)
+}
+
+// DownloadMedia resolves a file ID with getFile and downloads the file
+func (t *TelegramService) DownloadMedia(ctx context.Context, fileID string, maxBytes int64) (*Media, error) {
+	var file struct {
+		FileSize int64  `json:"file_size"`
+		FilePath string `json:"file_path"`
+	}
+	if err := t.call(ctx, "getFile", map[string]interface{}{"file_id": fileID}, &file); err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && file.FileSize > maxBytes {
+		return nil, ErrMediaTooLarge
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/file/bot%s/%s", t.baseURL, t.token, file.FilePath), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Telegram file download returned status: %d", resp.StatusCode)
+	}
+
+	reader := io.Reader(resp.Body)
+	if maxBytes > 0 {
+		reader = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media: %w", err)
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, ErrMediaTooLarge
+	}
+
+	return &Media{Data: data, MimeType: resp.Header.Get("Content-Type"), SHA256: hashMedia(data)}, nil
+}
+
+func (t *TelegramService) methodURL(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", t.baseURL, t.token, method)
+}
+
+// call invokes a Bot API method with a JSON body and decodes its result into result (if not nil)
+func (t *TelegramService) call(ctx context.Context, method string, request interface{}, result interface{}) error {
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.methodURL(method), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return t.do(req, result)
+}
+
+func (t *TelegramService) do(req *http.Request, result interface{}) error {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call Telegram API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to decode Telegram response (status %d): %w", resp.StatusCode, err)
+	}
+	if !body.OK {
+		return fmt.Errorf("Telegram API returned status %d: %s", resp.StatusCode, body.Description)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(body.Result, result); err != nil {
+			return fmt.Errorf("failed to decode Telegram result: %w", err)
+		}
+	}
+	return nil
+}
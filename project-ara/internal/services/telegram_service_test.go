@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelegramUpdateToInbound(t *testing.T) {
+	s := NewTelegramService()
+
+	update, err := s.ParseUpdate([]byte(`{"update_id":1,"message":{"message_id":7,"date":1760000000,"chat":{"id":42},
+		"voice":{"file_id":"voice-1","mime_type":"audio/ogg","file_size":1200},"reply_to_message":{"message_id":5}}}`))
+	require.NoError(t, err)
+	inbound, ok := update.ToInbound()
+	require.True(t, ok)
+	assert.Equal(t, ChannelTelegram, inbound.Channel)
+	assert.Equal(t, "42", inbound.From)
+	assert.Equal(t, InboundAudio, inbound.Type)
+	assert.Equal(t, "voice-1", inbound.Media.ID)
+	assert.Equal(t, "5", inbound.ReplyTo)
+
+	update, err = s.ParseUpdate([]byte(`{"update_id":2,"callback_query":{"id":"cb-1","data":"summary_week","message":{"message_id":8,"chat":{"id":42}}}}`))
+	require.NoError(t, err)
+	inbound, ok = update.ToInbound()
+	require.True(t, ok)
+	assert.Equal(t, InboundInteractive, inbound.Type)
+	assert.Equal(t, "summary_week", inbound.ReplyID)
+
+	update, err = s.ParseUpdate([]byte(`{"update_id":3,"edited_message":{"message_id":9}}`))
+	require.NoError(t, err)
+	_, ok = update.ToInbound()
+	assert.False(t, ok)
+}
+
+func TestTelegramSendUsesInlineKeyboard(t *testing.T) {
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/bottest-token/sendMessage", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		w.Write([]byte(`{"ok":true,"result":{"message_id":10}}`))
+	}))
+	defer server.Close()
+	t.Setenv("TELEGRAM_API_BASE_URL", server.URL)
+	t.Setenv("TELEGRAM_BOT_TOKEN", "test-token")
+
+	var channel Channel = NewTelegramService()
+	chat := Chat{Channel: channel, To: "42"}
+	require.NoError(t, chat.SendButtons("📊 Qual período você quer ver?", []Button{
+		{ID: "summary_today", Title: "Hoje"},
+		{ID: "summary_week", Title: "Semana"},
+	}))
+
+	assert.Equal(t, "42", request["chat_id"])
+	keyboard := request["reply_markup"].(map[string]interface{})["inline_keyboard"].([]interface{})
+	row := keyboard[0].([]interface{})
+	require.Len(t, row, 2)
+	assert.Equal(t, "summary_week", row[1].(map[string]interface{})["callback_data"])
+
+	assert.NoError(t, channel.Send(context.Background(), OutgoingMessage{To: "42", Text: "oi"}))
+}
@@ -1,24 +1,60 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
-	"gorm.io/gorm"
 
 	"project-ara/internal/models"
+	"project-ara/internal/repository"
 )
 
 type TransactionService struct {
-	db *gorm.DB
+	transactions      repository.TransactionRepository
+	users             repository.UserRepository
+	duplicateDetector *DuplicateDetector
+	analytics         *AnalyticsService
 }
 
-func NewTransactionService(db *gorm.DB) *TransactionService {
-	return &TransactionService{db: db}
+// NewTransactionService creates the service; analytics, which may be nil, records how far
+// into the trial users get
+func NewTransactionService(transactions repository.TransactionRepository, users repository.UserRepository, analytics *AnalyticsService) *TransactionService {
+	return &TransactionService{
+		transactions:      transactions,
+		users:             users,
+		duplicateDetector: NewDuplicateDetector(transactions),
+		analytics:         analytics,
+	}
+}
+
+// TransactionInput carries the data of a new transaction together with the
+// evidence identifiers used for duplicate detection
+type TransactionInput struct {
+	Amount             float64
+	Description        string
+	TransactionType    models.TransactionType
+	Source             models.TransactionSource
+	MediaSHA256        string     // SHA-256 of the WhatsApp media the transaction came from
+	ExternalRef        string     // NFC-e access key or Pix E2E ID
+	MediaArtifactID    *uuid.UUID // Cached transcript or OCR extraction, kept for audit
+	AttachmentID       *uuid.UUID // Archived media to link to the transaction
+	SkipDuplicateCheck bool
 }
 
 func (s *TransactionService) CreateTransaction(userID string, amount float64, description string, transactionType models.TransactionType, source models.TransactionSource) (*models.Transaction, error) {
+	return s.CreateTransactionFromInput(userID, TransactionInput{
+		Amount:          amount,
+		Description:     description,
+		TransactionType: transactionType,
+		Source:          source,
+	})
+}
+
+// CreateTransactionFromInput creates a transaction, returning a *DuplicateTransactionError
+// instead when it looks like a repeat of an existing one
+func (s *TransactionService) CreateTransactionFromInput(userID string, input TransactionInput) (*models.Transaction, error) {
 	// Parse user ID
 	userUUID, err := uuid.Parse(userID)
 	if err != nil {
@@ -27,21 +63,41 @@ func (s *TransactionService) CreateTransaction(userID string, amount float64, de
 
 	transaction := &models.Transaction{
 		UserID:          userUUID,
-		Amount:          amount,
-		Description:     description,
-		TransactionType: transactionType,
-		Source:          source,
+		Amount:          input.Amount,
+		Description:     input.Description,
+		TransactionType: input.TransactionType,
+		Source:          input.Source,
+		MediaSHA256:     input.MediaSHA256,
+		ExternalRef:     input.ExternalRef,
+		MediaArtifactID: input.MediaArtifactID,
 		CreatedAt:       time.Now(),
 	}
 
-	if err := s.db.Create(transaction).Error; err != nil {
+	if !input.SkipDuplicateCheck {
+		match, err := s.duplicateDetector.FindDuplicate(transaction)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for duplicates: %w", err)
+		}
+		if match != nil {
+			return nil, &DuplicateTransactionError{Match: match}
+		}
+	}
+
+	if err := s.transactions.Create(transaction); err != nil {
 		return nil, fmt.Errorf("failed to create transaction: %w", err)
 	}
 
+	if input.AttachmentID != nil {
+		if err := s.transactions.LinkAttachment(*input.AttachmentID, transaction.ID); err != nil {
+			return nil, fmt.Errorf("failed to link attachment: %w", err)
+		}
+	}
+
 	// Update user's trial transaction count
-	if err := s.updateUserTrialCount(userUUID.String()); err != nil {
+	if err := s.users.IncrementTrialTransactions(userUUID); err != nil {
 		return nil, fmt.Errorf("failed to update trial count: %w", err)
 	}
+	s.analytics.TrackTransaction(userUUID)
 
 	return transaction, nil
 }
@@ -52,11 +108,8 @@ func (s *TransactionService) GetUserTransactions(userID string, limit int) ([]mo
 		return nil, fmt.Errorf("invalid user ID: %w", err)
 	}
 
-	var transactions []models.Transaction
-	if err := s.db.Where("user_id = ?", userUUID).
-		Order("created_at DESC").
-		Limit(limit).
-		Find(&transactions).Error; err != nil {
+	transactions, err := s.transactions.ListByUser(userUUID, limit)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get transactions: %w", err)
 	}
 
@@ -71,8 +124,8 @@ func (s *TransactionService) GetFinancialSummary(userID string) (*FinancialSumma
 
 	// Get today's transactions
 	today := time.Now().Truncate(24 * time.Hour)
-	var todayTransactions []models.Transaction
-	if err := s.db.Where("user_id = ? AND created_at >= ?", userUUID, today).Find(&todayTransactions).Error; err != nil {
+	todayTransactions, err := s.transactions.ListBetween(userUUID, today, today.Add(24*time.Hour))
+	if err != nil {
 		return nil, fmt.Errorf("failed to get today's transactions: %w", err)
 	}
 
@@ -120,15 +173,31 @@ func (s *TransactionService) GetPeriodSummary(userID string, period string) (*Pe
 		return nil, fmt.Errorf("invalid period: %s", period)
 	}
 
-	var transactions []models.Transaction
-	if err := s.db.Where("user_id = ? AND created_at >= ? AND created_at < ?",
-		userUUID, startDate, endDate).Find(&transactions).Error; err != nil {
+	summary, err := s.summarizeBetween(userUUID, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	summary.Period = period
+	return summary, nil
+}
+
+// GetSummaryBetween totals the user's transactions created in [from, to)
+func (s *TransactionService) GetSummaryBetween(userID string, from, to time.Time) (*PeriodSummary, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+	return s.summarizeBetween(userUUID, from, to)
+}
+
+func (s *TransactionService) summarizeBetween(userID uuid.UUID, startDate, endDate time.Time) (*PeriodSummary, error) {
+	transactions, err := s.transactions.ListBetween(userID, startDate, endDate)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get period transactions: %w", err)
 	}
 
 	summary := &PeriodSummary{
-		UserID:    userID,
-		Period:    period,
+		UserID:    userID.String(),
 		StartDate: startDate,
 		EndDate:   endDate,
 	}
@@ -153,33 +222,29 @@ func (s *TransactionService) CorrectTransaction(transactionID string, correctedA
 		return nil, fmt.Errorf("invalid transaction ID: %w", err)
 	}
 
-	var transaction models.Transaction
-	if err := s.db.Where("id = ?", transactionUUID).First(&transaction).Error; err != nil {
+	transaction, err := s.transactions.GetByID(transactionUUID)
+	if err != nil {
 		return nil, fmt.Errorf("transaction not found: %w", err)
 	}
 
 	// Store correction data
-	correctionData := map[string]interface{}{
+	now := time.Now()
+	correctionData, err := json.Marshal(map[string]interface{}{
 		"original_amount":       transaction.Amount,
 		"original_description":  transaction.Description,
 		"corrected_amount":      correctedAmount,
 		"corrected_description": correctedDescription,
-		"corrected_at":          time.Now(),
-	}
-
-	// Update transaction
-	updates := map[string]interface{}{
-		"amount":          correctedAmount,
-		"description":     correctedDescription,
-		"corrected_at":    time.Now(),
-		"correction_data": correctionData,
+		"corrected_at":          now,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode correction: %w", err)
 	}
 
-	if err := s.db.Model(&transaction).Updates(updates).Error; err != nil {
+	if err := s.transactions.Correct(transactionUUID, correctedAmount, correctedDescription, correctionData, now); err != nil {
 		return nil, fmt.Errorf("failed to correct transaction: %w", err)
 	}
 
-	return &transaction, nil
+	return s.transactions.GetByID(transactionUUID)
 }
 
 func (s *TransactionService) GetTransactionByID(transactionID string) (*models.Transaction, error) {
@@ -188,12 +253,12 @@ func (s *TransactionService) GetTransactionByID(transactionID string) (*models.T
 		return nil, fmt.Errorf("invalid transaction ID: %w", err)
 	}
 
-	var transaction models.Transaction
-	if err := s.db.Where("id = ?", transactionUUID).First(&transaction).Error; err != nil {
+	transaction, err := s.transactions.GetByID(transactionUUID)
+	if err != nil {
 		return nil, fmt.Errorf("transaction not found: %w", err)
 	}
 
-	return &transaction, nil
+	return transaction, nil
 }
 
 func (s *TransactionService) GetUserBalance(userID string) (float64, error) {
@@ -202,23 +267,12 @@ func (s *TransactionService) GetUserBalance(userID string) (float64, error) {
 		return 0, fmt.Errorf("invalid user ID: %w", err)
 	}
 
-	var result struct {
-		Balance float64
-	}
-
-	query := `
-		SELECT 
-			COALESCE(SUM(CASE WHEN transaction_type = 'income' THEN amount ELSE 0 END), 0) -
-			COALESCE(SUM(CASE WHEN transaction_type = 'expense' THEN amount ELSE 0 END), 0) as balance
-		FROM transactions 
-		WHERE user_id = ?
-	`
-
-	if err := s.db.Raw(query, userUUID).Scan(&result).Error; err != nil {
+	balance, err := s.transactions.Balance(userUUID)
+	if err != nil {
 		return 0, fmt.Errorf("failed to calculate balance: %w", err)
 	}
 
-	return result.Balance, nil
+	return balance, nil
 }
 
 func (s *TransactionService) GetTopCategories(userID string, period string, limit int) ([]CategorySummary, error) {
@@ -239,32 +293,159 @@ func (s *TransactionService) GetTopCategories(userID string, period string, limi
 		startDate = now.Truncate(24 * time.Hour) // today
 	}
 
-	var results []CategorySummary
-	query := `
-		SELECT 
-			description,
-			transaction_type,
-			COUNT(*) as count,
-			SUM(amount) as total_amount
-		FROM transactions 
-		WHERE user_id = ? AND created_at >= ?
-		GROUP BY description, transaction_type
-		ORDER BY total_amount DESC
-		LIMIT ?
-	`
-
-	if err := s.db.Raw(query, userUUID, startDate, limit).Scan(&results).Error; err != nil {
+	results, err := s.transactions.TopCategories(userUUID, startDate, limit)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get top categories: %w", err)
 	}
 
 	return results, nil
 }
 
-func (s *TransactionService) updateUserTrialCount(userID string) error {
-	return s.db.Model(&models.User{}).
-		Where("id = ?", userID).
-		UpdateColumn("trial_transactions_count", gorm.Expr("trial_transactions_count + 1")).
-		Error
+// GetUserVocabulary returns the user's most frequent transaction descriptions from the last 90 days
+func (s *TransactionService) GetUserVocabulary(userID string, limit int) ([]string, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	descriptions, err := s.transactions.FrequentDescriptions(userUUID, time.Now().AddDate(0, 0, -90), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user vocabulary: %w", err)
+	}
+
+	return descriptions, nil
+}
+
+// SavePendingDuplicate stores a suspected duplicate until the user confirms or discards it,
+// replacing any earlier pending one
+func (s *TransactionService) SavePendingDuplicate(userID string, input TransactionInput, match *DuplicateMatch) (*models.PendingTransaction, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	pending := &models.PendingTransaction{
+		UserID:          userUUID,
+		Amount:          input.Amount,
+		Description:     input.Description,
+		TransactionType: input.TransactionType,
+		Source:          input.Source,
+		MediaSHA256:     input.MediaSHA256,
+		ExternalRef:     input.ExternalRef,
+		MediaArtifactID: input.MediaArtifactID,
+		AttachmentID:    input.AttachmentID,
+		DuplicateOfID:   match.Existing.ID,
+		MatchReason:     match.Reason,
+		CreatedAt:       time.Now(),
+		ExpiresAt:       time.Now().Add(30 * time.Minute),
+	}
+
+	if err := s.transactions.ReplacePending(pending); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+// GetPendingDuplicate returns the user's unexpired pending duplicate, or nil if there is none
+func (s *TransactionService) GetPendingDuplicate(userID string) (*models.PendingTransaction, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	pending, err := s.transactions.GetPending(userUUID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending transaction: %w", err)
+	}
+
+	return pending, nil
+}
+
+// ConfirmPendingDuplicate records the pending transaction the user chose to keep
+func (s *TransactionService) ConfirmPendingDuplicate(userID string) (*models.Transaction, error) {
+	pending, err := s.GetPendingDuplicate(userID)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, fmt.Errorf("no pending transaction to confirm")
+	}
+
+	transaction, err := s.CreateTransactionFromInput(userID, TransactionInput{
+		Amount:             pending.Amount,
+		Description:        pending.Description,
+		TransactionType:    pending.TransactionType,
+		Source:             pending.Source,
+		MediaSHA256:        pending.MediaSHA256,
+		ExternalRef:        pending.ExternalRef,
+		MediaArtifactID:    pending.MediaArtifactID,
+		AttachmentID:       pending.AttachmentID,
+		SkipDuplicateCheck: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.transactions.DeletePending(pending.UserID); err != nil {
+		return nil, fmt.Errorf("failed to clear pending transaction: %w", err)
+	}
+
+	return transaction, nil
+}
+
+// DiscardPendingDuplicate drops the user's pending duplicate without recording it
+func (s *TransactionService) DiscardPendingDuplicate(userID string) error {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	return s.transactions.DeletePending(userUUID)
+}
+
+// GetUsageStats sums up how the user has used the Ara since a date: what they logged, how,
+// and their best day of sales
+func (s *TransactionService) GetUsageStats(userID string, since time.Time) (*UsageStats, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	now := time.Now()
+	transactions, err := s.transactions.ListBetween(userUUID, since, now.Add(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transactions: %w", err)
+	}
+
+	stats := &UsageStats{Since: since, BySource: make(map[models.TransactionSource]int)}
+	salesByDay := make(map[string]float64)
+	for _, t := range transactions {
+		stats.Transactions++
+		stats.BySource[t.Source]++
+		if !t.IsIncome() {
+			stats.Expenses += t.Amount
+			continue
+		}
+		stats.Revenue += t.Amount
+		salesByDay[t.CreatedAt.Format(time.DateOnly)] += t.Amount
+	}
+
+	// Ties go to the earliest day
+	bestDay := ""
+	for day, sales := range salesByDay {
+		if sales > stats.BestDaySales || sales == stats.BestDaySales && day < bestDay {
+			bestDay, stats.BestDaySales = day, sales
+		}
+	}
+	if bestDay != "" {
+		date, err := time.ParseInLocation(time.DateOnly, bestDay, now.Location())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse best day: %w", err)
+		}
+		stats.BestDay = &date
+	}
+	return stats, nil
 }
 
 type FinancialSummary struct {
@@ -286,9 +467,16 @@ type PeriodSummary struct {
 	TransactionCount int       `json:"transaction_count"`
 }
 
-type CategorySummary struct {
-	Description     string  `json:"description"`
-	TransactionType string  `json:"transaction_type"`
-	Count           int     `json:"count"`
-	TotalAmount     float64 `json:"total_amount"`
+// UsageStats is what a user logged since a date
+type UsageStats struct {
+	Since        time.Time                        `json:"since"`
+	Transactions int                              `json:"transactions"`
+	BySource     map[models.TransactionSource]int `json:"by_source"`
+	Revenue      float64                          `json:"revenue"`
+	Expenses     float64                          `json:"expenses"`
+	BestDay      *time.Time                       `json:"best_day,omitempty"` // The day with the most sales
+	BestDaySales float64                          `json:"best_day_sales"`
 }
+
+// CategorySummary totals the transactions sharing a description and type
+type CategorySummary = repository.CategorySummary
@@ -1,66 +1,127 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
-	"gorm.io/gorm"
+	"github.com/google/uuid"
 
 	"project-ara/internal/models"
+	"project-ara/internal/repository"
 )
 
 type UserService struct {
-	db *gorm.DB
+	users     repository.UserRepository
+	plans     *PlanCatalog
+	analytics *AnalyticsService
 }
 
-func NewUserService(db *gorm.DB) *UserService {
-	return &UserService{db: db}
+// NewUserService creates the service; plans sets how many free transactions users get,
+// and analytics, which may be nil, records the signups
+func NewUserService(users repository.UserRepository, plans *PlanCatalog, analytics *AnalyticsService) *UserService {
+	return &UserService{users: users, plans: plans, analytics: analytics}
 }
 
 func (s *UserService) GetOrCreateUser(phoneNumber string) (*models.User, error) {
-	var user models.User
-
-	// Try to find existing user
-	if err := s.db.Where("phone_number = ?", phoneNumber).First(&user).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			// Create new user
-			user = models.User{
-				PhoneNumber:            phoneNumber,
-				TrialTransactionsCount: 0,
-				SubscriptionStatus:     "trial",
-			}
-
-			if err := s.db.Create(&user).Error; err != nil {
-				return nil, fmt.Errorf("failed to create user: %w", err)
-			}
-		} else {
-			return nil, fmt.Errorf("failed to get user: %w", err)
-		}
+	return s.GetOrCreateChannelUser(ChannelWhatsApp, phoneNumber)
+}
+
+// GetOrCreateChannelUser finds or creates the user behind an address on a messaging channel
+func (s *UserService) GetOrCreateChannelUser(channel, address string) (*models.User, error) {
+	var existing *models.User
+	var err error
+	user := models.User{Channel: channel, SubscriptionStatus: models.SubscriptionStatusTrial}
+	switch channel {
+	case ChannelWhatsApp:
+		existing, err = s.users.GetByPhoneNumber(address)
+		user.PhoneNumber = address
+	case ChannelTelegram:
+		existing, err = s.users.GetByTelegramChatID(address)
+		user.TelegramChatID = address
+	default:
+		return nil, fmt.Errorf("unknown channel: %s", channel)
 	}
 
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, repository.ErrNotFound) {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if err := s.users.Create(&user); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	s.analytics.Track(user.ID, models.AnalyticsUserCreated, map[string]interface{}{"channel": channel})
 	return &user, nil
 }
 
 func (s *UserService) GetUserByID(userID string) (*models.User, error) {
-	var user models.User
-	if err := s.db.Where("id = ?", userID).First(&user).Error; err != nil {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	user, err := s.users.GetByID(userUUID)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
-	return &user, nil
+	return user, nil
 }
 
 func (s *UserService) GetUserByPhoneNumber(phoneNumber string) (*models.User, error) {
-	var user models.User
-	if err := s.db.Where("phone_number = ?", phoneNumber).First(&user).Error; err != nil {
+	user, err := s.users.GetByPhoneNumber(phoneNumber)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
-	return &user, nil
+	return user, nil
+}
+
+// GetUserByReferralCode returns the user whose referral code it is
+func (s *UserService) GetUserByReferralCode(code string) (*models.User, error) {
+	user, err := s.users.GetByReferralCode(code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, nil
+}
+
+// ReferralCode returns the user's referral code, giving them one the first time
+func (s *UserService) ReferralCode(user *models.User) (string, error) {
+	if user.ReferralCode != "" {
+		return user.ReferralCode, nil
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := newReferralCode()
+		if err != nil {
+			return "", err
+		}
+		err = s.users.SetReferralCode(user.ID, code)
+		if errors.Is(err, repository.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to save referral code: %w", err)
+		}
+		user.ReferralCode = code
+		return code, nil
+	}
+	return "", fmt.Errorf("failed to find a free referral code")
 }
 
-func (s *UserService) UpdateSubscriptionStatus(userID string, status string) error {
-	return s.db.Model(&models.User{}).
-		Where("id = ?", userID).
-		Update("subscription_status", status).
-		Error
+// AddBonusTransactions gives the user free transactions on top of the trial's
+func (s *UserService) AddBonusTransactions(userID uuid.UUID, count int) error {
+	return s.users.AddBonusTransactions(userID, count)
+}
+
+// SetConversionVariant records the variant of the conversion message the user is shown
+func (s *UserService) SetConversionVariant(user *models.User, variant string) error {
+	if err := s.users.SetConversionVariant(user.ID, variant); err != nil {
+		return fmt.Errorf("failed to save conversion variant: %w", err)
+	}
+	user.ConversionVariant = variant
+	return nil
 }
 
 func (s *UserService) CanUserCreateTransaction(userID string) (bool, error) {
@@ -69,5 +130,20 @@ func (s *UserService) CanUserCreateTransaction(userID string) (bool, error) {
 		return false, err
 	}
 
-	return user.CanCreateTransaction(), nil
+	return user.CanCreateTransaction(s.plans.Trial.Transactions), nil
+}
+
+// RecordInbound stores when the user last sent us a message. Older timestamps
+// (out-of-order webhook deliveries) never move the window backwards.
+func (s *UserService) RecordInbound(phoneNumber string, at time.Time) error {
+	return s.users.RecordInbound(phoneNumber, at)
+}
+
+// LastInboundAt returns when the user last sent us a message, or nil if unknown
+func (s *UserService) LastInboundAt(phoneNumber string) (*time.Time, error) {
+	user, err := s.GetUserByPhoneNumber(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	return user.LastInboundAt, nil
 }
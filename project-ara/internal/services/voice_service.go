@@ -3,73 +3,403 @@ package services
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"project-ara/internal/models"
+)
+
+const defaultWhisperBaseURL = "https://api.openai.com/v1"
+
+var (
+	// ErrAudioTooLong is returned when an audio exceeds the configured size or duration
+	ErrAudioTooLong = errors.New("audio exceeds the allowed length")
+	// ErrUnsupportedAudioFormat is returned for formats Whisper can't read and we can't convert
+	ErrUnsupportedAudioFormat = errors.New("unsupported audio format")
 )
 
+// TranscriptionOptions tunes a single transcription request
+type TranscriptionOptions struct {
+	MimeType    string   // MIME type reported by WhatsApp, e.g. "audio/ogg; codecs=opus"
+	MediaSHA256 string   // Hash from the webhook; lets a cached transcript skip the download
+	Vocabulary  []string // Words the user commonly uses, sent to Whisper as a prompt
+}
+
+// TranscriptionResult is a transcript together with the cached artifact that holds it
+type TranscriptionResult struct {
+	Text        string
+	MediaSHA256 string
+	ArtifactID  *uuid.UUID
+	Cached      bool
+}
+
 type VoiceService struct {
-	openaiAPIKey string
+	openaiAPIKey       string
+	baseURL            string
+	model              string
+	language           string
+	maxBytes           int64
+	maxDurationSeconds int
+	httpClient         *http.Client
+	cache              *MediaCache
+	probeDuration      func(ctx context.Context, data []byte) time.Duration
 }
 
-func NewVoiceService() *VoiceService {
+func NewVoiceService(cache *MediaCache) *VoiceService {
+	baseURL := strings.TrimRight(os.Getenv("WHISPER_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = defaultWhisperBaseURL
+	}
+
+	model := os.Getenv("WHISPER_MODEL")
+	if model == "" {
+		model = "whisper-1"
+	}
+
+	timeout := 60 * time.Second
+	if seconds, err := strconv.Atoi(os.Getenv("VOICE_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	maxBytes := int64(5 * 1024 * 1024)
+	if value, err := strconv.ParseInt(os.Getenv("VOICE_MAX_BYTES"), 10, 64); err == nil && value > 0 {
+		maxBytes = value
+	}
+
+	maxDuration := 120
+	if value, err := strconv.Atoi(os.Getenv("VOICE_MAX_DURATION_SECONDS")); err == nil && value > 0 {
+		maxDuration = value
+	}
+
 	return &VoiceService{
-		openaiAPIKey: os.Getenv("OPENAI_API_KEY"),
+		openaiAPIKey:       os.Getenv("OPENAI_API_KEY"),
+		baseURL:            baseURL,
+		model:              model,
+		language:           "pt",
+		maxBytes:           maxBytes,
+		maxDurationSeconds: maxDuration,
+		httpClient:         &http.Client{Timeout: timeout},
+		cache:              cache,
+		probeDuration:      ffprobeDuration,
 	}
 }
 
+// MaxBytes returns the largest audio file accepted for transcription
+func (s *VoiceService) MaxBytes() int64 {
+	return s.maxBytes
+}
+
+// MaxDurationSeconds returns the longest audio accepted for transcription
+func (s *VoiceService) MaxDurationSeconds() int {
+	return s.maxDurationSeconds
+}
+
 // TranscribeAudio uses OpenAI Whisper API to transcribe audio from a URL
 func (s *VoiceService) TranscribeAudio(ctx context.Context, audioURL string) (string, error) {
-	if s.openaiAPIKey == "" {
-		return "", fmt.Errorf("OPENAI_API_KEY not set")
+	result, err := s.TranscribeAudioWithOptions(ctx, audioURL, TranscriptionOptions{})
+	if err != nil {
+		return "", err
 	}
+	return result.Text, nil
+}
 
-	// Download audio file
-	req, err := http.NewRequestWithContext(ctx, "GET", audioURL, nil)
+// TranscribeAudioWithOptions downloads audio from a URL and transcribes it,
+// answering from the media cache when the same audio was transcribed before
+func (s *VoiceService) TranscribeAudioWithOptions(ctx context.Context, audioURL string, opts TranscriptionOptions) (*TranscriptionResult, error) {
+	if result, err := s.cachedTranscript(opts.MediaSHA256); err != nil || result != nil {
+		return result, err
+	}
+
+	data, contentType, err := s.downloadAudio(ctx, audioURL)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+
+	if opts.MimeType == "" {
+		opts.MimeType = contentType
+	}
+
+	return s.TranscribeAudioData(ctx, data, opts)
+}
+
+// TranscribeAudioData transcribes audio that has already been downloaded
+func (s *VoiceService) TranscribeAudioData(ctx context.Context, data []byte, opts TranscriptionOptions) (*TranscriptionResult, error) {
+	if opts.MediaSHA256 == "" {
+		opts.MediaSHA256 = hashMedia(data)
+	}
+	if result, err := s.cachedTranscript(opts.MediaSHA256); err != nil || result != nil {
+		return result, err
+	}
+
+	text, err := s.transcribe(ctx, data, opts)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	result := &TranscriptionResult{Text: text, MediaSHA256: opts.MediaSHA256}
+	artifact, err := s.cache.Put(opts.MediaSHA256, models.MediaArtifactTranscript, s.provider(), s.model, text)
+	if err != nil {
+		return nil, err
+	}
+	if artifact != nil {
+		result.ArtifactID = &artifact.ID
+	}
+
+	return result, nil
+}
+
+func (s *VoiceService) cachedTranscript(mediaSHA256 string) (*TranscriptionResult, error) {
+	artifact, err := s.cache.Get(mediaSHA256, models.MediaArtifactTranscript, s.provider(), s.model)
+	if err != nil || artifact == nil {
+		return nil, err
+	}
+
+	var text string
+	if err := json.Unmarshal(artifact.Content, &text); err != nil {
+		return nil, fmt.Errorf("failed to decode cached transcript: %w", err)
+	}
+
+	return &TranscriptionResult{Text: text, MediaSHA256: mediaSHA256, ArtifactID: &artifact.ID, Cached: true}, nil
+}
+
+// provider identifies the transcription backend in cache keys
+func (s *VoiceService) provider() string {
+	if u, err := url.Parse(s.baseURL); err == nil && u.Host != "" {
+		return "whisper@" + u.Host
+	}
+	return "whisper@" + s.baseURL
+}
+
+func (s *VoiceService) transcribe(ctx context.Context, data []byte, opts TranscriptionOptions) (string, error) {
+	// A local Whisper server doesn't need the OpenAI key
+	if s.openaiAPIKey == "" && s.baseURL == defaultWhisperBaseURL {
+		return "", fmt.Errorf("OPENAI_API_KEY not set")
+	}
+
+	if int64(len(data)) > s.maxBytes {
+		return "", ErrAudioTooLong
+	}
+
+	mimeType := opts.MimeType
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	filename, needsConversion := audioFilename(mimeType)
+	if needsConversion {
+		converted, err := convertToOgg(ctx, data)
+		if err != nil {
+			return "", err
+		}
+		data, filename = converted, "audio.ogg"
+	}
+
+	// The duration is checked on what Whisper gets: Ogg/Opus, converted audio included, is
+	// read from its last page and other formats are measured with ffprobe
+	duration := estimateOggDuration(data)
+	if duration == 0 {
+		duration = s.probeDuration(ctx, data)
+	}
+	if duration > time.Duration(s.maxDurationSeconds)*time.Second {
+		return "", ErrAudioTooLong
 	}
-	defer resp.Body.Close()
 
 	// Prepare multipart form for Whisper API
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
-	part, err := writer.CreateFormFile("file", "audio.ogg")
+	part, err := writer.CreateFormFile("file", filename)
 	if err != nil {
 		return "", err
 	}
-	if _, err := io.Copy(part, resp.Body); err != nil {
+	if _, err := part.Write(data); err != nil {
 		return "", err
 	}
-	writer.WriteField("model", "whisper-1")
+	writer.WriteField("model", s.model)
+	writer.WriteField("language", s.language)
+	writer.WriteField("response_format", "json")
+	if prompt := buildTranscriptionPrompt(opts.Vocabulary); prompt != "" {
+		writer.WriteField("prompt", prompt)
+	}
 	writer.Close()
 
-	// Call OpenAI Whisper API
-	whisperReq, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/audio/transcriptions", &buf)
+	// Call Whisper API
+	whisperReq, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+"/audio/transcriptions", &buf)
 	if err != nil {
 		return "", err
 	}
-	whisperReq.Header.Set("Authorization", "Bearer "+s.openaiAPIKey)
+	if s.openaiAPIKey != "" {
+		whisperReq.Header.Set("Authorization", "Bearer "+s.openaiAPIKey)
+	}
 	whisperReq.Header.Set("Content-Type", writer.FormDataContentType())
 
-	whisperResp, err := http.DefaultClient.Do(whisperReq)
+	whisperResp, err := s.httpClient.Do(whisperReq)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to call transcription API: %w", err)
 	}
 	defer whisperResp.Body.Close()
 
+	if whisperResp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(whisperResp.Body, 512))
+		return "", fmt.Errorf("transcription API returned status %d: %s", whisperResp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
 	var result struct {
 		Text string `json:"text"`
 	}
 	if err := json.NewDecoder(whisperResp.Body).Decode(&result); err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to decode transcription response: %w", err)
 	}
-	return result.Text, nil
+	return strings.TrimSpace(result.Text), nil
+}
+
+// downloadAudio fetches the audio, refusing anything larger than the configured limit
+func (s *VoiceService) downloadAudio(ctx context.Context, audioURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", audioURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download audio: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("audio download returned status: %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > s.maxBytes {
+		return nil, "", ErrAudioTooLong
+	}
+
+	// Read one byte past the limit so oversized bodies without Content-Length are detected
+	data, err := io.ReadAll(io.LimitReader(resp.Body, s.maxBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read audio: %w", err)
+	}
+	if int64(len(data)) > s.maxBytes {
+		return nil, "", ErrAudioTooLong
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// audioFilename maps a MIME type to a filename Whisper recognizes, and reports
+// whether the format has to be converted first
+func audioFilename(mimeType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	}
+
+	switch mediaType {
+	case "audio/ogg", "audio/opus", "application/ogg":
+		return "audio.ogg", false
+	case "audio/mp4", "audio/m4a", "audio/x-m4a", "video/mp4":
+		return "audio.m4a", false
+	case "audio/mpeg", "audio/mp3":
+		return "audio.mp3", false
+	case "audio/wav", "audio/x-wav", "audio/wave":
+		return "audio.wav", false
+	case "audio/webm", "video/webm":
+		return "audio.webm", false
+	case "audio/amr", "audio/aac":
+		return "", true
+	default:
+		return "audio.ogg", false
+	}
+}
+
+// convertToOgg transcodes formats Whisper doesn't accept (AMR, raw AAC) using ffmpeg
+func convertToOgg(ctx context.Context, data []byte) ([]byte, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, ErrUnsupportedAudioFormat
+	}
+
+	cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-c:a", "libopus", "-f", "ogg", "pipe:1")
+	cmd.Stdin = bytes.NewReader(data)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to convert audio: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// estimateOggDuration reads the granule position of the last Ogg page of an
+// Opus stream. It returns 0 when the data isn't Ogg/Opus.
+func estimateOggDuration(data []byte) time.Duration {
+	if len(data) < 64 || !bytes.HasPrefix(data, []byte("OggS")) || !bytes.Contains(data[:64], []byte("OpusHead")) {
+		return 0
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || last+14 > len(data) {
+		return 0
+	}
+
+	granule := int64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+	if granule <= 0 {
+		return 0
+	}
+
+	// Opus granule positions are always expressed in 48 kHz samples
+	return time.Duration(granule) * time.Second / 48000
+}
+
+// ffprobeDuration measures audio in any format ffprobe reads. It returns 0 when ffprobe
+// isn't installed or can't tell the duration, leaving VOICE_MAX_BYTES as the only limit.
+func ffprobeDuration(ctx context.Context, data []byte) time.Duration {
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0
+	}
+
+	// MP4 containers may keep their index at the end, which ffprobe can't seek to on a pipe
+	file, err := os.CreateTemp("", "voice-*")
+	if err != nil {
+		return 0
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err != nil || closeErr != nil {
+		return 0
+	}
+
+	out, err := exec.CommandContext(ctx, ffprobe, "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", file.Name()).Output()
+	if err != nil {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// buildTranscriptionPrompt primes Whisper with the user's usual vocabulary
+func buildTranscriptionPrompt(vocabulary []string) string {
+	if len(vocabulary) == 0 {
+		return ""
+	}
+	if len(vocabulary) > 30 {
+		vocabulary = vocabulary[:30]
+	}
+	return "Registro de vendas e despesas de um microempreendedor. Termos comuns: " + strings.Join(vocabulary, ", ") + "."
 }
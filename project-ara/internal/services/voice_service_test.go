@@ -0,0 +1,126 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// oggOpus builds a minimal two-page Ogg/Opus stream ending at the given duration
+func oggOpus(duration time.Duration) []byte {
+	page := func(granule int64, payload string) []byte {
+		header := make([]byte, 27)
+		copy(header, "OggS")
+		binary.LittleEndian.PutUint64(header[6:14], uint64(granule))
+		return append(header, payload...)
+	}
+	data := page(0, "OpusHead")
+	data = append(data, make([]byte, 64)...)
+	return append(data, page(int64(duration/time.Second)*48000, "audio")...)
+}
+
+func TestAudioFilename(t *testing.T) {
+	name, convert := audioFilename("audio/ogg; codecs=opus")
+	assert.Equal(t, "audio.ogg", name)
+	assert.False(t, convert)
+
+	name, _ = audioFilename("audio/mp4")
+	assert.Equal(t, "audio.m4a", name)
+
+	_, convert = audioFilename("audio/amr")
+	assert.True(t, convert)
+}
+
+func TestEstimateOggDuration(t *testing.T) {
+	assert.Equal(t, 90*time.Second, estimateOggDuration(oggOpus(90*time.Second)))
+	assert.Equal(t, time.Duration(0), estimateOggDuration([]byte("not an ogg file")))
+}
+
+func TestTranscribeAudioDataWithLocalServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/audio/transcriptions", r.URL.Path)
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		assert.Equal(t, "pt", r.FormValue("language"))
+		assert.Contains(t, r.FormValue("prompt"), "cachorro-quente")
+		_, header, err := r.FormFile("file")
+		require.NoError(t, err)
+		assert.Equal(t, "audio.ogg", header.Filename)
+		w.Write([]byte(`{"text":" vendi dois cachorros-quentes "}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("WHISPER_BASE_URL", server.URL+"/v1")
+	t.Setenv("OPENAI_API_KEY", "")
+	s := NewVoiceService(nil)
+
+	result, err := s.TranscribeAudioData(context.Background(), oggOpus(10*time.Second), TranscriptionOptions{
+		MimeType:   "audio/ogg; codecs=opus",
+		Vocabulary: []string{"cachorro-quente"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "vendi dois cachorros-quentes", result.Text)
+
+	_, err = s.TranscribeAudioData(context.Background(), oggOpus(10*time.Minute), TranscriptionOptions{})
+	assert.ErrorIs(t, err, ErrAudioTooLong)
+}
+
+// wavSilence builds a mono 8 kHz 8-bit WAV file of the given duration
+func wavSilence(duration time.Duration) []byte {
+	samples := int(duration / time.Second * 8000)
+	header := make([]byte, 44)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+samples))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[22:], 1)
+	binary.LittleEndian.PutUint32(header[24:], 8000)
+	binary.LittleEndian.PutUint32(header[28:], 8000)
+	binary.LittleEndian.PutUint16(header[32:], 1)
+	binary.LittleEndian.PutUint16(header[34:], 8)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(samples))
+	return append(header, bytes.Repeat([]byte{128}, samples)...)
+}
+
+func TestLongAudioInOtherFormatsIsRefused(t *testing.T) {
+	transcribed := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transcribed++
+		w.Write([]byte(`{"text":"vendi um bolo"}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("WHISPER_BASE_URL", server.URL+"/v1")
+	t.Setenv("OPENAI_API_KEY", "")
+	s := NewVoiceService(nil)
+	probed := map[string]time.Duration{"short mp3": 30 * time.Second, "long mp3": 10 * time.Minute}
+	s.probeDuration = func(ctx context.Context, data []byte) time.Duration {
+		return probed[string(data)]
+	}
+
+	_, err := s.TranscribeAudioData(context.Background(), []byte("long mp3"), TranscriptionOptions{MimeType: "audio/mpeg"})
+	assert.ErrorIs(t, err, ErrAudioTooLong)
+	assert.Zero(t, transcribed)
+
+	result, err := s.TranscribeAudioData(context.Background(), []byte("short mp3"), TranscriptionOptions{MimeType: "audio/mpeg"})
+	require.NoError(t, err)
+	assert.Equal(t, "vendi um bolo", result.Text)
+	assert.Equal(t, 1, transcribed)
+}
+
+func TestFFprobeDuration(t *testing.T) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		t.Skip("ffprobe not installed")
+	}
+	assert.InDelta(t, float64(3*time.Minute), float64(ffprobeDuration(context.Background(), wavSilence(3*time.Minute))), float64(time.Second))
+	assert.Equal(t, time.Duration(0), ffprobeDuration(context.Background(), []byte("not audio")))
+}
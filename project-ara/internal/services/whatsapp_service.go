@@ -2,12 +2,52 @@ package services
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+var (
+	// ErrMediaTooLarge is returned when a media file exceeds the allowed download size
+	ErrMediaTooLarge = errors.New("media exceeds the allowed size")
+	// ErrOutsideServiceWindow is returned when a free-form message is sent more than
+	// 24 hours after the user's last message; a template must be used instead
+	ErrOutsideServiceWindow = errors.New("outside the 24-hour customer service window")
+)
+
+// WhatsAppAPIError is a non-2xx response from the Graph API
+type WhatsAppAPIError struct {
+	StatusCode int
+	Code       int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *WhatsAppAPIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("WhatsApp API returned status %d: %s (code %d)", e.StatusCode, e.Message, e.Code)
+	}
+	return fmt.Sprintf("WhatsApp API returned status: %d", e.StatusCode)
+}
+
+// Temporary reports whether the request may succeed if retried later
+func (e *WhatsAppAPIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
 // WhatsAppMessage represents a message from WhatsApp
 type WhatsAppMessage struct {
 	Object string `json:"object"`
@@ -26,95 +66,691 @@ type WhatsAppMessage struct {
 					} `json:"profile"`
 					WaID string `json:"wa_id"`
 				} `json:"contacts"`
-				Messages []struct {
-					From      string `json:"from"`
-					ID        string `json:"id"`
-					Timestamp string `json:"timestamp"`
-					Type      string `json:"type"`
-					Text      struct {
-						Body string `json:"body"`
-					} `json:"text,omitempty"`
-					Audio struct {
-						ID       string `json:"id"`
-						MimeType string `json:"mime_type"`
-					} `json:"audio,omitempty"`
-					Image struct {
-						ID       string `json:"id"`
-						MimeType string `json:"mime_type"`
-						SHA256   string `json:"sha256"`
-					} `json:"image,omitempty"`
-				} `json:"messages"`
+				Messages []WhatsAppInboundMessage `json:"messages"`
+				Statuses []WhatsAppStatus         `json:"statuses"`
 			} `json:"value"`
 			Field string `json:"field"`
 		} `json:"changes"`
 	} `json:"entry"`
 }
 
+// WhatsAppInboundMessage is a single message received through the webhook
+type WhatsAppInboundMessage struct {
+	From      string `json:"from"`
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"`
+	Text      struct {
+		Body string `json:"body"`
+	} `json:"text,omitempty"`
+	Audio struct {
+		ID       string `json:"id"`
+		MimeType string `json:"mime_type"`
+		SHA256   string `json:"sha256"`
+	} `json:"audio,omitempty"`
+	Image struct {
+		ID       string `json:"id"`
+		MimeType string `json:"mime_type"`
+		SHA256   string `json:"sha256"`
+		Caption  string `json:"caption"`
+	} `json:"image,omitempty"`
+	Interactive struct {
+		Type        string `json:"type"`
+		ButtonReply struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		} `json:"button_reply"`
+		ListReply struct {
+			ID          string `json:"id"`
+			Title       string `json:"title"`
+			Description string `json:"description"`
+		} `json:"list_reply"`
+	} `json:"interactive,omitempty"`
+	Button struct {
+		Payload string `json:"payload"`
+		Text    string `json:"text"`
+	} `json:"button,omitempty"`
+	Context struct {
+		From string `json:"from"`
+		ID   string `json:"id"` // wamid of the message being replied to
+	} `json:"context,omitempty"`
+}
+
+// ReplyID returns the ID of the tapped button or list row, or "" for other messages
+func (m *WhatsAppInboundMessage) ReplyID() string {
+	switch m.Type {
+	case "interactive":
+		if m.Interactive.Type == "list_reply" {
+			return m.Interactive.ListReply.ID
+		}
+		return m.Interactive.ButtonReply.ID
+	case "button":
+		return m.Button.Payload
+	}
+	return ""
+}
+
+// ToInbound converts a webhook message to the channel-neutral model
+func (m *WhatsAppInboundMessage) ToInbound() InboundMessage {
+	inbound := InboundMessage{
+		Channel:    ChannelWhatsApp,
+		From:       m.From,
+		ID:         m.ID,
+		ReceivedAt: time.Now(),
+		ReplyTo:    m.Context.ID,
+	}
+	if seconds, err := strconv.ParseInt(m.Timestamp, 10, 64); err == nil {
+		inbound.ReceivedAt = time.Unix(seconds, 0)
+	}
+
+	switch m.Type {
+	case "text":
+		inbound.Type = InboundText
+		inbound.Text = m.Text.Body
+	case "audio":
+		inbound.Type = InboundAudio
+		inbound.Media = &MediaRef{ID: m.Audio.ID, MimeType: m.Audio.MimeType, SHA256: m.Audio.SHA256}
+	case "image":
+		inbound.Type = InboundImage
+		inbound.Text = m.Image.Caption
+		inbound.Media = &MediaRef{ID: m.Image.ID, MimeType: m.Image.MimeType, SHA256: m.Image.SHA256}
+	case "interactive", "button":
+		inbound.Type = InboundInteractive
+		inbound.ReplyID = m.ReplyID()
+	default:
+		inbound.Type = InboundUnsupported
+	}
+
+	return inbound
+}
+
+// WhatsAppStatus is a delivery receipt for a message we sent (sent, delivered, read or failed)
+type WhatsAppStatus struct {
+	ID          string `json:"id"` // wamid of the outgoing message
+	Status      string `json:"status"`
+	Timestamp   string `json:"timestamp"`
+	RecipientID string `json:"recipient_id"`
+	Errors      []struct {
+		Code    int    `json:"code"`
+		Title   string `json:"title"`
+		Message string `json:"message"`
+	} `json:"errors,omitempty"`
+}
+
+// At returns when the status change happened, or now if the timestamp is missing
+func (s *WhatsAppStatus) At() time.Time {
+	if seconds, err := strconv.ParseInt(s.Timestamp, 10, 64); err == nil {
+		return time.Unix(seconds, 0)
+	}
+	return time.Now()
+}
+
+// ErrorDetail summarizes the errors WhatsApp attached to a failed status
+func (s *WhatsAppStatus) ErrorDetail() string {
+	details := make([]string, len(s.Errors))
+	for i, e := range s.Errors {
+		details[i] = fmt.Sprintf("%d %s", e.Code, e.Title)
+	}
+	return strings.Join(details, "; ")
+}
+
 // WhatsAppResponse represents a response to WhatsApp
 type WhatsAppResponse struct {
-	MessagingProduct string `json:"messaging_product"`
-	RecipientType    string `json:"recipient_type"`
-	To               string `json:"to"`
-	Type             string `json:"type"`
-	Text             struct {
-		Body string `json:"body"`
-	} `json:"text"`
+	MessagingProduct string                `json:"messaging_product"`
+	RecipientType    string                `json:"recipient_type"`
+	To               string                `json:"to"`
+	Type             string                `json:"type"`
+	Text             *WhatsAppText         `json:"text,omitempty"`
+	Image            *WhatsAppMediaMessage `json:"image,omitempty"`
+	Interactive      *WhatsAppInteractive  `json:"interactive,omitempty"`
+	Template         *WhatsAppTemplateBody `json:"template,omitempty"`
+	Context          *WhatsAppContext      `json:"context,omitempty"`
+}
+
+// WhatsAppContext makes an outgoing message quote an earlier one
+type WhatsAppContext struct {
+	MessageID string `json:"message_id"`
+}
+
+// WhatsAppTemplateBody references an approved template in an outgoing message
+type WhatsAppTemplateBody struct {
+	Name     string `json:"name"`
+	Language struct {
+		Code string `json:"code"`
+	} `json:"language"`
+	Components []WhatsAppTemplateComponent `json:"components,omitempty"`
+}
+
+type WhatsAppTemplateComponent struct {
+	Type       string                      `json:"type"`
+	Parameters []WhatsAppTemplateParameter `json:"parameters"`
+}
+
+type WhatsAppTemplateParameter struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type WhatsAppText struct {
+	Body string `json:"body"`
+}
+
+// WhatsAppMediaMessage references previously uploaded media in an outgoing message
+type WhatsAppMediaMessage struct {
+	ID      string `json:"id"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// WhatsAppInteractive is a reply-button or list message
+type WhatsAppInteractive struct {
+	Type   string                    `json:"type"` // "button" or "list"
+	Header *WhatsAppText             `json:"header,omitempty"`
+	Body   WhatsAppText              `json:"body"`
+	Footer *WhatsAppText             `json:"footer,omitempty"`
+	Action WhatsAppInteractiveAction `json:"action"`
+}
+
+type WhatsAppInteractiveAction struct {
+	Button   string                `json:"button,omitempty"` // List menu button label
+	Buttons  []WhatsAppReplyButton `json:"buttons,omitempty"`
+	Sections []WhatsAppListSection `json:"sections,omitempty"`
+}
+
+type WhatsAppReplyButton struct {
+	Type  string `json:"type"` // always "reply"
+	Reply struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"reply"`
+}
+
+type WhatsAppListSection struct {
+	Title string            `json:"title,omitempty"`
+	Rows  []WhatsAppListRow `json:"rows"`
+}
+
+type WhatsAppListRow struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+}
+
+// WhatsApp limits for interactive messages
+const (
+	maxReplyButtons     = 3
+	maxButtonTitleRunes = 20
+	maxListRows         = 10
+	maxListTitleRunes   = 24
+)
+
+// customerServiceWindow is how long after the user's last message WhatsApp allows free-form replies
+const customerServiceWindow = 24 * time.Hour
+
+// ConversationWindowStore remembers when each phone number last wrote to us
+type ConversationWindowStore interface {
+	RecordInbound(phoneNumber string, at time.Time) error
+	LastInboundAt(phoneNumber string) (*time.Time, error)
 }
 
 type WhatsAppService struct {
 	accessToken   string
+	appSecret     string
 	phoneNumberID string
 	apiVersion    string
+	baseURL       string
+	windows       ConversationWindowStore
+	templates     *TemplateRegistry
+	outbox        *OutboundQueue
+	client        *http.Client
 }
 
-func NewWhatsAppService() *WhatsAppService {
+// NewWhatsAppService creates the WhatsApp client. With an outbox, messages are queued and
+// delivered by the OutboundSender; without one they are sent synchronously.
+func NewWhatsAppService(windows ConversationWindowStore, templates *TemplateRegistry, outbox *OutboundQueue) *WhatsAppService {
+	baseURL := strings.TrimRight(os.Getenv("WHATSAPP_API_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "https://graph.facebook.com"
+	}
+
 	return &WhatsAppService{
 		accessToken:   os.Getenv("WHATSAPP_ACCESS_TOKEN"),
+		appSecret:     os.Getenv("WHATSAPP_APP_SECRET"),
 		phoneNumberID: os.Getenv("WHATSAPP_PHONE_NUMBER_ID"),
 		apiVersion:    "v18.0",
+		baseURL:       baseURL,
+		windows:       windows,
+		templates:     templates,
+		outbox:        outbox,
+		client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// RecordInbound notes that the user just wrote to us, opening the customer service window
+func (w *WhatsAppService) RecordInbound(phoneNumber string, at time.Time) error {
+	if w.windows == nil {
+		return nil
+	}
+	return w.windows.RecordInbound(phoneNumber, at)
+}
+
+// IsWindowOpen reports whether free-form messages can be sent to the number right now
+func (w *WhatsAppService) IsWindowOpen(phoneNumber string) bool {
+	if w.windows == nil {
+		return true
+	}
+
+	lastInbound, err := w.windows.LastInboundAt(phoneNumber)
+	if err != nil {
+		// Let WhatsApp decide rather than dropping the message
+		return true
+	}
+	return lastInbound != nil && time.Since(*lastInbound) < customerServiceWindow
+}
+
+// SendTemplate sends an approved template message, which WhatsApp delivers even
+// outside the customer service window
+func (w *WhatsAppService) SendTemplate(to, name string, params map[string]string) error {
+	if w.templates == nil {
+		return fmt.Errorf("no WhatsApp template registry configured")
+	}
+
+	template, err := w.templates.Get(name)
+	if err != nil {
+		return err
+	}
+
+	values, err := template.BodyParameters(params)
+	if err != nil {
+		return err
+	}
+
+	body := &WhatsAppTemplateBody{Name: template.Name}
+	body.Language.Code = template.Language
+	if len(values) > 0 {
+		parameters := make([]WhatsAppTemplateParameter, len(values))
+		for i, value := range values {
+			parameters[i] = WhatsAppTemplateParameter{Type: "text", Text: value}
+		}
+		body.Components = []WhatsAppTemplateComponent{{Type: "body", Parameters: parameters}}
+	}
+
+	return w.send(WhatsAppResponse{
+		MessagingProduct: "whatsapp",
+		RecipientType:    "individual",
+		To:               to,
+		Type:             "template",
+		Template:         body,
+	})
+}
+
+// SendNotification sends a proactive message: the template's free-text version while
+// the customer service window is open, the approved template otherwise
+func (w *WhatsAppService) SendNotification(to, templateName string, params map[string]string) error {
+	if w.templates == nil {
+		return fmt.Errorf("no WhatsApp template registry configured")
+	}
+
+	template, err := w.templates.Get(templateName)
+	if err != nil {
+		return err
+	}
+
+	if w.IsWindowOpen(to) {
+		return w.SendMessage(to, template.RenderFallback(params))
 	}
+	return w.SendTemplate(to, templateName, params)
+}
+
+// Name identifies the WhatsApp channel
+func (w *WhatsAppService) Name() string {
+	return ChannelWhatsApp
+}
+
+// Send delivers a channel-neutral message as the matching WhatsApp message type
+func (w *WhatsAppService) Send(ctx context.Context, message OutgoingMessage) error {
+	var response WhatsAppResponse
+	var err error
+	switch {
+	case message.Image != nil:
+		response, err = w.imageMessage(message.To, message.Image.Data, message.Image.MimeType, message.Text)
+	case message.List != nil:
+		response, err = listMessage(message.To, message.Text, message.List.ButtonLabel, message.List.Sections)
+	case len(message.Buttons) > 0:
+		response, err = buttonsMessage(message.To, message.Text, message.Buttons)
+	default:
+		response = textMessage(message.To, message.Text)
+	}
+	if err != nil {
+		return err
+	}
+
+	if message.ReplyTo != "" {
+		response.Context = &WhatsAppContext{MessageID: message.ReplyTo}
+	}
+	return w.send(response)
 }
 
 func (w *WhatsAppService) SendMessage(to, message string) error {
-	url := fmt.Sprintf("https://graph.facebook.com/%s/%s/messages", w.apiVersion, w.phoneNumberID)
+	return w.send(textMessage(to, message))
+}
 
-	response := WhatsAppResponse{
+// SendButtons sends a message with up to three reply buttons
+func (w *WhatsAppService) SendButtons(to, body string, buttons []Button) error {
+	response, err := buttonsMessage(to, body, buttons)
+	if err != nil {
+		return err
+	}
+	return w.send(response)
+}
+
+// SendList sends a list menu; buttonLabel is the text of the button that opens it
+func (w *WhatsAppService) SendList(to, body, buttonLabel string, sections []ListSection) error {
+	response, err := listMessage(to, body, buttonLabel, sections)
+	if err != nil {
+		return err
+	}
+	return w.send(response)
+}
+
+// SendImage uploads an image and sends it to the user with an optional caption
+func (w *WhatsAppService) SendImage(to string, data []byte, mimeType, caption string) error {
+	response, err := w.imageMessage(to, data, mimeType, caption)
+	if err != nil {
+		return err
+	}
+	return w.send(response)
+}
+
+func textMessage(to, body string) WhatsAppResponse {
+	return WhatsAppResponse{
 		MessagingProduct: "whatsapp",
 		RecipientType:    "individual",
 		To:               to,
 		Type:             "text",
-		Text: struct {
-			Body string `json:"body"`
-		}{
-			Body: message,
+		Text:             &WhatsAppText{Body: body},
+	}
+}
+
+func buttonsMessage(to, body string, buttons []Button) (WhatsAppResponse, error) {
+	if len(buttons) == 0 || len(buttons) > maxReplyButtons {
+		return WhatsAppResponse{}, fmt.Errorf("reply messages need 1 to %d buttons, got %d", maxReplyButtons, len(buttons))
+	}
+
+	replyButtons := make([]WhatsAppReplyButton, len(buttons))
+	for i, button := range buttons {
+		if utf8.RuneCountInString(button.Title) > maxButtonTitleRunes {
+			return WhatsAppResponse{}, fmt.Errorf("button title %q is longer than %d characters", button.Title, maxButtonTitleRunes)
+		}
+		replyButtons[i].Type = "reply"
+		replyButtons[i].Reply.ID = button.ID
+		replyButtons[i].Reply.Title = button.Title
+	}
+
+	return WhatsAppResponse{
+		MessagingProduct: "whatsapp",
+		RecipientType:    "individual",
+		To:               to,
+		Type:             "interactive",
+		Interactive: &WhatsAppInteractive{
+			Type:   "button",
+			Body:   WhatsAppText{Body: body},
+			Action: WhatsAppInteractiveAction{Buttons: replyButtons},
 		},
+	}, nil
+}
+
+func listMessage(to, body, buttonLabel string, sections []ListSection) (WhatsAppResponse, error) {
+	rows := 0
+	listSections := make([]WhatsAppListSection, len(sections))
+	for i, section := range sections {
+		listSections[i].Title = section.Title
+		for _, row := range section.Rows {
+			if utf8.RuneCountInString(row.Title) > maxListTitleRunes {
+				return WhatsAppResponse{}, fmt.Errorf("list row title %q is longer than %d characters", row.Title, maxListTitleRunes)
+			}
+			listSections[i].Rows = append(listSections[i].Rows, WhatsAppListRow{ID: row.ID, Title: row.Title, Description: row.Description})
+			rows++
+		}
+	}
+	if rows == 0 || rows > maxListRows {
+		return WhatsAppResponse{}, fmt.Errorf("list messages need 1 to %d rows, got %d", maxListRows, rows)
+	}
+
+	return WhatsAppResponse{
+		MessagingProduct: "whatsapp",
+		RecipientType:    "individual",
+		To:               to,
+		Type:             "interactive",
+		Interactive: &WhatsAppInteractive{
+			Type:   "list",
+			Body:   WhatsAppText{Body: body},
+			Action: WhatsAppInteractiveAction{Button: buttonLabel, Sections: listSections},
+		},
+	}, nil
+}
+
+func (w *WhatsAppService) imageMessage(to string, data []byte, mimeType, caption string) (WhatsAppResponse, error) {
+	mediaID, err := w.UploadMedia(data, mimeType)
+	if err != nil {
+		return WhatsAppResponse{}, err
+	}
+
+	return WhatsAppResponse{
+		MessagingProduct: "whatsapp",
+		RecipientType:    "individual",
+		To:               to,
+		Type:             "image",
+		Image:            &WhatsAppMediaMessage{ID: mediaID, Caption: caption},
+	}, nil
+}
+
+func (w *WhatsAppService) send(response WhatsAppResponse) error {
+	if response.Type != "template" && !w.IsWindowOpen(response.To) {
+		return ErrOutsideServiceWindow
+	}
+
+	if w.outbox != nil {
+		return w.outbox.Enqueue(response)
 	}
 
+	_, err := w.deliver(context.Background(), response)
+	return err
+}
+
+// deliver posts a message to the Graph API and returns its wamid
+func (w *WhatsAppService) deliver(ctx context.Context, response WhatsAppResponse) (string, error) {
+	url := fmt.Sprintf("%s/%s/%s/messages", w.baseURL, w.apiVersion, w.phoneNumberID)
+
 	jsonData, err := json.Marshal(response)
 	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+		return "", fmt.Errorf("failed to marshal response: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+w.accessToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &WhatsAppAPIError{StatusCode: resp.StatusCode}
+		var errorBody struct {
+			Error struct {
+				Message string `json:"message"`
+				Code    int    `json:"code"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(body, &errorBody) == nil {
+			apiErr.Message = errorBody.Error.Message
+			apiErr.Code = errorBody.Error.Code
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return "", apiErr
+	}
+
+	var result struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+	}
+	// The message was accepted either way; a missing ID only means we can't track receipts
+	if err := json.Unmarshal(body, &result); err != nil || len(result.Messages) == 0 {
+		return "", nil
+	}
+
+	return result.Messages[0].ID, nil
+}
+
+// RecordStatus updates the outbox with a delivery receipt from the webhook
+func (w *WhatsAppService) RecordStatus(status WhatsAppStatus) error {
+	if w.outbox == nil {
+		return nil
+	}
+	return w.outbox.ApplyStatus(status)
+}
+
+// DownloadMedia resolves a media ID from a webhook to its temporary URL and downloads it
+func (w *WhatsAppService) DownloadMedia(ctx context.Context, mediaID string, maxBytes int64) (*Media, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%s/%s", w.baseURL, w.apiVersion, mediaID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+w.accessToken)
+
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to get media URL: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("WhatsApp API returned status: %d", resp.StatusCode)
+		return nil, fmt.Errorf("WhatsApp media lookup returned status: %d", resp.StatusCode)
+	}
+
+	var info struct {
+		URL      string `json:"url"`
+		MimeType string `json:"mime_type"`
+		SHA256   string `json:"sha256"`
+		FileSize int64  `json:"file_size"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode media info: %w", err)
 	}
+	if maxBytes > 0 && info.FileSize > maxBytes {
+		return nil, ErrMediaTooLarge
+	}
+
+	// The media URL also requires the access token
+	mediaReq, err := http.NewRequestWithContext(ctx, "GET", info.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	mediaReq.Header.Set("Authorization", "Bearer "+w.accessToken)
+
+	mediaResp, err := client.Do(mediaReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download media: %w", err)
+	}
+	defer mediaResp.Body.Close()
+
+	if mediaResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("WhatsApp media download returned status: %d", mediaResp.StatusCode)
+	}
+
+	reader := io.Reader(mediaResp.Body)
+	if maxBytes > 0 {
+		reader = io.LimitReader(mediaResp.Body, maxBytes+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media: %w", err)
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, ErrMediaTooLarge
+	}
+
+	return &Media{Data: data, MimeType: info.MimeType, SHA256: info.SHA256}, nil
+}
 
-	return nil
+// UploadMedia uploads a file to WhatsApp so it can be referenced in outgoing messages
+func (w *WhatsAppService) UploadMedia(data []byte, mimeType string) (string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("messaging_product", "whatsapp")
+	writer.WriteField("type", mimeType)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="media"`)
+	header.Set("Content-Type", mimeType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload form: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", fmt.Errorf("failed to write upload form: %w", err)
+	}
+	writer.Close()
+
+	url := fmt.Sprintf("%s/%s/%s/media", w.baseURL, w.apiVersion, w.phoneNumberID)
+	req, err := http.NewRequest("POST", url, &buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+w.accessToken)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("WhatsApp media upload returned status: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode upload response: %w", err)
+	}
+
+	return result.ID, nil
+}
+
+// VerifySignature checks the X-Hub-Signature-256 header Meta computes over the webhook
+// body with the app secret. Without WHATSAPP_APP_SECRET every request is accepted.
+func (w *WhatsAppService) VerifySignature(body []byte, signature string) bool {
+	if w.appSecret == "" {
+		return true
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(w.appSecret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
 }
 
 func (w *WhatsAppService) ParseWebhook(body []byte) (*WhatsAppMessage, error) {
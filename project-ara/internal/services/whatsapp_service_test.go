@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryWindows map[string]time.Time
+
+func (m memoryWindows) RecordInbound(phoneNumber string, at time.Time) error {
+	m[phoneNumber] = at
+	return nil
+}
+
+func (m memoryWindows) LastInboundAt(phoneNumber string) (*time.Time, error) {
+	if at, ok := m[phoneNumber]; ok {
+		return &at, nil
+	}
+	return nil, nil
+}
+
+func TestSendNotificationPicksSessionOrTemplate(t *testing.T) {
+	var sent []WhatsAppResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response WhatsAppResponse
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&response))
+		sent = append(sent, response)
+		w.Write([]byte(`{"messages":[{"id":"wamid.test"}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("WHATSAPP_API_BASE_URL", server.URL)
+
+	templates, err := LoadTemplateRegistry("")
+	require.NoError(t, err)
+	windows := memoryWindows{}
+	w := NewWhatsAppService(windows, templates, nil)
+
+	params := map[string]string{"expires_at": "10/11/2026", "link": "https://ara.app/renovar"}
+
+	// Never wrote to us: template
+	require.NoError(t, w.SendNotification("5511999999999", "subscription_renewal", params))
+	require.Len(t, sent, 1)
+	assert.Equal(t, "template", sent[0].Type)
+	assert.Equal(t, "subscription_renewal", sent[0].Template.Name)
+	assert.Equal(t, "10/11/2026", sent[0].Template.Components[0].Parameters[0].Text)
+	assert.ErrorIs(t, w.SendMessage("5511999999999", "oi"), ErrOutsideServiceWindow)
+
+	// Wrote an hour ago: free-text session message
+	require.NoError(t, w.RecordInbound("5511999999999", time.Now().Add(-time.Hour)))
+	require.NoError(t, w.SendNotification("5511999999999", "subscription_renewal", params))
+	require.Len(t, sent, 2)
+	assert.Equal(t, "text", sent[1].Type)
+	assert.Contains(t, sent[1].Text.Body, "https://ara.app/renovar")
+
+	assert.Error(t, w.SendTemplate("5511999999999", "subscription_renewal", map[string]string{}))
+}
+
+func TestDeliverReturnsWAMIDAndClassifiesErrors(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":{"message":"Rate limit hit","code":130429}}`))
+			return
+		}
+		w.Write([]byte(`{"messages":[{"id":"wamid.abc"}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("WHATSAPP_API_BASE_URL", server.URL)
+
+	w := NewWhatsAppService(nil, nil, nil)
+	message := WhatsAppResponse{MessagingProduct: "whatsapp", To: "5511999999999", Type: "text", Text: &WhatsAppText{Body: "oi"}}
+
+	wamid, err := w.deliver(context.Background(), message)
+	require.NoError(t, err)
+	assert.Equal(t, "wamid.abc", wamid)
+
+	var apiErr *WhatsAppAPIError
+	status = http.StatusTooManyRequests
+	_, err = w.deliver(context.Background(), message)
+	require.ErrorAs(t, err, &apiErr)
+	assert.True(t, apiErr.Temporary())
+	assert.Equal(t, 130429, apiErr.Code)
+	assert.Equal(t, 30*time.Second, apiErr.RetryAfter)
+
+	status = http.StatusBadGateway
+	_, err = w.deliver(context.Background(), message)
+	require.ErrorAs(t, err, &apiErr)
+	assert.True(t, apiErr.Temporary())
+
+	status = http.StatusBadRequest
+	_, err = w.deliver(context.Background(), message)
+	require.ErrorAs(t, err, &apiErr)
+	assert.False(t, apiErr.Temporary())
+}
+
+func TestTemplateParametersAreSentOnOneLine(t *testing.T) {
+	var sent WhatsAppResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&sent))
+		w.Write([]byte(`{"messages":[{"id":"wamid.test"}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("WHATSAPP_API_BASE_URL", server.URL)
+
+	templates, err := LoadTemplateRegistry("")
+	require.NoError(t, err)
+	w := NewWhatsAppService(memoryWindows{}, templates, nil)
+
+	summary := "📊 *Resumo de hoje*\n\n💰 Vendas:\tR$ 120,00\r\n💸 Gastos:     R$ 35,50\n"
+	require.NoError(t, w.SendNotification("5511999999999", "daily_summary", map[string]string{"summary": summary}))
+	require.Equal(t, "template", sent.Type)
+	assert.Equal(t, "📊 *Resumo de hoje* · 💰 Vendas: R$ 120,00 · 💸 Gastos: R$ 35,50", sent.Template.Components[0].Parameters[0].Text)
+
+	// The free-text version keeps the lines
+	require.NoError(t, w.RecordInbound("5511999999999", time.Now()))
+	require.NoError(t, w.SendNotification("5511999999999", "daily_summary", map[string]string{"summary": summary}))
+	require.Equal(t, "text", sent.Type)
+	assert.Equal(t, summary, sent.Text.Body)
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//go:embed whatsapp_templates.json
+var defaultWhatsAppTemplates []byte
+
+// WhatsAppTemplate mirrors a message template approved in WhatsApp Manager. Fallback is
+// the equivalent free-text message sent instead while the customer service window is open.
+type WhatsAppTemplate struct {
+	Name       string   `json:"name"`
+	Language   string   `json:"language"`
+	Category   string   `json:"category"`
+	Parameters []string `json:"parameters"` // Body parameter names, in {{1}}, {{2}}... order
+	Fallback   string   `json:"fallback"`   // Uses {{name}} placeholders
+}
+
+// TemplateRegistry is the local catalog of approved templates
+type TemplateRegistry struct {
+	templates map[string]WhatsAppTemplate
+}
+
+// LoadTemplateRegistry loads the templates from path, or the built-in ones when path is empty
+func LoadTemplateRegistry(path string) (*TemplateRegistry, error) {
+	data := defaultWhatsAppTemplates
+	if path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read templates file: %w", err)
+		}
+		data = fileData
+	}
+
+	var templates []WhatsAppTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+
+	registry := &TemplateRegistry{templates: make(map[string]WhatsAppTemplate, len(templates))}
+	for _, template := range templates {
+		if template.Name == "" {
+			return nil, fmt.Errorf("template without name")
+		}
+		if template.Language == "" {
+			template.Language = "pt_BR"
+		}
+		registry.templates[template.Name] = template
+	}
+
+	return registry, nil
+}
+
+// Get returns a template by name
+func (r *TemplateRegistry) Get(name string) (WhatsAppTemplate, error) {
+	template, ok := r.templates[name]
+	if !ok {
+		return WhatsAppTemplate{}, fmt.Errorf("unknown WhatsApp template: %s", name)
+	}
+	return template, nil
+}
+
+// BodyParameters returns the parameter values in template order, failing on missing ones.
+// The Cloud API rejects parameters with newlines, tabs or runs of spaces, so each value is
+// flattened to a single line.
+func (t WhatsAppTemplate) BodyParameters(params map[string]string) ([]string, error) {
+	values := make([]string, len(t.Parameters))
+	for i, name := range t.Parameters {
+		value, ok := params[name]
+		if !ok {
+			return nil, fmt.Errorf("template %s is missing parameter %s", t.Name, name)
+		}
+		values[i] = flattenTemplateParameter(value)
+	}
+	return values, nil
+}
+
+// flattenTemplateParameter joins the lines of a value with " · ", collapsing whitespace
+func flattenTemplateParameter(value string) string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, " · ")
+}
+
+// RenderFallback fills the fallback text with the parameter values
+func (t WhatsAppTemplate) RenderFallback(params map[string]string) string {
+	pairs := make([]string, 0, len(params)*2)
+	for name, value := range params {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(t.Fallback)
+}
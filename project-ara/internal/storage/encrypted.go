@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// EncryptedStorage seals objects with AES-256-GCM before handing them to the backend
+type EncryptedStorage struct {
+	backend Storage
+	aead    cipher.AEAD
+}
+
+// NewEncryptedStorage derives a 256-bit key from secret. A 32-byte key given as hex or
+// base64 is used as is; any other non-empty value is hashed with SHA-256.
+func NewEncryptedStorage(backend Storage, secret string) (*EncryptedStorage, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KEY not set")
+	}
+
+	block, err := aes.NewCipher(deriveKey(secret))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return &EncryptedStorage{backend: backend, aead: aead}, nil
+}
+
+func (s *EncryptedStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// The key is bound as additional data so objects can't be swapped between keys
+	sealed := s.aead.Seal(nonce, nonce, data, []byte(key))
+	return s.backend.Put(ctx, key, sealed, "application/octet-stream")
+}
+
+func (s *EncryptedStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	sealed, err := s.backend.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("encrypted object too short")
+	}
+
+	data, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object: %w", err)
+	}
+	return data, nil
+}
+
+func (s *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return s.backend.Delete(ctx, key)
+}
+
+func deriveKey(secret string) []byte {
+	if key, err := hex.DecodeString(secret); err == nil && len(key) == 32 {
+		return key
+	}
+	if key, err := base64.StdEncoding.DecodeString(secret); err == nil && len(key) == 32 {
+		return key
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned when an object doesn't exist in the store
+var ErrNotFound = errors.New("object not found")
+
+// Storage is a minimal blob store used to archive WhatsApp media
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// NewFromEnv builds the media store configured by MEDIA_STORAGE_DRIVER ("local" or "s3"),
+// wrapped with encryption using ENCRYPTION_KEY
+func NewFromEnv() (Storage, error) {
+	var backend Storage
+	switch driver := strings.ToLower(getEnv("MEDIA_STORAGE_DRIVER", "local")); driver {
+	case "local":
+		backend = NewLocalStorage(getEnv("MEDIA_STORAGE_PATH", "./data/media"))
+	case "s3":
+		backend = NewS3Storage(S3Config{
+			Endpoint:        getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:          getEnv("S3_REGION", "us-east-1"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown media storage driver: %s", driver)
+	}
+
+	return NewEncryptedStorage(backend, os.Getenv("ENCRYPTION_KEY"))
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a MinIO-like stand-in that keeps objects in memory and only
+// checks that requests are signed
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = data
+	case http.MethodGet:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testRoundTrip(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.Put(ctx, "users/1/receipt.jpg", []byte("receipt"), "image/jpeg"))
+
+	data, err := s.Get(ctx, "users/1/receipt.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("receipt"), data)
+
+	require.NoError(t, s.Delete(ctx, "users/1/receipt.jpg"))
+	_, err = s.Get(ctx, "users/1/receipt.jpg")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestLocalStorage(t *testing.T) {
+	testRoundTrip(t, NewLocalStorage(t.TempDir()))
+}
+
+func TestS3Storage(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	testRoundTrip(t, NewS3Storage(S3Config{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "media",
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+	}))
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	backend := NewLocalStorage(t.TempDir())
+	s, err := NewEncryptedStorage(backend, "test-secret")
+	require.NoError(t, err)
+
+	testRoundTrip(t, s)
+
+	require.NoError(t, s.Put(context.Background(), "a", []byte("receipt"), "image/jpeg"))
+	raw, err := backend.Get(context.Background(), "a")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "receipt")
+
+	_, err = NewEncryptedStorage(backend, "")
+	assert.Error(t, err)
+}
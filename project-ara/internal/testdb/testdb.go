@@ -0,0 +1,113 @@
+// Package testdb opens throwaway databases with the application schema for tests.
+package testdb
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"project-ara/internal/database"
+	"project-ara/internal/models"
+)
+
+// Tables lists the models whose tables tests need, in dependency order
+var Tables = []interface{}{
+	&models.User{},
+	&models.Transaction{},
+	&models.PendingTransaction{},
+	&models.MediaArtifact{},
+	&models.Attachment{},
+	&models.OutboundMessage{},
+	&models.OutboundRecipient{},
+	&models.Job{},
+	&models.JobRun{},
+	&models.Subscription{},
+	&models.Payment{},
+	&models.SubscriptionEvent{},
+	&models.PaymentWebhookEvent{},
+	&models.DunningCase{},
+	&models.Referral{},
+	&models.Coupon{},
+	&models.CouponRedemption{},
+	&models.AnalyticsEvent{},
+}
+
+// SQLite opens an isolated in-memory SQLite database that is closed when the test ends
+func SQLite(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to open SQLite: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql.DB: %v", err)
+	}
+	// Every connection to :memory: is a new database, so keep a single one
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	for _, table := range Tables {
+		// SQLite can't use gen_random_uuid() as a column default; BeforeCreate hooks set IDs anyway
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(table); err != nil {
+			t.Fatalf("failed to parse %T: %v", table, err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if strings.Contains(field.DefaultValue, "gen_random_uuid") {
+				field.DefaultValue = ""
+				field.HasDefaultValue = false
+				field.DefaultValueInterface = nil
+			}
+		}
+	}
+	if err := db.AutoMigrate(Tables...); err != nil {
+		t.Fatalf("failed to migrate SQLite: %v", err)
+	}
+
+	return db
+}
+
+// Postgres connects to TEST_DATABASE_URL, applies the migrations and empties every table,
+// skipping the test when the variable isn't set. Tests using it must not run in parallel.
+func Postgres(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to connect to Postgres: %v", err)
+	}
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("failed to migrate Postgres: %v", err)
+	}
+	var tables []string
+	if err := db.Raw("SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'").
+		Scan(&tables).Error; err != nil {
+		t.Fatalf("failed to list tables: %v", err)
+	}
+	if len(tables) > 0 {
+		if err := db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " CASCADE").Error; err != nil {
+			t.Fatalf("failed to truncate tables: %v", err)
+		}
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		t.Cleanup(func() { sqlDB.Close() })
+	}
+
+	return db
+}
@@ -200,7 +200,13 @@ test_payment_webhook() {
         "amount": 9.90,
         "currency": "BRL"
     }'
-    response=$(make_request "POST" "/subscriptions/webhook/payment" "$data")
+    # Signed like the server expects, with the PAYMENT_WEBHOOK_SECRET it was started with
+    signature=$(printf '%s' "$data" | openssl dgst -sha256 -hmac "${PAYMENT_WEBHOOK_SECRET:-}" | sed 's/^.* //')
+    response=$(curl -s -X POST \
+        -H "Content-Type: application/json" \
+        -H "X-Ara-Signature: sha256=$signature" \
+        -d "$data" \
+        "$BASE_URL/api/$API_VERSION/subscriptions/webhook/payment")
     if echo "$response" | grep -q "message"; then
         print_success "Payment webhook endpoint working"
     else